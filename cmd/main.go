@@ -14,13 +14,25 @@ import (
 	"github.com/crazy-max/undock/internal/app"
 	"github.com/crazy-max/undock/internal/config"
 	"github.com/crazy-max/undock/internal/logging"
+	ximage "github.com/crazy-max/undock/pkg/extractor/image"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
 var version = "dev"
 
+// exitRateLimited is the exit code when the rate limit of a registry is
+// exceeded
+const exitRateLimited = 3
+
 func main() {
 	if err := run(); err != nil {
+		var rateLimitErr *ximage.RateLimitError
+		if errors.As(err, &rateLimitErr) {
+			log.WithLevel(zerolog.FatalLevel).Stack().Err(err).Send()
+			os.Exit(exitRateLimited)
+		}
 		log.Fatal().Stack().Err(err).Send()
 	}
 }
@@ -2,13 +2,21 @@ package app
 
 import (
 	"context"
+	"encoding/json"
+	"io"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 
+	"github.com/alecthomas/kong"
 	"github.com/containerd/platforms"
 	"github.com/crazy-max/undock/internal/config"
+	"github.com/crazy-max/undock/pkg/extractor"
 	ximage "github.com/crazy-max/undock/pkg/extractor/image"
 	"github.com/crazy-max/undock/pkg/image"
+	"github.com/crazy-max/undock/pkg/s3"
+	units "github.com/docker/go-units"
 	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 )
@@ -18,6 +26,7 @@ type Undock struct {
 	meta     config.Meta
 	cli      config.Cli
 	platform ocispecs.Platform
+	stdin    io.Reader
 }
 
 // New creates new undock instance
@@ -30,22 +39,67 @@ func New(meta config.Meta, cli config.Cli) (*Undock, error) {
 		}
 	}
 
+	// dist is not a path type so object store URLs are kept as is
+	if cli.Dist != "-" && !s3.IsURL(cli.Dist) {
+		cli.Dist = kong.ExpandPath(cli.Dist)
+	}
+
 	return &Undock{
 		meta:     meta,
 		cli:      cli,
 		platform: platform,
+		stdin:    os.Stdin,
 	}, nil
 }
 
 // Start starts undock
 func (c *Undock) Start(ctx context.Context) error {
-	if _, err := os.Stat(c.cli.Dist); err == nil && c.cli.RmDist {
-		if err := os.RemoveAll(c.cli.Dist); err != nil {
-			return errors.Wrapf(err, "failed to remove dist folder %q", c.cli.Dist)
-		}
+	outputFormat := extractor.OutputFormat(c.cli.OutputFormat)
+	if err := c.validate(outputFormat); err != nil {
+		return err
+	}
+	if c.cli.Dist == "-" && !outputFormat.IsArchive() {
+		outputFormat = extractor.OutputFormatTar
+	}
+
+	overrides, err := c.configOverrides()
+	if err != nil {
+		return err
+	}
+	chunkSize, err := c.chunkSize()
+	if err != nil {
+		return err
+	}
+	limitRate, err := c.limitRate()
+	if err != nil {
+		return err
+	}
+	password, err := c.password()
+	if err != nil {
+		return err
+	}
+	mirrors, err := c.registryMirrors()
+	if err != nil {
+		return err
+	}
+	proxy, err := c.proxy()
+	if err != nil {
+		return err
 	}
-	if err := os.MkdirAll(c.cli.Dist, 0700); err != nil {
-		return errors.Wrapf(err, "failed to create dist folder %q", c.cli.Dist)
+
+	if c.cli.Dist != "-" && !s3.IsURL(c.cli.Dist) {
+		if _, err := os.Stat(c.cli.Dist); err == nil && c.cli.RmDist {
+			if err := os.RemoveAll(c.cli.Dist); err != nil {
+				return errors.Wrapf(err, "failed to remove dist folder %q", c.cli.Dist)
+			}
+		}
+		distDir := c.cli.Dist
+		if outputFormat.IsArchive() || outputFormat == extractor.OutputFormatOCIArchive {
+			distDir = filepath.Dir(c.cli.Dist)
+		}
+		if err := os.MkdirAll(distDir, 0700); err != nil {
+			return errors.Wrapf(err, "failed to create dist folder %q", distDir)
+		}
 	}
 
 	if ok, err := validateScheme(c.cli.Source); err != nil {
@@ -54,24 +108,292 @@ func (c *Undock) Start(ctx context.Context) error {
 		return errors.Errorf("unsupported source %q", c.cli.Source)
 	}
 
+	var timeoutErr error
+	if c.cli.Timeout > 0 {
+		var cancel context.CancelFunc
+		timeoutErr = errors.Errorf("timeout of %s exceeded", c.cli.Timeout)
+		ctx, cancel = context.WithTimeoutCause(ctx, c.cli.Timeout, timeoutErr)
+		defer cancel()
+	}
+
 	xcli, err := ximage.New(ctx, ximage.Options{
 		Source:   c.cli.Source,
 		Platform: c.platform,
 		Includes: c.cli.Includes,
 		All:      c.cli.All,
 
-		Dist: c.cli.Dist,
-		Wrap: c.cli.Wrap,
+		Dist:           c.cli.Dist,
+		OutputFormat:   outputFormat,
+		Wrap:           c.cli.Wrap,
+		Bundle:         c.cli.Bundle,
+		ExportLayers:   c.cli.ExportLayers,
+		Parallelism:    c.cli.Parallelism,
+		MaxConcurrency: c.cli.MaxConcurrency,
+		Config:         overrides,
 
-		RegistryInsecure:  c.cli.Insecure,
-		RegistryUserAgent: c.meta.UserAgent,
+		RegistryInsecure:     c.cli.Insecure,
+		RegistryUserAgent:    c.meta.UserAgent,
+		RegistryUsername:     c.cli.Username,
+		RegistryPassword:     password,
+		RegistryToken:        c.cli.RegistryToken,
+		RegistryAuthFile:     c.cli.AuthFile,
+		RegistriesConf:       c.cli.RegistriesConf,
+		RegistryMirrors:      mirrors,
+		CertDir:              c.cli.CertDir,
+		CAFile:               c.cli.CAFile,
+		Proxy:                proxy,
+		NoProxy:              c.cli.NoProxy,
+		ChunkSize:            chunkSize,
+		Connections:          c.cli.Connections,
+		Retries:              c.cli.Retries,
+		RetryDelay:           c.cli.RetryDelay,
+		RequestTimeout:       c.cli.RequestTimeout,
+		LimitRate:            limitRate,
+		MaxParallelDownloads: c.cli.MaxParallelDownloads,
+		RateLimitWait:        c.cli.RateLimitWait,
 
-		CacheDir: c.cli.CacheDir,
+		CacheDir:   c.cli.CacheDir,
+		NoCache:    c.cli.NoCache,
+		Offline:    c.cli.Offline,
+		ResolveTTL: c.cli.ResolveTTL,
+		Refresh:    c.cli.Refresh,
+		Snapshots:  c.cli.Snapshots,
+
+		SnapshotLinks: c.cli.SnapshotLinks,
 	})
 	if err != nil {
 		return err
 	}
-	return xcli.Extract()
+	if err := xcli.Extract(); err != nil {
+		if timeoutErr != nil && errors.Is(context.Cause(ctx), timeoutErr) {
+			return timeoutErr
+		}
+		return err
+	}
+	return nil
+}
+
+// validate checks that the output options can be used together
+func (c *Undock) validate(outputFormat extractor.OutputFormat) error {
+	if c.cli.Parallelism < 0 {
+		return errors.New("parallelism cannot be negative")
+	}
+	if c.cli.MaxConcurrency < 0 {
+		return errors.New("max concurrency cannot be negative")
+	}
+	if c.cli.Connections < 0 {
+		return errors.New("connections cannot be negative")
+	}
+	switch {
+	case c.cli.Retries < 0:
+		return errors.New("retries cannot be negative")
+	case c.cli.RetryDelay < 0:
+		return errors.New("retry delay cannot be negative")
+	case c.cli.RequestTimeout < 0:
+		return errors.New("request timeout cannot be negative")
+	case c.cli.Timeout < 0:
+		return errors.New("timeout cannot be negative")
+	case c.cli.RateLimitWait < 0:
+		return errors.New("rate limit wait cannot be negative")
+	case c.cli.ResolveTTL < 0:
+		return errors.New("resolve TTL cannot be negative")
+	case c.cli.MaxParallelDownloads < 0:
+		return errors.New("max parallel downloads cannot be negative")
+	}
+	switch {
+	case c.cli.PasswordStdin && c.cli.Username == "":
+		return errors.New("password-stdin requires a username")
+	case c.cli.Username != "" && !c.cli.PasswordStdin:
+		return errors.New("username requires password-stdin")
+	case c.cli.Username != "" && c.cli.RegistryToken != "":
+		return errors.New("username cannot be used with registry-token")
+	}
+	if c.cli.Bundle {
+		switch {
+		case c.cli.Dist == "-":
+			return errors.New("bundle cannot be streamed to stdout")
+		case outputFormat.IsArchive() || outputFormat.IsOCI():
+			return errors.Errorf("bundle cannot be written with %s output format", outputFormat)
+		case c.cli.Wrap:
+			return errors.New("bundle cannot be written with wrap")
+		}
+	}
+	if c.cli.ExportLayers {
+		switch {
+		case c.cli.Dist == "-":
+			return errors.New("layers cannot be exported to stdout")
+		case outputFormat.IsArchive() || outputFormat.IsOCI():
+			return errors.Errorf("layers cannot be exported with %s output format", outputFormat)
+		case c.cli.Bundle:
+			return errors.New("layers cannot be exported with bundle")
+		case c.cli.Wrap:
+			return errors.New("layers cannot be exported with wrap")
+		case len(c.cli.Includes) > 0:
+			return errors.New("layers cannot be exported with include")
+		}
+	}
+	if s3.IsURL(c.cli.Dist) {
+		switch {
+		case outputFormat.IsArchive() || outputFormat.IsOCI():
+			return errors.Errorf("%s output cannot be uploaded to an object store", outputFormat)
+		case c.cli.Bundle:
+			return errors.New("bundle cannot be uploaded to an object store")
+		case c.cli.ExportLayers:
+			return errors.New("layers cannot be exported to an object store")
+		case c.cli.RmDist:
+			return errors.New("rm-dist cannot be used with an object store")
+		}
+		if _, _, err := s3.ParseURL(c.cli.Dist); err != nil {
+			return err
+		}
+	}
+	if c.cli.Dist == "-" && outputFormat.IsOCI() {
+		return errors.Errorf("%s output cannot be streamed to stdout", outputFormat)
+	}
+	if c.cli.Snapshots {
+		switch {
+		case c.cli.NoCache:
+			return errors.New("snapshots cannot be used with no-cache")
+		case c.cli.Dist == "-" || s3.IsURL(c.cli.Dist) || outputFormat.IsArchive() || outputFormat.IsOCI():
+			return errors.New("snapshots can only be used to extract to a folder")
+		case c.cli.Bundle:
+			return errors.New("snapshots cannot be used with bundle")
+		case c.cli.ExportLayers:
+			return errors.New("snapshots cannot be used with export-layers")
+		}
+	}
+	if c.cli.SnapshotLinks && !c.cli.Snapshots {
+		return errors.New("snapshot-links requires snapshots")
+	}
+	if c.cli.Offline && c.cli.NoCache {
+		return errors.New("offline cannot be used with no-cache")
+	} else if c.cli.Offline && c.cli.Refresh {
+		return errors.New("offline cannot be used with refresh")
+	}
+	return nil
+}
+
+func (c *Undock) configOverrides() (ximage.ConfigOverrides, error) {
+	entrypoint, err := parseExecArgs(c.cli.ConfigEntrypoint)
+	if err != nil {
+		return ximage.ConfigOverrides{}, errors.Wrap(err, "invalid entrypoint")
+	}
+	cmd, err := parseExecArgs(c.cli.ConfigCmd)
+	if err != nil {
+		return ximage.ConfigOverrides{}, errors.Wrap(err, "invalid command")
+	}
+	for _, env := range c.cli.ConfigEnv {
+		if k, _, ok := strings.Cut(env, "="); !ok || k == "" {
+			return ximage.ConfigOverrides{}, errors.Errorf("invalid environment variable %q, expected KEY=VALUE", env)
+		}
+	}
+	return ximage.ConfigOverrides{
+		Entrypoint: entrypoint,
+		Cmd:        cmd,
+		Env:        c.cli.ConfigEnv,
+		Labels:     c.cli.ConfigLabels,
+		WorkingDir: c.cli.ConfigWorkdir,
+		User:       c.cli.ConfigUser,
+	}, nil
+}
+
+// chunkSize parses the size of the ranges of a blob downloaded at once,
+// such as 16MiB. Zero uses the default size.
+func (c *Undock) chunkSize() (int64, error) {
+	if c.cli.ChunkSize == "" {
+		return 0, nil
+	}
+	size, err := units.RAMInBytes(c.cli.ChunkSize)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid chunk size %q", c.cli.ChunkSize)
+	} else if size <= 0 {
+		return 0, errors.Errorf("invalid chunk size %q", c.cli.ChunkSize)
+	}
+	return size, nil
+}
+
+// limitRate parses the maximum rate of downloads in bytes per second, such
+// as 10MiB. Zero means no limit.
+func (c *Undock) limitRate() (int64, error) {
+	if c.cli.LimitRate == "" {
+		return 0, nil
+	}
+	rate, err := units.RAMInBytes(c.cli.LimitRate)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid limit rate %q", c.cli.LimitRate)
+	} else if rate < 0 {
+		return 0, errors.Errorf("invalid limit rate %q", c.cli.LimitRate)
+	}
+	return rate, nil
+}
+
+// password reads the password of the registry username from stdin
+func (c *Undock) password() (string, error) {
+	if !c.cli.PasswordStdin {
+		return "", nil
+	}
+	dt, err := io.ReadAll(c.stdin)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot read password from stdin")
+	}
+	password := strings.TrimRight(string(dt), "\r\n")
+	if password == "" {
+		return "", errors.New("password from stdin is empty")
+	}
+	return password, nil
+}
+
+// registryMirrors parses the mirrors of registries set as host=mirror, in
+// the order they are tried
+func (c *Undock) registryMirrors() (map[string][]string, error) {
+	if len(c.cli.RegistryMirror) == 0 {
+		return nil, nil
+	}
+	mirrors := map[string][]string{}
+	for _, m := range c.cli.RegistryMirror {
+		registry, mirror, ok := strings.Cut(m, "=")
+		registry, mirror = strings.TrimSuffix(registry, "/"), strings.TrimSuffix(mirror, "/")
+		if !ok || registry == "" || mirror == "" || strings.Contains(registry, "://") || strings.Contains(mirror, "://") {
+			return nil, errors.Errorf("invalid registry mirror %q, expected REGISTRY=MIRROR", m)
+		}
+		mirrors[registry] = append(mirrors[registry], mirror)
+	}
+	return mirrors, nil
+}
+
+// proxy parses the URL of the proxy to contact registries with
+func (c *Undock) proxy() (*url.URL, error) {
+	if c.cli.Proxy == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(c.cli.Proxy)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid proxy %q", c.cli.Proxy)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, errors.Errorf("invalid proxy %q, expected an http, https or socks5 URL", c.cli.Proxy)
+	}
+	if u.Host == "" {
+		return nil, errors.Errorf("invalid proxy %q, expected an http, https or socks5 URL", c.cli.Proxy)
+	}
+	return u, nil
+}
+
+// parseExecArgs parses a JSON array of arguments, or a single argument
+func parseExecArgs(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(strings.TrimSpace(s), "[") {
+		return []string{s}, nil
+	}
+	var args []string
+	if err := json.Unmarshal([]byte(s), &args); err != nil {
+		return nil, err
+	}
+	return args, nil
 }
 
 func validateScheme(source string) (bool, error) {
@@ -4,16 +4,34 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/containerd/platforms"
 	"github.com/crazy-max/undock/internal/config"
+	ximage "github.com/crazy-max/undock/pkg/extractor/image"
+	"github.com/crazy-max/undock/pkg/registry"
+	"github.com/crazy-max/undock/pkg/registry/registrytest"
+	"github.com/crazy-max/undock/pkg/s3/s3test"
+	"github.com/mholt/archives"
 	digest "github.com/opencontainers/go-digest"
 	specs "github.com/opencontainers/image-spec/specs-go"
 	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -80,7 +98,7 @@ func TestStartExtractsOCIImage(t *testing.T) {
 	require.NoError(t, os.MkdirAll(distDir, 0o755))
 	require.NoError(t, os.WriteFile(filepath.Join(distDir, "stale.txt"), []byte("old"), 0o644))
 
-	createOCIImageLayout(t, layoutDir, platforms.DefaultSpec(), []ociLayerEntry{
+	createOCIImageLayout(t, layoutDir, platforms.DefaultSpec(), ocispecs.ImageConfig{}, []ociLayerEntry{
 		{name: "etc/app/config.yaml", body: "wanted"},
 		{name: "usr/bin/tool", body: "skip"},
 	})
@@ -116,12 +134,1241 @@ func TestStartExtractsOCIImage(t *testing.T) {
 	require.DirExists(t, filepath.Join(cacheDir, "blobs"))
 }
 
+func TestStartStreamsOCIImage(t *testing.T) {
+	root := t.TempDir()
+	layoutDir := filepath.Join(root, "layout")
+	cacheDir := filepath.Join(root, "cache")
+	distDir := filepath.Join(root, "dist")
+
+	createOCIImageLayout(t, layoutDir, platforms.DefaultSpec(), ocispecs.ImageConfig{}, []ociLayerEntry{
+		{name: "etc/app/config.yaml", body: "wanted"},
+		{name: "usr/bin/tool", body: "skip"},
+	})
+
+	app, err := New(config.Meta{
+		UserAgent: "undock-tests",
+	}, config.Cli{
+		Source:   "oci://" + layoutDir,
+		Dist:     distDir,
+		CacheDir: cacheDir,
+		NoCache:  true,
+		Includes: []string{"/etc/app"},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, app.Start(context.Background()))
+
+	requireFileContent(t, filepath.Join(distDir, "etc", "app", "config.yaml"), "wanted")
+	require.NoFileExists(t, filepath.Join(distDir, "usr", "bin", "tool"))
+
+	cacheEntries, err := os.ReadDir(cacheDir)
+	require.NoError(t, err)
+	for _, entry := range cacheEntries {
+		assert.Contains(t, []string{"blobs", "containers"}, entry.Name())
+	}
+}
+
+func TestStartStreamFetchesBlobsOnce(t *testing.T) {
+	srv := registrytest.NewServer()
+	defer srv.Close()
+	lower, lowerDigest := marshalLayer(t, []ociLayerEntry{
+		{name: "etc/app/config.yaml", body: "overwritten"},
+		{name: "usr/bin/tool", body: "tool"},
+		{name: "usr/bin/old", body: "old"},
+	})
+	upper, upperDigest := marshalLayer(t, []ociLayerEntry{
+		{name: "etc/app/config.yaml", body: "wanted"},
+		{name: "usr/bin/.wh.old"},
+	})
+	// layers are not spilled to the temporary folder
+	t.Setenv("TMPDIR", filepath.Join(t.TempDir(), "missing"))
+	pushLayers(t, srv, "undock/app", "latest", registryLayer{
+		payload:   lower,
+		diffID:    lowerDigest,
+		mediaType: ocispecs.MediaTypeImageLayer,
+	}, registryLayer{
+		payload:   upper,
+		diffID:    upperDigest,
+		mediaType: ocispecs.MediaTypeImageLayer,
+	})
+
+	root := t.TempDir()
+	distDir := filepath.Join(root, "dist")
+	app, err := New(config.Meta{UserAgent: "undock-tests"}, config.Cli{
+		Source:   "docker://" + srv.Host() + "/undock/app:latest",
+		Dist:     distDir,
+		CacheDir: filepath.Join(root, "cache"),
+		Insecure: true,
+		NoCache:  true,
+	})
+	require.NoError(t, err)
+	require.NoError(t, app.Start(context.Background()))
+
+	requireFileContent(t, filepath.Join(distDir, "etc", "app", "config.yaml"), "wanted")
+	requireFileContent(t, filepath.Join(distDir, "usr", "bin", "tool"), "tool")
+	require.NoFileExists(t, filepath.Join(distDir, "usr", "bin", "old"))
+	// each layer is fetched and read once
+	requests, _ := srv.BlobRequests()
+	require.Equal(t, 2, requests)
+}
+
+func TestStartStreamRejectsCorruptedLayer(t *testing.T) {
+	root := t.TempDir()
+	layoutDir := filepath.Join(root, "layout")
+	entries := []ociLayerEntry{{name: "etc/app/config.yaml", body: "wanted"}}
+
+	createOCIImageLayout(t, layoutDir, platforms.DefaultSpec(), ocispecs.ImageConfig{}, entries)
+
+	// same size, different content
+	layerPayload, _ := marshalLayer(t, entries)
+	corrupted, _ := marshalLayer(t, []ociLayerEntry{{name: "etc/app/config.yaml", body: "forged"}})
+	require.Len(t, corrupted, len(layerPayload))
+	require.NoError(t, os.WriteFile(blobPath(layoutDir, digest.FromBytes(layerPayload)), corrupted, 0o644))
+
+	app, err := New(config.Meta{
+		UserAgent: "undock-tests",
+	}, config.Cli{
+		Source:   "oci://" + layoutDir,
+		Dist:     filepath.Join(root, "dist"),
+		CacheDir: filepath.Join(root, "cache"),
+		NoCache:  true,
+	})
+	require.NoError(t, err)
+
+	require.ErrorContains(t, app.Start(context.Background()), "digest mismatch")
+}
+
+func TestStartRepacksOCIImage(t *testing.T) {
+	root := t.TempDir()
+	layoutDir := filepath.Join(root, "layout")
+	cacheDir := filepath.Join(root, "cache")
+	distDir := filepath.Join(root, "dist")
+
+	createOCIImageLayout(t, layoutDir, platforms.DefaultSpec(), ocispecs.ImageConfig{
+		Env:        []string{"PATH=/usr/bin", "MODE=dev"},
+		Entrypoint: []string{"/bin/sh"},
+		Cmd:        []string{"-c", "tool"},
+		Labels:     map[string]string{"org.opencontainers.image.title": "tool"},
+	}, []ociLayerEntry{
+		{name: "etc/app/config.yaml", body: "skip"},
+		{name: "usr/bin/tool", body: "wanted"},
+	})
+
+	app, err := New(config.Meta{}, config.Cli{
+		Source:           "oci://" + layoutDir,
+		Dist:             distDir,
+		CacheDir:         cacheDir,
+		Includes:         []string{"/usr/bin/tool"},
+		OutputFormat:     "oci",
+		ConfigEntrypoint: `["/usr/bin/tool"]`,
+		ConfigEnv:        []string{"MODE=prod"},
+		ConfigLabels:     map[string]string{"org.opencontainers.image.version": "1.0"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, app.Start(context.Background()))
+
+	var index ocispecs.Index
+	readJSONFile(t, filepath.Join(distDir, ocispecs.ImageIndexFile), &index)
+	require.Len(t, index.Manifests, 1)
+
+	var man ocispecs.Manifest
+	readJSONFile(t, blobPath(distDir, index.Manifests[0].Digest), &man)
+	require.Len(t, man.Layers, 1)
+
+	var img ocispecs.Image
+	readJSONFile(t, blobPath(distDir, man.Config.Digest), &img)
+	assert.Equal(t, platforms.DefaultSpec().Architecture, img.Architecture)
+	assert.Equal(t, []string{"PATH=/usr/bin", "MODE=prod"}, img.Config.Env)
+	assert.Equal(t, []string{"/usr/bin/tool"}, img.Config.Entrypoint)
+	assert.Empty(t, img.Config.Cmd)
+	assert.Equal(t, map[string]string{
+		"org.opencontainers.image.title":   "tool",
+		"org.opencontainers.image.version": "1.0",
+	}, img.Config.Labels)
+	require.Len(t, img.RootFS.DiffIDs, 1)
+
+	// repacked image can be extracted back
+	extractDir := filepath.Join(root, "extract")
+	app, err = New(config.Meta{}, config.Cli{
+		Source:   "oci://" + distDir,
+		Dist:     extractDir,
+		CacheDir: cacheDir,
+	})
+	require.NoError(t, err)
+	require.NoError(t, app.Start(context.Background()))
+	requireFileContent(t, filepath.Join(extractDir, "usr", "bin", "tool"), "wanted")
+	require.NoFileExists(t, filepath.Join(extractDir, "etc", "app", "config.yaml"))
+}
+
+func TestStartWritesBundle(t *testing.T) {
+	root := t.TempDir()
+	layoutDir := filepath.Join(root, "layout")
+	distDir := filepath.Join(root, "dist")
+
+	createOCIImageLayout(t, layoutDir, platforms.DefaultSpec(), ocispecs.ImageConfig{
+		Env:        []string{"PATH=/usr/bin"},
+		Entrypoint: []string{"/usr/bin/tool"},
+		WorkingDir: "/srv",
+	}, []ociLayerEntry{
+		{name: "usr/bin/tool", body: "tool"},
+	})
+
+	app, err := New(config.Meta{}, config.Cli{
+		Source:    "oci://" + layoutDir,
+		Dist:      distDir,
+		CacheDir:  filepath.Join(root, "cache"),
+		Bundle:    true,
+		ConfigCmd: "--version",
+	})
+	require.NoError(t, err)
+	require.NoError(t, app.Start(context.Background()))
+
+	requireFileContent(t, filepath.Join(distDir, "rootfs", "usr", "bin", "tool"), "tool")
+	for _, dir := range []string{"dev", "proc", "sys"} {
+		require.DirExists(t, filepath.Join(distDir, "rootfs", dir))
+	}
+
+	var spec rspec.Spec
+	readJSONFile(t, filepath.Join(distDir, "config.json"), &spec)
+	assert.Equal(t, "rootfs", spec.Root.Path)
+	assert.Equal(t, []string{"/usr/bin/tool", "--version"}, spec.Process.Args)
+	assert.Equal(t, []string{"PATH=/usr/bin"}, spec.Process.Env)
+	assert.Equal(t, "/srv", spec.Process.Cwd)
+}
+
+func TestStartExportsLayers(t *testing.T) {
+	root := t.TempDir()
+	layoutDir := filepath.Join(root, "layout")
+	distDir := filepath.Join(root, "dist")
+
+	entries := []ociLayerEntry{
+		{name: "usr/bin/tool", body: "tool"},
+	}
+	createOCIImageLayout(t, layoutDir, platforms.DefaultSpec(), ocispecs.ImageConfig{}, entries)
+	_, diffID := marshalLayer(t, entries)
+
+	app, err := New(config.Meta{}, config.Cli{
+		Source:       "oci://" + layoutDir,
+		Dist:         distDir,
+		CacheDir:     filepath.Join(root, "cache"),
+		ExportLayers: true,
+	})
+	require.NoError(t, err)
+	require.NoError(t, app.Start(context.Background()))
+
+	var lm struct {
+		Layers []struct {
+			File      string        `json:"file"`
+			MediaType string        `json:"mediaType"`
+			Digest    digest.Digest `json:"digest"`
+			DiffID    digest.Digest `json:"diffID"`
+		} `json:"layers"`
+	}
+	readJSONFile(t, filepath.Join(distDir, "manifest.json"), &lm)
+	require.Len(t, lm.Layers, 1)
+
+	layer := lm.Layers[0]
+	// uncompressed layers are compressed in the cache
+	assert.Equal(t, ocispecs.MediaTypeImageLayerGzip, layer.MediaType)
+	assert.Equal(t, "sha256-"+layer.Digest.Hex()+".tar.gz", layer.File)
+	assert.Equal(t, diffID, layer.DiffID)
+
+	blob, err := os.ReadFile(filepath.Join(distDir, layer.File))
+	require.NoError(t, err)
+	assert.Equal(t, layer.Digest, digest.FromBytes(blob))
+	require.NoDirExists(t, filepath.Join(distDir, "usr"))
+}
+
+func TestStartUploadsToObjectStore(t *testing.T) {
+	root := t.TempDir()
+	layoutDir := filepath.Join(root, "layout")
+
+	createOCIImageLayout(t, layoutDir, platforms.DefaultSpec(), ocispecs.ImageConfig{}, []ociLayerEntry{
+		{name: "etc/app/config.yaml", body: "skip"},
+		{name: "usr/bin/tool", body: "tool"},
+	})
+
+	srv := s3test.NewServer("access")
+	defer srv.Close()
+	t.Setenv("AWS_ENDPOINT_URL_S3", srv.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "access")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	app, err := New(config.Meta{}, config.Cli{
+		Source:   "oci://" + layoutDir,
+		Dist:     "s3://bucket/tools",
+		CacheDir: filepath.Join(root, "cache"),
+		Includes: []string{"/usr/bin"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, app.Start(context.Background()))
+
+	assert.Equal(t, []string{"tools/usr/", "tools/usr/bin/", "tools/usr/bin/tool"}, srv.Keys("bucket"))
+	obj, ok := srv.Object("bucket", "tools/usr/bin/tool")
+	require.True(t, ok)
+	assert.Equal(t, "tool", string(obj.Body))
+}
+
+func TestStartRejectsArchiveOutputToObjectStore(t *testing.T) {
+	app, err := New(config.Meta{}, config.Cli{
+		Source:       "alpine:latest",
+		Dist:         "s3://bucket/prefix",
+		OutputFormat: "tar",
+	})
+	require.NoError(t, err)
+	require.EqualError(t, app.Start(context.Background()), "tar output cannot be uploaded to an object store")
+}
+
+func TestStartRecachesRebuiltImageLayout(t *testing.T) {
+	root := t.TempDir()
+	layoutDir := filepath.Join(root, "layout")
+	cacheDir := filepath.Join(root, "cache")
+
+	for _, body := range []string{"old", "new"} {
+		require.NoError(t, os.RemoveAll(layoutDir))
+		createOCIImageLayout(t, layoutDir, platforms.DefaultSpec(), ocispecs.ImageConfig{}, []ociLayerEntry{
+			{name: "etc/app/config.yaml", body: body},
+		})
+
+		distDir := filepath.Join(root, "dist-"+body)
+		app, err := New(config.Meta{
+			UserAgent: "undock-tests",
+		}, config.Cli{
+			Source:   "oci://" + layoutDir,
+			Dist:     distDir,
+			CacheDir: cacheDir,
+		})
+		require.NoError(t, err)
+		require.NoError(t, app.Start(context.Background()))
+
+		requireFileContent(t, filepath.Join(distDir, "etc", "app", "config.yaml"), body)
+
+		// the cache is keyed by the manifest digest
+		dt, err := os.ReadFile(filepath.Join(layoutDir, ocispecs.ImageIndexFile))
+		require.NoError(t, err)
+		var index ocispecs.Index
+		require.NoError(t, json.Unmarshal(dt, &index))
+		require.Len(t, index.Manifests, 1)
+		require.DirExists(t, filepath.Join(cacheDir, "oci-"+index.Manifests[0].Digest.Encoded()))
+	}
+}
+
+func TestStartDownloadsLayersWithRanges(t *testing.T) {
+	srv := registrytest.NewServer()
+	defer srv.Close()
+
+	root := t.TempDir()
+	distDir := filepath.Join(root, "dist")
+	pushImage(t, srv, "undock/app", "latest", []ociLayerEntry{
+		{name: "etc/app/config.yaml", body: "wanted"},
+		{name: "usr/share/data", body: strings.Repeat("data", 2048)},
+	})
+
+	app, err := New(config.Meta{
+		UserAgent: "undock-tests",
+	}, config.Cli{
+		Source:      "docker://" + srv.Host() + "/undock/app:latest",
+		Dist:        distDir,
+		CacheDir:    filepath.Join(root, "cache"),
+		Insecure:    true,
+		ChunkSize:   "1KiB",
+		Connections: 4,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, app.Start(context.Background()))
+
+	requireFileContent(t, filepath.Join(distDir, "etc", "app", "config.yaml"), "wanted")
+	requireFileContent(t, filepath.Join(distDir, "usr", "share", "data"), strings.Repeat("data", 2048))
+
+	// the layer is only downloaded with range requests
+	requests, ranges := srv.BlobRequests()
+	assert.Equal(t, ranges+1, requests)
+	assert.Greater(t, ranges, 1)
+}
+
+func TestStartResumesDownloadWithSingleConnection(t *testing.T) {
+	srv := registrytest.NewServer()
+	defer srv.Close()
+
+	root := t.TempDir()
+	cacheDir := filepath.Join(root, "cache")
+	pushImage(t, srv, "undock/app", "latest", []ociLayerEntry{
+		{name: "usr/share/data", body: strings.Repeat("data", 2048)},
+	})
+	start := func(dist string) error {
+		app, err := New(config.Meta{
+			UserAgent: "undock-tests",
+		}, config.Cli{
+			Source:    "docker://" + srv.Host() + "/undock/app:latest",
+			Dist:      filepath.Join(root, dist),
+			CacheDir:  cacheDir,
+			Insecure:  true,
+			ChunkSize: "1KiB",
+		})
+		require.NoError(t, err)
+		return app.Start(context.Background())
+	}
+
+	srv.FailAfter = 4096
+	require.Error(t, start("interrupted"))
+	requests, ranges := srv.BlobRequests()
+
+	srv.FailAfter = 0
+	require.NoError(t, start("dist"))
+	requireFileContent(t, filepath.Join(root, "dist", "usr", "share", "data"), strings.Repeat("data", 2048))
+
+	// the config is pulled again and the layer is downloaded from where it
+	// was interrupted
+	resumed, resumedRanges := srv.BlobRequests()
+	assert.Equal(t, 2, resumed-requests)
+	assert.Equal(t, 1, resumedRanges-ranges)
+}
+
+func TestStartDownloadsLayersWithoutRangesOnFailure(t *testing.T) {
+	srv := registrytest.NewServer()
+	defer srv.Close()
+
+	root := t.TempDir()
+	distDir := filepath.Join(root, "dist")
+	cacheDir := filepath.Join(root, "cache")
+	pushImage(t, srv, "undock/app", "latest", []ociLayerEntry{
+		{name: "usr/share/data", body: strings.Repeat("data", 2048)},
+	})
+	// the downloads folder cannot be created
+	require.NoError(t, os.MkdirAll(cacheDir, 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(cacheDir, "downloads"), nil, 0o600))
+
+	app, err := New(config.Meta{
+		UserAgent: "undock-tests",
+	}, config.Cli{
+		Source:      "docker://" + srv.Host() + "/undock/app:latest",
+		Dist:        distDir,
+		CacheDir:    cacheDir,
+		Insecure:    true,
+		ChunkSize:   "1KiB",
+		Connections: 4,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, app.Start(context.Background()))
+	requireFileContent(t, filepath.Join(distDir, "usr", "share", "data"), strings.Repeat("data", 2048))
+
+	// the layer is pulled by the image copy instead
+	_, ranges := srv.BlobRequests()
+	assert.Zero(t, ranges)
+}
+
+func TestStartExtractsOfflineFromCache(t *testing.T) {
+	srv := registrytest.NewServer()
+	pushImage(t, srv, "undock/app", "latest", []ociLayerEntry{
+		{name: "etc/app/config.yaml", body: "wanted"},
+	})
+	source := "docker://" + srv.Host() + "/undock/app"
+
+	root := t.TempDir()
+	cacheDir := filepath.Join(root, "cache")
+	start := func(source, dist string, offline bool) error {
+		app, err := New(config.Meta{UserAgent: "undock-tests"}, config.Cli{
+			Source:   source,
+			Dist:     filepath.Join(root, dist),
+			CacheDir: cacheDir,
+			Insecure: true,
+			Offline:  offline,
+		})
+		require.NoError(t, err)
+		return app.Start(context.Background())
+	}
+	require.NoError(t, start(source+":latest", "online", false))
+	srv.Close()
+
+	require.NoError(t, start(source+":latest", "offline", true))
+	requireFileContent(t, filepath.Join(root, "offline", "etc", "app", "config.yaml"), "wanted")
+
+	require.ErrorContains(t, start(source+":other", "other", true), "was never pulled")
+	require.ErrorContains(t, start(source+"@"+digest.FromString("other").String(), "pinned", true), "is not in the cache, it cannot be extracted offline")
+}
+
+func TestStartTrustsResolvedTagsForTTL(t *testing.T) {
+	srv := registrytest.NewServer()
+	pushImage(t, srv, "undock/app", "latest", []ociLayerEntry{
+		{name: "etc/app/config.yaml", body: "v1"},
+	})
+	source := "docker://" + srv.Host() + "/undock/app:latest"
+
+	root := t.TempDir()
+	cacheDir := filepath.Join(root, "cache")
+	start := func(dist string, refresh bool) error {
+		app, err := New(config.Meta{UserAgent: "undock-tests"}, config.Cli{
+			Source:     source,
+			Dist:       filepath.Join(root, dist),
+			CacheDir:   cacheDir,
+			Insecure:   true,
+			ResolveTTL: time.Hour,
+			Refresh:    refresh,
+		})
+		require.NoError(t, err)
+		return app.Start(context.Background())
+	}
+	require.NoError(t, start("first", false))
+	pushImage(t, srv, "undock/app", "latest", []ociLayerEntry{
+		{name: "etc/app/config.yaml", body: "v2"},
+	})
+
+	_, heads := srv.ManifestRequests()
+
+	// the fresh entry is trusted without asking the registry
+	require.NoError(t, start("trusted", false))
+	requireFileContent(t, filepath.Join(root, "trusted", "etc", "app", "config.yaml"), "v1")
+	_, trustedHeads := srv.ManifestRequests()
+	assert.Equal(t, heads, trustedHeads)
+
+	// refresh bypasses the fresh entry
+	require.NoError(t, start("refreshed", true))
+	requireFileContent(t, filepath.Join(root, "refreshed", "etc", "app", "config.yaml"), "v2")
+	_, refreshedHeads := srv.ManifestRequests()
+	assert.Equal(t, heads+1, refreshedHeads)
+
+	srv.Close()
+	require.NoError(t, start("closed", false))
+	requireFileContent(t, filepath.Join(root, "closed", "etc", "app", "config.yaml"), "v2")
+}
+
+func TestStartResolvesExpiredTags(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		shift time.Duration
+	}{
+		{name: "past", shift: -2 * time.Hour},
+		// resolved in the future after a clock change or an edit
+		{name: "future", shift: 2 * time.Hour},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := registrytest.NewServer()
+			defer srv.Close()
+			pushImage(t, srv, "undock/app", "latest", []ociLayerEntry{
+				{name: "etc/app/config.yaml", body: "v1"},
+			})
+			source := "docker://" + srv.Host() + "/undock/app:latest"
+
+			root := t.TempDir()
+			cacheDir := filepath.Join(root, "cache")
+			start := func(dist string) error {
+				app, err := New(config.Meta{UserAgent: "undock-tests"}, config.Cli{
+					Source:     source,
+					Dist:       filepath.Join(root, dist),
+					CacheDir:   cacheDir,
+					Insecure:   true,
+					ResolveTTL: time.Hour,
+				})
+				require.NoError(t, err)
+				return app.Start(context.Background())
+			}
+			require.NoError(t, start("first"))
+			pushImage(t, srv, "undock/app", "latest", []ociLayerEntry{
+				{name: "etc/app/config.yaml", body: "v2"},
+			})
+
+			tagIndex := filepath.Join(cacheDir, "tags.json")
+			dt, err := os.ReadFile(tagIndex)
+			require.NoError(t, err)
+			var index map[string]struct {
+				Digest   digest.Digest `json:"digest"`
+				Resolved time.Time     `json:"resolved"`
+			}
+			require.NoError(t, json.Unmarshal(dt, &index))
+			require.Len(t, index, 1)
+			for name, entry := range index {
+				entry.Resolved = entry.Resolved.Add(tt.shift)
+				index[name] = entry
+			}
+			dt, err = json.Marshal(index)
+			require.NoError(t, err)
+			require.NoError(t, os.WriteFile(tagIndex, dt, 0o600))
+
+			require.NoError(t, start("expired"))
+			requireFileContent(t, filepath.Join(root, "expired", "etc", "app", "config.yaml"), "v2")
+		})
+	}
+}
+
+func TestStartExtractsPinnedDigestWithoutRegistry(t *testing.T) {
+	srv := registrytest.NewServer()
+	defer srv.Close()
+	pushImage(t, srv, "undock/app", "latest", []ociLayerEntry{
+		{name: "etc/app/config.yaml", body: "wanted"},
+	})
+	dgst, err := registry.New(srv.Host(), registry.Options{HTTPClient: srv.Client()}).ManifestDigest(context.Background(), "undock/app", "latest")
+	require.NoError(t, err)
+
+	// a registry which fails any request
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		http.Error(w, "unexpected request", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	root := t.TempDir()
+	start := func(host, dist string) error {
+		app, err := New(config.Meta{UserAgent: "undock-tests"}, config.Cli{
+			Source:   "docker://" + host + "/undock/app@" + dgst.String(),
+			Dist:     filepath.Join(root, dist),
+			CacheDir: filepath.Join(root, "cache"),
+			Insecure: true,
+		})
+		require.NoError(t, err)
+		return app.Start(context.Background())
+	}
+	require.NoError(t, start(srv.Host(), "online"))
+
+	// the digest is known and its image is in the cache
+	require.NoError(t, start(strings.TrimPrefix(failing.URL, "http://"), "pinned"))
+	requireFileContent(t, filepath.Join(root, "pinned", "etc", "app", "config.yaml"), "wanted")
+}
+
+func TestStartRetriesUnavailableRegistry(t *testing.T) {
+	for _, retries := range []int{0, 3} {
+		t.Run(strconv.Itoa(retries), func(t *testing.T) {
+			srv := registrytest.NewServer()
+			defer srv.Close()
+			pushImage(t, srv, "undock/app", "latest", []ociLayerEntry{
+				{name: "etc/app/config.yaml", body: "wanted"},
+			})
+			srv.Unavailable = 2
+
+			root := t.TempDir()
+			distDir := filepath.Join(root, "dist")
+			app, err := New(config.Meta{UserAgent: "undock-tests"}, config.Cli{
+				Source:     "docker://" + srv.Host() + "/undock/app:latest",
+				Dist:       distDir,
+				CacheDir:   filepath.Join(root, "cache"),
+				Insecure:   true,
+				Retries:    retries,
+				RetryDelay: time.Millisecond,
+			})
+			require.NoError(t, err)
+
+			err = app.Start(context.Background())
+			if retries == 0 {
+				require.ErrorContains(t, err, "503")
+				return
+			}
+			require.NoError(t, err)
+			requireFileContent(t, filepath.Join(distDir, "etc", "app", "config.yaml"), "wanted")
+		})
+	}
+}
+
+func TestStartWaitsForRegistryRateLimit(t *testing.T) {
+	for _, tt := range []struct {
+		name            string
+		tooManyRequests int
+		retryAfter      string
+		retryAfterErr   time.Duration
+	}{
+		{name: "reset", tooManyRequests: 2},
+		{name: "exhausted", tooManyRequests: 10, retryAfter: "3600", retryAfterErr: time.Hour},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := registrytest.NewServer()
+			defer srv.Close()
+			pushImage(t, srv, "undock/app", "latest", []ociLayerEntry{
+				{name: "etc/app/config.yaml", body: "wanted"},
+			})
+			srv.RateLimit = 100
+			srv.TooManyRequests = tt.tooManyRequests
+			srv.RetryAfter = tt.retryAfter
+
+			root := t.TempDir()
+			distDir := filepath.Join(root, "dist")
+			app, err := New(config.Meta{UserAgent: "undock-tests"}, config.Cli{
+				Source:        "docker://" + srv.Host() + "/undock/app:latest",
+				Dist:          distDir,
+				CacheDir:      filepath.Join(root, "cache"),
+				Insecure:      true,
+				RetryDelay:    time.Millisecond,
+				RateLimitWait: time.Minute,
+			})
+			require.NoError(t, err)
+
+			err = app.Start(context.Background())
+			if tt.retryAfterErr > 0 {
+				var rateLimitErr *ximage.RateLimitError
+				require.ErrorAs(t, err, &rateLimitErr)
+				assert.Equal(t, tt.retryAfterErr, rateLimitErr.RetryAfter)
+				return
+			}
+			require.NoError(t, err)
+			requireFileContent(t, filepath.Join(distDir, "etc", "app", "config.yaml"), "wanted")
+		})
+	}
+}
+
+func TestStartSendsNoQuotaRequest(t *testing.T) {
+	srv := registrytest.NewServer()
+	defer srv.Close()
+	pushImage(t, srv, "undock/app", "latest", []ociLayerEntry{
+		{name: "etc/app/config.yaml", body: "wanted"},
+	})
+	srv.RateLimit = 100
+
+	root := t.TempDir()
+	distDir := filepath.Join(root, "dist")
+	app, err := New(config.Meta{UserAgent: "undock-tests"}, config.Cli{
+		Source:   "docker://" + srv.Host() + "/undock/app:latest",
+		Dist:     distDir,
+		CacheDir: filepath.Join(root, "cache"),
+		Insecure: true,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, app.Start(context.Background()))
+	requireFileContent(t, filepath.Join(distDir, "etc", "app", "config.yaml"), "wanted")
+	// the only HEAD request of the manifest resolves the tag
+	_, heads := srv.ManifestRequests()
+	assert.Equal(t, 1, heads)
+}
+
+func TestStartLimitsDownloads(t *testing.T) {
+	for _, noCache := range []bool{false, true} {
+		t.Run(fmt.Sprintf("no-cache=%t", noCache), func(t *testing.T) {
+			srv := registrytest.NewServer()
+			defer srv.Close()
+			var layers []registryLayer
+			for _, entries := range [][]ociLayerEntry{
+				{{name: "etc/app/config.yaml", body: "wanted"}},
+				{{name: "usr/share/data", body: strings.Repeat("data", 8192)}},
+				{{name: "usr/share/more", body: strings.Repeat("more", 8192)}},
+			} {
+				payload, diffID := marshalLayer(t, entries)
+				layers = append(layers, registryLayer{payload: payload, diffID: diffID, mediaType: ocispecs.MediaTypeImageLayer})
+			}
+			pushLayers(t, srv, "undock/app", "latest", layers...)
+
+			root := t.TempDir()
+			distDir := filepath.Join(root, "dist")
+			app, err := New(config.Meta{UserAgent: "undock-tests"}, config.Cli{
+				Source:               "docker://" + srv.Host() + "/undock/app:latest",
+				Dist:                 distDir,
+				CacheDir:             filepath.Join(root, "cache"),
+				NoCache:              noCache,
+				Insecure:             true,
+				Parallelism:          3,
+				LimitRate:            "1MiB",
+				MaxParallelDownloads: 1,
+			})
+			require.NoError(t, err)
+
+			require.NoError(t, app.Start(context.Background()))
+			requireFileContent(t, filepath.Join(distDir, "etc", "app", "config.yaml"), "wanted")
+			requireFileContent(t, filepath.Join(distDir, "usr", "share", "more"), strings.Repeat("more", 8192))
+		})
+	}
+}
+
+func TestStartRejectsInvalidLimitRate(t *testing.T) {
+	app, err := New(config.Meta{}, config.Cli{
+		Source:    "alpine:latest",
+		Dist:      t.TempDir(),
+		LimitRate: "fast",
+	})
+	require.NoError(t, err)
+	require.ErrorContains(t, app.Start(context.Background()), "invalid limit rate")
+}
+
+func TestStartRejectsNegativeRetries(t *testing.T) {
+	app, err := New(config.Meta{}, config.Cli{
+		Source:  "alpine:latest",
+		Dist:    t.TempDir(),
+		Retries: -1,
+	})
+	require.NoError(t, err)
+	require.ErrorContains(t, app.Start(context.Background()), "retries cannot be negative")
+}
+
+func TestStartFetchesIncludedFilesOfZstdChunkedLayers(t *testing.T) {
+	srv := registrytest.NewServer()
+	defer srv.Close()
+
+	root := t.TempDir()
+	distDir := filepath.Join(root, "dist")
+	chunkedPayload, chunkedDiffID, annotations := marshalZstdChunkedLayer(t, []ociLayerEntry{
+		{name: "etc/app/config.yaml", body: "wanted"},
+		{name: "usr/share/data", body: strings.Repeat("data", 2048)},
+	})
+	plainPayload, plainDiffID := marshalLayer(t, []ociLayerEntry{
+		{name: "etc/app/extra.yaml", body: "plain"},
+	})
+	pushLayers(t, srv, "undock/app", "latest", registryLayer{
+		payload:     chunkedPayload,
+		diffID:      chunkedDiffID,
+		mediaType:   "application/vnd.oci.image.layer.v1.tar+zstd",
+		annotations: annotations,
+	}, registryLayer{
+		payload:   plainPayload,
+		diffID:    plainDiffID,
+		mediaType: ocispecs.MediaTypeImageLayer,
+	})
+
+	app, err := New(config.Meta{
+		UserAgent: "undock-tests",
+	}, config.Cli{
+		Source:   "docker://" + srv.Host() + "/undock/app:latest",
+		Dist:     distDir,
+		CacheDir: filepath.Join(root, "cache"),
+		Insecure: true,
+		Includes: []string{"/etc/app"},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, app.Start(context.Background()))
+
+	requireFileContent(t, filepath.Join(distDir, "etc", "app", "config.yaml"), "wanted")
+	requireFileContent(t, filepath.Join(distDir, "etc", "app", "extra.yaml"), "plain")
+	assert.NoFileExists(t, filepath.Join(distDir, "usr", "share", "data"))
+
+	// the manifest and the included file of the zstd:chunked layer are
+	// fetched with range requests, the plain layer is pulled
+	requests, ranges := srv.BlobRequests()
+	assert.Equal(t, 2, ranges)
+	assert.Equal(t, 3, requests)
+}
+
+func TestStartAuthenticatesWithRegistry(t *testing.T) {
+	srv := registrytest.NewServer()
+	defer srv.Close()
+	srv.Username, srv.Password = "user", "pass"
+	pushImage(t, srv, "undock/app", "latest", []ociLayerEntry{
+		{name: "etc/app/config.yaml", body: "wanted"},
+	})
+
+	authfile := filepath.Join(t.TempDir(), "auth.json")
+	require.NoError(t, os.WriteFile(authfile, []byte(`{"auths":{"`+srv.Host()+`":{"auth":"`+base64.StdEncoding.EncodeToString([]byte("user:pass"))+`"}}}`), 0o600))
+
+	for _, tc := range []struct {
+		name  string
+		cli   config.Cli
+		stdin string
+	}{
+		{
+			name:  "password-stdin",
+			cli:   config.Cli{Username: "user", PasswordStdin: true},
+			stdin: "pass\n",
+		},
+		{
+			name: "authfile",
+			cli:  config.Cli{AuthFile: authfile},
+		},
+		{
+			name: "registry-token",
+			cli:  config.Cli{RegistryToken: srv.IssueToken()},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			distDir := filepath.Join(root, "dist")
+			cli := tc.cli
+			cli.Source = "docker://" + srv.Host() + "/undock/app:latest"
+			cli.Dist = distDir
+			cli.CacheDir = filepath.Join(root, "cache")
+			cli.Insecure = true
+			app, err := New(config.Meta{UserAgent: "undock-tests"}, cli)
+			require.NoError(t, err)
+			app.stdin = strings.NewReader(tc.stdin)
+
+			require.NoError(t, app.Start(context.Background()))
+			requireFileContent(t, filepath.Join(distDir, "etc", "app", "config.yaml"), "wanted")
+		})
+	}
+}
+
+func TestStartReportsRegistryAuthErrors(t *testing.T) {
+	srv := registrytest.NewServer()
+	defer srv.Close()
+	srv.Username, srv.Password = "user", "pass"
+	pushImage(t, srv, "undock/app", "latest", []ociLayerEntry{
+		{name: "etc/app/config.yaml", body: "wanted"},
+	})
+
+	// an empty auth file so credentials of the host are not used
+	authfile := filepath.Join(t.TempDir(), "auth.json")
+	require.NoError(t, os.WriteFile(authfile, []byte(`{"auths":{}}`), 0o600))
+
+	for _, tc := range []struct {
+		name      string
+		cli       config.Cli
+		stdin     string
+		anonymous bool
+		expected  string
+	}{
+		{
+			name:      "no credentials",
+			cli:       config.Cli{AuthFile: authfile},
+			anonymous: true,
+			expected:  "registry " + srv.Host() + " requires authentication and no credentials were found",
+		},
+		{
+			name:     "invalid credentials",
+			cli:      config.Cli{Username: "user", PasswordStdin: true},
+			stdin:    "wrong",
+			expected: "registry " + srv.Host() + " rejected the credentials",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			cli := tc.cli
+			cli.Source = "docker://" + srv.Host() + "/undock/app:latest"
+			cli.Dist = filepath.Join(root, "dist")
+			cli.CacheDir = filepath.Join(root, "cache")
+			cli.Insecure = true
+			app, err := New(config.Meta{UserAgent: "undock-tests"}, cli)
+			require.NoError(t, err)
+			app.stdin = strings.NewReader(tc.stdin)
+
+			err = app.Start(context.Background())
+			var authErr *ximage.AuthError
+			require.ErrorAs(t, err, &authErr)
+			assert.Equal(t, tc.anonymous, authErr.Anonymous)
+			require.ErrorContains(t, err, tc.expected)
+		})
+	}
+}
+
+func TestStartRejectsInvalidRegistryCredentialsOptions(t *testing.T) {
+	for _, tc := range []struct {
+		cli      config.Cli
+		stdin    string
+		expected string
+	}{
+		{
+			cli:      config.Cli{PasswordStdin: true},
+			expected: "password-stdin requires a username",
+		},
+		{
+			cli:      config.Cli{Username: "user"},
+			expected: "username requires password-stdin",
+		},
+		{
+			cli:      config.Cli{Username: "user", PasswordStdin: true, RegistryToken: "token"},
+			expected: "username cannot be used with registry-token",
+		},
+		{
+			cli:      config.Cli{Username: "user", PasswordStdin: true},
+			stdin:    "\n",
+			expected: "password from stdin is empty",
+		},
+	} {
+		cli := tc.cli
+		cli.Source = "alpine:latest"
+		cli.Dist = t.TempDir()
+		app, err := New(config.Meta{}, cli)
+		require.NoError(t, err)
+		app.stdin = strings.NewReader(tc.stdin)
+		require.ErrorContains(t, app.Start(context.Background()), tc.expected)
+	}
+}
+
+func TestStartPullsThroughRegistryMirrors(t *testing.T) {
+	srv := registrytest.NewServer()
+	defer srv.Close()
+	pushImage(t, srv, "undock/app", "latest", []ociLayerEntry{
+		{name: "etc/app/config.yaml", body: "wanted"},
+		{name: "usr/share/data", body: strings.Repeat("data", 2048)},
+	})
+	down := registrytest.NewServer()
+	down.Close()
+
+	registriesConf := filepath.Join(t.TempDir(), "registries.conf")
+	require.NoError(t, os.WriteFile(registriesConf, []byte(`
+[aliases]
+"app" = "registry.invalid/undock/app"
+
+[[registry]]
+location = "registry.invalid"
+
+[[registry.mirror]]
+location = "`+down.Host()+`"
+
+[[registry.mirror]]
+location = "`+srv.Host()+`"
+`), 0o600))
+
+	for _, tc := range []struct {
+		name string
+		cli  config.Cli
+	}{
+		{
+			name: "registry-mirror",
+			cli: config.Cli{
+				Source:         "docker://registry.invalid/undock/app:latest",
+				RegistryMirror: []string{"registry.invalid=" + down.Host(), "registry.invalid=" + srv.Host()},
+			},
+		},
+		{
+			name: "registries-conf",
+			cli: config.Cli{
+				Source:         "app:latest",
+				RegistriesConf: registriesConf,
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			distDir := filepath.Join(root, "dist")
+			cli := tc.cli
+			cli.Dist = distDir
+			cli.CacheDir = filepath.Join(root, "cache")
+			cli.Insecure = true
+			cli.ChunkSize = "1KiB"
+			cli.Connections = 2
+			app, err := New(config.Meta{UserAgent: "undock-tests"}, cli)
+			require.NoError(t, err)
+
+			require.NoError(t, app.Start(context.Background()))
+			requireFileContent(t, filepath.Join(distDir, "etc", "app", "config.yaml"), "wanted")
+			requireFileContent(t, filepath.Join(distDir, "usr", "share", "data"), strings.Repeat("data", 2048))
+		})
+	}
+}
+
+func TestStartRejectsBlockedRegistry(t *testing.T) {
+	srv := registrytest.NewServer()
+	defer srv.Close()
+	pushImage(t, srv, "undock/app", "latest", []ociLayerEntry{
+		{name: "etc/app/config.yaml", body: "wanted"},
+	})
+
+	root := t.TempDir()
+	registriesConf := filepath.Join(root, "registries.conf")
+	require.NoError(t, os.WriteFile(registriesConf, []byte(`
+[[registry]]
+location = "`+srv.Host()+`"
+blocked = true
+`), 0o600))
+
+	app, err := New(config.Meta{UserAgent: "undock-tests"}, config.Cli{
+		Source:         "docker://" + srv.Host() + "/undock/app:latest",
+		Dist:           filepath.Join(root, "dist"),
+		CacheDir:       filepath.Join(root, "cache"),
+		Insecure:       true,
+		RegistriesConf: registriesConf,
+	})
+	require.NoError(t, err)
+	require.ErrorContains(t, app.Start(context.Background()), "is blocked")
+}
+
+func TestStartRejectsInvalidRegistryMirror(t *testing.T) {
+	for _, mirror := range []string{"mirror.gcr.io", "docker.io=", "docker.io=https://mirror.gcr.io"} {
+		app, err := New(config.Meta{}, config.Cli{
+			Source:         "alpine:latest",
+			Dist:           t.TempDir(),
+			RegistryMirror: []string{mirror},
+		})
+		require.NoError(t, err)
+		require.ErrorContains(t, app.Start(context.Background()), "invalid registry mirror")
+	}
+}
+
+func TestStartTrustsRegistryCertificates(t *testing.T) {
+	srv := registrytest.NewServer()
+	defer srv.Close()
+	pushImage(t, srv, "undock/app", "latest", []ociLayerEntry{
+		{name: "etc/app/config.yaml", body: "wanted"},
+		{name: "usr/share/data", body: strings.Repeat("data", 2048)},
+	})
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, ca, 0o600))
+	certDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(certDir, srv.Host()), 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(certDir, srv.Host(), "ca.crt"), ca, 0o600))
+
+	for _, tc := range []struct {
+		name     string
+		cli      config.Cli
+		expected string
+	}{
+		{
+			name:     "untrusted",
+			expected: "certificate",
+		},
+		{
+			name: "ca-file",
+			cli:  config.Cli{CAFile: caFile},
+		},
+		{
+			name: "cert-dir",
+			cli:  config.Cli{CertDir: certDir},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			distDir := filepath.Join(root, "dist")
+			cli := tc.cli
+			cli.Source = "docker://" + srv.Host() + "/undock/app:latest"
+			cli.Dist = distDir
+			cli.CacheDir = filepath.Join(root, "cache")
+			cli.ChunkSize = "1KiB"
+			cli.Connections = 2
+			app, err := New(config.Meta{UserAgent: "undock-tests"}, cli)
+			require.NoError(t, err)
+
+			err = app.Start(context.Background())
+			if tc.expected != "" {
+				require.ErrorContains(t, err, tc.expected)
+				return
+			}
+			require.NoError(t, err)
+			requireFileContent(t, filepath.Join(distDir, "usr", "share", "data"), strings.Repeat("data", 2048))
+		})
+	}
+}
+
+func TestStartContactsRegistryThroughProxy(t *testing.T) {
+	srv := registrytest.NewServer()
+	defer srv.Close()
+	pushImage(t, srv, "undock/app", "latest", []ociLayerEntry{
+		{name: "etc/app/config.yaml", body: "wanted"},
+		{name: "usr/share/data", body: strings.Repeat("data", 2048)},
+	})
+
+	var tunnels atomic.Int64
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		tunnels.Add(1)
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			_ = upstream.Close()
+			return
+		}
+		go func() {
+			_, _ = io.Copy(upstream, conn)
+			_ = upstream.Close()
+		}()
+		_, _ = io.Copy(conn, upstream)
+		_ = conn.Close()
+	}))
+	defer proxy.Close()
+
+	for _, tc := range []struct {
+		name    string
+		noProxy []string
+		tunnels bool
+	}{
+		{
+			name:    "proxy",
+			tunnels: true,
+		},
+		{
+			name:    "no-proxy",
+			noProxy: []string{"example.com", "127.0.0.0/8"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tunnels.Store(0)
+			root := t.TempDir()
+			distDir := filepath.Join(root, "dist")
+			app, err := New(config.Meta{UserAgent: "undock-tests"}, config.Cli{
+				Source:      "docker://" + srv.Host() + "/undock/app:latest",
+				Dist:        distDir,
+				CacheDir:    filepath.Join(root, "cache"),
+				Insecure:    true,
+				ChunkSize:   "1KiB",
+				Connections: 2,
+				Proxy:       proxy.URL,
+				NoProxy:     tc.noProxy,
+			})
+			require.NoError(t, err)
+
+			require.NoError(t, app.Start(context.Background()))
+			requireFileContent(t, filepath.Join(distDir, "usr", "share", "data"), strings.Repeat("data", 2048))
+			assert.Equal(t, tc.tunnels, tunnels.Load() > 0)
+		})
+	}
+}
+
+func TestStartRejectsInvalidProxy(t *testing.T) {
+	for _, proxy := range []string{"proxy:3128", "ftp://proxy", "http://"} {
+		app, err := New(config.Meta{}, config.Cli{
+			Source: "alpine:latest",
+			Dist:   t.TempDir(),
+			Proxy:  proxy,
+		})
+		require.NoError(t, err)
+		require.ErrorContains(t, app.Start(context.Background()), "invalid proxy")
+	}
+}
+
+func TestStartRejectsInvalidChunkSize(t *testing.T) {
+	app, err := New(config.Meta{}, config.Cli{
+		Source:    "alpine:latest",
+		Dist:      t.TempDir(),
+		ChunkSize: "large",
+	})
+	require.NoError(t, err)
+	require.ErrorContains(t, app.Start(context.Background()), `invalid chunk size "large"`)
+}
+
+func TestNewExpandsDist(t *testing.T) {
+	app, err := New(config.Meta{}, config.Cli{Dist: "dist"})
+	require.NoError(t, err)
+	assert.True(t, filepath.IsAbs(app.cli.Dist))
+
+	app, err = New(config.Meta{}, config.Cli{Dist: "s3://bucket/prefix"})
+	require.NoError(t, err)
+	assert.Equal(t, "s3://bucket/prefix", app.cli.Dist)
+}
+
+func TestStartRejectsBundleWithArchiveOutput(t *testing.T) {
+	app, err := New(config.Meta{}, config.Cli{
+		Source:       "alpine:latest",
+		Dist:         "./dist",
+		OutputFormat: "tar",
+		Bundle:       true,
+	})
+	require.NoError(t, err)
+	require.EqualError(t, app.Start(context.Background()), "bundle cannot be written with tar output format")
+}
+
+func TestStartRejectsOCIOutputToStdout(t *testing.T) {
+	app, err := New(config.Meta{}, config.Cli{
+		Source:       "alpine:latest",
+		Dist:         "-",
+		OutputFormat: "oci-archive",
+	})
+	require.NoError(t, err)
+	require.ErrorContains(t, app.Start(context.Background()), "oci-archive output cannot be streamed to stdout")
+}
+
+func TestParseExecArgs(t *testing.T) {
+	args, err := parseExecArgs(`["/bin/app", "--flag"]`)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/bin/app", "--flag"}, args)
+
+	args, err = parseExecArgs("/bin/app")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/bin/app"}, args)
+
+	_, err = parseExecArgs(`["/bin/app"`)
+	require.Error(t, err)
+}
+
 type ociLayerEntry struct {
 	name string
 	body string
 }
 
-func createOCIImageLayout(t *testing.T, dir string, platform ocispecs.Platform, entries []ociLayerEntry) {
+func createOCIImageLayout(t *testing.T, dir string, platform ocispecs.Platform, imgConfig ocispecs.ImageConfig, entries []ociLayerEntry) {
 	t.Helper()
 
 	require.NoError(t, os.MkdirAll(filepath.Join(dir, ocispecs.ImageBlobsDir, "sha256"), 0o755))
@@ -133,6 +1380,7 @@ func createOCIImageLayout(t *testing.T, dir string, platform ocispecs.Platform,
 		"architecture": platform.Architecture,
 		"os":           platform.OS,
 		"variant":      platform.Variant,
+		"config":       imgConfig,
 		"rootfs": map[string]any{
 			"type":     "layers",
 			"diff_ids": []string{layerDigest.String()},
@@ -156,6 +1404,125 @@ func createOCIImageLayout(t *testing.T, dir string, platform ocispecs.Platform,
 	_ = manifestPayload
 }
 
+// pushImage stores an image with a single layer in a registry
+func pushImage(t *testing.T, srv *registrytest.Server, repo, tag string, entries []ociLayerEntry) {
+	t.Helper()
+
+	layerPayload, layerDigest := marshalLayer(t, entries)
+	pushLayers(t, srv, repo, tag, registryLayer{
+		payload:   layerPayload,
+		diffID:    layerDigest,
+		mediaType: ocispecs.MediaTypeImageLayer,
+	})
+}
+
+type registryLayer struct {
+	payload     []byte
+	diffID      digest.Digest
+	mediaType   string
+	annotations map[string]string
+}
+
+func pushLayers(t *testing.T, srv *registrytest.Server, repo, tag string, layers ...registryLayer) {
+	t.Helper()
+
+	var diffIDs []digest.Digest
+	var descs []ocispecs.Descriptor
+	for _, layer := range layers {
+		descs = append(descs, ocispecs.Descriptor{
+			MediaType:   layer.mediaType,
+			Digest:      srv.AddBlob(layer.payload),
+			Size:        int64(len(layer.payload)),
+			Annotations: layer.annotations,
+		})
+		diffIDs = append(diffIDs, layer.diffID)
+	}
+	platform := platforms.DefaultSpec()
+	configPayload, err := json.Marshal(ocispecs.Image{
+		Platform: platform,
+		RootFS:   ocispecs.RootFS{Type: "layers", DiffIDs: diffIDs},
+	})
+	require.NoError(t, err)
+	configDigest := srv.AddBlob(configPayload)
+
+	manifestPayload, err := json.Marshal(ocispecs.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispecs.MediaTypeImageManifest,
+		Config: ocispecs.Descriptor{
+			MediaType: ocispecs.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      int64(len(configPayload)),
+		},
+		Layers: descs,
+	})
+	require.NoError(t, err)
+	srv.AddManifest(repo, ocispecs.MediaTypeImageManifest, manifestPayload, tag)
+}
+
+// marshalZstdChunkedLayer returns a zstd:chunked layer with the content of
+// each file in its own zstd frame, its diff ID and its annotations
+func marshalZstdChunkedLayer(t *testing.T, entries []ociLayerEntry) ([]byte, digest.Digest, map[string]string) {
+	t.Helper()
+
+	type tocEntry struct {
+		Type      string `json:"type"`
+		Name      string `json:"name"`
+		Mode      int64  `json:"mode"`
+		Size      int64  `json:"size,omitempty"`
+		Digest    string `json:"digest,omitempty"`
+		Offset    int64  `json:"offset,omitempty"`
+		EndOffset int64  `json:"endOffset,omitempty"`
+	}
+	var buf, pending bytes.Buffer
+	diffID := digest.Canonical.Digester()
+	tw := tar.NewWriter(io.MultiWriter(&pending, diffID.Hash()))
+	flush := func(w *bytes.Buffer, dt []byte) {
+		zw, err := archives.Zstd{}.OpenWriter(w)
+		require.NoError(t, err)
+		_, err = zw.Write(dt)
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+	}
+
+	var toc []tocEntry
+	for _, entry := range entries {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: entry.name, Mode: 0o644, Size: int64(len(entry.body))}))
+		flush(&buf, pending.Bytes())
+		pending.Reset()
+		offset := int64(buf.Len())
+		_, err := tw.Write([]byte(entry.body))
+		require.NoError(t, err)
+		flush(&buf, pending.Bytes())
+		pending.Reset()
+		toc = append(toc, tocEntry{
+			Type:      "reg",
+			Name:      entry.name,
+			Mode:      0o644,
+			Size:      int64(len(entry.body)),
+			Digest:    digest.FromString(entry.body).String(),
+			Offset:    offset,
+			EndOffset: int64(buf.Len()),
+		})
+	}
+	require.NoError(t, tw.Close())
+	flush(&buf, pending.Bytes())
+
+	manifest, err := json.Marshal(map[string]any{"version": 1, "entries": toc})
+	require.NoError(t, err)
+	var compressed bytes.Buffer
+	flush(&compressed, manifest)
+	// the manifest is stored in a skippable frame
+	buf.Write(binary.LittleEndian.AppendUint32(nil, 0x184d2a50))
+	buf.Write(binary.LittleEndian.AppendUint32(nil, uint32(compressed.Len())))
+	offset := buf.Len()
+	buf.Write(compressed.Bytes())
+
+	return buf.Bytes(), diffID.Digest(), map[string]string{
+		"io.github.containers.zstd-chunked.manifest-checksum": digest.FromBytes(compressed.Bytes()).String(),
+		"io.github.containers.zstd-chunked.manifest-position": fmt.Sprintf("%d:%d:%d:1", offset, compressed.Len(), len(manifest)),
+	}
+}
+
 func marshalLayer(t *testing.T, entries []ociLayerEntry) ([]byte, digest.Digest) {
 	t.Helper()
 
@@ -206,6 +1573,18 @@ func writeOCIObject(t *testing.T, dir string, payload []byte, mediaType string)
 	}
 }
 
+func readJSONFile(t *testing.T, filename string, v any) {
+	t.Helper()
+
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, v))
+}
+
+func blobPath(dir string, dgst digest.Digest) string {
+	return filepath.Join(dir, ocispecs.ImageBlobsDir, dgst.Algorithm().String(), dgst.Hex())
+}
+
 func requireFileContent(t *testing.T, filename string, expected string) {
 	t.Helper()
 
@@ -1,6 +1,10 @@
 package config
 
-import "github.com/alecthomas/kong"
+import (
+	"time"
+
+	"github.com/alecthomas/kong"
+)
 
 type Cli struct {
 	Version kong.VersionFlag
@@ -10,15 +14,55 @@ type Cli struct {
 	LogCaller  bool   `kong:"name=log-caller,env=LOG_CALLER,default=false,help='Add file:line of the caller to log output.'"`
 	LogNoColor bool   `kong:"name=log-nocolor,env=LOG_NOCOLOR,default=false,help='Disable colorized output.'"`
 
-	CacheDir string `kong:"name=cachedir,type=path,env=UNDOCK_CACHE_DIR,help='Set cache path. (eg. ~/.local/share/undock/cache)'"`
-	Platform string `kong:"name=platform,help='Enforce platform for source image. (eg. linux/amd64)'"`
+	CacheDir      string `kong:"name=cachedir,type=path,env=UNDOCK_CACHE_DIR,help='Set cache path. (eg. ~/.local/share/undock/cache)'"`
+	NoCache       bool   `kong:"name=no-cache,env=UNDOCK_NO_CACHE,default=false,help='Stream layers from the source instead of caching the image.'"`
+	Offline       bool   `kong:"name=offline,env=UNDOCK_OFFLINE,default=false,help='Extract registry images from the cache without network, resolving tags to the digests recorded when they were last pulled.'"`
+	Snapshots     bool   `kong:"name=snapshots,env=UNDOCK_SNAPSHOTS,default=false,help='Keep unpacked layers in the cache and assemble the dist folder from them.'"`
+	SnapshotLinks bool   `kong:"name=snapshot-links,env=UNDOCK_SNAPSHOT_LINKS,default=false,help='Hard link files from the snapshots to the dist folder if they cannot be reflinked, instead of copying them.'"`
+	Platform      string `kong:"name=platform,help='Enforce platform for source image. (eg. linux/amd64)'"`
+
+	ResolveTTL time.Duration `kong:"name=resolve-ttl,env=UNDOCK_RESOLVE_TTL,default=0s,help='Time a tag resolved to a digest is trusted without contacting the registry. Tags are always resolved if 0.'"`
+	Refresh    bool          `kong:"name=refresh,default=false,help='Resolve tags with the registry even if they were resolved less than --resolve-ttl ago.'"`
+
+	All            bool     `kong:"name=all,default=false,help='Extract all architectures if source is a manifest list.'"`
+	Includes       []string `kong:"name=include,help='Include a subset of files/dirs from the source image.'"`
+	ChunkSize      string   `kong:"name=chunk-size,default=16MiB,help='Size of the ranges of a large layer blob downloaded at once from a registry.'"`
+	Connections    int      `kong:"name=connections,default=1,help='Number of concurrent range requests to download a large layer blob from a registry.'"`
+	Username       string   `kong:"name=username,env=UNDOCK_USERNAME,help='Username to authenticate with the registry.'"`
+	PasswordStdin  bool     `kong:"name=password-stdin,default=false,help='Read the password of the registry username from stdin.'"`
+	RegistryToken  string   `kong:"name=registry-token,env=UNDOCK_REGISTRY_TOKEN,help='Bearer token to authenticate with the registry.'"`
+	AuthFile       string   `kong:"name=authfile,type=path,help='Path of a containers auth.json or docker config.json file to read registry credentials from.'"`
+	RegistriesConf string   `kong:"name=registries-conf,type=path,help='Path of a registries.conf file for registry mirrors, short-name aliases and blocked registries.'"`
+	RegistryMirror []string `kong:"name=registry-mirror,sep=none,help='Pull images of a registry from a mirror, tried in the order set before the registry. (eg. docker.io=mirror.gcr.io)'"`
+	CertDir        string   `kong:"name=cert-dir,type=path,help='Directory of the certificates of registries in host[:port] subfolders, or of the docker daemon.'"`
+	CAFile         string   `kong:"name=ca-file,type=path,help='File of CA certificates to trust along with the system ones.'"`
+	Proxy          string   `kong:"name=proxy,help='Proxy URL to contact registries with. Defaults to the proxy environment variables. (eg. http://proxy:3128)'"`
+	NoProxy        []string `kong:"name=no-proxy,help='Comma-separated list of registry hosts, domains or CIDRs to contact without proxy.'"`
+	Insecure       bool     `kong:"name=insecure,default=false,help='Allow contacting the registry or docker daemon over HTTP, or HTTPS with failed TLS verification.'"`
+	OutputFormat   string   `kong:"name=output-format,enum='dir,tar,tar.gz,tar.zst,zip,cpio,cpio.gz,cpio.zst,squashfs,erofs,oci,oci-archive',default=dir,help='Output format of the extracted content. Defaults to tar if dist is -.'"`
+	RmDist         bool     `kong:"name=rm-dist,default=false,help='Removes dist folder.'"`
+	Wrap           bool     `kong:"name=wrap,default=false,help='For a manifest list, merge output in dist folder.'"`
+	Bundle         bool     `kong:"name=bundle,default=false,help='Write an OCI runtime bundle (rootfs and config.json) in dist folder.'"`
+	ExportLayers   bool     `kong:"name=export-layers,default=false,help='Copy layer blobs and a manifest.json in dist folder without unpacking.'"`
+	Parallelism    int      `kong:"name=parallelism,default=1,help='Number of layers decompressed at once.'"`
+	MaxConcurrency int      `kong:"name=max-concurrency,default=0,help='Number of platforms extracted at once. Defaults to the number of CPUs.'"`
+
+	Retries        int           `kong:"name=retries,default=3,help='Number of times a registry request failing with a transient error is retried.'"`
+	RetryDelay     time.Duration `kong:"name=retry-delay,default=1s,help='Delay before the first retry of a registry request, doubled for each of the next ones.'"`
+	RequestTimeout time.Duration `kong:"name=request-timeout,default=1m,help='Time to wait for the response to a registry request, or for the next bytes of a blob. No timeout if 0.'"`
+	Timeout        time.Duration `kong:"name=timeout,default=0s,help='Time after which the extraction is aborted. No timeout if 0.'"`
+	RateLimitWait  time.Duration `kong:"name=rate-limit-wait,default=1m,help='Time to wait in total for registry rate limits to reset before failing.'"`
+
+	LimitRate            string `kong:"name=limit-rate,help='Maximum rate of the downloads from registries in bytes per second, shared by all blobs. (eg. 10MiB)'"`
+	MaxParallelDownloads int    `kong:"name=max-parallel-downloads,default=0,help='Number of blobs downloaded at once. Defaults to the limit of the image copy.'"`
 
-	All      bool     `kong:"name=all,default=false,help='Extract all architectures if source is a manifest list.'"`
-	Includes []string `kong:"name=include,help='Include a subset of files/dirs from the source image.'"`
-	Insecure bool     `kong:"name=insecure,default=false,help='Allow contacting the registry or docker daemon over HTTP, or HTTPS with failed TLS verification.'"`
-	RmDist   bool     `kong:"name=rm-dist,default=false,help='Removes dist folder.'"`
-	Wrap     bool     `kong:"name=wrap,default=false,help='For a manifest list, merge output in dist folder.'"`
+	ConfigEntrypoint string            `kong:"name=config-entrypoint,help='Override the entrypoint of the OCI image, as a JSON array or a single executable. Resets the command.'"`
+	ConfigCmd        string            `kong:"name=config-cmd,help='Override the command of the OCI image, as a JSON array or a single argument.'"`
+	ConfigEnv        []string          `kong:"name=config-env,sep=none,help='Set an environment variable in the OCI image. (eg. KEY=VALUE)'"`
+	ConfigLabels     map[string]string `kong:"name=config-label,mapsep=none,help='Set a label in the OCI image. (eg. KEY=VALUE)'"`
+	ConfigWorkdir    string            `kong:"name=config-workdir,help='Override the working directory of the OCI image.'"`
+	ConfigUser       string            `kong:"name=config-user,help='Override the user of the OCI image.'"`
 
 	Source string `kong:"arg,required,name=source,help='Source image. (eg. alpine:latest)'"`
-	Dist   string `kong:"arg,required,name=dist,type=path,help='Dist folder. (eg. ./dist)'"`
+	Dist   string `kong:"arg,required,name=dist,help='Dist folder, archive file with --output-format, or s3://bucket/prefix URL. Use - to stream to stdout. (eg. ./dist)'"`
 }
@@ -27,14 +27,20 @@ func Configure(cli config.Cli) {
 	// Adds support for NO_COLOR. More info https://no-color.org/
 	_, noColor := os.LookupEnv("NO_COLOR")
 
+	// Keep stdout clean if extracted content is streamed to it
+	out := os.Stdout
+	if cli.Dist == "-" {
+		out = os.Stderr
+	}
+
 	if !cli.LogJSON {
 		w = zerolog.ConsoleWriter{
-			Out:        os.Stdout,
+			Out:        out,
 			NoColor:    noColor || cli.LogNoColor,
 			TimeFormat: time.RFC1123,
 		}
 	} else {
-		w = os.Stdout
+		w = out
 	}
 
 	zerolog.ErrorStackMarshaler = pkgerrors.MarshalStack
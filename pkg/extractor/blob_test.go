@@ -5,12 +5,11 @@ import (
 	"compress/gzip"
 	"context"
 	"io"
-	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
-	"github.com/mholt/archives"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/require"
 )
@@ -316,34 +315,66 @@ func TestExtractBlobKeepsRecreatedDirWhenWhiteoutComesLater(t *testing.T) {
 	require.NoFileExists(t, filepath.Join(dest, "dir", "sub", "lower.txt"))
 }
 
-func TestWriteFileHonorsCanceledContext(t *testing.T) {
+func TestExtractBlobFollowsLowerDirSymlink(t *testing.T) {
+	skipIfSymlinkUnsupported(t)
+
 	root := t.TempDir()
-	source := filepath.Join(root, "source.txt")
-	destName := "dest.txt"
-	dest := filepath.Join(root, destName)
-	require.NoError(t, os.WriteFile(source, []byte("payload"), 0o644))
+	dest := filepath.Join(root, "dist")
 
-	info, err := os.Stat(source)
-	require.NoError(t, err)
+	layer1 := filepath.Join(root, "layer1.tar")
+	writeTarFile(t, layer1, []tarEntry{
+		{name: "usr/lib/", typeflag: tar.TypeDir},
+		{name: "usr/lib/a.so", body: "a"},
+		{name: "lib", typeflag: tar.TypeSymlink, linkname: "usr/lib"},
+	})
+
+	layer2 := filepath.Join(root, "layer2.tar")
+	writeTarFile(t, layer2, []tarEntry{
+		{name: "lib/b.so", body: "b"},
+	})
+
+	opts := ExtractBlobOpts{
+		Context: context.Background(),
+		Logger:  zerolog.New(io.Discard),
+	}
+
+	require.NoError(t, ExtractBlob(layer1, dest, opts))
+	require.NoError(t, ExtractBlob(layer2, dest, opts))
 
-	rootFS, err := os.OpenRoot(root)
+	target, err := os.Readlink(filepath.Join(dest, "lib"))
 	require.NoError(t, err)
-	defer rootFS.Close()
+	require.Equal(t, "usr/lib", target)
+	require.FileExists(t, filepath.Join(dest, "usr", "lib", "a.so"))
+	require.FileExists(t, filepath.Join(dest, "usr", "lib", "b.so"))
+}
+
+func TestExtractBlobHonorsCanceledContext(t *testing.T) {
+	root := t.TempDir()
+	dest := filepath.Join(root, "dist")
+
+	layer := filepath.Join(root, "layer.tar")
+	writeTarFile(t, layer, []tarEntry{
+		{name: "dest.txt", body: "payload"},
+	})
 
 	ctx, cancel := context.WithCancelCause(context.Background())
 	cancel(nil)
 
-	err = writeFile(ctx, rootFS, destName, archives.FileInfo{
-		FileInfo: info,
-		Open: func() (fs.File, error) {
-			return os.Open(source)
-		},
+	err := ExtractBlob(layer, dest, ExtractBlobOpts{
+		Context: ctx,
+		Logger:  zerolog.New(io.Discard),
 	})
 	require.ErrorIs(t, err, context.Canceled)
+	require.NoFileExists(t, filepath.Join(dest, "dest.txt"))
+}
 
-	data, readErr := os.ReadFile(dest)
-	require.NoError(t, readErr)
-	require.Empty(t, data)
+func TestReaderContextHonorsCanceledContext(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(nil)
+
+	n, err := readerContext(ctx, strings.NewReader("payload")).Read(make([]byte, 7))
+	require.ErrorIs(t, err, context.Canceled)
+	require.Zero(t, n)
 }
 
 type tarEntry struct {
@@ -0,0 +1,183 @@
+package extractor
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// cloner copies regular files by reflink if the filesystem supports it,
+// then by hard link if allowed, then by copying their content. A method is
+// not tried again once it failed.
+type cloner struct {
+	logger     zerolog.Logger
+	noReflink  bool
+	noHardlink bool
+}
+
+// CloneTree copies the content of the src folder in dst. Regular files are
+// cloned by reflink if the filesystem supports it, or copied, so changes to
+// dst never affect src.
+func CloneTree(src, dst string, logger zerolog.Logger) error {
+	return cloneTree(src, dst, logger, false, nil)
+}
+
+// cloneTree copies the content of the src folder in dst, replacing existing
+// entries. Regular files are hard linked if hardlink is true and they
+// cannot be reflinked. Entries are skipped if skip returns true, and the
+// content of a skipped folder too.
+func cloneTree(src, dst string, logger zerolog.Logger, hardlink bool, skip func(name string, d fs.DirEntry) bool) error {
+	if err := os.MkdirAll(dst, 0o755); err != nil {
+		return err
+	}
+	root, err := os.OpenRoot(dst)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	c := &cloner{logger: logger, noHardlink: !hardlink}
+	var dirs []string
+	if err := filepath.WalkDir(src, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, name)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if skip != nil && skip(filepath.ToSlash(rel), d) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		switch {
+		case d.IsDir():
+			if fi, err := root.Lstat(rel); err == nil && !fi.IsDir() {
+				if err := root.RemoveAll(rel); err != nil {
+					return err
+				}
+			}
+			dirs = append(dirs, rel)
+			return root.MkdirAll(rel, 0o755)
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(name)
+			if err != nil {
+				return err
+			}
+			if err := root.RemoveAll(rel); err != nil {
+				return err
+			}
+			return root.Symlink(target, rel)
+		case d.Type().IsRegular():
+			if err := root.RemoveAll(rel); err != nil {
+				return err
+			}
+			return c.cloneFile(name, root, rel)
+		default:
+			logger.Debug().Msgf("Skipping %s, cannot be cloned", rel)
+			return nil
+		}
+	}); err != nil {
+		return err
+	}
+
+	// children first, so modification times of parents are kept
+	for i := len(dirs) - 1; i >= 0; i-- {
+		fi, err := os.Stat(filepath.Join(src, dirs[i]))
+		if err != nil {
+			return err
+		}
+		if err := setModeAndTime(root, dirs[i], fi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cloner) cloneFile(src string, root *os.Root, name string) error {
+	if !c.noReflink {
+		err := c.reflinkFile(src, root, name)
+		if err == nil {
+			return nil
+		}
+		c.logger.Debug().Err(err).Msg("Cannot reflink files, falling back")
+		c.noReflink = true
+		if err := root.RemoveAll(name); err != nil {
+			return err
+		}
+	}
+	if !c.noHardlink {
+		err := os.Link(src, filepath.Join(root.Name(), name))
+		if err == nil {
+			return nil
+		}
+		c.logger.Debug().Err(err).Msg("Cannot hard link files, copying them")
+		c.noHardlink = true
+	}
+	return c.copyFile(src, root, name)
+}
+
+func (c *cloner) reflinkFile(src string, root *os.Root, name string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := reflink(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return setModeAndTime(root, name, fi)
+}
+
+func (c *cloner) copyFile(src string, root *os.Root, name string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return setModeAndTime(root, name, fi)
+}
+
+func setModeAndTime(root *os.Root, name string, fi fs.FileInfo) error {
+	if err := root.Chmod(name, fi.Mode()); err != nil {
+		return err
+	}
+	// a zero access time is left unchanged
+	return root.Chtimes(name, time.Time{}, fi.ModTime())
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package extractor
+
+import (
+	goerrors "errors"
+	"os"
+)
+
+func reflink(out, _ *os.File) error {
+	return &os.PathError{Op: "reflink", Path: out.Name(), Err: goerrors.ErrUnsupported}
+}
@@ -0,0 +1,49 @@
+package extractor
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCloneTree(t *testing.T) {
+	skipIfSymlinkUnsupported(t)
+
+	root := t.TempDir()
+	src := filepath.Join(root, "src")
+	dst := filepath.Join(root, "dst")
+	mtime := time.Unix(1700000000, 0)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "dir"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "dir", "file.txt"), []byte("content"), 0o640))
+	require.NoError(t, os.Symlink("dir/file.txt", filepath.Join(src, "link")))
+	require.NoError(t, os.Chtimes(filepath.Join(src, "dir"), mtime, mtime))
+
+	require.NoError(t, CloneTree(src, dst, zerolog.New(io.Discard)))
+
+	requireFileBody(t, filepath.Join(dst, "dir", "file.txt"), "content")
+	target, err := os.Readlink(filepath.Join(dst, "link"))
+	require.NoError(t, err)
+	require.Equal(t, "dir/file.txt", target)
+
+	fi, err := os.Stat(filepath.Join(dst, "dir"))
+	require.NoError(t, err)
+	require.True(t, fi.ModTime().Equal(mtime))
+
+	// files are not hard linked, so changes to the clone do not affect the
+	// source
+	srcfi, err := os.Stat(filepath.Join(src, "dir", "file.txt"))
+	require.NoError(t, err)
+	dstfi, err := os.Stat(filepath.Join(dst, "dir", "file.txt"))
+	require.NoError(t, err)
+	require.False(t, os.SameFile(srcfi, dstfi))
+
+	// the clone is not affected by changes of the source
+	require.NoError(t, os.Remove(filepath.Join(src, "dir", "file.txt")))
+	requireFileBody(t, filepath.Join(dst, "dir", "file.txt"), "content")
+}
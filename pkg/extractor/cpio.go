@@ -0,0 +1,162 @@
+package extractor
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	cpioMagic   = "070701"
+	cpioTrailer = "TRAILER!!!"
+
+	cpioModeFifo    = 0o010000
+	cpioModeChar    = 0o020000
+	cpioModeDir     = 0o040000
+	cpioModeBlock   = 0o060000
+	cpioModeRegular = 0o100000
+	cpioModeSymlink = 0o120000
+)
+
+// cpioWriter writes entries as a newc (SVR4 without CRC) cpio archive, as
+// expected by the Linux kernel for initramfs. Ownership, modes and device
+// numbers are taken from the layer headers.
+type cpioWriter struct {
+	w   io.Writer
+	cw  io.Closer
+	ino uint32
+}
+
+func newCpioWriter(w io.Writer, cw io.Closer) *cpioWriter {
+	return &cpioWriter{w: w, cw: cw}
+}
+
+func (c *cpioWriter) WriteEntry(hdr *tar.Header, r io.Reader) error {
+	c.ino++
+	return c.writeEntry(hdr, r, c.ino, 1)
+}
+
+func (c *cpioWriter) WriteHardlinks(hdr *tar.Header, r io.Reader, links []*tar.Header) error {
+	c.ino++
+	nlink := uint32(len(links) + 1)
+	if err := c.writeEntry(hdr, r, c.ino, nlink); err != nil {
+		return err
+	}
+	// links share the inode of the first entry and have no content
+	for _, link := range links {
+		h := *hdr
+		h.Name = link.Name
+		h.Size = 0
+		if err := c.writeEntry(&h, nil, c.ino, nlink); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cpioWriter) writeEntry(hdr *tar.Header, r io.Reader, ino uint32, nlink uint32) error {
+	var mode int64
+	var body io.Reader
+	size := hdr.Size
+	switch hdr.Typeflag {
+	case tar.TypeReg:
+		mode = cpioModeRegular
+		body = r
+	case tar.TypeDir:
+		mode = cpioModeDir
+		size = 0
+		nlink = 2
+	case tar.TypeSymlink:
+		mode = cpioModeSymlink
+		body = strings.NewReader(hdr.Linkname)
+		size = int64(len(hdr.Linkname))
+	case tar.TypeChar:
+		mode = cpioModeChar
+		size = 0
+	case tar.TypeBlock:
+		mode = cpioModeBlock
+		size = 0
+	case tar.TypeFifo:
+		mode = cpioModeFifo
+		size = 0
+	default:
+		return errors.Errorf("cannot handle file type %q for %s", hdr.Typeflag, hdr.Name)
+	}
+	if body == nil {
+		size = 0
+	}
+	if size > math.MaxUint32 {
+		return errors.Errorf("file %s is too large for cpio (%d bytes)", hdr.Name, size)
+	}
+
+	if err := c.writeHeader(cpioHeader{
+		ino:      ino,
+		mode:     uint32(mode | hdr.Mode&0o7777),
+		uid:      uint32(hdr.Uid),
+		gid:      uint32(hdr.Gid),
+		nlink:    nlink,
+		mtime:    uint32(hdr.ModTime.Unix()),
+		filesize: uint32(size),
+		rdevmaj:  uint32(hdr.Devmajor),
+		rdevmin:  uint32(hdr.Devminor),
+		name:     hdr.Name,
+	}); err != nil {
+		return errors.Wrapf(err, "cannot write header for %s", hdr.Name)
+	}
+	if body == nil {
+		return nil
+	}
+	n, err := io.Copy(c.w, io.LimitReader(body, size))
+	if err != nil {
+		return err
+	} else if n != size {
+		return errors.Errorf("short read for %s: %d/%d bytes", hdr.Name, n, size)
+	}
+	return c.pad(size)
+}
+
+type cpioHeader struct {
+	ino      uint32
+	mode     uint32
+	uid      uint32
+	gid      uint32
+	nlink    uint32
+	mtime    uint32
+	filesize uint32
+	rdevmaj  uint32
+	rdevmin  uint32
+	name     string
+}
+
+func (c *cpioWriter) writeHeader(h cpioHeader) error {
+	// namesize includes the trailing NUL
+	if _, err := fmt.Fprintf(c.w, "%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%s\x00",
+		cpioMagic, h.ino, h.mode, h.uid, h.gid, h.nlink, h.mtime, h.filesize,
+		0, 0, h.rdevmaj, h.rdevmin, len(h.name)+1, 0, h.name); err != nil {
+		return err
+	}
+	// header is 110 bytes long, name and header are padded to 4 bytes
+	return c.pad(int64(110 + len(h.name) + 1))
+}
+
+func (c *cpioWriter) pad(n int64) error {
+	if rem := n % 4; rem != 0 {
+		_, err := c.w.Write(make([]byte, 4-rem))
+		return err
+	}
+	return nil
+}
+
+func (c *cpioWriter) Close() error {
+	err := c.writeHeader(cpioHeader{nlink: 1, name: cpioTrailer})
+	if c.cw != nil {
+		if cerr := c.cw.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
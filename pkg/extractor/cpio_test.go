@@ -0,0 +1,140 @@
+package extractor
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeLayersWritesCpio(t *testing.T) {
+	root := t.TempDir()
+
+	layer1 := filepath.Join(root, "layer1.tar")
+	writeTarFile(t, layer1, []tarEntry{
+		{name: "bin/", typeflag: tar.TypeDir},
+		{name: "bin/busybox", body: "busybox", mode: 0o755},
+		{name: "bin/sh", typeflag: tar.TypeLink, linkname: "bin/busybox"},
+		{name: "bin/ls", typeflag: tar.TypeSymlink, linkname: "busybox"},
+		{name: "dev/console", typeflag: tar.TypeChar, mode: 0o600},
+	})
+
+	layer2 := filepath.Join(root, "layer2.tar")
+	writeTarFile(t, layer2, []tarEntry{
+		{name: "bin/.wh.busybox"},
+	})
+
+	var buf bytes.Buffer
+	w, err := NewArchiveWriter(OutputFormatCpio, &buf)
+	require.NoError(t, err)
+	require.NoError(t, MergeLayers(testLayers(layer1, layer2), w, MergeOpts{
+		Context: context.Background(),
+	}))
+	require.NoError(t, w.Close())
+
+	entries := readCpio(t, buf.Bytes())
+	require.Len(t, entries, 5)
+
+	require.Equal(t, "bin", entries[0].name)
+	require.Equal(t, uint32(cpioModeDir|0o755), entries[0].mode)
+	require.Equal(t, "dev", entries[1].name)
+
+	require.Equal(t, "bin/sh", entries[2].name)
+	require.Equal(t, uint32(cpioModeRegular|0o755), entries[2].mode)
+	require.Equal(t, "busybox", entries[2].body)
+
+	require.Equal(t, "bin/ls", entries[3].name)
+	require.Equal(t, uint32(cpioModeSymlink|0o644), entries[3].mode)
+	require.Equal(t, "busybox", entries[3].body)
+
+	require.Equal(t, "dev/console", entries[4].name)
+	require.Equal(t, uint32(cpioModeChar|0o600), entries[4].mode)
+}
+
+func TestCpioWriterSharesInodeForHardlinks(t *testing.T) {
+	var buf bytes.Buffer
+	w := newCpioWriter(&buf, nil)
+	require.NoError(t, w.WriteHardlinks(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     "bin/a",
+		Mode:     0o755,
+		Size:     4,
+		Uid:      1000,
+		Gid:      1000,
+	}, bytes.NewReader([]byte("data")), []*tar.Header{{
+		Typeflag: tar.TypeLink,
+		Name:     "bin/b",
+		Linkname: "bin/a",
+	}}))
+	require.NoError(t, w.Close())
+
+	entries := readCpio(t, buf.Bytes())
+	require.Len(t, entries, 2)
+	require.Equal(t, entries[0].ino, entries[1].ino)
+	require.Equal(t, uint32(2), entries[0].nlink)
+	require.Equal(t, uint32(2), entries[1].nlink)
+	require.Equal(t, uint32(1000), entries[1].uid)
+	require.Equal(t, "data", entries[0].body)
+	require.Empty(t, entries[1].body)
+}
+
+type cpioEntry struct {
+	name  string
+	ino   uint32
+	mode  uint32
+	uid   uint32
+	nlink uint32
+	body  string
+}
+
+func readCpio(t *testing.T, data []byte) []cpioEntry {
+	t.Helper()
+
+	var entries []cpioEntry
+	r := bytes.NewReader(data)
+	align := func() {
+		pos := len(data) - r.Len()
+		if rem := pos % 4; rem != 0 {
+			_, err := r.Seek(int64(4-rem), io.SeekCurrent)
+			require.NoError(t, err)
+		}
+	}
+	field := func(hdr []byte, i int) uint32 {
+		v, err := strconv.ParseUint(string(hdr[6+i*8:14+i*8]), 16, 32)
+		require.NoError(t, err)
+		return uint32(v)
+	}
+	for {
+		hdr := make([]byte, 110)
+		_, err := io.ReadFull(r, hdr)
+		require.NoError(t, err)
+		require.Equal(t, cpioMagic, string(hdr[:6]))
+
+		name := make([]byte, field(hdr, 11))
+		_, err = io.ReadFull(r, name)
+		require.NoError(t, err)
+		align()
+		if string(name[:len(name)-1]) == cpioTrailer {
+			return entries
+		}
+
+		body := make([]byte, field(hdr, 6))
+		_, err = io.ReadFull(r, body)
+		require.NoError(t, err)
+		align()
+
+		entries = append(entries, cpioEntry{
+			name:  string(name[:len(name)-1]),
+			ino:   field(hdr, 0),
+			mode:  field(hdr, 1),
+			uid:   field(hdr, 2),
+			nlink: field(hdr, 4),
+			body:  string(body),
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package extractor
+
+import (
+	"archive/tar"
+	goerrors "errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// dirWriter writes the entries of a merged filesystem to a folder with
+// their ownership, modes and modification times. Ownership and device
+// nodes need root privileges on Linux and are skipped with a warning
+// otherwise.
+type dirWriter struct {
+	root   *os.Root
+	logger zerolog.Logger
+	dirs   []*tar.Header
+	// dirMode is the mode of the dest folder and of the parent folders
+	// missing from the entries
+	dirMode os.FileMode
+	// followDirLinks keeps a symlink to a folder found at the path of a
+	// folder entry instead of replacing it, for entries merged without the
+	// layer holding the symlink
+	followDirLinks bool
+	// unprivileged is set once changing ownership or creating a device node
+	// has been denied
+	unprivileged bool
+}
+
+// NewDirWriter creates an entry writer that writes entries in the dest
+// folder, such as the root filesystem of a bundle. Folders missing from the
+// entries are created with 0755 mode.
+func NewDirWriter(dest string, logger zerolog.Logger) (HardlinkWriter, error) {
+	return newDirWriter(dest, 0o755, logger)
+}
+
+func newDirWriter(dest string, dirMode os.FileMode, logger zerolog.Logger) (*dirWriter, error) {
+	if err := os.MkdirAll(dest, dirMode); err != nil {
+		return nil, err
+	}
+	root, err := os.OpenRoot(dest)
+	if err != nil {
+		return nil, err
+	}
+	return &dirWriter{root: root, logger: logger, dirMode: dirMode}, nil
+}
+
+func (d *dirWriter) WriteEntry(hdr *tar.Header, r io.Reader) error {
+	name := filepath.FromSlash(hdr.Name)
+	if dir := filepath.Dir(name); dir != "." {
+		if err := d.root.MkdirAll(dir, d.dirMode); err != nil {
+			return err
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if fi, err := d.root.Lstat(name); err == nil && !fi.IsDir() {
+			if d.isDirLink(name, fi) {
+				return nil
+			}
+			if err := d.remove(name); err != nil {
+				return err
+			}
+		}
+		if err := d.root.MkdirAll(name, d.dirMode); err != nil {
+			return err
+		}
+		// applied on close so the folder stays writable while its content
+		// is written
+		d.dirs = append(d.dirs, hdr)
+		return nil
+	case tar.TypeReg:
+		if err := d.writeFile(name, r); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := d.remove(name); err != nil {
+			return err
+		}
+		if err := d.root.Symlink(hdr.Linkname, name); err != nil {
+			return err
+		}
+		return d.chown(name, hdr)
+	case tar.TypeLink:
+		if err := d.remove(name); err != nil {
+			return err
+		}
+		return d.root.Link(filepath.FromSlash(hdr.Linkname), name)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		if d.unprivileged {
+			d.logger.Debug().Msgf("Skipping device node %s", hdr.Name)
+			return nil
+		}
+		if err := d.remove(name); err != nil {
+			return err
+		}
+		if err := mknod(d.root, name, hdr); err != nil {
+			if !isDenied(err) {
+				return errors.Wrapf(err, "cannot create device node %s", hdr.Name)
+			}
+			d.denied()
+			return nil
+		}
+	default:
+		return errors.Errorf("cannot handle entry type %q for %s", hdr.Typeflag, hdr.Name)
+	}
+	return d.setAttrs(name, hdr)
+}
+
+func (d *dirWriter) WriteHardlinks(hdr *tar.Header, r io.Reader, links []*tar.Header) error {
+	if err := d.WriteEntry(hdr, r); err != nil {
+		return err
+	}
+	for _, link := range links {
+		if err := d.WriteEntry(link, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *dirWriter) Remove(name string, opaque bool) error {
+	name = filepath.FromSlash(name)
+	if !opaque {
+		return d.remove(name)
+	}
+	if fi, err := d.root.Lstat(name); os.IsNotExist(err) || (err == nil && !fi.IsDir()) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	f, err := d.root.Open(name)
+	if err != nil {
+		return err
+	}
+	entries, err := f.ReadDir(-1)
+	_ = f.Close()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := d.remove(filepath.Join(name, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *dirWriter) Close() error {
+	defer d.root.Close()
+	// children first, so modification times of parents are kept
+	for i := len(d.dirs) - 1; i >= 0; i-- {
+		hdr := d.dirs[i]
+		if err := d.setAttrs(filepath.FromSlash(hdr.Name), hdr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isDirLink returns true if the symlink at name is followed to a folder,
+// whose attributes are left as is
+func (d *dirWriter) isDirLink(name string, fi os.FileInfo) bool {
+	if !d.followDirLinks || fi.Mode()&os.ModeSymlink == 0 {
+		return false
+	}
+	target, err := d.root.Stat(name)
+	return err == nil && target.IsDir()
+}
+
+func (d *dirWriter) writeFile(name string, r io.Reader) error {
+	if err := d.remove(name); err != nil {
+		return err
+	}
+	f, err := d.root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// setAttrs sets ownership, mode and modification time. Ownership is changed
+// first as it clears setuid and setgid bits.
+func (d *dirWriter) setAttrs(name string, hdr *tar.Header) error {
+	if err := d.chown(name, hdr); err != nil {
+		return err
+	}
+	if err := d.root.Chmod(name, hdr.FileInfo().Mode()); err != nil {
+		return err
+	}
+	mtime := hdr.ModTime
+	if mtime.IsZero() {
+		mtime = time.Unix(0, 0)
+	}
+	return d.root.Chtimes(name, mtime, mtime)
+}
+
+func (d *dirWriter) chown(name string, hdr *tar.Header) error {
+	if d.unprivileged {
+		return nil
+	}
+	if err := d.root.Lchown(name, hdr.Uid, hdr.Gid); err != nil {
+		if !isDenied(err) {
+			return err
+		}
+		d.denied()
+	}
+	return nil
+}
+
+func (d *dirWriter) denied() {
+	if d.unprivileged {
+		return
+	}
+	d.unprivileged = true
+	d.logger.Warn().Msg("Insufficient privileges, ownership and device nodes are not preserved")
+}
+
+// isDenied returns true if err is due to insufficient privileges or to an
+// operation not supported by the platform
+func isDenied(err error) bool {
+	return os.IsPermission(err) || errors.Is(err, goerrors.ErrUnsupported)
+}
+
+func (d *dirWriter) remove(name string) error {
+	if err := d.root.RemoveAll(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package extractor
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeLayersWritesDir(t *testing.T) {
+	root := t.TempDir()
+
+	layer1 := filepath.Join(root, "layer1.tar")
+	writeTarFile(t, layer1, []tarEntry{
+		{name: "bin/", typeflag: tar.TypeDir, mode: 0o555},
+		{name: "bin/busybox", body: "busybox", mode: 0o4755},
+		{name: "bin/sh", typeflag: tar.TypeLink, linkname: "bin/busybox"},
+		{name: "bin/ls", typeflag: tar.TypeSymlink, linkname: "busybox"},
+		{name: "run/fifo", typeflag: tar.TypeFifo, mode: 0o600},
+		{name: "etc/removed", body: "removed"},
+	})
+
+	layer2 := filepath.Join(root, "layer2.tar")
+	writeTarFile(t, layer2, []tarEntry{
+		{name: "etc/.wh.removed"},
+	})
+
+	dest := filepath.Join(root, "rootfs")
+	w, err := NewDirWriter(dest, zerolog.New(io.Discard))
+	require.NoError(t, err)
+	require.NoError(t, MergeLayers(testLayers(layer1, layer2), w, MergeOpts{
+		Context: context.Background(),
+	}))
+	require.NoError(t, w.Close())
+
+	fi, err := os.Stat(filepath.Join(dest, "bin"))
+	require.NoError(t, err)
+	require.Equal(t, os.ModeDir|0o555, fi.Mode())
+
+	busybox, err := os.Stat(filepath.Join(dest, "bin", "busybox"))
+	require.NoError(t, err)
+	require.Equal(t, os.ModeSetuid|0o755, busybox.Mode())
+	sh, err := os.Stat(filepath.Join(dest, "bin", "sh"))
+	require.NoError(t, err)
+	require.True(t, os.SameFile(busybox, sh))
+	data, err := os.ReadFile(filepath.Join(dest, "bin", "sh"))
+	require.NoError(t, err)
+	require.Equal(t, "busybox", string(data))
+
+	target, err := os.Readlink(filepath.Join(dest, "bin", "ls"))
+	require.NoError(t, err)
+	require.Equal(t, "busybox", target)
+
+	fi, err = os.Lstat(filepath.Join(dest, "run", "fifo"))
+	require.NoError(t, err)
+	require.Equal(t, os.ModeNamedPipe|0o600, fi.Mode())
+
+	require.NoFileExists(t, filepath.Join(dest, "etc", "removed"))
+}
+
+func TestDirWriterPreservesOwnership(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing ownership requires root")
+	}
+
+	dest := t.TempDir()
+	w, err := NewDirWriter(dest, zerolog.New(io.Discard))
+	require.NoError(t, err)
+	mtime := time.Unix(1700000000, 0)
+	require.NoError(t, w.WriteEntry(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     "home/user",
+		Mode:     0o700,
+		Uid:      1000,
+		Gid:      1000,
+		ModTime:  mtime,
+	}, nil))
+	require.NoError(t, w.WriteEntry(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     "home/user/file",
+		Mode:     0o2755,
+		Size:     4,
+		Uid:      1000,
+		Gid:      50,
+		ModTime:  mtime,
+	}, strings.NewReader("data")))
+	require.NoError(t, w.WriteEntry(&tar.Header{
+		Typeflag: tar.TypeChar,
+		Name:     "dev/null",
+		Mode:     0o666,
+		Devmajor: 1,
+		Devminor: 3,
+	}, nil))
+	require.NoError(t, w.Close())
+
+	fi, err := os.Stat(filepath.Join(dest, "home", "user"))
+	require.NoError(t, err)
+	require.Equal(t, uint32(1000), fi.Sys().(*syscall.Stat_t).Uid)
+	require.Equal(t, mtime, fi.ModTime())
+
+	fi, err = os.Stat(filepath.Join(dest, "home", "user", "file"))
+	require.NoError(t, err)
+	require.Equal(t, os.ModeSetgid|0o755, fi.Mode())
+	require.Equal(t, uint32(50), fi.Sys().(*syscall.Stat_t).Gid)
+
+	fi, err = os.Stat(filepath.Join(dest, "dev", "null"))
+	require.NoError(t, err)
+	require.Equal(t, os.ModeDevice|os.ModeCharDevice|0o666, fi.Mode())
+	require.Equal(t, uint64(1<<8|3), fi.Sys().(*syscall.Stat_t).Rdev)
+}
+
+func TestExtractLayersCreatesPrivateFolders(t *testing.T) {
+	root := t.TempDir()
+
+	layer := filepath.Join(root, "layer.tar")
+	writeTarFile(t, layer, []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir, mode: 0o755},
+		{name: "etc/app/config.yaml", body: "config"},
+	})
+
+	dest := filepath.Join(root, "dist")
+	require.NoError(t, ExtractLayers(testLayers(layer), dest, ExtractLayersOpts{
+		Context: context.Background(),
+		Logger:  zerolog.New(io.Discard),
+	}))
+
+	for name, mode := range map[string]os.FileMode{
+		"":        0o700,
+		"etc":     0o755,
+		"etc/app": 0o700,
+	} {
+		fi, err := os.Stat(filepath.Join(dest, name))
+		require.NoError(t, err)
+		require.Equal(t, mode, fi.Mode().Perm(), name)
+	}
+}
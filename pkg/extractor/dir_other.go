@@ -0,0 +1,13 @@
+//go:build !linux
+
+package extractor
+
+import (
+	"archive/tar"
+	goerrors "errors"
+	"os"
+)
+
+func mknod(_ *os.Root, name string, _ *tar.Header) error {
+	return &os.PathError{Op: "mknod", Path: name, Err: goerrors.ErrUnsupported}
+}
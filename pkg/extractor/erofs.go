@@ -0,0 +1,488 @@
+package extractor
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	erofsMagic          = 0xe0f5e1e2
+	erofsBlockBits      = 12
+	erofsBlockSize      = 1 << erofsBlockBits
+	erofsSuperblockOff  = 1024
+	erofsSuperblockLen  = 128
+	erofsInodeLen       = 64
+	erofsInodeSlot      = 32
+	erofsDirentLen      = 12
+	erofsXattrHeaderLen = 12
+
+	// extended inode with flat plain data layout
+	erofsInodeFormat = 1
+
+	erofsFileTypeReg     = 1
+	erofsFileTypeDir     = 2
+	erofsFileTypeChar    = 3
+	erofsFileTypeBlock   = 4
+	erofsFileTypeFifo    = 5
+	erofsFileTypeSymlink = 7
+)
+
+// erofsXattrPrefixes maps xattr prefixes to their EROFS name index
+var erofsXattrPrefixes = []struct {
+	prefix string
+	index  uint8
+}{
+	{"user.", 1},
+	{"system.posix_acl_access", 2},
+	{"system.posix_acl_default", 3},
+	{"trusted.", 4},
+	{"security.", 6},
+}
+
+// erofsWriter writes entries as an uncompressed EROFS image. Content of
+// regular files is written as it comes in block aligned extents, while
+// directories, symlinks and inodes are written on close. Inodes use the
+// extended layout to keep 32-bit ids, mtime and link count.
+type erofsWriter struct {
+	out   *imageOutput
+	tree  *imageTree
+	pos   int64
+	mtime int64
+}
+
+func newErofsWriter(w io.Writer) (*erofsWriter, error) {
+	out, err := newImageOutput(w)
+	if err != nil {
+		return nil, err
+	}
+	// first block holds the superblock and the root inode, both written
+	// on close
+	if _, err := out.Write(make([]byte, erofsBlockSize)); err != nil {
+		return nil, err
+	}
+	return &erofsWriter{
+		out:  out,
+		tree: newImageTree(),
+		pos:  erofsBlockSize,
+	}, nil
+}
+
+func (e *erofsWriter) WriteEntry(hdr *tar.Header, r io.Reader) error {
+	inode, err := e.tree.add(hdr, nil)
+	if err != nil {
+		return err
+	}
+	return e.writeContent(inode, r)
+}
+
+func (e *erofsWriter) WriteHardlinks(hdr *tar.Header, r io.Reader, links []*tar.Header) error {
+	inode, err := e.tree.add(hdr, nil)
+	if err != nil {
+		return err
+	}
+	if err := e.writeContent(inode, r); err != nil {
+		return err
+	}
+	for _, link := range links {
+		h := *hdr
+		h.Name = link.Name
+		if _, err := e.tree.add(&h, inode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *erofsWriter) writeContent(inode *imageInode, r io.Reader) error {
+	hdr := inode.hdr
+	if t := hdr.ModTime.Unix(); t > e.mtime {
+		e.mtime = t
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+	inode.start = e.pos
+	if hdr.Size == 0 {
+		return nil
+	}
+	if r == nil {
+		return errors.Errorf("short read for %s: 0/%d bytes", hdr.Name, hdr.Size)
+	}
+	n, err := io.CopyN(e.out, r, hdr.Size)
+	if err != nil {
+		return errors.Wrapf(err, "short read for %s: %d/%d bytes", hdr.Name, n, hdr.Size)
+	}
+	e.pos += n
+	return e.pad()
+}
+
+// pad pads the image to the next block
+func (e *erofsWriter) pad() error {
+	if rem := e.pos % erofsBlockSize; rem != 0 {
+		return e.write(make([]byte, erofsBlockSize-rem))
+	}
+	return nil
+}
+
+func (e *erofsWriter) write(p []byte) error {
+	if _, err := e.out.Write(p); err != nil {
+		return err
+	}
+	e.pos += int64(len(p))
+	return nil
+}
+
+func (e *erofsWriter) Close() error {
+	if err := e.writeImage(); err != nil {
+		return err
+	}
+	return e.out.Close()
+}
+
+type erofsDir struct {
+	node   *imageNode
+	blocks [][]erofsDirent
+	size   int64
+}
+
+type erofsDirent struct {
+	name  string
+	inode *imageInode
+}
+
+func (e *erofsWriter) writeImage() error {
+	// hard links share the inode of the first entry
+	var nodes []*imageNode
+	seen := map[*imageInode]bool{}
+	var walk func(n *imageNode)
+	walk = func(n *imageNode) {
+		nodes = append(nodes, n)
+		for _, child := range n.sortedChildren() {
+			if child.children != nil {
+				walk(child)
+			} else if !seen[child.inode] {
+				seen[child.inode] = true
+				nodes = append(nodes, child)
+			}
+		}
+	}
+	walk(e.tree.root)
+
+	// directories and symlinks are written after the content of regular
+	// files, then inodes are laid out so their nid is known
+	var dirs []*erofsDir
+	sizes := map[*imageNode]int64{}
+	xattrs := make(map[*imageInode][]byte, len(nodes))
+	for i, n := range nodes {
+		inode := n.inode
+		inode.ino = uint32(i + 1)
+		if inode.hdr.Typeflag == tar.TypeDir {
+			dir, err := erofsLayoutDir(n)
+			if err != nil {
+				return err
+			}
+			dirs = append(dirs, dir)
+			sizes[n] = dir.size
+		}
+		xattr, err := erofsXattrs(inode.hdr)
+		if err != nil {
+			return errors.Wrapf(err, "cannot write xattrs for %s", inode.hdr.Name)
+		}
+		xattrs[inode] = xattr
+	}
+
+	pos := e.pos
+	for _, dir := range dirs {
+		dir.node.inode.start = pos
+		pos += int64(len(dir.blocks)) * erofsBlockSize
+	}
+	for _, n := range nodes {
+		if n.inode.hdr.Typeflag == tar.TypeSymlink {
+			n.inode.start = pos
+			pos += align(int64(len(n.inode.hdr.Linkname)), erofsBlockSize)
+		}
+	}
+
+	// root nid is 16-bit so the root inode is stored in the first block
+	// after the superblock
+	root := e.tree.root.inode
+	rootPos := int64(erofsSuperblockOff + erofsSuperblockLen)
+	if rootPos+erofsInodeLen+int64(len(xattrs[root])) > erofsBlockSize {
+		return errors.New("too many xattrs for root directory")
+	}
+	root.ref = uint64(rootPos / erofsInodeSlot)
+	metaStart := pos
+	for _, n := range nodes[1:] {
+		size := int64(erofsInodeLen + len(xattrs[n.inode]))
+		// inodes do not cross block boundaries unless larger than a block
+		if rem := erofsBlockSize - pos%erofsBlockSize; size <= erofsBlockSize && size > rem {
+			pos += rem
+		}
+		n.inode.ref = uint64(pos / erofsInodeSlot)
+		pos = align(pos+size, erofsInodeSlot)
+	}
+
+	for _, dir := range dirs {
+		if err := e.writeDir(dir); err != nil {
+			return errors.Wrapf(err, "cannot write directory %s", dir.node.inode.hdr.Name)
+		}
+	}
+	for _, n := range nodes {
+		if n.inode.hdr.Typeflag != tar.TypeSymlink {
+			continue
+		}
+		if err := e.write([]byte(n.inode.hdr.Linkname)); err != nil {
+			return err
+		}
+		if err := e.pad(); err != nil {
+			return err
+		}
+	}
+
+	var meta bytes.Buffer
+	for _, n := range nodes[1:] {
+		off := int64(n.inode.ref)*erofsInodeSlot - metaStart
+		meta.Write(make([]byte, off-int64(meta.Len())))
+		if err := erofsWriteInode(&meta, n, xattrs[n.inode], sizes[n]); err != nil {
+			return errors.Wrapf(err, "cannot write inode for %s", n.inode.hdr.Name)
+		}
+	}
+	if err := e.write(meta.Bytes()); err != nil {
+		return err
+	}
+	if err := e.pad(); err != nil {
+		return err
+	}
+
+	var head bytes.Buffer
+	if err := binary.Write(&head, binary.LittleEndian, erofsSuperblock{
+		Magic:     erofsMagic,
+		BlockBits: erofsBlockBits,
+		RootNid:   uint16(root.ref),
+		Inodes:    uint64(len(nodes)),
+		BuildTime: uint64(e.mtime),
+		Blocks:    uint32(e.pos / erofsBlockSize),
+	}); err != nil {
+		return err
+	}
+	if err := erofsWriteInode(&head, nodes[0], xattrs[root], sizes[nodes[0]]); err != nil {
+		return errors.Wrap(err, "cannot write root inode")
+	}
+	return e.out.writeAt(head.Bytes(), erofsSuperblockOff)
+}
+
+// erofsLayoutDir splits the entries of a directory in blocks. Entries are
+// sorted by name, including . and .., as EROFS looks them up with a binary
+// search.
+func erofsLayoutDir(n *imageNode) (*erofsDir, error) {
+	parent := n.parent
+	if parent == nil {
+		parent = n
+	}
+	entries := []erofsDirent{
+		{name: ".", inode: n.inode},
+		{name: "..", inode: parent.inode},
+	}
+	for _, child := range n.children {
+		if len(child.name) > math.MaxUint8 {
+			return nil, errors.Errorf("name %s is too long", child.name)
+		}
+		entries = append(entries, erofsDirent{name: child.name, inode: child.inode})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+
+	dir := &erofsDir{node: n}
+	var block []erofsDirent
+	var used int64
+	for _, entry := range entries {
+		size := int64(erofsDirentLen + len(entry.name))
+		if used+size > erofsBlockSize {
+			dir.blocks = append(dir.blocks, block)
+			block, used = nil, 0
+		}
+		block = append(block, entry)
+		used += size
+	}
+	dir.blocks = append(dir.blocks, block)
+	dir.size = int64(len(dir.blocks)-1)*erofsBlockSize + used
+	return dir, nil
+}
+
+func (e *erofsWriter) writeDir(dir *erofsDir) error {
+	for _, block := range dir.blocks {
+		var buf bytes.Buffer
+		nameoff := len(block) * erofsDirentLen
+		for _, entry := range block {
+			_ = binary.Write(&buf, binary.LittleEndian, erofsDirentHeader{
+				Nid:      entry.inode.ref,
+				NameOff:  uint16(nameoff),
+				FileType: erofsFileType(entry.inode.hdr),
+			})
+			nameoff += len(entry.name)
+		}
+		for _, entry := range block {
+			buf.WriteString(entry.name)
+		}
+		if err := e.write(buf.Bytes()); err != nil {
+			return err
+		}
+		if err := e.pad(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// erofsWriteInode writes the inode of an entry followed by its xattrs. Size
+// is the size of the entries for a directory.
+func erofsWriteInode(w *bytes.Buffer, n *imageNode, xattr []byte, size int64) error {
+	inode := n.inode
+	hdr := inode.hdr
+	if hdr.Uid < 0 || hdr.Uid > math.MaxUint32 || hdr.Gid < 0 || hdr.Gid > math.MaxUint32 {
+		return errors.Errorf("invalid uid/gid %d/%d", hdr.Uid, hdr.Gid)
+	}
+	ei := erofsInode{
+		Format:  erofsInodeFormat,
+		Mode:    uint16(fileMode(hdr)),
+		Ino:     inode.ino,
+		UID:     uint32(hdr.Uid),
+		GID:     uint32(hdr.Gid),
+		MTime:   uint64(hdr.ModTime.Unix()),
+		MTimeNs: uint32(hdr.ModTime.Nanosecond()),
+		Nlink:   inode.nlink,
+	}
+	if len(xattr) > 0 {
+		ei.XattrCount = uint16((len(xattr)-erofsXattrHeaderLen)/4 + 1)
+	}
+	switch hdr.Typeflag {
+	case tar.TypeReg:
+		ei.Size = uint64(hdr.Size)
+		ei.U = uint32(inode.start / erofsBlockSize)
+	case tar.TypeDir:
+		ei.Size = uint64(size)
+		ei.U = uint32(inode.start / erofsBlockSize)
+		ei.Nlink = uint32(2 + n.subdirs())
+	case tar.TypeSymlink:
+		ei.Size = uint64(len(hdr.Linkname))
+		ei.U = uint32(inode.start / erofsBlockSize)
+	case tar.TypeChar, tar.TypeBlock:
+		ei.U = encodeDev(hdr.Devmajor, hdr.Devminor)
+	}
+	if err := binary.Write(w, binary.LittleEndian, ei); err != nil {
+		return err
+	}
+	_, err := w.Write(xattr)
+	return err
+}
+
+// erofsXattrs returns the inline xattrs of an entry
+func erofsXattrs(hdr *tar.Header) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, xattr := range imageXattrs(hdr) {
+		var index uint8
+		var name string
+		for _, p := range erofsXattrPrefixes {
+			if suffix, ok := strings.CutPrefix(xattr.name, p.prefix); ok {
+				index, name = p.index, suffix
+				break
+			}
+		}
+		if index == 0 {
+			// EROFS cannot store other namespaces without prefix table
+			continue
+		}
+		if len(name) > math.MaxUint8 || len(xattr.value) > math.MaxUint16 {
+			return nil, errors.Errorf("xattr %s is too large", xattr.name)
+		}
+		if buf.Len() == 0 {
+			buf.Write(make([]byte, erofsXattrHeaderLen))
+		}
+		buf.WriteByte(uint8(len(name)))
+		buf.WriteByte(index)
+		_ = binary.Write(&buf, binary.LittleEndian, uint16(len(xattr.value)))
+		buf.WriteString(name)
+		buf.WriteString(xattr.value)
+		buf.Write(make([]byte, align(int64(buf.Len()), 4)-int64(buf.Len())))
+	}
+	return buf.Bytes(), nil
+}
+
+func erofsFileType(hdr *tar.Header) uint8 {
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return erofsFileTypeDir
+	case tar.TypeSymlink:
+		return erofsFileTypeSymlink
+	case tar.TypeChar:
+		return erofsFileTypeChar
+	case tar.TypeBlock:
+		return erofsFileTypeBlock
+	case tar.TypeFifo:
+		return erofsFileTypeFifo
+	default:
+		return erofsFileTypeReg
+	}
+}
+
+func align(n, to int64) int64 {
+	return (n + to - 1) / to * to
+}
+
+type erofsSuperblock struct {
+	Magic            uint32
+	Checksum         uint32
+	FeatureCompat    uint32
+	BlockBits        uint8
+	ExtSlots         uint8
+	RootNid          uint16
+	Inodes           uint64
+	BuildTime        uint64
+	BuildTimeNs      uint32
+	Blocks           uint32
+	MetaBlkAddr      uint32
+	XattrBlkAddr     uint32
+	UUID             [16]byte
+	VolumeName       [16]byte
+	FeatureIncompat  uint32
+	ComprAlgs        uint16
+	ExtraDevices     uint16
+	DevtSlotOff      uint16
+	DirBlockBits     uint8
+	XattrPrefixCount uint8
+	XattrPrefixStart uint32
+	PackedNid        uint64
+	XattrFilter      uint8
+	_                [23]byte
+}
+
+type erofsInode struct {
+	Format     uint16
+	XattrCount uint16
+	Mode       uint16
+	_          uint16
+	Size       uint64
+	U          uint32
+	Ino        uint32
+	UID        uint32
+	GID        uint32
+	MTime      uint64
+	MTimeNs    uint32
+	Nlink      uint32
+	_          [16]byte
+}
+
+type erofsDirentHeader struct {
+	Nid      uint64
+	NameOff  uint16
+	FileType uint8
+	_        uint8
+}
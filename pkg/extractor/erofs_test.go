@@ -0,0 +1,165 @@
+package extractor
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeLayersWritesErofs(t *testing.T) {
+	root := t.TempDir()
+
+	layer1 := filepath.Join(root, "layer1.tar")
+	writeTarFile(t, layer1, []tarEntry{
+		{name: "bin/", typeflag: tar.TypeDir},
+		{name: "bin/busybox", body: "busybox", mode: 0o755},
+		{name: "bin/sh", typeflag: tar.TypeLink, linkname: "bin/busybox"},
+		{name: "bin/ls", typeflag: tar.TypeSymlink, linkname: "busybox"},
+		{name: "dev/console", typeflag: tar.TypeChar, mode: 0o600},
+		{name: "etc/removed", body: "removed"},
+	})
+
+	layer2 := filepath.Join(root, "layer2.tar")
+	writeTarFile(t, layer2, []tarEntry{
+		{name: "etc/.wh.removed"},
+	})
+
+	var buf bytes.Buffer
+	w, err := NewArchiveWriter(OutputFormatErofs, &buf)
+	require.NoError(t, err)
+	require.NoError(t, MergeLayers(testLayers(layer1, layer2), w, MergeOpts{
+		Context: context.Background(),
+	}))
+	require.NoError(t, w.Close())
+	require.Zero(t, buf.Len()%erofsBlockSize)
+
+	entries := readErofs(t, buf.Bytes())
+	require.Equal(t, []string{"bin", "bin/busybox", "bin/ls", "bin/sh", "dev", "dev/console", "etc"}, erofsNames(entries))
+
+	require.Equal(t, uint16(cpioModeRegular|0o755), entries["bin/busybox"].inode.Mode)
+	require.Equal(t, "busybox", entries["bin/busybox"].body)
+	require.Equal(t, uint32(2), entries["bin/busybox"].inode.Nlink)
+	require.Equal(t, entries["bin/busybox"].nid, entries["bin/sh"].nid)
+
+	require.Equal(t, uint16(cpioModeSymlink|0o644), entries["bin/ls"].inode.Mode)
+	require.Equal(t, "busybox", entries["bin/ls"].body)
+	require.Equal(t, uint16(cpioModeChar|0o600), entries["dev/console"].inode.Mode)
+	require.Equal(t, uint32(2), entries["etc"].inode.Nlink)
+}
+
+func TestErofsWriterLargeDirectory(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := newErofsWriter(&buf)
+	require.NoError(t, err)
+	for i := range 500 {
+		require.NoError(t, w.WriteEntry(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     fmt.Sprintf("dir/%s-%03d", strings.Repeat("x", 20), i),
+			Mode:     0o644,
+			Size:     3,
+			Uid:      100000,
+			PAXRecords: map[string]string{
+				paxXattrPrefix + "user.index": fmt.Sprint(i),
+			},
+		}, strings.NewReader(fmt.Sprintf("%03d", i))))
+	}
+	require.NoError(t, w.Close())
+
+	entries := readErofs(t, buf.Bytes())
+	require.Len(t, entries, 501)
+	require.Greater(t, entries["dir"].inode.Size, uint64(erofsBlockSize))
+
+	entry := entries[fmt.Sprintf("dir/%s-%03d", strings.Repeat("x", 20), 321)]
+	require.Equal(t, "321", entry.body)
+	require.Equal(t, uint32(100000), entry.inode.UID)
+	require.Equal(t, map[string]string{"user.index": "321"}, entry.xattrs)
+}
+
+type erofsEntry struct {
+	nid    uint64
+	inode  erofsInode
+	body   string
+	xattrs map[string]string
+}
+
+func erofsNames(entries map[string]erofsEntry) []string {
+	var names []string
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// readErofs reads the entries of an EROFS image written by erofsWriter
+func readErofs(t *testing.T, data []byte) map[string]erofsEntry {
+	t.Helper()
+
+	var sb erofsSuperblock
+	require.NoError(t, binary.Read(bytes.NewReader(data[erofsSuperblockOff:]), binary.LittleEndian, &sb))
+	require.Equal(t, uint32(erofsMagic), sb.Magic)
+	require.Equal(t, uint32(len(data)/erofsBlockSize), sb.Blocks)
+
+	entries := map[string]erofsEntry{}
+	var walk func(name string, nid uint64)
+	walk = func(name string, nid uint64) {
+		entry := erofsEntry{nid: nid}
+		off := nid * erofsInodeSlot
+		require.NoError(t, binary.Read(bytes.NewReader(data[off:]), binary.LittleEndian, &entry.inode))
+		require.Equal(t, uint16(erofsInodeFormat), entry.inode.Format)
+
+		if entry.inode.XattrCount > 0 {
+			entry.xattrs = map[string]string{}
+			xattrs := data[off+erofsInodeLen+erofsXattrHeaderLen:][:(entry.inode.XattrCount-1)*4]
+			for len(xattrs) > 0 {
+				nameLen, index, valueLen := int(xattrs[0]), xattrs[1], int(binary.LittleEndian.Uint16(xattrs[2:]))
+				var prefix string
+				for _, p := range erofsXattrPrefixes {
+					if p.index == index {
+						prefix = p.prefix
+					}
+				}
+				entry.xattrs[prefix+string(xattrs[4:4+nameLen])] = string(xattrs[4+nameLen : 4+nameLen+valueLen])
+				xattrs = xattrs[align(int64(4+nameLen+valueLen), 4):]
+			}
+		}
+
+		content := data[int64(entry.inode.U)*erofsBlockSize:][:entry.inode.Size]
+		switch entry.inode.Mode &^ 0o7777 {
+		case cpioModeRegular, cpioModeSymlink:
+			entry.body = string(content)
+		case cpioModeDir:
+			for len(content) > 0 {
+				block := content[:min(len(content), erofsBlockSize)]
+				content = content[len(block):]
+				count := int(binary.LittleEndian.Uint16(block[8:])) / erofsDirentLen
+				for i := range count {
+					dirent := block[i*erofsDirentLen:]
+					start := int(binary.LittleEndian.Uint16(dirent[8:]))
+					end := len(block)
+					if i+1 < count {
+						end = int(binary.LittleEndian.Uint16(dirent[erofsDirentLen+8:]))
+					}
+					child := strings.TrimRight(string(block[start:end]), "\x00")
+					if child != "." && child != ".." {
+						walk(path.Join(name, child), binary.LittleEndian.Uint64(dirent))
+					}
+				}
+			}
+		}
+		if name != "" {
+			entries[name] = entry
+		}
+	}
+	walk("", uint64(sb.RootNid))
+	return entries
+}
@@ -0,0 +1,241 @@
+package extractor
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const paxXattrPrefix = "SCHILY.xattr."
+
+// imageTree holds the entries of a filesystem image while content of
+// regular files is written to the image as it comes. Filesystem images
+// need the whole tree to write their metadata, so it is kept in memory
+// until the image is closed.
+type imageTree struct {
+	root *imageNode
+}
+
+type imageNode struct {
+	name     string
+	inode    *imageInode
+	parent   *imageNode
+	children map[string]*imageNode
+}
+
+type imageInode struct {
+	hdr   *tar.Header
+	nlink uint32
+	// start is the offset of the content in the image
+	start int64
+	// blocks holds the on-disk size of each data block if the format splits
+	// the content in blocks
+	blocks []uint32
+	// ino and ref are assigned by the image format when writing metadata
+	ino uint32
+	ref uint64
+}
+
+func newImageTree() *imageTree {
+	t := &imageTree{}
+	t.root = &imageNode{
+		children: map[string]*imageNode{},
+	}
+	t.root.inode = newImageInode(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Mode:     0o755,
+		ModTime:  time.Unix(0, 0),
+	})
+	return t
+}
+
+func newImageInode(hdr *tar.Header) *imageInode {
+	return &imageInode{hdr: hdr, nlink: 1}
+}
+
+// add adds an entry to the tree, replacing any existing one. Parent
+// directories are created if missing. If inode is set, the entry is a hard
+// link to it.
+func (t *imageTree) add(hdr *tar.Header, inode *imageInode) (*imageInode, error) {
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeDir, tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+	default:
+		return nil, errors.Errorf("cannot handle file type %q for %s", hdr.Typeflag, hdr.Name)
+	}
+	name := path.Clean(strings.TrimPrefix(hdr.Name, "/"))
+	if name == "." {
+		if hdr.Typeflag == tar.TypeDir {
+			t.root.inode.hdr = hdr
+		}
+		return t.root.inode, nil
+	}
+
+	parent := t.root
+	for _, segment := range strings.Split(path.Dir(name), "/") {
+		if segment == "." {
+			continue
+		}
+		child, ok := parent.children[segment]
+		if !ok || child.children == nil {
+			child = &imageNode{
+				name:   segment,
+				parent: parent,
+				inode: newImageInode(&tar.Header{
+					Typeflag: tar.TypeDir,
+					Mode:     0o755,
+					ModTime:  time.Unix(0, 0),
+				}),
+				children: map[string]*imageNode{},
+			}
+			parent.children[segment] = child
+		}
+		parent = child
+	}
+
+	base := path.Base(name)
+	if existing, ok := parent.children[base]; ok && existing.children != nil && hdr.Typeflag == tar.TypeDir {
+		existing.inode.hdr = hdr
+		return existing.inode, nil
+	}
+	if inode == nil {
+		inode = newImageInode(hdr)
+	} else {
+		inode.nlink++
+	}
+	node := &imageNode{
+		name:   base,
+		parent: parent,
+		inode:  inode,
+	}
+	if hdr.Typeflag == tar.TypeDir {
+		node.children = map[string]*imageNode{}
+	}
+	parent.children[base] = node
+	return inode, nil
+}
+
+// sortedChildren returns children of a directory sorted by name
+func (n *imageNode) sortedChildren() []*imageNode {
+	children := make([]*imageNode, 0, len(n.children))
+	for _, child := range n.children {
+		children = append(children, child)
+	}
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].name < children[j].name
+	})
+	return children
+}
+
+// subdirs returns the number of subdirectories of a directory
+func (n *imageNode) subdirs() int {
+	var count int
+	for _, child := range n.children {
+		if child.children != nil {
+			count++
+		}
+	}
+	return count
+}
+
+type imageXattr struct {
+	name  string
+	value string
+}
+
+// imageXattrs returns extended attributes of an entry sorted by name
+func imageXattrs(hdr *tar.Header) []imageXattr {
+	var xattrs []imageXattr
+	for k, v := range hdr.PAXRecords {
+		if name, ok := strings.CutPrefix(k, paxXattrPrefix); ok {
+			xattrs = append(xattrs, imageXattr{name: name, value: v})
+		}
+	}
+	sort.Slice(xattrs, func(i, j int) bool {
+		return xattrs[i].name < xattrs[j].name
+	})
+	return xattrs
+}
+
+// fileMode returns the unix mode of an entry, including its file type
+func fileMode(hdr *tar.Header) uint32 {
+	var mode int64
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		mode = cpioModeDir
+	case tar.TypeSymlink:
+		mode = cpioModeSymlink
+	case tar.TypeChar:
+		mode = cpioModeChar
+	case tar.TypeBlock:
+		mode = cpioModeBlock
+	case tar.TypeFifo:
+		mode = cpioModeFifo
+	default:
+		mode = cpioModeRegular
+	}
+	return uint32(mode | hdr.Mode&0o7777)
+}
+
+// encodeDev encodes a device number like the Linux kernel new_encode_dev
+func encodeDev(major, minor int64) uint32 {
+	return uint32((minor & 0xff) | (major&0xfff)<<8 | (minor&^0xff)<<12)
+}
+
+// imageOutput is the output of a filesystem image. Images need to go back
+// and write their superblock once the content is written, so a temp file
+// is used if the output cannot be seeked (e.g. stdout).
+type imageOutput struct {
+	io.WriteSeeker
+	dst io.Writer
+	tmp *os.File
+}
+
+func newImageOutput(w io.Writer) (*imageOutput, error) {
+	if ws, ok := w.(io.WriteSeeker); ok {
+		if _, err := ws.Seek(0, io.SeekCurrent); err == nil {
+			return &imageOutput{WriteSeeker: ws}, nil
+		}
+	}
+	tmp, err := os.CreateTemp("", "undock-image-")
+	if err != nil {
+		return nil, err
+	}
+	return &imageOutput{WriteSeeker: tmp, dst: w, tmp: tmp}, nil
+}
+
+// writeAt writes p at the given offset and restores the current offset
+func (o *imageOutput) writeAt(p []byte, off int64) error {
+	cur, err := o.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := o.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := o.Write(p); err != nil {
+		return err
+	}
+	_, err = o.Seek(cur, io.SeekStart)
+	return err
+}
+
+func (o *imageOutput) Close() error {
+	if o.tmp == nil {
+		return nil
+	}
+	defer func() {
+		_ = o.tmp.Close()
+		_ = os.Remove(o.tmp.Name())
+	}()
+	if _, err := o.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.Copy(o.dst, o.tmp)
+	return err
+}
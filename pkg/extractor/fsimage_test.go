@@ -0,0 +1,157 @@
+package extractor
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestFSImagesReadByReferenceTools checks the filesystem images against the
+// tools of their reference implementation, which are skipped if they are
+// not installed
+func TestFSImagesReadByReferenceTools(t *testing.T) {
+	skipIfSymlinkUnsupported(t)
+
+	tests := []struct {
+		format  OutputFormat
+		tool    string
+		extract func(t *testing.T, tool, image, dir string)
+	}{
+		{
+			format: OutputFormatSquashfs,
+			tool:   "unsquashfs",
+			extract: func(t *testing.T, tool, image, dir string) {
+				runTool(t, tool, "-l", image)
+				runTool(t, tool, "-no-progress", "-no-xattrs", "-d", dir, image)
+			},
+		},
+		{
+			format: OutputFormatErofs,
+			tool:   "fsck.erofs",
+			extract: func(t *testing.T, tool, image, dir string) {
+				runTool(t, tool, image)
+				if dump, err := exec.LookPath("dump.erofs"); err == nil {
+					runTool(t, dump, "--ls", "--path=/bin", image)
+				}
+				if help, _ := exec.Command(tool, "--help").CombinedOutput(); !strings.Contains(string(help), "--extract") {
+					t.Skipf("%s cannot extract images", tool)
+				}
+				runTool(t, tool, "--extract="+dir, image)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.format), func(t *testing.T) {
+			tool, err := exec.LookPath(tt.tool)
+			if err != nil {
+				t.Skipf("%s is not installed", tt.tool)
+			}
+			root := t.TempDir()
+
+			big := strings.Repeat("0123456789", squashfsBlockSize/4)
+			layer1 := filepath.Join(root, "layer1.tar")
+			entries := []tarEntry{
+				{name: "bin/", typeflag: tar.TypeDir},
+				{name: "bin/busybox", body: "busybox", mode: 0o755},
+				{name: "bin/sh", typeflag: tar.TypeLink, linkname: "bin/busybox"},
+				{name: "bin/ls", typeflag: tar.TypeSymlink, linkname: "busybox"},
+				{name: "etc/big", body: big},
+				{name: "etc/empty"},
+				{name: "etc/removed", body: "removed"},
+			}
+			for i := range 300 {
+				entries = append(entries, tarEntry{name: fmt.Sprintf("usr/share/%s-%03d", strings.Repeat("x", 20), i), body: fmt.Sprintf("%03d", i)})
+			}
+			writeTarFile(t, layer1, entries)
+
+			layer2 := filepath.Join(root, "layer2.tar")
+			writeTarFile(t, layer2, []tarEntry{
+				{name: "etc/.wh.removed"},
+			})
+
+			image := filepath.Join(root, "image")
+			f, err := os.Create(image)
+			require.NoError(t, err)
+			w, err := NewArchiveWriter(tt.format, f)
+			require.NoError(t, err)
+			require.NoError(t, MergeLayers(testLayers(layer1, layer2), w, MergeOpts{
+				Context: context.Background(),
+			}))
+			require.NoError(t, w.Close())
+			require.NoError(t, f.Close())
+
+			dir := filepath.Join(root, "dir")
+			tt.extract(t, tool, image, dir)
+
+			want := map[string]string{
+				"bin":         "dir",
+				"bin/busybox": "file:busybox",
+				"bin/sh":      "file:busybox",
+				"bin/ls":      "symlink:busybox",
+				"etc":         "dir",
+				"etc/big":     "file:" + big,
+				"etc/empty":   "file:",
+				"usr":         "dir",
+				"usr/share":   "dir",
+			}
+			for i := range 300 {
+				want[fmt.Sprintf("usr/share/%s-%03d", strings.Repeat("x", 20), i)] = fmt.Sprintf("file:%03d", i)
+			}
+			require.Equal(t, want, readTree(t, dir))
+
+			fi, err := os.Stat(filepath.Join(dir, "bin", "busybox"))
+			require.NoError(t, err)
+			require.Equal(t, fs.FileMode(0o755), fi.Mode().Perm())
+		})
+	}
+}
+
+func runTool(t *testing.T, name string, args ...string) {
+	t.Helper()
+
+	out, err := exec.Command(name, args...).CombinedOutput()
+	require.NoError(t, err, "%s %s: %s", name, strings.Join(args, " "), out)
+}
+
+// readTree returns the entries of a folder by their slash separated path,
+// as dir, file:<content> or symlink:<target>
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+
+	tree := map[string]string{}
+	require.NoError(t, filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			tree[filepath.ToSlash(rel)] = "dir"
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			tree[filepath.ToSlash(rel)] = "symlink:" + target
+		default:
+			dt, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			tree[filepath.ToSlash(rel)] = "file:" + string(dt)
+		}
+		return nil
+	}))
+	return tree
+}
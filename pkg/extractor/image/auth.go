@@ -0,0 +1,98 @@
+package image
+
+import (
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/crazy-max/undock/pkg/image"
+	"github.com/crazy-max/undock/pkg/registry"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/pkg/errors"
+	"go.podman.io/image/v5/docker"
+	"go.podman.io/image/v5/docker/reference"
+	"go.podman.io/image/v5/pkg/docker/config"
+	"go.podman.io/image/v5/types"
+)
+
+// AuthError is returned when a registry refuses access to the source image,
+// either because no credentials were found for it or because it rejected
+// the ones sent
+type AuthError struct {
+	// Domain of the registry
+	Domain string
+	// Anonymous is true if no credentials were sent
+	Anonymous bool
+	Err       error
+}
+
+func (e *AuthError) Error() string {
+	if e.Anonymous {
+		return "registry " + e.Domain + " requires authentication and no credentials were found: " + e.Err.Error()
+	}
+	return "registry " + e.Domain + " rejected the credentials: " + e.Err.Error()
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// dockerAuth returns the credentials for a registry: the username and
+// password set in the options, or the ones of the auth file. They are
+// empty if a registry token is set.
+func (c *Client) dockerAuth(domain string) (types.DockerAuthConfig, error) {
+	if c.opts.RegistryUsername != "" {
+		return types.DockerAuthConfig{
+			Username: c.opts.RegistryUsername,
+			Password: c.opts.RegistryPassword,
+		}, nil
+	} else if c.opts.RegistryToken != "" {
+		return types.DockerAuthConfig{}, nil
+	}
+	if c.opts.RegistryAuthFile != "" {
+		if _, err := os.Stat(c.opts.RegistryAuthFile); err != nil {
+			return types.DockerAuthConfig{}, errors.Wrap(err, "cannot read auth file")
+		}
+	}
+	auth, err := config.GetCredentials(&types.SystemContext{AuthFilePath: c.opts.RegistryAuthFile}, domain)
+	if err != nil {
+		return types.DockerAuthConfig{}, errors.Wrapf(err, "cannot retrieve credentials of %s", domain)
+	}
+	return auth, nil
+}
+
+// authError returns an AuthError if err is an authentication failure of
+// the registry of a docker source, or err otherwise
+func (c *Client) authError(src string, err error) error {
+	if err == nil || !isUnauthorized(err) || NewSource(src).Scheme() != "docker" {
+		return err
+	}
+	ref, rerr := image.DockerReference(strings.TrimPrefix(src, "docker://"))
+	if rerr != nil {
+		return err
+	}
+	domain := reference.Domain(ref.DockerReference())
+	auth, _ := c.dockerAuth(domain)
+	return &AuthError{
+		Domain:    domain,
+		Anonymous: auth == (types.DockerAuthConfig{}) && c.opts.RegistryToken == "",
+		Err:       err,
+	}
+}
+
+// isUnauthorized returns true if err is a refused authentication, by the
+// docker transport or the registry client
+func isUnauthorized(err error) bool {
+	var credsErr docker.ErrUnauthorizedForCredentials
+	var regErr *registry.Error
+	var codeErr errcode.Error
+	switch {
+	case errors.As(err, &credsErr):
+		return true
+	case errors.As(err, &regErr):
+		return regErr.StatusCode == http.StatusUnauthorized
+	case errors.As(err, &codeErr):
+		return codeErr.Code == errcode.ErrorCodeUnauthorized || codeErr.Code == errcode.ErrorCodeDenied
+	}
+	return false
+}
@@ -0,0 +1,238 @@
+package image
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"sync"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"go.podman.io/image/v5/pkg/blobinfocache/none"
+	"go.podman.io/image/v5/types"
+)
+
+// blobStore opens the blobs of the source image
+type blobStore interface {
+	open(ctx context.Context, info types.BlobInfo) (io.ReadCloser, error)
+}
+
+// readBlob reads a whole blob from the store
+func readBlob(ctx context.Context, blobs blobStore, info types.BlobInfo) (_ []byte, err error) {
+	rc, err := blobs.open(ctx, info)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if cerr := rc.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	return io.ReadAll(rc)
+}
+
+// cacheStore opens blobs from the OCI layout of the cache
+type cacheStore string
+
+func (s cacheStore) open(_ context.Context, info types.BlobInfo) (io.ReadCloser, error) {
+	return os.Open(path.Join(string(s), "blobs", info.Digest.Algorithm().String(), info.Digest.Hex()))
+}
+
+// sourceStore streams blobs from the source image without caching them. A
+// blob is fetched each time it is opened.
+type sourceStore struct {
+	c   *Client
+	src types.ImageSource
+}
+
+func (s sourceStore) open(ctx context.Context, info types.BlobInfo) (io.ReadCloser, error) {
+	if err := info.Digest.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid blob digest %q", info.Digest)
+	}
+	release, err := s.c.acquireDownload(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := retry(s.c, "blob request", func() (io.ReadCloser, error) {
+		rc, _, err := s.src.GetBlob(ctx, info, none.NoCache)
+		return rc, err
+	})
+	if err != nil {
+		release()
+		return nil, errors.Wrapf(err, "cannot get blob %s", info.Digest)
+	}
+	return &verifiedReader{
+		rc:       rc,
+		info:     info,
+		verifier: info.Digest.Verifier(),
+		release:  release,
+	}, nil
+}
+
+// streamed returns true if the blobs of a store are fetched from the source
+// each time they are opened, so layers are extracted in a single pass
+func streamed(blobs blobStore) bool {
+	_, ok := blobs.(sourceStore)
+	return ok
+}
+
+// spillStore fetches each blob once in a temporary folder, and opens it
+// from there for each pass over it, so a layer read twice to skip the
+// files overwritten by upper layers is not fetched twice from its source
+type spillStore struct {
+	dir   string
+	fetch func(ctx context.Context, info types.BlobInfo, f *os.File) error
+
+	mu    sync.Mutex
+	blobs map[digest.Digest]*spilledBlob
+}
+
+// spilledBlob is a blob fetched once and opened by each pass over it
+type spilledBlob struct {
+	mu       sync.Mutex
+	filename string
+	err      error
+}
+
+// newSpillStore returns a spillStore writing blobs with fetch in a
+// temporary folder with the given prefix
+func newSpillStore(prefix string, fetch func(ctx context.Context, info types.BlobInfo, f *os.File) error) (*spillStore, error) {
+	dir, err := os.MkdirTemp("", prefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create blobs folder")
+	}
+	return &spillStore{
+		dir:   dir,
+		fetch: fetch,
+		blobs: map[digest.Digest]*spilledBlob{},
+	}, nil
+}
+
+// newSourceSpillStore returns a spillStore of the blobs of the source image
+func (c *Client) newSourceSpillStore(src types.ImageSource) (*spillStore, error) {
+	source := sourceStore{c: c, src: src}
+	return newSpillStore("undock-blobs-", func(ctx context.Context, info types.BlobInfo, f *os.File) error {
+		return copyStoreBlob(ctx, source, info, f)
+	})
+}
+
+func (s *spillStore) open(ctx context.Context, info types.BlobInfo) (io.ReadCloser, error) {
+	if err := info.Digest.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid blob digest %q", info.Digest)
+	}
+
+	s.mu.Lock()
+	b, ok := s.blobs[info.Digest]
+	if !ok {
+		b = &spilledBlob{}
+		s.blobs[info.Digest] = b
+	}
+	s.mu.Unlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.filename == "" && b.err == nil {
+		filename, err := s.spill(ctx, info)
+		// a fetch canceled by its caller is retried by the next one
+		if err != nil && ctx.Err() != nil {
+			return nil, err
+		}
+		b.filename, b.err = filename, err
+	}
+	if b.err != nil {
+		return nil, b.err
+	}
+	return os.Open(b.filename)
+}
+
+func (s *spillStore) spill(ctx context.Context, info types.BlobInfo) (_ string, err error) {
+	f, err := os.CreateTemp(s.dir, info.Digest.Encoded()+"-")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			_ = os.Remove(f.Name())
+		}
+	}()
+	if err := s.fetch(ctx, info, f); err != nil {
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// Close removes the fetched blobs
+func (s *spillStore) Close() error {
+	return os.RemoveAll(s.dir)
+}
+
+// copyStoreBlob writes a whole blob of a store to w
+func copyStoreBlob(ctx context.Context, blobs blobStore, info types.BlobInfo, w io.Writer) (err error) {
+	rc, err := blobs.open(ctx, info)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := rc.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	_, err = io.Copy(w, rc)
+	return err
+}
+
+// verifiedReader verifies the digest and size of a blob as it is read. A
+// mismatch is returned instead of io.EOF. A blob closed before being read
+// to the end is not verified, nor read any further.
+type verifiedReader struct {
+	rc       io.ReadCloser
+	info     types.BlobInfo
+	verifier digest.Verifier
+	n        int64
+	err      error
+	closed   bool
+	// release is called on close if set
+	release func()
+}
+
+func (v *verifiedReader) Read(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+	n, err := v.rc.Read(p)
+	_, _ = v.verifier.Write(p[:n])
+	v.n += int64(n)
+	if err == io.EOF {
+		if verr := v.verify(); verr != nil {
+			err = verr
+		}
+	}
+	v.err = err
+	return n, err
+}
+
+func (v *verifiedReader) verify() error {
+	if v.info.Size >= 0 && v.n != v.info.Size {
+		return errors.Errorf("blob %s size mismatch: expected %d bytes, got %d", v.info.Digest, v.info.Size, v.n)
+	}
+	if !v.verifier.Verified() {
+		return errors.Errorf("blob %s digest mismatch", v.info.Digest)
+	}
+	return nil
+}
+
+func (v *verifiedReader) Close() error {
+	if v.closed {
+		return nil
+	}
+	v.closed = true
+	err := v.rc.Close()
+	if v.release != nil {
+		v.release()
+	}
+	return err
+}
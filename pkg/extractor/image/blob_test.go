@@ -0,0 +1,91 @@
+package image
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"go.podman.io/image/v5/types"
+)
+
+func TestSpillStoreRetriesCanceledFetch(t *testing.T) {
+	content := []byte("content")
+	info := types.BlobInfo{Digest: digest.FromBytes(content), Size: int64(len(content))}
+
+	var fetches int
+	fail := errors.New("fetch failed")
+	ss, err := newSpillStore("undock-test-", func(ctx context.Context, info types.BlobInfo, f *os.File) error {
+		fetches++
+		if err := ctx.Err(); err != nil {
+			return err
+		} else if fetches == 2 {
+			return fail
+		}
+		_, err := f.Write(content)
+		return err
+	})
+	require.NoError(t, err)
+	defer ss.Close()
+
+	read := func(ctx context.Context) ([]byte, error) {
+		rc, err := ss.open(ctx, info)
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(rc)
+	}
+
+	// the fetch canceled by the first caller is not kept for the next ones
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = read(ctx)
+	require.ErrorIs(t, err, context.Canceled)
+
+	// other errors are kept
+	_, err = read(context.Background())
+	require.ErrorIs(t, err, fail)
+	_, err = read(context.Background())
+	require.ErrorIs(t, err, fail)
+	require.Equal(t, 2, fetches)
+
+	entries, err := os.ReadDir(ss.dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestSpillStoreFetchesBlobOnce(t *testing.T) {
+	content := []byte("content")
+	info := types.BlobInfo{Digest: digest.FromBytes(content), Size: int64(len(content))}
+
+	var fetches int
+	ss, err := newSpillStore("undock-test-", func(ctx context.Context, info types.BlobInfo, f *os.File) error {
+		fetches++
+		if fetches == 1 {
+			return context.Canceled
+		}
+		_, err := f.Write(content)
+		return err
+	})
+	require.NoError(t, err)
+	defer ss.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = ss.open(ctx, info)
+	require.Error(t, err)
+
+	for range 2 {
+		rc, err := ss.open(context.Background(), info)
+		require.NoError(t, err)
+		dt, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		require.Equal(t, content, dt)
+	}
+	require.Equal(t, 2, fetches)
+}
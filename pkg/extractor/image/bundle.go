@@ -0,0 +1,398 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crazy-max/undock/pkg/extractor"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+const (
+	bundleRootfs = "rootfs"
+	bundleConfig = "config.json"
+
+	defaultPathEnv = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+)
+
+// annotations set from the image config, see
+// https://github.com/opencontainers/image-spec/blob/main/conversion.md
+const (
+	annotationOS           = "org.opencontainers.image.os"
+	annotationOSVersion    = "org.opencontainers.image.os.version"
+	annotationOSFeatures   = "org.opencontainers.image.os.features"
+	annotationArchitecture = "org.opencontainers.image.architecture"
+	annotationVariant      = "org.opencontainers.image.variant"
+	annotationAuthor       = "org.opencontainers.image.author"
+	annotationCreated      = "org.opencontainers.image.created"
+	annotationStopSignal   = "org.opencontainers.image.stopSignal"
+	annotationExposedPorts = "org.opencontainers.image.exposedPorts"
+)
+
+// writeBundles writes an OCI runtime bundle for each platform. Bundles of
+// a manifest list are written in their own folder.
+func (c *Client) writeBundles(mans []manifestEntry, blobs blobStore) error {
+	for _, me := range mans {
+		dest := c.opts.Dist
+		if len(mans) > 1 {
+			dest = path.Join(c.opts.Dist, platformDir(me.platform))
+		}
+		if err := c.writeBundle(dest, me, blobs); err != nil {
+			return errors.Wrapf(err, "cannot write bundle for platform %s", platformDir(me.platform))
+		}
+	}
+	return nil
+}
+
+// writeBundle merges layers of a platform in the rootfs folder of dest and
+// generates the runtime config from the image config
+func (c *Client) writeBundle(dest string, me manifestEntry, blobs blobStore) error {
+	img, err := c.imageConfig(me, blobs)
+	if err != nil {
+		return err
+	}
+
+	rootfs := filepath.Join(dest, bundleRootfs)
+	w, err := extractor.NewDirWriter(rootfs, c.logger)
+	if err != nil {
+		return errors.Wrapf(err, "cannot create rootfs %q", rootfs)
+	}
+	var layers []extractor.Layer
+	for _, layer := range me.manifest.LayerInfos() {
+		layers = append(layers, c.layer(c.ctx, blobs, me.platform, layer))
+	}
+	if err := extractor.MergeLayers(layers, w, extractor.MergeOpts{
+		Context:     c.ctx,
+		Includes:    c.opts.Includes,
+		Parallelism: c.opts.Parallelism,
+	}); err != nil {
+		_ = w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return errors.Wrap(err, "cannot close rootfs")
+	}
+
+	root, err := os.OpenRoot(rootfs)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	// mountpoints of the runtime config
+	for _, dir := range []string{"dev", "proc", "sys"} {
+		if err := root.MkdirAll(dir, 0o755); err != nil {
+			return errors.Wrapf(err, "cannot create /%s mountpoint", dir)
+		}
+	}
+
+	spec, err := runtimeSpec(root, img)
+	if err != nil {
+		return err
+	}
+	dt, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return err
+	}
+	c.logger.Info().Msgf("Writing %s", bundleConfig)
+	return os.WriteFile(filepath.Join(dest, bundleConfig), dt, 0o644)
+}
+
+// runtimeSpec generates the runtime config of a bundle from the image
+// config. Defaults are the ones of "runc spec", without terminal and with a
+// writable rootfs. User and group names are resolved against the rootfs.
+func runtimeSpec(root *os.Root, img ocispecs.Image) (*rspec.Spec, error) {
+	user, err := resolveUser(root, img.Config.User)
+	if err != nil {
+		return nil, err
+	}
+
+	env := img.Config.Env
+	if !hasEnv(env, "PATH") {
+		env = append([]string{defaultPathEnv}, env...)
+	}
+	cwd := img.Config.WorkingDir
+	if cwd == "" {
+		cwd = "/"
+	}
+	caps := []string{"CAP_AUDIT_WRITE", "CAP_KILL", "CAP_NET_BIND_SERVICE"}
+
+	spec := &rspec.Spec{
+		Version: rspec.Version,
+		Process: &rspec.Process{
+			User: user,
+			Args: append(append([]string{}, img.Config.Entrypoint...), img.Config.Cmd...),
+			Env:  env,
+			Cwd:  cwd,
+			Capabilities: &rspec.LinuxCapabilities{
+				Bounding:  caps,
+				Effective: caps,
+				Permitted: caps,
+			},
+			Rlimits: []rspec.POSIXRlimit{{
+				Type: "RLIMIT_NOFILE",
+				Hard: 1024,
+				Soft: 1024,
+			}},
+			NoNewPrivileges: true,
+		},
+		Root: &rspec.Root{
+			Path: bundleRootfs,
+		},
+		Mounts: []rspec.Mount{
+			{Destination: "/proc", Type: "proc", Source: "proc"},
+			{Destination: "/dev", Type: "tmpfs", Source: "tmpfs", Options: []string{"nosuid", "strictatime", "mode=755", "size=65536k"}},
+			{Destination: "/dev/pts", Type: "devpts", Source: "devpts", Options: []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620", "gid=5"}},
+			{Destination: "/dev/shm", Type: "tmpfs", Source: "shm", Options: []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"}},
+			{Destination: "/dev/mqueue", Type: "mqueue", Source: "mqueue", Options: []string{"nosuid", "noexec", "nodev"}},
+			{Destination: "/sys", Type: "sysfs", Source: "sysfs", Options: []string{"nosuid", "noexec", "nodev", "ro"}},
+			{Destination: "/sys/fs/cgroup", Type: "cgroup", Source: "cgroup", Options: []string{"nosuid", "noexec", "nodev", "relatime", "ro"}},
+		},
+		Annotations: imageAnnotations(img),
+		Linux: &rspec.Linux{
+			Resources: &rspec.LinuxResources{
+				Devices: []rspec.LinuxDeviceCgroup{{Allow: false, Access: "rwm"}},
+			},
+			Namespaces: []rspec.LinuxNamespace{
+				{Type: rspec.PIDNamespace},
+				{Type: rspec.NetworkNamespace},
+				{Type: rspec.IPCNamespace},
+				{Type: rspec.UTSNamespace},
+				{Type: rspec.MountNamespace},
+				{Type: rspec.CgroupNamespace},
+			},
+			MaskedPaths: []string{
+				"/proc/acpi", "/proc/asound", "/proc/kcore", "/proc/keys", "/proc/latency_stats",
+				"/proc/timer_list", "/proc/timer_stats", "/proc/sched_debug", "/proc/scsi", "/sys/firmware",
+			},
+			ReadonlyPaths: []string{
+				"/proc/bus", "/proc/fs", "/proc/irq", "/proc/sys", "/proc/sysrq-trigger",
+			},
+		},
+	}
+
+	// volumes are backed by a tmpfs as the bundle has no storage for them
+	var volumes []string
+	for vol := range img.Config.Volumes {
+		volumes = append(volumes, vol)
+	}
+	sort.Strings(volumes)
+	for _, vol := range volumes {
+		spec.Mounts = append(spec.Mounts, rspec.Mount{
+			Destination: vol,
+			Type:        "tmpfs",
+			Source:      "none",
+			Options:     []string{"rw", "nosuid", "nodev", "noexec", "relatime"},
+		})
+	}
+
+	return spec, nil
+}
+
+// imageAnnotations returns the annotations of the runtime config. Labels are
+// set first so they cannot override the properties of the image.
+func imageAnnotations(img ocispecs.Image) map[string]string {
+	annotations := make(map[string]string)
+	for k, v := range img.Config.Labels {
+		annotations[k] = v
+	}
+	set := func(key, value string) {
+		if value != "" {
+			annotations[key] = value
+		}
+	}
+	set(annotationOS, img.OS)
+	set(annotationOSVersion, img.OSVersion)
+	set(annotationOSFeatures, strings.Join(img.OSFeatures, ","))
+	set(annotationArchitecture, img.Architecture)
+	set(annotationVariant, img.Variant)
+	set(annotationAuthor, img.Author)
+	if img.Created != nil {
+		set(annotationCreated, img.Created.Format(time.RFC3339Nano))
+	}
+	set(annotationStopSignal, img.Config.StopSignal)
+	var ports []string
+	for port := range img.Config.ExposedPorts {
+		ports = append(ports, port)
+	}
+	sort.Strings(ports)
+	set(annotationExposedPorts, strings.Join(ports, ","))
+	return annotations
+}
+
+// resolveUser resolves the user of the image config, in the user, uid,
+// user:group, uid:gid, uid:group or user:gid form, against the passwd and
+// group files of the rootfs
+func resolveUser(root *os.Root, s string) (rspec.User, error) {
+	var user rspec.User
+	if s == "" {
+		return user, nil
+	}
+	name, group, hasGroup := strings.Cut(s, ":")
+
+	passwd, err := readDatabase(root, "etc/passwd")
+	if err != nil {
+		return user, err
+	}
+	var username string
+	if uid, err := strconv.ParseUint(name, 10, 32); err == nil {
+		user.UID = uint32(uid)
+		for _, entry := range passwd {
+			if len(entry) > 3 && entry[2] == name {
+				username = entry[0]
+				if gid, err := strconv.ParseUint(entry[3], 10, 32); err == nil {
+					user.GID = uint32(gid)
+				}
+				break
+			}
+		}
+	} else {
+		var found bool
+		for _, entry := range passwd {
+			if len(entry) > 3 && entry[0] == name {
+				uid, uerr := strconv.ParseUint(entry[2], 10, 32)
+				gid, gerr := strconv.ParseUint(entry[3], 10, 32)
+				if uerr != nil || gerr != nil {
+					return user, errors.Errorf("invalid passwd entry for user %q", name)
+				}
+				user.UID, user.GID = uint32(uid), uint32(gid)
+				username, found = name, true
+				break
+			}
+		}
+		if !found {
+			return user, errors.Errorf("cannot find user %q in /etc/passwd", name)
+		}
+	}
+
+	groups, err := readDatabase(root, "etc/group")
+	if err != nil {
+		return user, err
+	}
+	if hasGroup {
+		if gid, err := strconv.ParseUint(group, 10, 32); err == nil {
+			user.GID = uint32(gid)
+		} else {
+			var found bool
+			for _, entry := range groups {
+				if len(entry) > 2 && entry[0] == group {
+					gid, err := strconv.ParseUint(entry[2], 10, 32)
+					if err != nil {
+						return user, errors.Errorf("invalid group entry for group %q", group)
+					}
+					user.GID, found = uint32(gid), true
+					break
+				}
+			}
+			if !found {
+				return user, errors.Errorf("cannot find group %q in /etc/group", group)
+			}
+		}
+	} else if username != "" {
+		// supplementary groups only apply if the group is not set
+		for _, entry := range groups {
+			if len(entry) < 4 {
+				continue
+			}
+			gid, err := strconv.ParseUint(entry[2], 10, 32)
+			if err != nil || uint32(gid) == user.GID {
+				continue
+			}
+			for _, member := range strings.Split(entry[3], ",") {
+				if member == username {
+					user.AdditionalGids = append(user.AdditionalGids, uint32(gid))
+					break
+				}
+			}
+		}
+	}
+	return user, nil
+}
+
+// readDatabase reads the colon separated entries of a passwd or group file
+// in the rootfs. A missing file has no entries.
+func readDatabase(root *os.Root, name string) ([][]string, error) {
+	resolved, err := resolveRootPath(root, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot resolve /%s", name)
+	}
+	dt, err := root.ReadFile(resolved)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "cannot read /%s", name)
+	}
+	var entries [][]string
+	s := bufio.NewScanner(bytes.NewReader(dt))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, strings.Split(line, ":"))
+	}
+	return entries, s.Err()
+}
+
+// maxSymlinks is the number of symlinks followed to resolve a path in the
+// rootfs, as the limit of Linux
+const maxSymlinks = 40
+
+// resolveRootPath resolves the symlinks of a path in the rootfs, such as an
+// /etc/passwd linked to a file of the Nix store. Absolute targets are
+// resolved from the rootfs, which os.Root refuses to follow.
+func resolveRootPath(root *os.Root, name string) (string, error) {
+	var resolved []string
+	pending := strings.Split(name, "/")
+	var links int
+	for len(pending) > 0 {
+		elem := pending[0]
+		pending = pending[1:]
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) > 0 {
+				resolved = resolved[:len(resolved)-1]
+			}
+			continue
+		}
+		target, err := root.Readlink(path.Join(append(resolved, elem)...))
+		if err != nil {
+			// not a symlink, or missing
+			resolved = append(resolved, elem)
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return "", errors.New("too many levels of symbolic links")
+		}
+		if path.IsAbs(target) {
+			resolved = nil
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+	if len(resolved) == 0 {
+		return ".", nil
+	}
+	return path.Join(resolved...), nil
+}
+
+// hasEnv returns true if env sets the variable key
+func hasEnv(env []string, key string) bool {
+	for _, e := range env {
+		if k, _, _ := strings.Cut(e, "="); k == key {
+			return true
+		}
+	}
+	return false
+}
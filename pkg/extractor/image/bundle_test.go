@@ -0,0 +1,130 @@
+package image
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveUser(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "etc"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "etc", "passwd"), []byte(
+		"root:x:0:0:root:/root:/bin/sh\n"+
+			"app:x:1000:1000::/home/app:/bin/sh\n",
+	), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "etc", "group"), []byte(
+		"# groups\n"+
+			"root:x:0:\n"+
+			"app:x:1000:\n"+
+			"audio:x:29:app,other\n"+
+			"video:x:44:other\n",
+	), 0o644))
+
+	root, err := os.OpenRoot(dir)
+	require.NoError(t, err)
+	defer root.Close()
+
+	for _, tt := range []struct {
+		user     string
+		expected rspec.User
+		err      string
+	}{
+		{user: "", expected: rspec.User{}},
+		{user: "app", expected: rspec.User{UID: 1000, GID: 1000, AdditionalGids: []uint32{29}}},
+		{user: "1000", expected: rspec.User{UID: 1000, GID: 1000, AdditionalGids: []uint32{29}}},
+		{user: "app:video", expected: rspec.User{UID: 1000, GID: 44}},
+		{user: "1234:5678", expected: rspec.User{UID: 1234, GID: 5678}},
+		{user: "1234", expected: rspec.User{UID: 1234}},
+		{user: "nobody", err: `cannot find user "nobody" in /etc/passwd`},
+		{user: "app:nogroup", err: `cannot find group "nogroup" in /etc/group`},
+	} {
+		t.Run(tt.user, func(t *testing.T) {
+			user, err := resolveUser(root, tt.user)
+			if tt.err != "" {
+				require.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, user)
+		})
+	}
+}
+
+func TestResolveUserSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "etc"), 0o755))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "nix", "store"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "nix", "store", "passwd"), []byte(
+		"app:x:1000:1000::/home/app:/bin/sh\n",
+	), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "nix", "store", "group"), []byte(
+		"app:x:1000:\n"+
+			"audio:x:29:app\n",
+	), 0o644))
+	if err := os.Symlink("/nix/store/passwd", filepath.Join(dir, "etc", "passwd")); err != nil {
+		t.Skipf("symlinks are not supported: %v", err)
+	}
+	// relative targets going above the rootfs stay in it
+	require.NoError(t, os.Symlink("../../../../nix/./store/group", filepath.Join(dir, "etc", "group")))
+
+	root, err := os.OpenRoot(dir)
+	require.NoError(t, err)
+	defer root.Close()
+
+	user, err := resolveUser(root, "app")
+	require.NoError(t, err)
+	assert.Equal(t, rspec.User{UID: 1000, GID: 1000, AdditionalGids: []uint32{29}}, user)
+
+	require.NoError(t, os.Remove(filepath.Join(dir, "etc", "group")))
+	require.NoError(t, os.Symlink("/etc/group", filepath.Join(dir, "etc", "group")))
+	_, err = resolveUser(root, "app")
+	require.ErrorContains(t, err, "too many levels of symbolic links")
+}
+
+func TestRuntimeSpec(t *testing.T) {
+	root, err := os.OpenRoot(t.TempDir())
+	require.NoError(t, err)
+	defer root.Close()
+
+	spec, err := runtimeSpec(root, ocispecs.Image{
+		Platform: ocispecs.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"},
+		Config: ocispecs.ImageConfig{
+			User:         "1000:1000",
+			Env:          []string{"FOO=bar"},
+			Entrypoint:   []string{"/bin/app"},
+			Cmd:          []string{"--serve"},
+			WorkingDir:   "/srv",
+			ExposedPorts: map[string]struct{}{"8080/tcp": {}, "53/udp": {}},
+			Volumes:      map[string]struct{}{"/data": {}},
+			Labels:       map[string]string{"org.opencontainers.image.os": "label", "foo": "bar"},
+			StopSignal:   "SIGQUIT",
+		},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"/bin/app", "--serve"}, spec.Process.Args)
+	assert.Equal(t, []string{defaultPathEnv, "FOO=bar"}, spec.Process.Env)
+	assert.Equal(t, "/srv", spec.Process.Cwd)
+	assert.Equal(t, rspec.User{UID: 1000, GID: 1000}, spec.Process.User)
+	assert.Equal(t, "rootfs", spec.Root.Path)
+	assert.Equal(t, rspec.Mount{
+		Destination: "/data",
+		Type:        "tmpfs",
+		Source:      "none",
+		Options:     []string{"rw", "nosuid", "nodev", "noexec", "relatime"},
+	}, spec.Mounts[len(spec.Mounts)-1])
+	assert.Equal(t, map[string]string{
+		"foo":                                   "bar",
+		"org.opencontainers.image.os":           "linux",
+		"org.opencontainers.image.architecture": "arm64",
+		"org.opencontainers.image.variant":      "v8",
+		"org.opencontainers.image.stopSignal":   "SIGQUIT",
+		"org.opencontainers.image.exposedPorts": "53/udp,8080/tcp",
+	}, spec.Annotations)
+}
@@ -1,32 +1,51 @@
 package image
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"archive/tar"
+	"bytes"
+	"crypto/tls"
 	"fmt"
 	"io"
+	"maps"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/crazy-max/undock/pkg/image"
 	mobyclient "github.com/moby/moby/client"
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	"go.podman.io/image/v5/copy"
-	"go.podman.io/image/v5/docker"
 	"go.podman.io/image/v5/docker/reference"
-	"go.podman.io/image/v5/pkg/docker/config"
+	"go.podman.io/image/v5/manifest"
+	"go.podman.io/image/v5/pkg/compression"
+	"go.podman.io/image/v5/pkg/sysregistriesv2"
 	"go.podman.io/image/v5/signature"
 	"go.podman.io/image/v5/transports/alltransports"
 	"go.podman.io/image/v5/types"
+	"go.podman.io/storage/pkg/configfile"
+	"go.podman.io/storage/pkg/unshare"
 )
 
-func (c *Client) cacheSource(src string) ([]byte, string, error) {
+// sourceRef is a parsed source reference along with the system context to
+// access it
+type sourceRef struct {
+	*Source
+	ref       types.ImageReference
+	dockerRef types.ImageReference
+	sysCtx    *types.SystemContext
+}
+
+func (c *Client) parseSource(src string) (*sourceRef, error) {
 	srcObj := NewSource(src)
 	srcRef, err := srcObj.Reference()
 	if err != nil {
-		return nil, "", errors.Wrapf(err, "cannot parse reference '%s'", srcObj.String())
+		return nil, errors.Wrapf(err, "cannot parse reference '%s'", srcObj.String())
 	}
 
 	var dockerRef types.ImageReference
@@ -34,29 +53,109 @@ func (c *Client) cacheSource(src string) ([]byte, string, error) {
 	if srcObj.Scheme() == "docker" {
 		dockerRef, err = image.DockerReference(strings.TrimPrefix(src, "docker://"))
 		if err != nil {
-			return nil, "", errors.Wrap(err, "cannot parse docker reference")
+			return nil, errors.Wrap(err, "cannot parse docker reference")
 		}
-		dockerAuth, err = config.GetCredentials(nil, reference.Domain(dockerRef.DockerReference()))
-		if err != nil {
-			c.logger.Warn().Msg("cannot retrieve Docker credentials")
+		if !c.opts.Offline {
+			dockerAuth, err = c.dockerAuth(reference.Domain(dockerRef.DockerReference()))
+			if err != nil && c.opts.RegistryAuthFile != "" {
+				return nil, err
+			} else if err != nil {
+				c.logger.Warn().Err(err).Msg("cannot retrieve Docker credentials")
+			}
 		}
 	}
 
 	srcCtx, err := c.srcCtx(&dockerAuth, c.opts.RegistryInsecure)
 	if err != nil {
-		return nil, "", errors.Wrap(err, "cannot create source context")
+		return nil, errors.Wrap(err, "cannot create source context")
 	}
 
+	// only downloads from registries are limited
+	if c.limiter != nil && srcObj.Scheme() == "docker" {
+		srcRef = limitedReference{ImageReference: srcRef, limiter: c.limiter}
+	}
+
+	sref := &sourceRef{
+		Source:    srcObj,
+		ref:       srcRef,
+		dockerRef: dockerRef,
+		sysCtx:    srcCtx,
+	}
+	if dockerRef != nil {
+		c.mu.Lock()
+		c.quotaSource = sref
+		c.mu.Unlock()
+	}
+	return sref, nil
+}
+
+// resolveShortName replaces a short name source, such as alpine:latest, by
+// its alias in the registries.conf file set in the options
+func (c *Client) resolveShortName() error {
+	if c.opts.RegistriesConf == "" || NewSource(c.opts.Source).Scheme() != "docker" {
+		return nil
+	}
+	name := strings.TrimPrefix(c.opts.Source, "docker://")
+	if i := strings.IndexRune(name, '/'); i >= 0 && (strings.ContainsAny(name[:i], ".:") || name[:i] == "localhost") {
+		return nil
+	}
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return nil
+	}
+	sysCtx, err := c.srcCtx(nil, c.opts.RegistryInsecure)
+	if err != nil {
+		return errors.Wrap(err, "cannot create source context")
+	}
+	alias, _, err := sysregistriesv2.ResolveShortNameAlias(sysCtx, reference.FamiliarName(named))
+	if err != nil {
+		return errors.Wrapf(err, "cannot resolve short name %s", name)
+	} else if alias == nil {
+		return nil
+	}
+	if tagged, ok := named.(reference.Tagged); ok {
+		if alias, err = reference.WithTag(alias, tagged.Tag()); err != nil {
+			return err
+		}
+	}
+	if canonical, ok := named.(reference.Canonical); ok {
+		if alias, err = reference.WithDigest(alias, canonical.Digest()); err != nil {
+			return err
+		}
+	}
+	c.logger.Info().Msgf("Resolved short name %s to %s", name, alias.String())
+	c.opts.Source = "docker://" + alias.String()
+	return nil
+}
+
+func (c *Client) cacheSource(src string) ([]byte, string, error) {
+	sref, err := c.parseSource(src)
+	if err != nil {
+		return nil, "", err
+	}
+	srcObj := sref.Source
+
 	var cacheDigest string
+	var dockerDigest digest.Digest
+	var resolvedLocally bool
+	var resolved time.Time
 	switch srcObj.Scheme() {
 	case "docker":
-		if dgst, err := docker.GetDigest(c.ctx, srcCtx, dockerRef); err == nil {
-			cacheDigest = srcObj.Scheme() + "-" + dgst.Encoded()
-		} else {
+		if dockerDigest, resolvedLocally, err = c.localDigest(sref); err != nil {
 			return nil, "", errors.Wrap(err, "cannot get docker reference digest")
+		} else if !resolvedLocally {
+			if dockerDigest, err = c.dockerDigest(sref); err != nil {
+				return nil, "", errors.Wrap(err, "cannot get docker reference digest")
+			}
+			resolved = time.Now()
 		}
+		cacheDigest = srcObj.Scheme() + "-" + dockerDigest.Encoded()
 	case "docker-daemon":
-		mobycli, err := mobyclient.New(mobyclient.FromEnv)
+		tlsOpts, err := c.daemonTLSOpts()
+		if err != nil {
+			return nil, "", err
+		}
+		mobycli, err := mobyclient.New(append([]mobyclient.Opt{mobyclient.FromEnv}, tlsOpts...)...)
 		if err != nil {
 			return nil, "", err
 		}
@@ -69,16 +168,43 @@ func (c *Client) cacheSource(src string) ([]byte, string, error) {
 		} else {
 			return nil, "", err
 		}
+	case "oci-archive", "docker-archive":
+		dgst, err := archiveDigest(sref)
+		if err != nil {
+			return nil, "", err
+		}
+		cacheDigest = srcObj.Scheme() + "-" + dgst.Encoded()
 	default:
-		// TODO: Find a proper way to create a cache fingerprint. Best effort atm with transport.
-		srcHash := sha256.New()
-		srcHash.Write([]byte(srcRef.StringWithinTransport()))
-		cacheDigest = srcObj.Scheme() + "-" + hex.EncodeToString(srcHash.Sum(nil))
+		dgst, err := c.manifestDigest(sref)
+		if err != nil {
+			return nil, "", err
+		}
+		cacheDigest = srcObj.Scheme() + "-" + dgst.Encoded()
 	}
 
 	cachedir := filepath.Join(c.opts.CacheDir, cacheDigest)
 	c.logger.Info().Msgf("Computed cache digest %s", cacheDigest)
 
+	// an image whose digest is known without the registry is extracted
+	// from the cache if it is there, and pulled by digest otherwise
+	if resolvedLocally {
+		manblob, err := c.cachedManifest(cachedir)
+		if err == nil {
+			return manblob, cachedir, nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, "", err
+		} else if c.opts.Offline {
+			return nil, "", errors.Errorf("image %s is not in the cache, it cannot be extracted offline", sref.String())
+		}
+		if sref, err = c.pinSource(sref, dockerDigest); err != nil {
+			return nil, "", err
+		}
+	}
+	srcRef, srcCtx := sref.ref, sref.sysCtx
+	if srcObj.Scheme() == "docker" {
+		srcRef = c.rangedReference(sref)
+	}
+
 	dstRef, err := alltransports.ParseImageName(fmt.Sprintf("oci:%s", cachedir))
 	if err != nil {
 		return nil, "", errors.Wrapf(err, "invalid oci cache folder %s", cachedir)
@@ -105,9 +231,119 @@ func (c *Client) cacheSource(src string) ([]byte, string, error) {
 		DestinationCtx:                        dstCtx,
 		ImageListSelection:                    imageSelection,
 		OptimizeDestinationImageAlreadyExists: true,
+		ConcurrentBlobCopiesSemaphore:         c.downloads,
 	})
+	if err != nil {
+		return nil, "", err
+	}
 
-	return manblob, cachedir, err
+	// the tag can be resolved without the registry once the image is in the
+	// cache
+	if srcObj.Scheme() == "docker" && !resolvedLocally {
+		if named, ok := sref.dockerRef.DockerReference().(reference.NamedTagged); ok {
+			if err := c.recordTag(named, dockerDigest, resolved); err != nil {
+				c.logger.Warn().Err(err).Msgf("Cannot record digest of %s", named.String())
+			}
+		}
+	}
+	return manblob, cachedir, nil
+}
+
+// dockerDigest returns the manifest digest of a docker source from the
+// registry
+func (c *Client) dockerDigest(sref *sourceRef) (digest.Digest, error) {
+	// getDigest requests the registry itself, which may not be reachable,
+	// so the manifest is pulled through the mirrors to compute its digest
+	// if any may be set
+	if c.opts.RegistriesConf != "" || len(c.opts.RegistryMirrors) > 0 {
+		return c.manifestDigest(sref)
+	}
+	return c.getDigest(sref)
+}
+
+// manifestDigest returns the digest of the manifest of the source image,
+// so an image rebuilt at the same location is cached again
+func (c *Client) manifestDigest(sref *sourceRef) (_ digest.Digest, err error) {
+	imgsrc, err := c.newImageSource(sref)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if cerr := imgsrc.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	manblob, _, err := c.getManifest(imgsrc, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot get manifest")
+	}
+	dgst, err := manifest.Digest(manblob)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot compute manifest digest")
+	}
+	return dgst, nil
+}
+
+// archivePath returns the path of the archive of an oci-archive or
+// docker-archive source, as parsed by its transport
+func archivePath(sref *sourceRef) string {
+	if sref.Scheme() == "oci-archive" {
+		// the path resolved by the transport, which keeps the drive letter
+		// of Windows paths
+		return sref.ref.PolicyConfigurationIdentity()
+	}
+	// the transport cuts the path at its first colon, before the optional
+	// reference of an image, so the path cannot contain one
+	filename, _, _ := strings.Cut(sref.ref.StringWithinTransport(), ":")
+	return filename
+}
+
+// archiveDigest returns the digest of the index of an oci-archive source, or
+// of the manifest of a docker-archive source, read from the archive without
+// extracting it, so an archive rebuilt at the same path is cached again
+func archiveDigest(sref *sourceRef) (_ digest.Digest, err error) {
+	entry := ocispecs.ImageIndexFile
+	if sref.Scheme() == "docker-archive" {
+		entry = "manifest.json"
+	}
+	filename := archivePath(sref)
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot open archive")
+	}
+	defer f.Close()
+	decompressor, r, err := compression.DetectCompression(f)
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot read archive %s", filename)
+	}
+	if decompressor == nil {
+		// entries of an uncompressed archive are skipped without being read
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		r = f
+	} else {
+		rc, err := decompressor(r)
+		if err != nil {
+			return "", errors.Wrapf(err, "cannot decompress archive %s", filename)
+		}
+		defer rc.Close()
+		r = rc
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return "", errors.Errorf("%s not found in archive %s", entry, filename)
+		} else if err != nil {
+			return "", errors.Wrapf(err, "cannot read archive %s", filename)
+		}
+		if path.Clean(hdr.Name) == entry && hdr.Typeflag == tar.TypeReg {
+			return digest.FromReader(tr)
+		}
+	}
 }
 
 func (c *Client) srcCtx(auth *types.DockerAuthConfig, insecure bool) (*types.SystemContext, error) {
@@ -118,8 +354,12 @@ func (c *Client) srcCtx(auth *types.DockerAuthConfig, insecure bool) (*types.Sys
 
 	sysCtx := &types.SystemContext{
 		DockerAuthConfig:                  auth,
+		DockerBearerRegistryToken:         c.opts.RegistryToken,
+		DockerPerHostCertDirPath:          c.opts.CertDir,
+		DockerProxy:                       c.proxy(),
+		DockerDaemonHost:                  os.Getenv("DOCKER_HOST"),
+		DockerDaemonCertPath:              c.opts.CertDir,
 		DockerDaemonInsecureSkipTLSVerify: insecure,
-		DockerInsecureSkipTLSVerify:       types.NewOptionalBool(insecure),
 		DockerRegistryUserAgent:           c.opts.RegistryUserAgent,
 		SystemRegistriesConfPath:          registriesConfPath,
 		SystemRegistriesConfDirPath:       registriesConfDirPath,
@@ -128,23 +368,189 @@ func (c *Client) srcCtx(auth *types.DockerAuthConfig, insecure bool) (*types.Sys
 		VariantChoice:                     c.opts.Platform.Variant,
 		BlobInfoCacheDir:                  filepath.Join(c.opts.CacheDir, "blobs"),
 	}
+	// registries set as insecure in registries.conf are honored otherwise
+	if insecure {
+		sysCtx.DockerInsecureSkipTLSVerify = types.OptionalBoolTrue
+	}
+	if c.opts.CAFile != "" {
+		pool, err := c.certPool()
+		if err != nil {
+			return nil, err
+		}
+		sysCtx.BaseTLSConfig = &tls.Config{RootCAs: pool}
+	}
 	return sysCtx, nil
 }
 
+// registriesConf returns the registries.conf file and drop-in directory of
+// the source context. System and user files are ignored unless a
+// registries.conf file is set in the options, which is read along with the
+// standard drop-in directories. Registry mirrors are merged in the settings
+// of their registry, in a drop-in directory created for this run and
+// removed by removeRegistriesConf, so concurrent runs do not share it.
 func (c *Client) registriesConf() (string, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.registriesConfPath != "" {
+		return c.registriesConfPath, c.registriesConfDir, nil
+	}
+
 	configDir := filepath.Join(c.opts.CacheDir, "containers")
 	if err := os.MkdirAll(configDir, 0o700); err != nil {
 		return "", "", errors.Wrapf(err, "failed to create containers config directory %q", configDir)
 	}
-	configPath := filepath.Join(configDir, "registries.conf")
-	if err := os.WriteFile(configPath, []byte("# Intentionally empty registries.conf v2 file for undock.\n"), 0o600); err != nil {
-		return "", "", errors.Wrapf(err, "failed to write registries configuration %q", configPath)
+	configPath := c.opts.RegistriesConf
+	var dropIns []string
+	if configPath == "" {
+		configPath = filepath.Join(configDir, "registries.conf")
+		if err := writeFileAtomic(configPath, []byte("# Intentionally empty registries.conf v2 file for undock.\n")); err != nil {
+			return "", "", errors.Wrapf(err, "failed to write registries configuration %q", configPath)
+		}
+	} else if _, err := os.Stat(configPath); err != nil {
+		return "", "", errors.Wrap(err, "cannot read registries configuration")
+	} else if len(c.opts.RegistryMirrors) == 0 {
+		// the standard drop-in directories are read along with the file
+		c.registriesConfPath = configPath
+		return configPath, "", nil
+	} else if dropIns, err = registriesDropIns(configPath); err != nil {
+		return "", "", errors.Wrap(err, "cannot read registries configuration")
+	}
+
+	dropInDir, err := os.MkdirTemp(configDir, "registries.conf.d-")
+	if err != nil {
+		return "", "", errors.Wrap(err, "failed to create registries configuration directory")
+	}
+	c.registriesConfPath, c.registriesConfDir = configPath, dropInDir
+
+	// drop-in files are read in the order of their names
+	for i, dropIn := range dropIns {
+		dt, err := os.ReadFile(dropIn)
+		if err != nil {
+			return "", "", errors.Wrap(err, "cannot read registries configuration")
+		}
+		if err := os.WriteFile(filepath.Join(dropInDir, fmt.Sprintf("%03d-%s", i, filepath.Base(dropIn))), dt, 0o600); err != nil {
+			return "", "", errors.Wrap(err, "failed to write registries configuration")
+		}
 	}
-	configDropInDir := filepath.Join(configDir, "registries.conf.d")
-	if err := os.MkdirAll(configDropInDir, 0o700); err != nil {
-		return "", "", errors.Wrapf(err, "failed to create registries configuration directory %q", configDropInDir)
+	if len(c.opts.RegistryMirrors) > 0 {
+		registries, err := sysregistriesv2.GetRegistries(&types.SystemContext{
+			SystemRegistriesConfPath:    configPath,
+			SystemRegistriesConfDirPath: dropInDir,
+		})
+		if err != nil {
+			return "", "", errors.Wrap(err, "cannot load registries configuration")
+		}
+		mirrorsPath := filepath.Join(dropInDir, fmt.Sprintf("%03d-mirrors.conf", len(dropIns)))
+		if err := os.WriteFile(mirrorsPath, c.mirrorsConf(registries), 0o600); err != nil {
+			return "", "", errors.Wrapf(err, "failed to write registry mirrors configuration %q", mirrorsPath)
+		}
+		// the configuration loaded without the mirrors is cached by path
+		sysregistriesv2.InvalidateCache()
+	}
+	return configPath, dropInDir, nil
+}
+
+// removeRegistriesConf removes the drop-in directory created for this run
+func (c *Client) removeRegistriesConf() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.registriesConfDir != "" {
+		_ = os.RemoveAll(c.registriesConfDir)
+	}
+	c.registriesConfPath, c.registriesConfDir = "", ""
+}
+
+// registriesDropIns returns the files of the standard drop-in directories
+// read along with a registries.conf file, in the order they are applied.
+// A file overrides the files of the same name in the next directories.
+func registriesDropIns(configPath string) ([]string, error) {
+	paths, err := configfile.GetSearchPaths(&configfile.File{
+		Name:                 "registries",
+		Extension:            "conf",
+		CustomConfigFilePath: configPath,
+		UserId:               unshare.GetRootlessUID(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	dropIns := map[string]string{}
+	for _, dir := range slices.Backward(paths.DropInDirectories) {
+		entries, err := os.ReadDir(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".conf") {
+				dropIns[entry.Name()] = filepath.Join(dir, entry.Name())
+			}
+		}
+	}
+	files := make([]string, 0, len(dropIns))
+	for _, name := range slices.Sorted(maps.Keys(dropIns)) {
+		files = append(files, dropIns[name])
+	}
+	return files, nil
+}
+
+// mirrorsConf returns a registries.conf drop-in file with the registry
+// mirrors, in the order they are tried. They are tried before the mirrors
+// already set for their registry, whose other settings are kept.
+func (c *Client) mirrorsConf(registries []sysregistriesv2.Registry) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("# Registry mirrors set with undock.\n")
+	for _, location := range slices.Sorted(maps.Keys(c.opts.RegistryMirrors)) {
+		reg := sysregistriesv2.Registry{Prefix: location, Endpoint: sysregistriesv2.Endpoint{Location: location}}
+		if i := slices.IndexFunc(registries, func(r sysregistriesv2.Registry) bool {
+			return r.Prefix == location
+		}); i >= 0 {
+			reg = registries[i]
+		}
+		fmt.Fprintf(&buf, "\n[[registry]]\nprefix = %q\nlocation = %q\n", reg.Prefix, reg.Location)
+		if reg.Insecure {
+			buf.WriteString("insecure = true\n")
+		}
+		if reg.Blocked {
+			buf.WriteString("blocked = true\n")
+		}
+		if reg.MirrorByDigestOnly {
+			buf.WriteString("mirror-by-digest-only = true\n")
+		}
+		for _, mirror := range c.opts.RegistryMirrors[location] {
+			fmt.Fprintf(&buf, "\n[[registry.mirror]]\nlocation = %q\n", mirror)
+		}
+		for _, mirror := range reg.Mirrors {
+			fmt.Fprintf(&buf, "\n[[registry.mirror]]\nlocation = %q\n", mirror.Location)
+			if mirror.Insecure {
+				buf.WriteString("insecure = true\n")
+			}
+			if mirror.PullFromMirror != "" {
+				fmt.Fprintf(&buf, "pull-from-mirror = %q\n", mirror.PullFromMirror)
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+// writeFileAtomic writes a file through a temporary file so concurrent
+// readers never see it partially written
+func writeFileAtomic(filename string, dt []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+"-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(dt)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
 	}
-	return configPath, configDropInDir, nil
+	return err
 }
 
 func (c *Client) dstCtx(_ string) (*types.SystemContext, error) {
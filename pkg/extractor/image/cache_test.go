@@ -1,17 +1,22 @@
 package image
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"os"
 	"path/filepath"
 	"testing"
 
+	digest "github.com/opencontainers/go-digest"
 	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.podman.io/image/v5/pkg/sysregistriesv2"
 	"go.podman.io/image/v5/types"
+	"go.podman.io/storage/pkg/configfile"
 )
 
 func TestSrcCtxUsesRegistrySettings(t *testing.T) {
@@ -41,14 +46,178 @@ func TestSrcCtxUsesRegistrySettings(t *testing.T) {
 	assert.Equal(t, "v8", sysCtx.VariantChoice)
 	assert.Equal(t, filepath.Join(cacheDir, "blobs"), sysCtx.BlobInfoCacheDir)
 	assert.Equal(t, filepath.Join(cacheDir, "containers", "registries.conf"), sysCtx.SystemRegistriesConfPath)
-	assert.Equal(t, filepath.Join(cacheDir, "containers", "registries.conf.d"), sysCtx.SystemRegistriesConfDirPath)
+	assert.Equal(t, filepath.Join(cacheDir, "containers"), filepath.Dir(sysCtx.SystemRegistriesConfDirPath))
 	assert.FileExists(t, sysCtx.SystemRegistriesConfPath)
 	assert.DirExists(t, sysCtx.SystemRegistriesConfDirPath)
 
+	// the drop-in directory is created for this run
+	c.removeRegistriesConf()
+	assert.NoDirExists(t, sysCtx.SystemRegistriesConfDirPath)
+
 	_, err = sysregistriesv2.TryUpdatingCache(sysCtx)
 	require.NoError(t, err)
 }
 
+func TestSrcCtxWritesRegistryMirrors(t *testing.T) {
+	cacheDir := t.TempDir()
+	c := &Client{
+		opts: Options{
+			CacheDir: cacheDir,
+			RegistryMirrors: map[string][]string{
+				"docker.io": {"mirror.gcr.io", "registry.local:5000"},
+			},
+		},
+	}
+
+	sysCtx, err := c.srcCtx(nil, false)
+	require.NoError(t, err)
+	assert.Equal(t, types.OptionalBoolUndefined, sysCtx.DockerInsecureSkipTLSVerify)
+
+	reg, err := sysregistriesv2.FindRegistry(sysCtx, "docker.io/library/alpine")
+	require.NoError(t, err)
+	require.NotNil(t, reg)
+	require.Len(t, reg.Mirrors, 2)
+	assert.Equal(t, "mirror.gcr.io", reg.Mirrors[0].Location)
+	assert.Equal(t, "registry.local:5000", reg.Mirrors[1].Location)
+
+	c.removeRegistriesConf()
+	c.opts.RegistryMirrors = nil
+	sysCtx, err = c.srcCtx(nil, false)
+	require.NoError(t, err)
+	reg, err = sysregistriesv2.FindRegistry(sysCtx, "docker.io/library/alpine")
+	require.NoError(t, err)
+	assert.Nil(t, reg)
+}
+
+func TestSrcCtxMergesRegistryMirrors(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(root, "config"))
+	t.Setenv("APPDATA", filepath.Join(root, "config"))
+	userConfig, err := configfile.UserConfigPath()
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(filepath.Join(userConfig, "registries.conf.d"), 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(userConfig, "registries.conf.d", "user.conf"), []byte(`
+[[registry]]
+location = "user.local"
+insecure = true
+`), 0o600))
+
+	registriesConf := filepath.Join(root, "registries.conf")
+	require.NoError(t, os.WriteFile(registriesConf, []byte(`
+[[registry]]
+location = "registry.local"
+insecure = true
+
+[[registry.mirror]]
+location = "mirror.local"
+
+[[registry]]
+location = "blocked.local"
+blocked = true
+`), 0o600))
+
+	c := &Client{
+		opts: Options{
+			CacheDir:       filepath.Join(root, "cache"),
+			RegistriesConf: registriesConf,
+			RegistryMirrors: map[string][]string{
+				"registry.local": {"cli-mirror.local"},
+				"blocked.local":  {"cli-mirror.local"},
+			},
+		},
+	}
+	sysCtx, err := c.srcCtx(nil, false)
+	require.NoError(t, err)
+	defer c.removeRegistriesConf()
+
+	reg, err := sysregistriesv2.FindRegistry(sysCtx, "registry.local/app")
+	require.NoError(t, err)
+	require.NotNil(t, reg)
+	assert.True(t, reg.Insecure)
+	require.Len(t, reg.Mirrors, 2)
+	assert.Equal(t, "cli-mirror.local", reg.Mirrors[0].Location)
+	assert.Equal(t, "mirror.local", reg.Mirrors[1].Location)
+
+	reg, err = sysregistriesv2.FindRegistry(sysCtx, "blocked.local/app")
+	require.NoError(t, err)
+	require.NotNil(t, reg)
+	assert.True(t, reg.Blocked)
+
+	// standard drop-in files are still read
+	reg, err = sysregistriesv2.FindRegistry(sysCtx, "user.local/app")
+	require.NoError(t, err)
+	require.NotNil(t, reg)
+	assert.True(t, reg.Insecure)
+
+	// another run gets its own drop-in directory
+	other := &Client{opts: Options{CacheDir: c.opts.CacheDir, RegistriesConf: registriesConf}}
+	otherCtx, err := other.srcCtx(nil, false)
+	require.NoError(t, err)
+	assert.NotEqual(t, sysCtx.SystemRegistriesConfDirPath, otherCtx.SystemRegistriesConfDirPath)
+	reg, err = sysregistriesv2.FindRegistry(otherCtx, "registry.local/app")
+	require.NoError(t, err)
+	require.NotNil(t, reg)
+	require.Len(t, reg.Mirrors, 1)
+}
+
+func TestArchiveDigest(t *testing.T) {
+	index := []byte(`{"schemaVersion":2,"manifests":[]}`)
+	manifest := []byte(`[{"Config":"config.json","Layers":[]}]`)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range []struct {
+		name string
+		body []byte
+	}{
+		{"blobs/sha256/layer", bytes.Repeat([]byte("layer"), 1024)},
+		{"./" + ocispecs.ImageIndexFile, index},
+		{"manifest.json", manifest},
+	} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: entry.name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(entry.body))}))
+		_, err := tw.Write(entry.body)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	var gzbuf bytes.Buffer
+	gw := gzip.NewWriter(&gzbuf)
+	_, err := gw.Write(buf.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	root := t.TempDir()
+	c := &Client{opts: Options{CacheDir: filepath.Join(root, "cache")}}
+	for name, body := range map[string][]byte{"image.tar": buf.Bytes(), "image.tar.gz": gzbuf.Bytes()} {
+		filename := filepath.Join(root, name)
+		require.NoError(t, os.WriteFile(filename, body, 0o600))
+
+		for _, tc := range []struct {
+			source   string
+			expected digest.Digest
+		}{
+			{"oci-archive://" + filename, digest.FromBytes(index)},
+			{"oci-archive://" + filename + ":app", digest.FromBytes(index)},
+			{"oci-archive://" + filename + ":app:v1", digest.FromBytes(index)},
+			{"docker-archive://" + filename, digest.FromBytes(manifest)},
+			{"docker-archive://" + filename + ":app:latest", digest.FromBytes(manifest)},
+		} {
+			sref, err := c.parseSource(tc.source)
+			require.NoError(t, err)
+			dgst, err := archiveDigest(sref)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, dgst, tc.source)
+		}
+	}
+
+	empty := filepath.Join(root, "empty.tar")
+	require.NoError(t, os.WriteFile(empty, make([]byte, 1024), 0o600))
+	sref, err := c.parseSource("oci-archive://" + empty)
+	require.NoError(t, err)
+	_, err = archiveDigest(sref)
+	require.ErrorContains(t, err, "index.json not found in archive")
+}
+
 func TestDstCtxForcesDecompression(t *testing.T) {
 	c := &Client{opts: Options{CacheDir: filepath.Join("cache", "root")}}
 
@@ -9,5 +9,5 @@ import (
 )
 
 func (c *Client) copyCachedImage(policyContext *signature.PolicyContext, dstRef, srcRef types.ImageReference, opts *copy.Options) ([]byte, error) {
-	return copy.Image(c.ctx, policyContext, dstRef, srcRef, opts)
+	return c.copyImage(policyContext, dstRef, srcRef, opts)
 }
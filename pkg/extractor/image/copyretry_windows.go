@@ -29,7 +29,7 @@ func (c *Client) copyCachedImage(policyContext *signature.PolicyContext, dstRef,
 	var attempt int
 	return backoff.Retry(c.ctx, func() ([]byte, error) {
 		attempt++
-		manblob, err := copy.Image(c.ctx, policyContext, dstRef, srcRef, opts)
+		manblob, err := c.copyImage(policyContext, dstRef, srcRef, opts)
 		if err == nil || isRetryableCopyImageError(err) {
 			return manblob, err
 		}
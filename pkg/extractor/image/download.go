@@ -0,0 +1,200 @@
+package image
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/crazy-max/undock/pkg/registry"
+	units "github.com/docker/go-units"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"go.podman.io/image/v5/docker/reference"
+	"go.podman.io/image/v5/pkg/docker/config"
+	"go.podman.io/image/v5/pkg/sysregistriesv2"
+	"go.podman.io/image/v5/types"
+)
+
+// rangedReference is a registry image reference whose layer blobs larger
+// than the chunk size are downloaded in the cache, with concurrent range
+// requests if there are several connections, once copy.Image needs them.
+// Interrupted downloads are resumed. Blobs are read from the source instead
+// if their download fails.
+type rangedReference struct {
+	types.ImageReference
+	c       *Client
+	sources []registrySource
+}
+
+func (r rangedReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	src, err := r.ImageReference.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return rangedSource{ImageSource: src, c: r.c, sources: r.sources}, nil
+}
+
+type rangedSource struct {
+	types.ImageSource
+	c       *Client
+	sources []registrySource
+}
+
+func (s rangedSource) GetBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache) (io.ReadCloser, int64, error) {
+	chunkSize := s.c.opts.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = registry.DefaultChunkSize
+	}
+	if info.Size > chunkSize && info.Digest.Validate() == nil {
+		rc, err := s.c.downloadBlob(ctx, s.sources, info.Digest, info.Size)
+		if err == nil {
+			return rc, info.Size, nil
+		} else if ctx.Err() != nil {
+			return nil, 0, err
+		}
+		s.c.logger.Warn().Err(err).Msgf("Cannot download blob %s with range requests, pulling it from the source", info.Digest)
+	}
+	return s.ImageSource.GetBlob(ctx, info, cache)
+}
+
+// rangedReference returns the reference of a docker source whose large
+// layer blobs are downloaded with resumable range requests, or the
+// reference itself if the registry sources cannot be loaded
+func (c *Client) rangedReference(sref *sourceRef) types.ImageReference {
+	sources, err := c.registrySources(sref)
+	if err != nil {
+		c.logger.Warn().Err(err).Msg("Cannot download blobs with range requests")
+		return sref.ref
+	}
+	return rangedReference{ImageReference: sref.ref, c: c, sources: sources}
+}
+
+// downloadBlob downloads a blob from the first registry source serving it
+// in the downloads folder of the cache, and returns its content, removed
+// once closed
+func (c *Client) downloadBlob(ctx context.Context, sources []registrySource, dgst digest.Digest, size int64) (io.ReadCloser, error) {
+	filename := filepath.Join(c.opts.CacheDir, "downloads", dgst.Algorithm().String(), dgst.Encoded())
+	if err := os.MkdirAll(filepath.Dir(filename), 0o700); err != nil {
+		return nil, err
+	}
+	if n := registry.DownloadedSize(filename, dgst, size); n > 0 {
+		c.logger.Info().Msgf("Resuming download of blob %s at %s of %s", dgst, units.HumanSize(float64(n)), units.HumanSize(float64(size)))
+	} else if c.opts.Connections > 1 {
+		c.logger.Info().Msgf("Downloading blob %s with %d connections", dgst, c.opts.Connections)
+	} else {
+		c.logger.Info().Msgf("Downloading blob %s", dgst)
+	}
+
+	var err error
+	for _, src := range sources {
+		_, err = retry(c, "blob download", func() (struct{}, error) {
+			return struct{}{}, src.client.DownloadBlob(ctx, src.repo, dgst, size, filename)
+		})
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+		c.logger.Warn().Err(err).Msgf("Cannot download blob %s from %s", dgst, src.name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	return removeOnClose{f}, nil
+}
+
+// removeOnClose is a downloaded blob removed once copied to the cache
+type removeOnClose struct {
+	*os.File
+}
+
+func (f removeOnClose) Close() error {
+	err := f.File.Close()
+	if rerr := os.Remove(f.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// registrySource is a registry, or a mirror of it, to pull blobs from
+type registrySource struct {
+	name   string
+	client *registry.Client
+	repo   string
+}
+
+// registrySources returns the mirrors of the registry of a docker source set
+// in registries.conf, in the order they are tried, and the registry itself
+func (c *Client) registrySources(sref *sourceRef) ([]registrySource, error) {
+	named := sref.dockerRef.DockerReference()
+	reg, err := sysregistriesv2.FindRegistry(sref.sysCtx, named.Name())
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot load registries configuration")
+	}
+	pullSources := []sysregistriesv2.PullSource{{Reference: named}}
+	if reg != nil {
+		if reg.Blocked {
+			return nil, errors.Errorf("registry %s is blocked in registries configuration", reference.Domain(named))
+		}
+		if pullSources, err = reg.PullSourcesFromReference(named); err != nil {
+			return nil, err
+		}
+	}
+
+	// clients are set up from the source context like the docker transport
+	sysCtx := sref.sysCtx
+	opts := registry.Options{
+		UserAgent:      sysCtx.DockerRegistryUserAgent,
+		ChunkSize:      c.opts.ChunkSize,
+		Connections:    c.opts.Connections,
+		RequestTimeout: c.opts.RequestTimeout,
+		RateLimiter:    c.limiter,
+		Proxy:          registryProxy(sysCtx),
+	}
+	sources := make([]registrySource, 0, len(pullSources))
+	for _, ps := range pullSources {
+		domain := reference.Domain(ps.Reference)
+		auth, err := config.GetCredentialsForRef(sysCtx, ps.Reference)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot retrieve credentials of %s", domain)
+		}
+		opts.Credentials = registry.Credentials{
+			Username:      auth.Username,
+			Password:      auth.Password,
+			Token:         sysCtx.DockerBearerRegistryToken,
+			IdentityToken: auth.IdentityToken,
+		}
+		// registries set as insecure in registries.conf are honored unless
+		// the source context tells otherwise
+		opts.Insecure = ps.Endpoint.Insecure
+		if sysCtx.DockerInsecureSkipTLSVerify != types.OptionalBoolUndefined {
+			opts.Insecure = sysCtx.DockerInsecureSkipTLSVerify == types.OptionalBoolTrue
+		}
+		if opts.TLSConfig, err = registryTLSConfig(sysCtx, domain, opts.Insecure); err != nil {
+			return nil, err
+		}
+		opts.OnQuota = func(quota registry.Quota) {
+			c.logger.Debug().Msgf("Quota of %s: %s", domain, quota)
+		}
+		sources = append(sources, registrySource{
+			name:   domain,
+			client: registry.New(domain, opts),
+			repo:   reference.Path(ps.Reference),
+		})
+	}
+	return sources, nil
+}
+
+// manifestRef returns the digest of a docker reference, or its tag which
+// defaults to latest
+func manifestRef(named reference.Named) string {
+	if canonical, ok := named.(reference.Canonical); ok {
+		return canonical.Digest().String()
+	} else if tagged, ok := named.(reference.Tagged); ok {
+		return tagged.Tag()
+	}
+	return "latest"
+}
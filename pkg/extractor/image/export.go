@@ -0,0 +1,138 @@
+package image
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"go.podman.io/image/v5/types"
+)
+
+const exportManifest = "manifest.json"
+
+// layersManifest describes the layers exported in a folder, in the order
+// they are applied
+type layersManifest struct {
+	Source   string            `json:"source"`
+	Platform ocispecs.Platform `json:"platform"`
+	Config   digest.Digest     `json:"config"`
+	Layers   []exportedLayer   `json:"layers"`
+}
+
+type exportedLayer struct {
+	File      string            `json:"file"`
+	MediaType string            `json:"mediaType"`
+	Digest    digest.Digest     `json:"digest"`
+	Size      int64             `json:"size"`
+	DiffID    digest.Digest     `json:"diffID,omitempty"`
+	History   *ocispecs.History `json:"history,omitempty"`
+}
+
+// exportLayers copies the layer blobs of each platform to
+// Dist folder along with a manifest.json. Layers of a manifest list are
+// exported in their own folder.
+func (c *Client) exportLayers(mans []manifestEntry, blobs blobStore) error {
+	for _, me := range mans {
+		dest := c.opts.Dist
+		if len(mans) > 1 {
+			dest = path.Join(c.opts.Dist, platformDir(me.platform))
+		}
+		if err := c.exportPlatformLayers(dest, me, blobs); err != nil {
+			return errors.Wrapf(err, "cannot export layers for platform %s", platformDir(me.platform))
+		}
+	}
+	return nil
+}
+
+func (c *Client) exportPlatformLayers(dest string, me manifestEntry, blobs blobStore) error {
+	img, err := c.imageConfig(me, blobs)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dest, 0o755); err != nil {
+		return err
+	}
+
+	// history entries of empty layers do not match a layer
+	var history []ocispecs.History
+	for _, h := range img.History {
+		if !h.EmptyLayer {
+			history = append(history, h)
+		}
+	}
+
+	lm := layersManifest{
+		Source:   c.opts.Source,
+		Platform: me.platform,
+		Config:   me.manifest.Config.Digest,
+	}
+	for i, layer := range me.manifest.LayerInfos() {
+		l := c.layer(c.ctx, blobs, me.platform, layer)
+		file := layer.Digest.Algorithm().String() + "-" + layer.Digest.Hex() + layerExtension(layer.MediaType)
+		l.Logger.Info().Msgf("Exporting blob to %s", file)
+		if err := c.copyBlob(blobs, layer.BlobInfo, filepath.Join(dest, file)); err != nil {
+			return errors.Wrapf(err, "cannot export blob %s", layer.Digest)
+		}
+		el := exportedLayer{
+			File:      file,
+			MediaType: layer.MediaType,
+			Digest:    layer.Digest,
+			Size:      layer.Size,
+		}
+		if i < len(img.RootFS.DiffIDs) {
+			el.DiffID = img.RootFS.DiffIDs[i]
+		}
+		if i < len(history) {
+			el.History = &history[i]
+		}
+		lm.Layers = append(lm.Layers, el)
+	}
+
+	dt, err := json.MarshalIndent(lm, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dest, exportManifest), dt, 0o644)
+}
+
+// layerExtension returns the file extension of a layer media type
+func layerExtension(mediaType string) string {
+	switch {
+	case strings.HasSuffix(mediaType, "+gzip"), strings.HasSuffix(mediaType, ".tar.gzip"):
+		return ".tar.gz"
+	case strings.HasSuffix(mediaType, "+zstd"):
+		return ".tar.zst"
+	case strings.HasSuffix(mediaType, ".tar"):
+		return ".tar"
+	default:
+		return ""
+	}
+}
+
+func (c *Client) copyBlob(blobs blobStore, info types.BlobInfo, dst string) (err error) {
+	in, err := blobs.open(c.ctx, info)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := in.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,21 @@
+package image
+
+import (
+	"testing"
+
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLayerExtension(t *testing.T) {
+	for mediaType, ext := range map[string]string{
+		ocispecs.MediaTypeImageLayer:                                ".tar",
+		ocispecs.MediaTypeImageLayerGzip:                            ".tar.gz",
+		ocispecs.MediaTypeImageLayerZstd:                            ".tar.zst",
+		"application/vnd.docker.image.rootfs.diff.tar.gzip":         ".tar.gz",
+		"application/vnd.oci.image.layer.nondistributable.v1.tar":   ".tar",
+		"application/vnd.cncf.helm.chart.content.v1.unknown+format": "",
+	} {
+		assert.Equal(t, ext, layerExtension(mediaType), mediaType)
+	}
+}
@@ -0,0 +1,107 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// platformGroup bounds the number of platforms extracted at once. The first
+// failure cancels the extraction of the other platforms, and the errors of
+// all the platforms that failed are returned by Wait.
+type platformGroup struct {
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	slots  chan struct{}
+
+	mu   sync.Mutex
+	errs platformErrors
+}
+
+func (c *Client) newPlatformGroup() *platformGroup {
+	limit := c.opts.MaxConcurrency
+	if limit <= 0 {
+		limit = runtime.NumCPU()
+	}
+	ctx, cancel := context.WithCancelCause(c.ctx)
+	return &platformGroup{
+		ctx:    ctx,
+		cancel: cancel,
+		slots:  make(chan struct{}, limit),
+	}
+}
+
+// run calls fn for the named platforms once a slot is available. fn is not
+// called if the group is canceled.
+func (g *platformGroup) run(name string, fn func(ctx context.Context) error) error {
+	select {
+	case g.slots <- struct{}{}:
+	case <-g.ctx.Done():
+		return context.Cause(g.ctx)
+	}
+	defer func() { <-g.slots }()
+	if g.ctx.Err() != nil {
+		return context.Cause(g.ctx)
+	}
+
+	err := fn(g.ctx)
+	if err == nil {
+		return nil
+	}
+	// errors of platforms canceled by another failure are not reported
+	if cause := context.Cause(g.ctx); cause != nil && (errors.Is(err, context.Canceled) || errors.Is(err, cause)) {
+		return err
+	}
+	g.mu.Lock()
+	g.errs = append(g.errs, platformError{name: name, err: err})
+	g.mu.Unlock()
+	g.cancel(err)
+	return err
+}
+
+// Wait returns the errors of the platforms that failed, once all calls to
+// run have returned
+func (g *platformGroup) Wait() error {
+	defer g.cancel(nil)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.errs) > 0 {
+		sort.SliceStable(g.errs, func(i, j int) bool {
+			return g.errs[i].name < g.errs[j].name
+		})
+		return g.errs
+	}
+	return context.Cause(g.ctx)
+}
+
+type platformError struct {
+	name string
+	err  error
+}
+
+// platformErrors holds the errors of the platforms that failed to extract
+type platformErrors []platformError
+
+func (e platformErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, pe := range e {
+		msgs = append(msgs, pe.name+": "+pe.err.Error())
+	}
+	if len(e) == 1 {
+		return "cannot extract " + msgs[0]
+	}
+	return fmt.Sprintf("cannot extract %d platforms: %s", len(e), strings.Join(msgs, "; "))
+}
+
+func (e platformErrors) Unwrap() []error {
+	errs := make([]error, 0, len(e))
+	for _, pe := range e {
+		errs = append(errs, pe.err)
+	}
+	return errs
+}
@@ -0,0 +1,80 @@
+package image
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlatformGroupLimitsConcurrency(t *testing.T) {
+	c := &Client{ctx: context.Background(), opts: Options{MaxConcurrency: 2}}
+	g := c.newPlatformGroup()
+
+	var running, peak atomic.Int32
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Go(func() {
+			_ = g.run("linux/amd64", func(ctx context.Context) error {
+				n := running.Add(1)
+				defer running.Add(-1)
+				for {
+					p := peak.Load()
+					if n <= p || peak.CompareAndSwap(p, n) {
+						break
+					}
+				}
+				return nil
+			})
+		})
+	}
+	wg.Wait()
+
+	require.NoError(t, g.Wait())
+	require.LessOrEqual(t, peak.Load(), int32(2))
+}
+
+func TestPlatformGroupCancelsOnFailure(t *testing.T) {
+	c := &Client{ctx: context.Background(), opts: Options{MaxConcurrency: 3}}
+	g := c.newPlatformGroup()
+
+	started := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, name := range []string{"linux/arm64", "linux/arm/v7"} {
+		wg.Go(func() {
+			_ = g.run(name, func(ctx context.Context) error {
+				started <- struct{}{}
+				<-ctx.Done()
+				return errors.Wrap(context.Canceled, "cannot read blob")
+			})
+		})
+	}
+	<-started
+	<-started
+	wg.Go(func() {
+		_ = g.run("linux/amd64", func(ctx context.Context) error {
+			return errors.New("blob unavailable")
+		})
+	})
+	wg.Wait()
+
+	// platforms started once the group is canceled are not run
+	require.Error(t, g.run("linux/386", func(ctx context.Context) error {
+		t.Fatal("platform should not be extracted")
+		return nil
+	}))
+	require.EqualError(t, g.Wait(), "cannot extract linux/amd64: blob unavailable")
+}
+
+func TestPlatformErrors(t *testing.T) {
+	errBlob := errors.New("blob unavailable")
+	err := platformErrors{
+		{name: "linux/amd64", err: errBlob},
+		{name: "linux/arm64", err: errors.New("no space left on device")},
+	}
+	require.EqualError(t, err, "cannot extract 2 platforms: linux/amd64: blob unavailable; linux/arm64: no space left on device")
+	require.ErrorIs(t, err, errBlob)
+}
@@ -3,26 +3,44 @@ package image
 import (
 	"context"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/containerd/platforms"
 	"github.com/crazy-max/undock/pkg/extractor"
+	"github.com/crazy-max/undock/pkg/registry"
+	"github.com/crazy-max/undock/pkg/s3"
 	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"go.podman.io/image/v5/manifest"
-	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 )
 
 // Client represents an active image extractor object
 type Client struct {
 	*extractor.Client
-	ctx    context.Context
-	opts   Options
-	logger zerolog.Logger
+	ctx       context.Context
+	opts      Options
+	logger    zerolog.Logger
+	limiter   *registry.RateLimiter
+	downloads *semaphore.Weighted
+
+	mu              sync.Mutex
+	rateLimitWaited time.Duration
+	rateLimitWaits  int
+	// quotaSource is the docker source whose registry is asked for its
+	// quota once a request is refused by its rate limit
+	quotaSource *sourceRef
+	// registries.conf file and drop-in directory of this run
+	registriesConfPath string
+	registriesConfDir  string
 }
 
 // Options represents image extractor options
@@ -36,19 +54,116 @@ type Options struct {
 	// All extracts all architectures if Source image is a manifest list
 	All bool
 
-	// Dist folder
+	// Dist folder, or archive file if OutputFormat is an archive. Archive is
+	// streamed to stdout if Dist is "-". Merged content is uploaded to an
+	// object store if Dist is an s3://bucket/prefix URL
 	Dist string
+	// OutputFormat of the extracted content
+	OutputFormat extractor.OutputFormat
 	// Wrap merges output in Dist folder for a manifest list
 	Wrap bool
+	// Bundle writes an OCI runtime bundle in Dist folder
+	Bundle bool
+	// ExportLayers copies the layer blobs in Dist folder without unpacking
+	ExportLayers bool
+	// Parallelism is the number of layers decompressed at once
+	Parallelism int
+	// MaxConcurrency is the number of platforms extracted at once. Defaults
+	// to the number of CPUs.
+	MaxConcurrency int
+	// Config overrides the image config if OutputFormat is an OCI image or
+	// Bundle is set
+	Config ConfigOverrides
 
 	// RegistryInsecure allows contacting the registry or docker daemon over
 	// HTTP, or HTTPS with failed TLS verification
 	RegistryInsecure bool
 	// RegistryUserAgent is the User-Agent string to send to the registry
 	RegistryUserAgent string
+	// RegistryUsername and RegistryPassword authenticate with the registry
+	// instead of the credentials of the auth file
+	RegistryUsername string
+	RegistryPassword string
+	// RegistryToken is a bearer token sent to the registry instead of
+	// credentials
+	RegistryToken string
+	// RegistryAuthFile is the containers auth.json or docker config.json
+	// file to read credentials from. Defaults to the files of the
+	// containers and docker tools.
+	RegistryAuthFile string
+	// RegistriesConf is a registries.conf file for the mirrors, short-name
+	// aliases and blocked registries of docker sources. System and user
+	// files are ignored if empty.
+	RegistriesConf string
+	// RegistryMirrors are the mirrors of registries, in the order they are
+	// tried before the registry itself
+	RegistryMirrors map[string][]string
+	// CertDir is a directory with the CA certificates (*.crt) and client
+	// certificates (*.cert and *.key) of registries in host[:port]
+	// subdirectories, or with the ca.pem, cert.pem and key.pem files of the
+	// docker daemon
+	CertDir string
+	// CAFile is a file of CA certificates trusted along with the system ones
+	CAFile string
+	// Proxy is the proxy to contact registries with. Defaults to the proxy
+	// environment variables.
+	Proxy *url.URL
+	// NoProxy is the list of registry hosts contacted without proxy
+	NoProxy []string
+	// ChunkSize is the size of the ranges of a layer blob downloaded at once
+	// from a registry. Defaults to registry.DefaultChunkSize.
+	ChunkSize int64
+	// Connections is the number of concurrent range requests to download a
+	// layer blob larger than ChunkSize. Such blobs are downloaded over a
+	// single request if lower than 2, and their download is resumed if
+	// interrupted either way. Blobs are downloaded by copy.Image if their
+	// download fails.
+	Connections int
+	// Retries is the number of times a manifest or blob request failing with
+	// a transient error, such as a timeout, a reset connection or a server
+	// error, is retried
+	Retries int
+	// RetryDelay is the delay before the first retry, doubled for each of
+	// the next ones. Defaults to DefaultRetryDelay.
+	RetryDelay time.Duration
+	// RequestTimeout is the time to wait for the response to a registry
+	// request, and for the next bytes of a blob download. No timeout if
+	// zero.
+	RequestTimeout time.Duration
+	// LimitRate is the maximum rate of the downloads from registries in
+	// bytes per second, shared by all blobs. No limit if zero.
+	LimitRate int64
+	// MaxParallelDownloads is the number of blobs downloaded at once. No
+	// limit other than the default of the image copy if zero.
+	MaxParallelDownloads int
+	// RateLimitWait is the time to wait in total for the rate limits of
+	// registries to reset, as told by the Retry-After header of their 429
+	// Too Many Requests responses, before failing with a RateLimitError
+	RateLimitWait time.Duration
 
 	// CacheDir is the directory where the cache is stored
 	CacheDir string
+	// NoCache streams the layers of the Source image instead of caching
+	// them. Blobs read several times, e.g. to write an archive, are fetched
+	// in a temporary folder.
+	NoCache bool
+	// Offline extracts docker sources from CacheDir without contacting the
+	// registry. Tags are resolved to the digests recorded when they were
+	// last pulled.
+	Offline bool
+	// ResolveTTL is the time the digest a tag of a docker source was
+	// resolved to is trusted, so the image is extracted from CacheDir
+	// without contacting the registry. Tags are always resolved if zero.
+	ResolveTTL time.Duration
+	// Refresh resolves tags with the registry even if they were resolved
+	// less than ResolveTTL ago
+	Refresh bool
+	// Snapshots keeps unpacked layers in CacheDir and assembles Dist folder
+	// from them
+	Snapshots bool
+	// SnapshotLinks hard links the files of the snapshots in Dist folder if
+	// they cannot be reflinked, instead of copying them
+	SnapshotLinks bool
 }
 
 // New creates new image extractor instance
@@ -77,11 +192,22 @@ func New(ctx context.Context, opts Options) (*extractor.Client, error) {
 		return nil, errors.Wrapf(err, "failed to create cache directory %q", opts.CacheDir)
 	}
 
+	var limiter *registry.RateLimiter
+	if opts.LimitRate > 0 {
+		limiter = registry.NewRateLimiter(opts.LimitRate)
+	}
+	var downloads *semaphore.Weighted
+	if opts.MaxParallelDownloads > 0 {
+		downloads = semaphore.NewWeighted(int64(opts.MaxParallelDownloads))
+	}
+
 	return &extractor.Client{
 		Handler: &Client{
-			ctx:    ctx,
-			opts:   opts,
-			logger: logger,
+			ctx:       ctx,
+			opts:      opts,
+			logger:    logger,
+			limiter:   limiter,
+			downloads: downloads,
 		},
 	}, nil
 }
@@ -94,6 +220,24 @@ func (c *Client) Type() string {
 // Extract extracts a registry image
 func (c *Client) Extract() error {
 	c.logger.Info().Msg("Extracting source")
+	defer c.removeRegistriesConf()
+
+	if err := c.resolveShortName(); err != nil {
+		return err
+	}
+	return c.authError(c.opts.Source, c.extractSource())
+}
+
+func (c *Client) extractSource() error {
+	if c.opts.NoCache {
+		return c.streamSource(c.opts.Source)
+	} else if c.partialPull() && NewSource(c.opts.Source).Scheme() == "docker" && !c.opts.Offline {
+		// images without any layer with a table of contents are pulled in
+		// the cache
+		if err := c.streamSource(c.opts.Source); !errors.Is(err, errNoTOC) {
+			return err
+		}
+	}
 
 	manblob, cachedir, err := c.cacheSource(c.opts.Source)
 	if err != nil {
@@ -102,12 +246,12 @@ func (c *Client) Extract() error {
 	return c.extractCachedSource(manblob, cachedir)
 }
 
-func (c *Client) extractCachedSource(manblob []byte, cachedir string) error {
-	type manifestEntry struct {
-		platform ocispecs.Platform
-		manifest *manifest.OCI1
-	}
+type manifestEntry struct {
+	platform ocispecs.Platform
+	manifest *manifest.OCI1
+}
 
+func (c *Client) extractCachedSource(manblob []byte, cachedir string) error {
 	var mans []manifestEntry
 
 	switch manifest.GuessMIMEType(manblob) {
@@ -141,31 +285,159 @@ func (c *Client) extractCachedSource(manblob []byte, cachedir string) error {
 		}
 	}
 
-	eg, _ := errgroup.WithContext(c.ctx)
+	return c.extract(mans, cacheStore(cachedir))
+}
+
+// extract writes the content of the manifests to Dist
+func (c *Client) extract(mans []manifestEntry, blobs blobStore) error {
+	if s3.IsURL(c.opts.Dist) {
+		return c.writeObjects(mans, blobs)
+	} else if c.opts.ExportLayers {
+		return c.exportLayers(mans, blobs)
+	} else if c.opts.Bundle {
+		return c.writeBundles(mans, blobs)
+	} else if c.opts.OutputFormat.IsArchive() {
+		return c.writeArchive(mans, blobs)
+	} else if c.opts.OutputFormat.IsOCI() {
+		return c.writeOCI(mans, blobs)
+	}
+
+	if c.opts.Snapshots {
+		return c.assembleSnapshots(mans, blobs)
+	} else if !c.opts.Wrap && len(mans) > 1 {
+		return c.extractPlatforms(mans, blobs)
+	}
+
+	if len(mans) == 1 {
+		return c.extractManifest(c.ctx, mans[0], blobs)
+	}
+	var wg sync.WaitGroup
+	g := c.newPlatformGroup()
 	for _, me := range mans {
-		func(me manifestEntry) {
-			eg.Go(func() error {
-				dest := c.opts.Dist
-				if !c.opts.Wrap && len(mans) > 1 {
-					dest = path.Join(c.opts.Dist, fmt.Sprintf("%s_%s%s", me.platform.OS, me.platform.Architecture, me.platform.Variant))
-				}
-				for _, layer := range me.manifest.LayerInfos() {
-					sublogger := c.logger.With().
-						Str("platform", platforms.Format(me.platform)).
-						Str("media-type", layer.MediaType).
-						Str("blob", layer.Digest.String()).Logger()
-					if err := extractor.ExtractBlob(path.Join(cachedir, "blobs", layer.Digest.Algorithm().String(), layer.Digest.Hex()), dest, extractor.ExtractBlobOpts{
-						Context:  c.ctx,
-						Logger:   sublogger,
-						Includes: c.opts.Includes,
-					}); err != nil {
-						return err
-					}
-				}
-				return nil
+		wg.Go(func() {
+			_ = g.run(platforms.Format(me.platform), func(ctx context.Context) error {
+				return c.extractManifest(ctx, me, blobs)
 			})
-		}(me)
+		})
+	}
+	wg.Wait()
+	return g.Wait()
+}
+
+// extractsFolder returns true if the layers are extracted as is in the Dist
+// folder, which reads each of them once if they are streamed
+func (c *Client) extractsFolder() bool {
+	return !s3.IsURL(c.opts.Dist) && !c.opts.ExportLayers && !c.opts.Bundle &&
+		!c.opts.OutputFormat.IsArchive() && !c.opts.OutputFormat.IsOCI() && !c.opts.Snapshots
+}
+
+// extractManifest extracts the layers of a manifest in Dist folder
+func (c *Client) extractManifest(ctx context.Context, me manifestEntry, blobs blobStore) error {
+	t := platformTarget{
+		dest:     c.opts.Dist,
+		platform: me.platform,
+		layers:   me.manifest.LayerInfos(),
+	}
+	return c.extractLayers(ctx, t, t.dest, len(t.layers), sharedBase{}, blobs)
+}
+
+// writeArchive merges layers of each platform and writes the result as a
+// single archive. Platforms are written sequentially in their own folder
+// unless Wrap is set.
+func (c *Client) writeArchive(mans []manifestEntry, blobs blobStore) (err error) {
+	out, err := c.openOutput()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	w, err := extractor.NewArchiveWriter(c.opts.OutputFormat, out)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := w.Close(); err == nil {
+			err = errors.Wrap(cerr, "cannot close archive")
+		}
+	}()
+
+	return c.mergePlatforms(mans, blobs, w)
+}
+
+// writeObjects merges layers of each platform and uploads the result to
+// the object store URL set in Dist. Platforms are uploaded sequentially
+// under their own prefix unless Wrap is set.
+func (c *Client) writeObjects(mans []manifestEntry, blobs blobStore) error {
+	bucket, prefix, err := s3.ParseURL(c.opts.Dist)
+	if err != nil {
+		return err
+	}
+	client, err := s3.New(s3.OptionsFromEnv())
+	if err != nil {
+		return errors.Wrap(err, "cannot create object store client")
+	}
+	c.logger.Info().Msgf("Uploading to bucket %s", bucket)
+	return c.mergePlatforms(mans, blobs, extractor.NewObjectWriter(c.ctx, client, bucket, prefix, c.logger))
+}
+
+// mergePlatforms merges layers of each platform in w, in their own folder
+// unless Wrap is set
+func (c *Client) mergePlatforms(mans []manifestEntry, blobs blobStore, w extractor.EntryWriter) error {
+	for _, me := range mans {
+		pw := w
+		if !c.opts.Wrap && len(mans) > 1 {
+			pw = extractor.PrefixWriter(w, platformDir(me.platform))
+		}
+		var layers []extractor.Layer
+		for _, layer := range me.manifest.LayerInfos() {
+			layers = append(layers, c.layer(c.ctx, blobs, me.platform, layer))
+		}
+		if err := extractor.MergeLayers(layers, pw, extractor.MergeOpts{
+			Context:     c.ctx,
+			Includes:    c.opts.Includes,
+			Parallelism: c.opts.Parallelism,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) openOutput() (io.WriteCloser, error) {
+	if c.opts.Dist == "-" {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+	f, err := os.Create(c.opts.Dist)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot create output file %q", c.opts.Dist)
+	}
+	return f, nil
+}
+
+func (c *Client) layer(ctx context.Context, blobs blobStore, platform ocispecs.Platform, layer manifest.LayerInfo) extractor.Layer {
+	return extractor.Layer{
+		Open: func() (io.ReadCloser, error) {
+			return blobs.open(ctx, layer.BlobInfo)
+		},
+		Logger: c.logger.With().
+			Str("platform", platforms.Format(platform)).
+			Str("media-type", layer.MediaType).
+			Str("blob", layer.Digest.String()).Logger(),
 	}
+}
+
+func platformDir(platform ocispecs.Platform) string {
+	return fmt.Sprintf("%s_%s%s", platform.OS, platform.Architecture, platform.Variant)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
 
-	return eg.Wait()
+func (nopWriteCloser) Close() error {
+	return nil
 }
@@ -11,12 +11,15 @@ import (
 	"testing"
 
 	"github.com/containerd/platforms"
+	"github.com/crazy-max/undock/pkg/extractor"
 	digest "github.com/opencontainers/go-digest"
 	specs "github.com/opencontainers/image-spec/specs-go"
 	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.podman.io/image/v5/manifest"
+	"go.podman.io/image/v5/types"
 )
 
 func TestNewDefaultsCacheDir(t *testing.T) {
@@ -102,6 +105,104 @@ func TestExtractCachedSourceSplitsPlatforms(t *testing.T) {
 	requireFileContent(t, filepath.Join(dest, "linux_arm64v8", "arch.txt"), "arm64")
 }
 
+func TestExtractCachedSourceSharesLayers(t *testing.T) {
+	root := t.TempDir()
+	cachedir := filepath.Join(root, "cache")
+	dest := filepath.Join(root, "dist")
+
+	baseLayer := writeLayerBlob(t, cachedir, []layerEntry{
+		{name: "etc/os-release", body: "base"},
+		{name: "etc/arch", body: "none"},
+	})
+	armLayer := writeLayerBlob(t, cachedir, []layerEntry{
+		{name: "etc/.wh.arch"},
+		{name: "etc/arm", body: "arm"},
+	})
+
+	amd64Layer := writeLayerBlob(t, cachedir, []layerEntry{{name: "etc/arch", body: "amd64"}})
+	_, amd64Desc := writeManifestBlobWithDescriptor(t, cachedir, []ocispecs.Descriptor{baseLayer, amd64Layer})
+	amd64Desc.Platform = &ocispecs.Platform{OS: "linux", Architecture: "amd64"}
+
+	v6Layer := writeLayerBlob(t, cachedir, []layerEntry{{name: "etc/variant", body: "v6"}})
+	_, v6Desc := writeManifestBlobWithDescriptor(t, cachedir, []ocispecs.Descriptor{baseLayer, armLayer, v6Layer})
+	v6Desc.Platform = &ocispecs.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}
+
+	v7Layer := writeLayerBlob(t, cachedir, []layerEntry{
+		{name: "etc/variant", body: "v7"},
+		{name: "etc/.wh.arm"},
+	})
+	_, v7Desc := writeManifestBlobWithDescriptor(t, cachedir, []ocispecs.Descriptor{baseLayer, armLayer, v7Layer})
+	v7Desc.Platform = &ocispecs.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+
+	indexBlob := writeIndexBlob(t, []ocispecs.Descriptor{amd64Desc, v6Desc, v7Desc})
+
+	c := &Client{
+		ctx:    context.Background(),
+		opts:   Options{Dist: dest, CacheDir: cachedir},
+		logger: zerolog.New(io.Discard),
+	}
+
+	require.NoError(t, c.extractCachedSource(indexBlob, cachedir))
+
+	requireFileContent(t, filepath.Join(dest, "linux_amd64", "etc", "os-release"), "base")
+	requireFileContent(t, filepath.Join(dest, "linux_amd64", "etc", "arch"), "amd64")
+	require.NoFileExists(t, filepath.Join(dest, "linux_amd64", "etc", "arm"))
+
+	requireFileContent(t, filepath.Join(dest, "linux_armv6", "etc", "os-release"), "base")
+	requireFileContent(t, filepath.Join(dest, "linux_armv6", "etc", "arm"), "arm")
+	requireFileContent(t, filepath.Join(dest, "linux_armv6", "etc", "variant"), "v6")
+	require.NoFileExists(t, filepath.Join(dest, "linux_armv6", "etc", "arch"))
+
+	requireFileContent(t, filepath.Join(dest, "linux_armv7", "etc", "os-release"), "base")
+	requireFileContent(t, filepath.Join(dest, "linux_armv7", "etc", "variant"), "v7")
+	require.NoFileExists(t, filepath.Join(dest, "linux_armv7", "etc", "arch"))
+	require.NoFileExists(t, filepath.Join(dest, "linux_armv7", "etc", "arm"))
+
+	entries, err := os.ReadDir(dest)
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	require.Equal(t, []string{"linux_amd64", "linux_armv6", "linux_armv7"}, names)
+
+	// shared files are not linked between platforms
+	v6fi, err := os.Stat(filepath.Join(dest, "linux_armv6", "etc", "os-release"))
+	require.NoError(t, err)
+	v7fi, err := os.Stat(filepath.Join(dest, "linux_armv7", "etc", "os-release"))
+	require.NoError(t, err)
+	require.False(t, os.SameFile(v6fi, v7fi))
+
+	matches, err := filepath.Glob(filepath.Join(cachedir, "shared-*"))
+	require.NoError(t, err)
+	require.Empty(t, matches)
+}
+
+func TestGroupTargets(t *testing.T) {
+	layers := func(digests ...digest.Digest) []manifest.LayerInfo {
+		var infos []manifest.LayerInfo
+		for _, dgst := range digests {
+			infos = append(infos, manifest.LayerInfo{BlobInfo: types.BlobInfo{Digest: dgst}})
+		}
+		return infos
+	}
+	a, b, c := digest.FromString("a"), digest.FromString("b"), digest.FromString("c")
+	targets := []platformTarget{
+		{dest: "1", layers: layers(a, b)},
+		{dest: "2", layers: layers(a, c, b)},
+		{dest: "3", layers: layers(a, c)},
+		{dest: "4", layers: layers(a)},
+	}
+
+	require.Equal(t, 1, sharedLayers(targets, 0))
+	groups := groupTargets(targets, 1)
+	require.Len(t, groups, 3)
+	require.Equal(t, []platformTarget{targets[0]}, groups[0])
+	require.Equal(t, []platformTarget{targets[1], targets[2]}, groups[1])
+	require.Equal(t, []platformTarget{targets[3]}, groups[2])
+	require.Equal(t, 2, sharedLayers(groups[1], 1))
+}
+
 func TestExtractCachedSourceWrapsPlatforms(t *testing.T) {
 	root := t.TempDir()
 	cachedir := filepath.Join(root, "cache")
@@ -131,6 +232,56 @@ func TestExtractCachedSourceWrapsPlatforms(t *testing.T) {
 	requireFileContent(t, filepath.Join(dest, "arm64.txt"), "arm64")
 }
 
+func TestExtractCachedSourceWritesArchive(t *testing.T) {
+	root := t.TempDir()
+	cachedir := filepath.Join(root, "cache")
+	dest := filepath.Join(root, "dist.tar")
+
+	amd64Layer := writeLayerBlob(t, cachedir, []layerEntry{{name: "arch.txt", body: "amd64"}})
+	_, amd64Desc := writeManifestBlobWithDescriptor(t, cachedir, []ocispecs.Descriptor{amd64Layer})
+	amd64Desc.Platform = &ocispecs.Platform{OS: "linux", Architecture: "amd64"}
+
+	arm64Layer := writeLayerBlob(t, cachedir, []layerEntry{{name: "arch.txt", body: "arm64"}})
+	_, arm64Desc := writeManifestBlobWithDescriptor(t, cachedir, []ocispecs.Descriptor{arm64Layer})
+	arm64Desc.Platform = &ocispecs.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}
+
+	indexBlob := writeIndexBlob(t, []ocispecs.Descriptor{amd64Desc, arm64Desc})
+
+	c := &Client{
+		ctx: context.Background(),
+		opts: Options{
+			Dist:         dest,
+			OutputFormat: extractor.OutputFormatTar,
+		},
+		logger: zerolog.New(io.Discard),
+	}
+
+	require.NoError(t, c.extractCachedSource(indexBlob, cachedir))
+
+	f, err := os.Open(dest)
+	require.NoError(t, err)
+	defer f.Close()
+
+	files := map[string]string{}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		body, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		files[hdr.Name] = string(body)
+	}
+	assert.Equal(t, map[string]string{
+		"linux_amd64/":           "",
+		"linux_amd64/arch.txt":   "amd64",
+		"linux_arm64v8/":         "",
+		"linux_arm64v8/arch.txt": "arm64",
+	}, files)
+}
+
 func TestExtractCachedSourceFailsOnMissingManifestBlob(t *testing.T) {
 	root := t.TempDir()
 	cachedir := filepath.Join(root, "cache")
@@ -170,6 +321,71 @@ func TestExtractCachedSourceFailsOnInvalidManifestBlob(t *testing.T) {
 	require.ErrorContains(t, err, "cannot create OCI manifest instance from blob")
 }
 
+func TestExtractCachedSourceUsesSnapshots(t *testing.T) {
+	root := t.TempDir()
+	cachedir := filepath.Join(root, "cache")
+
+	baseLayer := writeLayerBlob(t, cachedir, []layerEntry{
+		{name: "etc/os-release", body: "base"},
+		{name: "etc/motd", body: "hello"},
+	})
+	appLayer := writeLayerBlob(t, cachedir, []layerEntry{
+		{name: "etc/.wh.motd"},
+		{name: "app/bin", body: "app"},
+	})
+	manblob := writeImageManifestBlob(t, cachedir, []ocispecs.Descriptor{baseLayer, appLayer})
+
+	c := &Client{
+		ctx: context.Background(),
+		opts: Options{
+			Dist:      filepath.Join(root, "dist"),
+			CacheDir:  filepath.Join(root, "undock"),
+			Snapshots: true,
+		},
+		logger: zerolog.New(io.Discard),
+	}
+	require.NoError(t, c.extractCachedSource(manblob, cachedir))
+	requireFileContent(t, filepath.Join(root, "dist", "etc", "os-release"), "base")
+	requireFileContent(t, filepath.Join(root, "dist", "app", "bin"), "app")
+	require.NoFileExists(t, filepath.Join(root, "dist", "etc", "motd"))
+	require.DirExists(t, filepath.Join(root, "undock", "snapshots", "sha256", baseLayer.Digest.Encoded()))
+
+	// layers are assembled from snapshots without reading their blobs
+	for _, layer := range []ocispecs.Descriptor{baseLayer, appLayer} {
+		require.NoError(t, os.Remove(filepath.Join(cachedir, "blobs", "sha256", layer.Digest.Encoded())))
+	}
+	c.opts.Dist = filepath.Join(root, "dist2")
+	c.opts.Includes = []string{"/etc"}
+	require.NoError(t, c.extractCachedSource(manblob, cachedir))
+	requireFileContent(t, filepath.Join(root, "dist2", "etc", "os-release"), "base")
+	require.NoFileExists(t, filepath.Join(root, "dist2", "etc", "motd"))
+	require.NoDirExists(t, filepath.Join(root, "dist2", "app"))
+}
+
+func TestExtractCachedSourceRejectsInvalidSnapshotDiffID(t *testing.T) {
+	root := t.TempDir()
+	cachedir := filepath.Join(root, "cache")
+
+	layer := writeLayerBlob(t, cachedir, []layerEntry{{name: "file.txt", body: "content"}})
+	config, err := json.Marshal(ocispecs.Image{
+		RootFS: ocispecs.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromString("other")}},
+	})
+	require.NoError(t, err)
+	manblob := writeManifestBlobWithConfig(t, cachedir, config, []ocispecs.Descriptor{layer})
+
+	c := &Client{
+		ctx: context.Background(),
+		opts: Options{
+			Dist:      filepath.Join(root, "dist"),
+			CacheDir:  filepath.Join(root, "undock"),
+			Snapshots: true,
+		},
+		logger: zerolog.New(io.Discard),
+	}
+	require.ErrorContains(t, c.extractCachedSource(manblob, cachedir), "diff ID mismatch")
+	require.NoDirExists(t, filepath.Join(root, "undock", "snapshots", "sha256", digest.FromString("other").Encoded()))
+}
+
 type layerEntry struct {
 	name string
 	body string
@@ -203,8 +419,33 @@ func writeManifestBlob(t *testing.T, cachedir string, layers []ocispecs.Descript
 
 func writeManifestBlobWithDescriptor(t *testing.T, cachedir string, layers []ocispecs.Descriptor) ([]byte, ocispecs.Descriptor) {
 	t.Helper()
+	return writeManifestBlobWithConfigDescriptor(t, cachedir, []byte(`{}`), layers)
+}
+
+// writeImageManifestBlob writes a manifest whose config lists the diff IDs
+// of its uncompressed layers
+func writeImageManifestBlob(t *testing.T, cachedir string, layers []ocispecs.Descriptor) []byte {
+	t.Helper()
+
+	img := ocispecs.Image{RootFS: ocispecs.RootFS{Type: "layers"}}
+	for _, layer := range layers {
+		img.RootFS.DiffIDs = append(img.RootFS.DiffIDs, layer.Digest)
+	}
+	config, err := json.Marshal(img)
+	require.NoError(t, err)
+	return writeManifestBlobWithConfig(t, cachedir, config, layers)
+}
+
+func writeManifestBlobWithConfig(t *testing.T, cachedir string, config []byte, layers []ocispecs.Descriptor) []byte {
+	t.Helper()
+	blob, _ := writeManifestBlobWithConfigDescriptor(t, cachedir, config, layers)
+	return blob
+}
+
+func writeManifestBlobWithConfigDescriptor(t *testing.T, cachedir string, config []byte, layers []ocispecs.Descriptor) ([]byte, ocispecs.Descriptor) {
+	t.Helper()
 
-	configDesc := writeOCIObject(t, cachedir, []byte(`{}`), ocispecs.MediaTypeImageConfig)
+	configDesc := writeOCIObject(t, cachedir, config, ocispecs.MediaTypeImageConfig)
 	payload, err := json.Marshal(ocispecs.Manifest{
 		Versioned: specs.Versioned{SchemaVersion: 2},
 		MediaType: ocispecs.MediaTypeImageManifest,
@@ -0,0 +1,53 @@
+package image
+
+import (
+	"context"
+	"io"
+
+	"github.com/crazy-max/undock/pkg/registry"
+	"go.podman.io/image/v5/types"
+)
+
+// limitedReference is an image reference whose blobs are read at the rate
+// of a RateLimiter
+type limitedReference struct {
+	types.ImageReference
+	limiter *registry.RateLimiter
+}
+
+func (r limitedReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	src, err := r.ImageReference.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return limitedSource{ImageSource: src, limiter: r.limiter}, nil
+}
+
+type limitedSource struct {
+	types.ImageSource
+	limiter *registry.RateLimiter
+}
+
+func (s limitedSource) GetBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache) (io.ReadCloser, int64, error) {
+	rc, size, err := s.ImageSource.GetBlob(ctx, info, cache)
+	if err != nil {
+		return nil, 0, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{s.limiter.Reader(ctx, rc), rc}, size, nil
+}
+
+// acquireDownload waits until a blob can be downloaded without exceeding
+// the parallel downloads set in the options, and returns the function to
+// call once the download is done
+func (c *Client) acquireDownload(ctx context.Context) (func(), error) {
+	if c.downloads == nil {
+		return func() {}, nil
+	}
+	if err := c.downloads.Acquire(ctx, 1); err != nil {
+		return nil, err
+	}
+	return func() { c.downloads.Release(1) }, nil
+}
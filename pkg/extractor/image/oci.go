@@ -0,0 +1,282 @@
+package image
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/crazy-max/undock/pkg/extractor"
+	"github.com/mholt/archives"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"go.podman.io/image/v5/oci/archive"
+	"go.podman.io/image/v5/oci/layout"
+	"go.podman.io/image/v5/pkg/blobinfocache/none"
+	"go.podman.io/image/v5/types"
+)
+
+// ConfigOverrides overrides the config of the source image when the
+// extracted content is repacked as an OCI image
+type ConfigOverrides struct {
+	// Entrypoint replaces the entrypoint and resets the command
+	Entrypoint []string
+	// Cmd replaces the command
+	Cmd []string
+	// Env sets environment variables in the KEY=VALUE form
+	Env []string
+	// Labels sets labels
+	Labels map[string]string
+	// WorkingDir replaces the working directory
+	WorkingDir string
+	// User replaces the user
+	User string
+}
+
+// writeOCI merges layers of each platform in a single layer and writes the
+// result as an OCI image layout or oci-archive. A manifest list is written
+// as an index with one manifest for each platform.
+func (c *Client) writeOCI(mans []manifestEntry, blobs blobStore) error {
+	var ref types.ImageReference
+	var err error
+	switch c.opts.OutputFormat {
+	case extractor.OutputFormatOCI:
+		ref, err = layout.NewReference(c.opts.Dist, "")
+	case extractor.OutputFormatOCIArchive:
+		ref, err = archive.NewReference(c.opts.Dist, "")
+	default:
+		err = errors.Errorf("unsupported image format %q", c.opts.OutputFormat)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "cannot create reference for %q", c.opts.Dist)
+	}
+
+	dest, err := ref.NewImageDestination(c.ctx, &types.SystemContext{})
+	if err != nil {
+		return errors.Wrapf(err, "cannot create image destination for %q", c.opts.Dist)
+	}
+	defer dest.Close()
+
+	var manblob []byte
+	var descs []ocispecs.Descriptor
+	for _, me := range mans {
+		blob, err := c.writeOCIManifest(dest, me, blobs)
+		if err != nil {
+			return errors.Wrapf(err, "cannot write image for platform %s", platformDir(me.platform))
+		}
+		if len(mans) == 1 {
+			manblob = blob
+			break
+		}
+		desc := ocispecs.Descriptor{
+			MediaType: ocispecs.MediaTypeImageManifest,
+			Digest:    digest.FromBytes(blob),
+			Size:      int64(len(blob)),
+			Platform:  &me.platform,
+		}
+		if err := dest.PutManifest(c.ctx, blob, &desc.Digest); err != nil {
+			return errors.Wrap(err, "cannot write manifest")
+		}
+		descs = append(descs, desc)
+	}
+	if len(descs) > 0 {
+		if manblob, err = json.Marshal(ocispecs.Index{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispecs.MediaTypeImageIndex,
+			Manifests: descs,
+		}); err != nil {
+			return err
+		}
+	}
+	if err := dest.PutManifest(c.ctx, manblob, nil); err != nil {
+		return errors.Wrap(err, "cannot write manifest")
+	}
+	return dest.Commit(c.ctx, nil)
+}
+
+// writeOCIManifest writes the layer and config of a platform and returns
+// its manifest
+func (c *Client) writeOCIManifest(dest types.ImageDestination, me manifestEntry, blobs blobStore) ([]byte, error) {
+	layer, diffID, err := c.writeOCILayer(dest, me, blobs)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := c.imageConfig(me, blobs)
+	if err != nil {
+		return nil, err
+	}
+	cfgblob, err := json.Marshal(c.ociConfig(img, diffID))
+	if err != nil {
+		return nil, err
+	}
+	config, err := dest.PutBlob(c.ctx, bytes.NewReader(cfgblob), types.BlobInfo{
+		Digest: digest.FromBytes(cfgblob),
+		Size:   int64(len(cfgblob)),
+	}, none.NoCache, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot write image config")
+	}
+
+	return json.Marshal(ocispecs.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispecs.MediaTypeImageManifest,
+		Config: ocispecs.Descriptor{
+			MediaType: ocispecs.MediaTypeImageConfig,
+			Digest:    config.Digest,
+			Size:      config.Size,
+		},
+		Layers: []ocispecs.Descriptor{layer},
+	})
+}
+
+// writeOCILayer merges layers of a platform in a gzip compressed layer and
+// returns its descriptor and diff ID
+func (c *Client) writeOCILayer(dest types.ImageDestination, me manifestEntry, blobs blobStore) (ocispecs.Descriptor, digest.Digest, error) {
+	tmp, err := os.CreateTemp("", "undock-layer-")
+	if err != nil {
+		return ocispecs.Descriptor{}, "", err
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+
+	blobDigester := digest.Canonical.Digester()
+	diffDigester := digest.Canonical.Digester()
+	gz, err := archives.Gz{}.OpenWriter(io.MultiWriter(tmp, blobDigester.Hash()))
+	if err != nil {
+		return ocispecs.Descriptor{}, "", err
+	}
+	w, err := extractor.NewArchiveWriter(extractor.OutputFormatTar, io.MultiWriter(gz, diffDigester.Hash()))
+	if err != nil {
+		return ocispecs.Descriptor{}, "", err
+	}
+	var layers []extractor.Layer
+	for _, layer := range me.manifest.LayerInfos() {
+		layers = append(layers, c.layer(c.ctx, blobs, me.platform, layer))
+	}
+	if err := extractor.MergeLayers(layers, w, extractor.MergeOpts{
+		Context:     c.ctx,
+		Includes:    c.opts.Includes,
+		Parallelism: c.opts.Parallelism,
+	}); err != nil {
+		return ocispecs.Descriptor{}, "", err
+	}
+	if err := w.Close(); err != nil {
+		return ocispecs.Descriptor{}, "", errors.Wrap(err, "cannot close layer")
+	}
+	if err := gz.Close(); err != nil {
+		return ocispecs.Descriptor{}, "", errors.Wrap(err, "cannot close layer")
+	}
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return ocispecs.Descriptor{}, "", err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return ocispecs.Descriptor{}, "", err
+	}
+	blob, err := dest.PutBlob(c.ctx, tmp, types.BlobInfo{
+		Digest: blobDigester.Digest(),
+		Size:   size,
+	}, none.NoCache, false)
+	if err != nil {
+		return ocispecs.Descriptor{}, "", errors.Wrap(err, "cannot write layer")
+	}
+	return ocispecs.Descriptor{
+		MediaType: ocispecs.MediaTypeImageLayerGzip,
+		Digest:    blob.Digest,
+		Size:      blob.Size,
+	}, diffDigester.Digest(), nil
+}
+
+// imageConfig reads the config of the source image for a platform and
+// applies overrides
+func (c *Client) imageConfig(me manifestEntry, blobs blobStore) (ocispecs.Image, error) {
+	var img ocispecs.Image
+	dt, err := readBlob(c.ctx, blobs, me.manifest.ConfigInfo())
+	if err != nil {
+		return img, errors.Wrap(err, "cannot read image config")
+	}
+	if err := json.Unmarshal(dt, &img); err != nil {
+		return img, errors.Wrap(err, "cannot parse image config")
+	}
+	if img.Architecture == "" {
+		img.Platform = me.platform
+	}
+
+	overrides := c.opts.Config
+	if overrides.Entrypoint != nil {
+		img.Config.Entrypoint = overrides.Entrypoint
+		img.Config.Cmd = nil
+	}
+	if overrides.Cmd != nil {
+		img.Config.Cmd = overrides.Cmd
+	}
+	for _, env := range overrides.Env {
+		img.Config.Env = setEnv(img.Config.Env, env)
+	}
+	if len(overrides.Labels) > 0 {
+		labels := make(map[string]string, len(img.Config.Labels)+len(overrides.Labels))
+		for k, v := range img.Config.Labels {
+			labels[k] = v
+		}
+		for k, v := range overrides.Labels {
+			labels[k] = v
+		}
+		img.Config.Labels = labels
+	}
+	if overrides.WorkingDir != "" {
+		img.Config.WorkingDir = overrides.WorkingDir
+	}
+	if overrides.User != "" {
+		img.Config.User = overrides.User
+	}
+	return img, nil
+}
+
+// ociConfig derives the config of the repacked image from the source
+// image config
+func (c *Client) ociConfig(src ocispecs.Image, diffID digest.Digest) ocispecs.Image {
+	return ocispecs.Image{
+		Created:  src.Created,
+		Author:   src.Author,
+		Platform: src.Platform,
+		Config: ocispecs.ImageConfig{
+			User:         src.Config.User,
+			ExposedPorts: src.Config.ExposedPorts,
+			Env:          src.Config.Env,
+			Entrypoint:   src.Config.Entrypoint,
+			Cmd:          src.Config.Cmd,
+			Volumes:      src.Config.Volumes,
+			WorkingDir:   src.Config.WorkingDir,
+			Labels:       src.Config.Labels,
+			StopSignal:   src.Config.StopSignal,
+		},
+		RootFS: ocispecs.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{diffID},
+		},
+		History: []ocispecs.History{{
+			Created:   src.Created,
+			CreatedBy: "undock",
+			Comment:   "repacked from " + c.opts.Source,
+		}},
+	}
+}
+
+// setEnv sets a KEY=VALUE variable in env, replacing any existing value
+func setEnv(env []string, kv string) []string {
+	key, _, _ := strings.Cut(kv, "=")
+	res := make([]string, 0, len(env)+1)
+	for _, e := range env {
+		if k, _, _ := strings.Cut(e, "="); k != key {
+			res = append(res, e)
+		}
+	}
+	return append(res, kv)
+}
@@ -0,0 +1,184 @@
+package image
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/containerd/platforms"
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"go.podman.io/image/v5/docker/reference"
+	"go.podman.io/storage/pkg/lockfile"
+)
+
+// tagEntry is the manifest digest a tag of a docker source was resolved to
+type tagEntry struct {
+	Digest   digest.Digest `json:"digest"`
+	Resolved time.Time     `json:"resolved"`
+}
+
+// tagIndexPath returns the file in the cache folder recording the digests
+// the tags of docker sources were resolved to, so they can be resolved
+// again without the registry
+func (c *Client) tagIndexPath() string {
+	return filepath.Join(c.opts.CacheDir, "tags.json")
+}
+
+func (c *Client) readTagIndex() (map[string]tagEntry, error) {
+	index := map[string]tagEntry{}
+	dt, err := os.ReadFile(c.tagIndexPath())
+	if os.IsNotExist(err) {
+		return index, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "cannot read tag index")
+	}
+	if err := json.Unmarshal(dt, &index); err != nil {
+		return nil, errors.Wrap(err, "cannot parse tag index")
+	}
+	return index, nil
+}
+
+// lookupTag returns the digest a tag was last resolved to
+func (c *Client) lookupTag(named reference.Named) (tagEntry, bool, error) {
+	index, err := c.readTagIndex()
+	if err != nil {
+		return tagEntry{}, false, err
+	}
+	entry, ok := index[named.String()]
+	return entry, ok, nil
+}
+
+// recordTag records the digest a tag was resolved to at the given time. The
+// tag index is locked while it is updated, as other runs may share the cache
+// folder.
+func (c *Client) recordTag(named reference.Named, dgst digest.Digest, resolved time.Time) error {
+	lock, err := lockfile.GetLockFile(c.tagIndexPath() + ".lock")
+	if err != nil {
+		return errors.Wrap(err, "cannot lock tag index")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+
+	index, err := c.readTagIndex()
+	if err != nil {
+		return err
+	}
+	index[named.String()] = tagEntry{Digest: dgst, Resolved: resolved.UTC()}
+	dt, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(writeFileAtomic(c.tagIndexPath(), dt), "cannot write tag index")
+}
+
+// localDigest returns the manifest digest of a docker source if it is known
+// without the registry: the digest of the reference, or the one its tag was
+// resolved to less than ResolveTTL ago, unless Refresh is set. Tags are
+// resolved to the digest they were last resolved to if Offline is set.
+func (c *Client) localDigest(sref *sourceRef) (digest.Digest, bool, error) {
+	named := sref.dockerRef.DockerReference()
+	if canonical, ok := named.(reference.Canonical); ok {
+		return canonical.Digest(), true, nil
+	} else if c.opts.Offline {
+		dgst, err := c.offlineDigest(named)
+		return dgst, err == nil, err
+	} else if c.opts.ResolveTTL <= 0 || c.opts.Refresh {
+		return "", false, nil
+	}
+	entry, ok, err := c.lookupTag(named)
+	if err != nil {
+		c.logger.Warn().Err(err).Msgf("Cannot look up digest of %s", named.String())
+		return "", false, nil
+	} else if !ok {
+		return "", false, nil
+	}
+	// an entry resolved in the future, after a clock change or an edit of
+	// the tag index, is expired
+	age := time.Since(entry.Resolved)
+	if age < 0 || age >= c.opts.ResolveTTL {
+		return "", false, nil
+	}
+	c.logger.Info().Msgf("Resolved %s to %s from the cache, %s ago", named.String(), entry.Digest, age.Round(time.Second))
+	return entry.Digest, true, nil
+}
+
+// offlineDigest returns the digest a tag was last resolved to
+func (c *Client) offlineDigest(named reference.Named) (digest.Digest, error) {
+	entry, ok, err := c.lookupTag(named)
+	if err != nil {
+		return "", err
+	} else if !ok {
+		return "", errors.Errorf("image %s was never pulled, it cannot be resolved offline", named.String())
+	}
+	c.logger.Info().Msgf("Resolved %s to %s from the cache", named.String(), entry.Digest)
+	return entry.Digest, nil
+}
+
+// pinSource returns a docker source pinned to the manifest digest its tag
+// was resolved to, so the image pulled is the one of the digest even if the
+// tag was pushed again since
+func (c *Client) pinSource(sref *sourceRef, dgst digest.Digest) (*sourceRef, error) {
+	named := sref.dockerRef.DockerReference()
+	if _, ok := named.(reference.Canonical); ok {
+		return sref, nil
+	}
+	canonical, err := reference.WithDigest(reference.TrimNamed(named), dgst)
+	if err != nil {
+		return nil, err
+	}
+	return c.parseSource("docker://" + canonical.String())
+}
+
+// cachedManifest returns the manifest copied in the OCI layout of the cache
+// folder for the platform, or the index of all platforms if All is set
+func (c *Client) cachedManifest(cachedir string) ([]byte, error) {
+	var index ocispecs.Index
+	if dt, err := os.ReadFile(filepath.Join(cachedir, "index.json")); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(dt, &index); err != nil {
+		return nil, errors.Wrap(err, "cannot parse OCI index of the cache")
+	}
+	matcher := platforms.Only(c.opts.Platform)
+	// the last copied manifests come last
+	for _, desc := range slices.Backward(index.Manifests) {
+		mblob, err := readCachedBlob(cachedir, desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if c.opts.All {
+			if desc.MediaType == ocispecs.MediaTypeImageIndex {
+				return mblob, nil
+			}
+			continue
+		} else if desc.MediaType != ocispecs.MediaTypeImageManifest {
+			continue
+		}
+		var man ocispecs.Manifest
+		if err := json.Unmarshal(mblob, &man); err != nil {
+			return nil, errors.Wrap(err, "cannot parse cached manifest")
+		}
+		cblob, err := readCachedBlob(cachedir, man.Config.Digest)
+		if err != nil {
+			return nil, err
+		}
+		var config ocispecs.Image
+		if err := json.Unmarshal(cblob, &config); err != nil {
+			return nil, errors.Wrap(err, "cannot parse cached image config")
+		}
+		if matcher.Match(config.Platform) {
+			return mblob, nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+func readCachedBlob(cachedir string, dgst digest.Digest) ([]byte, error) {
+	if err := dgst.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid blob digest %q", dgst)
+	}
+	return os.ReadFile(filepath.Join(cachedir, "blobs", dgst.Algorithm().String(), dgst.Encoded()))
+}
@@ -0,0 +1,52 @@
+package image
+
+import (
+	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+	"go.podman.io/image/v5/docker/reference"
+	"go.podman.io/storage/pkg/lockfile"
+)
+
+func TestRecordTagWaitsForLock(t *testing.T) {
+	c := &Client{opts: Options{CacheDir: t.TempDir()}}
+	named, err := reference.ParseNormalizedNamed("registry.example/app:latest")
+	require.NoError(t, err)
+	dgst := digest.FromString("manifest")
+
+	lock, err := lockfile.GetLockFile(c.tagIndexPath() + ".lock")
+	require.NoError(t, err)
+	lock.Lock()
+	done := make(chan error, 1)
+	go func() {
+		done <- c.recordTag(named, dgst, time.Now())
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("tag recorded while the index is locked: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	lock.Unlock()
+	require.NoError(t, <-done)
+
+	entry, ok, err := c.lookupTag(named)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, dgst, entry.Digest)
+}
+
+func TestRecordTagKeepsResolutionTime(t *testing.T) {
+	c := &Client{opts: Options{CacheDir: t.TempDir()}}
+	named, err := reference.ParseNormalizedNamed("registry.example/app:latest")
+	require.NoError(t, err)
+	resolved := time.Now().Add(-time.Minute)
+
+	// the pull may end long after the tag was resolved
+	require.NoError(t, c.recordTag(named, digest.FromString("manifest"), resolved))
+	entry, ok, err := c.lookupTag(named)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.True(t, resolved.Equal(entry.Resolved))
+}
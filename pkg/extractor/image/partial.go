@@ -0,0 +1,101 @@
+package image
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/crazy-max/undock/pkg/extractor"
+	"github.com/pkg/errors"
+	"go.podman.io/image/v5/types"
+)
+
+// errNoTOC is returned by streamSource for a partial pull if no layer of
+// the source image has a table of contents
+var errNoTOC = errors.New("no layer with a table of contents")
+
+// partialPull returns true if only the included files of the layers with a
+// table of contents are fetched from a registry image
+func (c *Client) partialPull() bool {
+	return len(c.opts.Includes) > 0 && !c.opts.Snapshots && !c.opts.ExportLayers
+}
+
+// partialStore opens the layer blobs of a registry image with a table of
+// contents, eStargz or zstd:chunked, as tarballs of the included files,
+// which are the only ones fetched with range requests. Other blobs are
+// pulled from the source. Blobs are fetched once in a temporary folder.
+type partialStore struct {
+	*spillStore
+	source  sourceStore
+	c       *Client
+	sources []registrySource
+}
+
+// newPartialStore returns a partialStore for the manifests of a registry
+// image. ok is false if no layer has a table of contents.
+func (c *Client) newPartialStore(sref *sourceRef, imgsrc types.ImageSource, mans []manifestEntry) (_ *partialStore, ok bool, err error) {
+	if sref.dockerRef == nil {
+		return nil, false, nil
+	}
+	var found bool
+	for _, me := range mans {
+		for _, layer := range me.manifest.LayerInfos() {
+			if extractor.HasTOC(layer.Annotations) {
+				found = true
+			}
+		}
+	}
+	if !found {
+		return nil, false, nil
+	}
+
+	sources, err := c.registrySources(sref)
+	if err != nil {
+		return nil, false, err
+	}
+	ps := &partialStore{
+		source:  sourceStore{c: c, src: imgsrc},
+		c:       c,
+		sources: sources,
+	}
+	if ps.spillStore, err = newSpillStore("undock-partial-", ps.fetch); err != nil {
+		return nil, false, err
+	}
+	return ps, true, nil
+}
+
+// fetch writes a blob in f, or only the included files of a layer blob
+// with a table of contents in a tarball
+func (s *partialStore) fetch(ctx context.Context, info types.BlobInfo, f *os.File) (err error) {
+	if !extractor.HasTOC(info.Annotations) || info.Size <= 0 {
+		return copyStoreBlob(ctx, s.source, info, f)
+	}
+
+	release, err := s.c.acquireDownload(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	s.c.logger.Info().Msgf("Fetching included files of blob %s", info.Digest)
+	for _, src := range s.sources {
+		ra := src.client.BlobReaderAt(ctx, src.repo, info.Digest, info.Size)
+		if _, err = retry(s.c, "partial fetch", func() (struct{}, error) {
+			if err := f.Truncate(0); err != nil {
+				return struct{}{}, err
+			} else if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return struct{}{}, err
+			}
+			return struct{}{}, extractor.WritePartialLayer(ra, info.Size, info.Annotations, f, extractor.PartialLayerOpts{
+				Context:  ctx,
+				Logger:   s.c.logger.With().Str("blob", info.Digest.String()).Logger(),
+				Includes: s.c.opts.Includes,
+			})
+		}); err == nil {
+			return nil
+		} else if ctx.Err() != nil {
+			break
+		}
+		s.c.logger.Warn().Err(err).Msgf("Cannot fetch included files of blob %s from %s", info.Digest, src.name)
+	}
+	return errors.Wrapf(err, "cannot fetch included files of blob %s", info.Digest)
+}
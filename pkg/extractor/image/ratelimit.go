@@ -0,0 +1,118 @@
+package image
+
+import (
+	"context"
+	"time"
+
+	"github.com/crazy-max/undock/pkg/registry"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/pkg/errors"
+	"go.podman.io/image/v5/docker"
+)
+
+// RateLimitError is returned when a registry keeps answering with 429 Too
+// Many Requests after waiting as long as allowed for its rate limit to
+// reset
+type RateLimitError struct {
+	// RetryAfter is the delay told by the registry before the next
+	// request, zero if unknown
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *RateLimitError) Error() string {
+	if e.RetryAfter > 0 {
+		return "registry rate limit exceeded, retry in " + e.RetryAfter.String() + ": " + e.Err.Error()
+	}
+	return "registry rate limit exceeded: " + e.Err.Error()
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return e.Err
+}
+
+// rateLimited returns true if err is a 429 Too Many Requests response of a
+// registry, along with the delay told by its Retry-After header if known
+func rateLimited(err error) (time.Duration, bool) {
+	var tooManyErr *registry.TooManyRequestsError
+	var codeErr errcode.Error
+	switch {
+	case errors.As(err, &tooManyErr):
+		return tooManyErr.RetryAfter, true
+	case errors.Is(err, docker.ErrTooManyRequests):
+		return 0, true
+	case errors.As(err, &codeErr):
+		return 0, codeErr.Code == errcode.ErrorCodeTooManyRequests
+	}
+	return 0, false
+}
+
+// waitRateLimit waits for the rate limit of a registry to reset, for the
+// delay told by the registry or the retry delay doubled for each wait. A
+// RateLimitError is returned instead if the time to wait in total set in
+// the options would be exceeded.
+func (c *Client) waitRateLimit(retryAfter time.Duration, err error) error {
+	c.mu.Lock()
+	wait := retryAfter
+	if wait <= 0 {
+		wait = c.opts.RetryDelay
+		if wait <= 0 {
+			wait = DefaultRetryDelay
+		}
+		for range c.rateLimitWaits {
+			if wait *= 2; wait >= retryMaxDelay {
+				wait = retryMaxDelay
+				break
+			}
+		}
+	}
+	if c.rateLimitWaited+wait > c.opts.RateLimitWait {
+		c.mu.Unlock()
+		return &RateLimitError{RetryAfter: retryAfter, Err: err}
+	}
+	c.rateLimitWaited += wait
+	c.rateLimitWaits++
+	c.mu.Unlock()
+
+	c.logger.Warn().Err(err).Msgf("Registry rate limit exceeded, waiting %s", wait)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-c.ctx.Done():
+		return context.Cause(c.ctx)
+	}
+}
+
+// logQuota logs the quota of the registry of the source after it refused a
+// request with err. The registry client logs the quota told by its own
+// responses, so the quota is only asked after a request of the image library
+// was refused, with a HEAD request of the manifest which Docker Hub does not
+// count against its rate limit.
+func (c *Client) logQuota(err error) {
+	var tooManyErr *registry.TooManyRequestsError
+	if errors.As(err, &tooManyErr) {
+		return
+	}
+	c.mu.Lock()
+	sref := c.quotaSource
+	c.mu.Unlock()
+	if sref == nil {
+		return
+	}
+	sources, err := c.registrySources(sref)
+	if err != nil {
+		return
+	}
+	// the registry itself comes after its mirrors
+	src := sources[len(sources)-1]
+	ref := manifestRef(sref.dockerRef.DockerReference())
+
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	// the quota told by the response is logged by the registry client
+	if _, err := src.client.Quota(ctx, src.repo, ref); err != nil && !errors.As(err, &tooManyErr) {
+		c.logger.Debug().Err(err).Msgf("Cannot check quota of %s", src.name)
+	}
+}
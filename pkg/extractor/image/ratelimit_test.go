@@ -0,0 +1,45 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/crazy-max/undock/pkg/registry"
+	"github.com/crazy-max/undock/pkg/registry/registrytest"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.podman.io/image/v5/docker"
+)
+
+func TestLogQuotaAsksRegistryOnlyForImageRequests(t *testing.T) {
+	srv := registrytest.NewServer()
+	defer srv.Close()
+	srv.RateLimit = 100
+	srv.AddManifest("undock/app", "application/vnd.oci.image.manifest.v1+json", []byte("{}"), "latest")
+
+	var logs bytes.Buffer
+	c := &Client{
+		ctx:    context.Background(),
+		logger: zerolog.New(&logs).Level(zerolog.DebugLevel),
+		opts: Options{
+			CacheDir:         filepath.Join(t.TempDir(), "cache"),
+			RegistryInsecure: true,
+		},
+	}
+	defer c.removeRegistriesConf()
+	_, err := c.parseSource("docker://" + srv.Host() + "/undock/app:latest")
+	require.NoError(t, err)
+
+	// the registry client logs the quota of its own refused requests
+	c.logQuota(&registry.TooManyRequestsError{})
+	_, heads := srv.ManifestRequests()
+	assert.Equal(t, 0, heads)
+
+	c.logQuota(docker.ErrTooManyRequests)
+	_, heads = srv.ManifestRequests()
+	assert.Equal(t, 1, heads)
+	assert.Contains(t, logs.String(), "Quota of "+srv.Host()+": 100 of 100 requests remaining per 6h0m0s")
+}
@@ -0,0 +1,182 @@
+package image
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/cenkalti/backoff/v5"
+	"github.com/crazy-max/undock/pkg/registry"
+	"github.com/docker/distribution/registry/api/errcode"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"go.podman.io/image/v5/copy"
+	"go.podman.io/image/v5/docker"
+	"go.podman.io/image/v5/signature"
+	"go.podman.io/image/v5/types"
+)
+
+const (
+	// DefaultRetryDelay is the delay before the first retry of a request to
+	// a registry
+	DefaultRetryDelay = time.Second
+
+	retryMaxDelay = 30 * time.Second
+)
+
+// retry calls fn until it succeeds, fails with an error which is not
+// transient, or fails as many times as the retries set in the options. The
+// delay between attempts grows exponentially. Requests refused by the rate
+// limit of a registry are sent again once it resets.
+func retry[T any](c *Client, what string, fn func() (T, error)) (T, error) {
+	for {
+		res, err := retryTransient(c, what, fn)
+		retryAfter, ok := rateLimited(err)
+		if !ok {
+			return res, err
+		}
+		c.logQuota(err)
+		if err := c.waitRateLimit(retryAfter, err); err != nil {
+			return res, err
+		}
+	}
+}
+
+// retryTransient retries fn after transient errors
+func retryTransient[T any](c *Client, what string, fn func() (T, error)) (T, error) {
+	if c.opts.Retries <= 0 {
+		return fn()
+	}
+	delay := c.opts.RetryDelay
+	if delay <= 0 {
+		delay = DefaultRetryDelay
+	}
+	bo := backoff.NewExponentialBackOff()
+	bo.InitialInterval = delay
+	bo.RandomizationFactor = 0.5
+	bo.Multiplier = 2
+	bo.MaxInterval = max(retryMaxDelay, delay)
+	var attempt int
+	res, err := backoff.Retry(c.ctx, func() (T, error) {
+		attempt++
+		res, err := fn()
+		if err != nil && !c.isTransient(err) {
+			return res, backoff.Permanent(err)
+		}
+		return res, err
+	},
+		backoff.WithBackOff(bo),
+		backoff.WithMaxTries(uint(c.opts.Retries)+1),
+		backoff.WithMaxElapsedTime(0),
+		backoff.WithNotify(func(err error, delay time.Duration) {
+			c.logger.Warn().Err(err).Int("attempt", attempt).Int("max-attempts", c.opts.Retries+1).Dur("backoff", delay).Msgf("Retrying %s after transient error", what)
+		}),
+	)
+	var permanent *backoff.PermanentError
+	if errors.As(err, &permanent) {
+		err = permanent.Err
+	}
+	return res, err
+}
+
+// isTransient returns true if err is a failure to contact a registry which
+// may not happen again: a timeout, a reset or refused connection, or a
+// server error
+func (c *Client) isTransient(err error) bool {
+	if c.ctx.Err() != nil {
+		return false
+	}
+	var timeoutErr interface{ Timeout() bool }
+	var statusErr docker.UnexpectedHTTPStatusError
+	var regErr *registry.Error
+	var codeErr errcode.Error
+	switch {
+	case errors.As(err, &timeoutErr) && timeoutErr.Timeout():
+		return true
+	case errors.As(err, &statusErr):
+		return statusErr.StatusCode >= http.StatusInternalServerError
+	case errors.As(err, &regErr):
+		return regErr.StatusCode >= http.StatusInternalServerError
+	case errors.As(err, &codeErr):
+		return codeErr.Code == errcode.ErrorCodeUnavailable
+	}
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+// requestContext returns the context of a single request to a registry,
+// which fails with a registry.TimeoutError after the request timeout set in
+// the options
+func (c *Client) requestContext() (context.Context, context.CancelFunc) {
+	if c.opts.RequestTimeout <= 0 {
+		return context.WithCancel(c.ctx)
+	}
+	return context.WithTimeoutCause(c.ctx, c.opts.RequestTimeout, &registry.TimeoutError{After: c.opts.RequestTimeout})
+}
+
+// newImageSource opens the source image
+func (c *Client) newImageSource(sref *sourceRef) (types.ImageSource, error) {
+	imgsrc, err := retry(c, "opening source", func() (types.ImageSource, error) {
+		return sref.ref.NewImageSource(c.ctx, sref.sysCtx)
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot open source '%s'", sref.String())
+	}
+	return imgsrc, nil
+}
+
+// getManifest returns the manifest of the source image, or of one of its
+// instances if it is a manifest list
+func (c *Client) getManifest(imgsrc types.ImageSource, instance *digest.Digest) ([]byte, string, error) {
+	type result struct {
+		blob []byte
+		mt   string
+	}
+	res, err := retry(c, "manifest request", func() (result, error) {
+		ctx, cancel := c.requestContext()
+		defer cancel()
+		blob, mt, err := imgsrc.GetManifest(ctx, instance)
+		return result{blob: blob, mt: mt}, requestError(ctx, err)
+	})
+	return res.blob, res.mt, err
+}
+
+// getDigest returns the digest of the manifest of a docker source, told by
+// its registry
+func (c *Client) getDigest(sref *sourceRef) (digest.Digest, error) {
+	sources, err := c.registrySources(sref)
+	if err != nil {
+		return "", err
+	}
+	// the registry itself comes after its mirrors
+	src := sources[len(sources)-1]
+	ref := manifestRef(sref.dockerRef.DockerReference())
+	return retry(c, "digest request", func() (digest.Digest, error) {
+		ctx, cancel := c.requestContext()
+		defer cancel()
+		dgst, err := src.client.ManifestDigest(ctx, src.repo, ref)
+		return dgst, requestError(ctx, err)
+	})
+}
+
+// copyImage copies the source image, again after a transient error. Blobs
+// already copied are not copied again.
+func (c *Client) copyImage(policyContext *signature.PolicyContext, dstRef, srcRef types.ImageReference, opts *copy.Options) ([]byte, error) {
+	return retry(c, "image copy", func() ([]byte, error) {
+		return copy.Image(c.ctx, policyContext, dstRef, srcRef, opts)
+	})
+}
+
+// requestError returns the timeout of a request context instead of the
+// error it caused
+func requestError(ctx context.Context, err error) error {
+	var timeoutErr *registry.TimeoutError
+	if err != nil && errors.As(context.Cause(ctx), &timeoutErr) {
+		return timeoutErr
+	}
+	return err
+}
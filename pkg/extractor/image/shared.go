@@ -0,0 +1,207 @@
+package image
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/containerd/platforms"
+	"github.com/crazy-max/undock/pkg/extractor"
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"go.podman.io/image/v5/manifest"
+)
+
+// platformTarget is a platform extracted in its own folder
+type platformTarget struct {
+	dest     string
+	platform ocispecs.Platform
+	layers   []manifest.LayerInfo
+}
+
+// extractPlatforms extracts each platform in its own folder. Leading layers
+// shared by several platforms are scanned and extracted once in a temporary
+// folder, which is copied for each of them before their own layers are
+// applied.
+func (c *Client) extractPlatforms(mans []manifestEntry, blobs blobStore) error {
+	targets := make([]platformTarget, 0, len(mans))
+	for _, me := range mans {
+		targets = append(targets, platformTarget{
+			dest:     path.Join(c.opts.Dist, platformDir(me.platform)),
+			platform: me.platform,
+			layers:   me.manifest.LayerInfos(),
+		})
+	}
+	g := c.newPlatformGroup()
+	c.extractShared(g, targets, blobs, sharedBase{})
+	return g.Wait()
+}
+
+// sharedBase holds the first layers shared by several platforms, extracted
+// in dir and merged in scan
+type sharedBase struct {
+	dir    string
+	layers int
+	scan   *extractor.MergeBase
+}
+
+// extractShared extracts targets whose first layers are already extracted
+// in base. Errors are reported to g.
+func (c *Client) extractShared(g *platformGroup, targets []platformTarget, blobs blobStore, base sharedBase) {
+	if len(targets) == 1 {
+		t := targets[0]
+		_ = g.run(targetNames(targets), func(ctx context.Context) error {
+			if base.dir != "" {
+				c.logger.Debug().Msgf("Copying %d shared layers to %s", base.layers, t.dest)
+				if err := extractor.CloneTree(base.dir, t.dest, c.logger); err != nil {
+					return errors.Wrapf(err, "cannot copy shared layers to %s", t.dest)
+				}
+			}
+			if base.layers == len(t.layers) {
+				return nil
+			}
+			return c.extractLayers(ctx, t, t.dest, len(t.layers), base, blobs)
+		})
+		return
+	}
+
+	if shared := sharedLayers(targets, base.layers); shared > base.layers {
+		var tmpdir string
+		err := g.run(targetNames(targets), func(ctx context.Context) (err error) {
+			// streamed layers are merged as they are extracted
+			var scan *extractor.MergeBase
+			if !streamed(blobs) {
+				scan, err = extractor.ScanLayers(c.layers(ctx, targets[0], shared, blobs), extractor.MergeOpts{
+					Context:     ctx,
+					Includes:    c.opts.Includes,
+					Parallelism: c.opts.Parallelism,
+					Base:        base.scan,
+				})
+				if err != nil {
+					return err
+				}
+			}
+			tmpdir, err = os.MkdirTemp(c.sharedTempDir(), "shared-")
+			if err != nil {
+				return errors.Wrap(err, "cannot create folder for shared layers")
+			}
+			if base.dir != "" {
+				if err := extractor.CloneTree(base.dir, tmpdir, c.logger); err != nil {
+					return errors.Wrap(err, "cannot copy shared layers")
+				}
+			}
+			c.logger.Info().Msgf("Extracting %d layers shared by %d platforms", shared-base.layers, len(targets))
+			if streamed(blobs) {
+				scan, err = extractor.StreamLayers(c.layers(ctx, targets[0], shared, blobs), tmpdir, c.extractLayersOpts(ctx, base))
+			} else {
+				err = c.extractLayers(ctx, targets[0], tmpdir, shared, sharedBase{layers: base.layers, scan: scan}, blobs)
+			}
+			if err != nil {
+				return err
+			}
+			base = sharedBase{dir: tmpdir, layers: shared, scan: scan}
+			return nil
+		})
+		if tmpdir != "" {
+			defer os.RemoveAll(tmpdir)
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	// the shared folder is removed once all the groups are extracted
+	var wg sync.WaitGroup
+	for _, group := range groupTargets(targets, base.layers) {
+		wg.Go(func() {
+			c.extractShared(g, group, blobs, base)
+		})
+	}
+	wg.Wait()
+}
+
+// sharedTempDir returns the folder holding the layers shared by several
+// platforms, in the cache unless it must be left untouched
+func (c *Client) sharedTempDir() string {
+	if c.opts.NoCache {
+		return os.TempDir()
+	}
+	return c.opts.CacheDir
+}
+
+// extractLayers extracts the first n layers of a target in dest, where the
+// first base ones are already extracted and merged in base.scan. Streamed
+// layers are read once.
+func (c *Client) extractLayers(ctx context.Context, t platformTarget, dest string, n int, base sharedBase, blobs blobStore) error {
+	if streamed(blobs) {
+		_, err := extractor.StreamLayers(c.layers(ctx, t, n, blobs), dest, c.extractLayersOpts(ctx, base))
+		return err
+	}
+	return extractor.ExtractLayers(c.layers(ctx, t, n, blobs), dest, c.extractLayersOpts(ctx, base))
+}
+
+// extractLayersOpts returns the options to extract layers on the ones
+// already extracted and merged in base
+func (c *Client) extractLayersOpts(ctx context.Context, base sharedBase) extractor.ExtractLayersOpts {
+	return extractor.ExtractLayersOpts{
+		Context:     ctx,
+		Logger:      c.logger,
+		Includes:    c.opts.Includes,
+		Parallelism: c.opts.Parallelism,
+		Applied:     base.layers,
+		Base:        base.scan,
+	}
+}
+
+// layers returns the first n layers of a target
+func (c *Client) layers(ctx context.Context, t platformTarget, n int, blobs blobStore) []extractor.Layer {
+	layers := make([]extractor.Layer, 0, n)
+	for _, layer := range t.layers[:n] {
+		layers = append(layers, c.layer(ctx, blobs, t.platform, layer))
+	}
+	return layers
+}
+
+// targetNames returns the platforms of targets, to report their errors
+func targetNames(targets []platformTarget) string {
+	names := make([]string, 0, len(targets))
+	for _, t := range targets {
+		names = append(names, platforms.Format(t.platform))
+	}
+	return strings.Join(names, ", ")
+}
+
+// sharedLayers returns the number of leading layers shared by all targets,
+// knowing they share the first from ones
+func sharedLayers(targets []platformTarget, from int) int {
+	for n := from; ; n++ {
+		for _, t := range targets {
+			if n >= len(t.layers) || t.layers[n].Digest != targets[0].layers[n].Digest {
+				return n
+			}
+		}
+	}
+}
+
+// groupTargets groups targets by their layer at index, keeping their order
+func groupTargets(targets []platformTarget, index int) [][]platformTarget {
+	var groups [][]platformTarget
+	groupIndex := map[digest.Digest]int{}
+	for _, t := range targets {
+		if index >= len(t.layers) {
+			groups = append(groups, []platformTarget{t})
+			continue
+		}
+		dgst := t.layers[index].Digest
+		if i, ok := groupIndex[dgst]; ok {
+			groups[i] = append(groups[i], t)
+			continue
+		}
+		groupIndex[dgst] = len(groups)
+		groups = append(groups, []platformTarget{t})
+	}
+	return groups
+}
@@ -0,0 +1,101 @@
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/containerd/platforms"
+	"github.com/crazy-max/undock/pkg/extractor"
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// snapshotsDir is the folder of the cache holding unpacked layers
+const snapshotsDir = "snapshots"
+
+// assembleSnapshots extracts each platform from the snapshots of its layers,
+// unpacking the layers missing in the cache first
+func (c *Client) assembleSnapshots(mans []manifestEntry, blobs blobStore) error {
+	if len(mans) == 1 {
+		return c.assembleSnapshot(c.ctx, mans[0], c.opts.Dist, blobs)
+	}
+	var wg sync.WaitGroup
+	g := c.newPlatformGroup()
+	for _, me := range mans {
+		dest := c.opts.Dist
+		if !c.opts.Wrap {
+			dest = path.Join(c.opts.Dist, platformDir(me.platform))
+		}
+		wg.Go(func() {
+			_ = g.run(platforms.Format(me.platform), func(ctx context.Context) error {
+				return c.assembleSnapshot(ctx, me, dest, blobs)
+			})
+		})
+	}
+	wg.Wait()
+	return g.Wait()
+}
+
+// assembleSnapshot applies the snapshots of the layers of a platform in dest
+func (c *Client) assembleSnapshot(ctx context.Context, me manifestEntry, dest string, blobs blobStore) error {
+	diffIDs, err := c.diffIDs(ctx, me, blobs)
+	if err != nil {
+		return err
+	}
+	for i, layer := range me.manifest.LayerInfos() {
+		dir := filepath.Join(c.opts.CacheDir, snapshotsDir, diffIDs[i].Algorithm().String(), diffIDs[i].Encoded())
+		l := c.layer(ctx, blobs, me.platform, layer)
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			l.Logger.Info().Msgf("Unpacking layer %s to cache", diffIDs[i])
+			if err := extractor.UnpackSnapshot(l, dir, extractor.UnpackSnapshotOpts{
+				Context: ctx,
+				DiffID:  diffIDs[i],
+			}); err != nil {
+				return errors.Wrapf(err, "cannot unpack layer %s", layer.Digest)
+			}
+		} else if err != nil {
+			return err
+		} else {
+			l.Logger.Debug().Msgf("Using cached layer %s", diffIDs[i])
+		}
+		if err := context.Cause(ctx); err != nil {
+			return err
+		}
+		if err := extractor.ApplySnapshot(dir, dest, extractor.ApplySnapshotOpts{
+			Logger:   l.Logger,
+			Includes: c.opts.Includes,
+			Hardlink: c.opts.SnapshotLinks,
+		}); err != nil {
+			return errors.Wrapf(err, "cannot apply layer %s", layer.Digest)
+		}
+	}
+	return nil
+}
+
+// diffIDs returns the digests of the uncompressed layers of a platform from
+// its image config
+func (c *Client) diffIDs(ctx context.Context, me manifestEntry, blobs blobStore) ([]digest.Digest, error) {
+	dt, err := readBlob(ctx, blobs, me.manifest.ConfigInfo())
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read image config")
+	}
+	var img ocispecs.Image
+	if err := json.Unmarshal(dt, &img); err != nil {
+		return nil, errors.Wrap(err, "cannot parse image config")
+	}
+	diffIDs := img.RootFS.DiffIDs
+	if len(diffIDs) != len(me.manifest.LayerInfos()) {
+		return nil, errors.Errorf("image config has %d diff IDs for %d layers", len(diffIDs), len(me.manifest.LayerInfos()))
+	}
+	for _, diffID := range diffIDs {
+		if err := diffID.Validate(); err != nil {
+			return nil, errors.Wrapf(err, "invalid diff ID %s", diffID)
+		}
+	}
+	return diffIDs, nil
+}
@@ -0,0 +1,175 @@
+package image
+
+import (
+	"github.com/containerd/platforms"
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"go.podman.io/image/v5/manifest"
+	"go.podman.io/image/v5/types"
+)
+
+// streamSource extracts the source image without caching it. Layers
+// extracted in a folder are streamed from the source in a single pass.
+// Blobs read several times by other outputs are fetched once in a temporary
+// folder. Blobs are verified as they are fetched. For a partial pull of a registry image, only the included
+// files of the layers with a table of contents are fetched, and errNoTOC is
+// returned if there is none unless NoCache is set.
+func (c *Client) streamSource(src string) (err error) {
+	sref, err := c.parseSource(src)
+	if err != nil {
+		return err
+	}
+
+	imgsrc, err := c.newImageSource(sref)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := imgsrc.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	mans, err := c.sourceManifests(sref, imgsrc)
+	if err != nil {
+		return err
+	}
+	if !c.partialPull() {
+		return c.extractStreamed(mans, imgsrc)
+	}
+
+	ps, ok, err := c.newPartialStore(sref, imgsrc, mans)
+	if err != nil {
+		return err
+	} else if !ok {
+		if !c.opts.NoCache {
+			return errNoTOC
+		}
+		return c.extractStreamed(mans, imgsrc)
+	}
+	defer func() {
+		if cerr := ps.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	return c.extract(mans, ps)
+}
+
+// extractStreamed extracts the manifests of the source image, streaming its
+// layers if they are extracted in a folder
+func (c *Client) extractStreamed(mans []manifestEntry, imgsrc types.ImageSource) error {
+	if c.extractsFolder() {
+		return c.extract(mans, sourceStore{c: c, src: imgsrc})
+	}
+	return c.extractSpilled(mans, imgsrc)
+}
+
+// extractSpilled extracts the manifests of the source image from its blobs
+// fetched once in a temporary folder
+func (c *Client) extractSpilled(mans []manifestEntry, imgsrc types.ImageSource) (err error) {
+	ss, err := c.newSourceSpillStore(imgsrc)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := ss.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	return c.extract(mans, ss)
+}
+
+// sourceManifests returns the manifests of the platforms to extract from the
+// source image
+func (c *Client) sourceManifests(sref *sourceRef, imgsrc types.ImageSource) ([]manifestEntry, error) {
+	manblob, mt, err := c.getManifest(imgsrc, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get manifest")
+	}
+
+	var mans []manifestEntry
+	if !manifest.MIMETypeIsMultiImage(mt) {
+		man, err := sourceManifest(manblob, mt)
+		if err != nil {
+			return nil, err
+		}
+		mans = append(mans, manifestEntry{
+			platform: c.opts.Platform,
+			manifest: man,
+		})
+	} else {
+		list, err := manifest.ListFromBlob(manblob, mt)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot parse manifest list")
+		}
+		var instances []digest.Digest
+		if c.opts.All {
+			instances = list.Instances()
+		} else {
+			instance, err := list.ChooseInstance(sref.sysCtx)
+			if err != nil {
+				return nil, errors.Wrap(err, "cannot choose image for platform")
+			}
+			instances = append(instances, instance)
+		}
+		for _, instance := range instances {
+			update, err := list.Instance(instance)
+			if err != nil {
+				return nil, err
+			}
+			platform := c.opts.Platform
+			if update.ReadOnly.Platform != nil {
+				platform = *update.ReadOnly.Platform
+			} else if c.opts.All {
+				c.logger.Debug().Msgf("Skipping manifest %s without platform", instance)
+				continue
+			}
+			mblob, mmt, err := c.getManifest(imgsrc, &instance)
+			if err != nil {
+				return nil, errors.Wrapf(err, "cannot get manifest for platform %s", platforms.Format(platform))
+			}
+			man, err := sourceManifest(mblob, mmt)
+			if err != nil {
+				return nil, err
+			}
+			mans = append(mans, manifestEntry{
+				platform: platform,
+				manifest: man,
+			})
+		}
+	}
+
+	return mans, nil
+}
+
+// sourceManifest converts an image manifest of any supported type to OCI
+// keeping the media types of its blobs
+func sourceManifest(manblob []byte, mt string) (*manifest.OCI1, error) {
+	man, err := manifest.FromBlob(manblob, manifest.NormalizedMIMEType(mt))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse manifest")
+	}
+	config := man.ConfigInfo()
+	if config.Digest == "" {
+		return nil, errors.Errorf("manifest type %s is not supported", mt)
+	}
+	var layers []ocispecs.Descriptor
+	for _, layer := range man.LayerInfos() {
+		if layer.EmptyLayer {
+			continue
+		}
+		layers = append(layers, descriptor(layer.BlobInfo))
+	}
+	return manifest.OCI1FromComponents(descriptor(config), layers), nil
+}
+
+func descriptor(info types.BlobInfo) ocispecs.Descriptor {
+	return ocispecs.Descriptor{
+		MediaType:   info.MediaType,
+		Digest:      info.Digest,
+		Size:        info.Size,
+		URLs:        info.URLs,
+		Annotations: info.Annotations,
+	}
+}
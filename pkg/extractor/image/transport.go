@@ -0,0 +1,180 @@
+package image
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	mobyclient "github.com/moby/moby/client"
+	"github.com/pkg/errors"
+	"go.podman.io/image/v5/pkg/tlsclientconfig"
+	"go.podman.io/image/v5/types"
+)
+
+// certPool returns the system CA certificates along with the ones of the CA
+// file
+func (c *Client) certPool() (*x509.CertPool, error) {
+	dt, err := os.ReadFile(c.opts.CAFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read CA file")
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read system CA certificates")
+	}
+	if !pool.AppendCertsFromPEM(dt) {
+		return nil, errors.Errorf("no certificate found in %s", c.opts.CAFile)
+	}
+	return pool, nil
+}
+
+// defaultCertDirs are the folders searched for the certificates of a
+// registry host in a host[:port] subfolder if no cert dir is set, like
+// the docker transport does
+var defaultCertDirs = []string{"/etc/containers/certs.d", "/etc/docker/certs.d"}
+
+// registryTLSConfig returns the TLS configuration of the docker transport
+// of a source context to contact a registry host: its base configuration
+// with the certificates of the host, skipping verification if insecure
+func registryTLSConfig(sys *types.SystemContext, host string, insecure bool) (*tls.Config, error) {
+	cfg := &tls.Config{}
+	if sys.BaseTLSConfig != nil {
+		cfg = sys.BaseTLSConfig.Clone()
+	}
+	certDir, err := registryCertDir(sys, host)
+	if err != nil {
+		return nil, err
+	} else if certDir != "" {
+		if err := tlsclientconfig.SetupCertificates(certDir, cfg); err != nil {
+			return nil, errors.Wrapf(err, "cannot load certificates of %s", host)
+		}
+	}
+	cfg.InsecureSkipVerify = insecure //nolint:gosec // explicitly requested with insecure
+	return cfg, nil
+}
+
+// registryCertDir returns the folder of the certificates of a registry
+// host set in a source context, or the first default folder holding it
+func registryCertDir(sys *types.SystemContext, host string) (string, error) {
+	if sys.DockerCertPath != "" {
+		return sys.DockerCertPath, nil
+	} else if sys.DockerPerHostCertDirPath != "" {
+		return filepath.Join(sys.DockerPerHostCertDirPath, host), nil
+	}
+	for _, dir := range defaultCertDirs {
+		hostDir := filepath.Join(dir, host)
+		if _, err := os.Stat(hostDir); err == nil {
+			return hostDir, nil
+		} else if !os.IsNotExist(err) && !os.IsPermission(err) {
+			return "", errors.Wrapf(err, "cannot read certificates of %s", host)
+		}
+	}
+	return "", nil
+}
+
+// registryProxy returns the proxy of the requests of the docker transport
+// of a source context, or nil to use the proxy environment variables
+func registryProxy(sys *types.SystemContext) func(*http.Request) (*url.URL, error) {
+	if sys.DockerProxy != nil {
+		return func(req *http.Request) (*url.URL, error) {
+			return sys.DockerProxy(req.URL)
+		}
+	} else if sys.DockerProxyURL != nil {
+		return http.ProxyURL(sys.DockerProxyURL)
+	}
+	return nil
+}
+
+// daemonTLSOpts returns the options of a docker daemon client for the CA
+// file and the certificates of the cert dir, if the daemon is reached over
+// TCP
+func (c *Client) daemonTLSOpts() ([]mobyclient.Opt, error) {
+	if c.opts.CAFile == "" && c.opts.CertDir == "" {
+		return nil, nil
+	}
+	host := os.Getenv("DOCKER_HOST")
+	if host == "" {
+		return nil, nil
+	}
+	hostURL, err := mobyclient.ParseHostURL(host)
+	if err != nil {
+		return nil, err
+	} else if hostURL.Scheme != "tcp" && hostURL.Scheme != "https" {
+		return nil, nil
+	}
+	var caFile, certFile, keyFile string
+	if c.opts.CertDir != "" {
+		caFile = filepath.Join(c.opts.CertDir, "ca.pem")
+		certFile = filepath.Join(c.opts.CertDir, "cert.pem")
+		keyFile = filepath.Join(c.opts.CertDir, "key.pem")
+	}
+	if c.opts.CAFile != "" {
+		caFile = c.opts.CAFile
+	}
+	return []mobyclient.Opt{mobyclient.WithTLSClientConfig(caFile, certFile, keyFile)}, nil
+}
+
+// proxy returns the proxy of a request URL: the proxy set in the options, or
+// the one of the environment variables, unless the host is in the no-proxy
+// list. It returns nil if neither are set, so the environment variables are
+// used as is.
+func (c *Client) proxy() func(*url.URL) (*url.URL, error) {
+	if c.opts.Proxy == nil && len(c.opts.NoProxy) == 0 {
+		return nil
+	}
+	return func(u *url.URL) (*url.URL, error) {
+		if matchNoProxy(u, c.opts.NoProxy) {
+			return nil, nil
+		} else if c.opts.Proxy != nil {
+			return c.opts.Proxy, nil
+		}
+		return http.ProxyFromEnvironment(&http.Request{URL: u})
+	}
+}
+
+// matchNoProxy returns true if the host of u matches an entry of a no-proxy
+// list: * for all hosts, a domain and its subdomains, a domain starting
+// with a dot for its subdomains only, or an IP address or CIDR. Entries
+// other than CIDR can have a port.
+func matchNoProxy(u *url.URL, noProxy []string) bool {
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	ip := net.ParseIP(host)
+	for _, entry := range noProxy {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "*" {
+			return true
+		} else if _, ipnet, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && ipnet.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			if p != port {
+				continue
+			}
+			entry = h
+		}
+		if entry == "" {
+			continue
+		} else if strings.HasPrefix(entry, ".") {
+			if strings.HasSuffix(host, entry) {
+				return true
+			}
+		} else if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package image
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.podman.io/image/v5/types"
+)
+
+func TestMatchNoProxy(t *testing.T) {
+	noProxy := []string{"internal.example", ".corp.example", "10.0.0.0/8", "registry.local:5000", "::1"}
+	for _, tc := range []struct {
+		url      string
+		expected bool
+	}{
+		{"https://internal.example/v2/", true},
+		{"https://registry.internal.example/v2/", true},
+		{"https://notinternal.example/v2/", false},
+		{"https://corp.example/v2/", false},
+		{"https://registry.corp.example/v2/", true},
+		{"https://10.1.2.3:5000/v2/", true},
+		{"https://11.1.2.3/v2/", false},
+		{"https://registry.local:5000/v2/", true},
+		{"https://registry.local/v2/", false},
+		{"https://[::1]:5000/v2/", true},
+		{"https://docker.io/v2/", false},
+	} {
+		u, err := url.Parse(tc.url)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, matchNoProxy(u, noProxy), tc.url)
+	}
+	u, _ := url.Parse("https://docker.io/v2/")
+	assert.True(t, matchNoProxy(u, []string{"*"}))
+}
+
+func TestRegistryTLSConfigReadsDefaultCertDirs(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "https://")
+
+	root := t.TempDir()
+	defaultCertDirs = []string{filepath.Join(root, "containers"), filepath.Join(root, "docker")}
+	t.Cleanup(func() {
+		defaultCertDirs = []string{"/etc/containers/certs.d", "/etc/docker/certs.d"}
+	})
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "docker", host), 0o700))
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	require.NoError(t, os.WriteFile(filepath.Join(root, "docker", host, "ca.crt"), ca, 0o600))
+
+	sys := &types.SystemContext{}
+	cfg, err := registryTLSConfig(sys, "other.example", false)
+	require.NoError(t, err)
+	_, err = (&http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}).Get(srv.URL)
+	require.Error(t, err)
+
+	cfg, err = registryTLSConfig(sys, host, false)
+	require.NoError(t, err)
+	res, err := (&http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}).Get(srv.URL)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+}
@@ -0,0 +1,110 @@
+package extractor
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"os"
+
+	"github.com/mholt/archives"
+	"github.com/pkg/errors"
+)
+
+// errLayerFormat is returned when a layer blob is not a (compressed) tarball
+var errLayerFormat = errors.New("blob format not recognized")
+
+// layerStream is the decompressed content of a layer blob
+type layerStream struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (l *layerStream) Close() error {
+	var err error
+	for i := len(l.closers) - 1; i >= 0; i-- {
+		if cerr := l.closers[i].Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// open opens the layer blob
+func (l Layer) open() (io.ReadCloser, error) {
+	if l.Open != nil {
+		return l.Open()
+	}
+	return os.Open(l.Filename)
+}
+
+type layerReader struct {
+	*tar.Reader
+	io.Closer
+	stream io.Reader
+}
+
+// drain reads the rest of the layer blob after the end of the tarball, such
+// as its padding, so the error of a streamed blob is returned even if the
+// tarball ends before it
+func (l *layerReader) drain() error {
+	_, err := io.Copy(io.Discard, l.stream)
+	return err
+}
+
+// openLayer opens a layer blob and returns a tar reader over its
+// decompressed content. Closing the reader returns the error of the blob
+// stream, e.g. a digest mismatch.
+func openLayer(ctx context.Context, l Layer) (*layerReader, error) {
+	ls, err := decompressLayer(ctx, l)
+	if err != nil {
+		return nil, err
+	}
+	return &layerReader{Reader: tar.NewReader(ls), Closer: ls, stream: ls}, nil
+}
+
+// decompressLayer opens a layer blob and returns its decompressed tarball
+func decompressLayer(ctx context.Context, l Layer) (*layerStream, error) {
+	dt, err := l.open()
+	if err != nil {
+		return nil, err
+	}
+	lr := &layerStream{closers: []io.Closer{dt}}
+
+	format, input, err := archives.Identify(ctx, l.Filename, dt)
+	if err != nil {
+		_ = lr.Close()
+		return nil, errLayerFormat
+	}
+
+	switch f := format.(type) {
+	case archives.CompressedArchive:
+		if _, ok := f.Extraction.(archives.Tar); !ok {
+			_ = lr.Close()
+			return nil, errors.Errorf("blob format not supported: %s", format.Extension())
+		}
+		rc, err := f.Compression.OpenReader(input)
+		if err != nil {
+			_ = lr.Close()
+			return nil, err
+		}
+		lr.closers = append(lr.closers, rc)
+		input = rc
+	case archives.Tar:
+	case archives.Decompressor:
+		// compressed stream whose content could not be identified, such as
+		// a .gz, assume a tarball
+		rc, err := f.OpenReader(input)
+		if err != nil {
+			_ = lr.Close()
+			return nil, err
+		}
+		lr.closers = append(lr.closers, rc)
+		input = rc
+	default:
+		_ = lr.Close()
+		return nil, errors.Errorf("blob format not supported: %s", format.Extension())
+	}
+
+	lr.Reader = readerContext(ctx, input)
+	return lr, nil
+}
@@ -0,0 +1,737 @@
+package extractor
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// Layer holds a layer blob to merge
+type Layer struct {
+	Filename string
+	// Open opens the blob instead of reading Filename if set. It is called
+	// once for each pass over the blob.
+	Open   func() (io.ReadCloser, error)
+	Logger zerolog.Logger
+}
+
+// MergeOpts holds merge layers options
+type MergeOpts struct {
+	Context  context.Context
+	Includes []string
+	// Parallelism is the number of layers decompressed at once. Layers are
+	// decompressed one after another if lower than 2.
+	Parallelism int
+	// TempDir holds layers decompressed ahead of writing. Defaults to
+	// os.TempDir.
+	TempDir string
+	// Applied is the number of leading layers whose merged content is
+	// already in w, e.g. copied from the output of another image sharing
+	// them. Only the changes of the next layers are written.
+	Applied int
+	// DirMode is the mode of the folders missing from the layers, such as
+	// the parents of included paths. Defaults to 0755.
+	DirMode os.FileMode
+	// Base is the scan of the first layers returned by ScanLayers, with the
+	// same Includes. These layers are not scanned again.
+	Base *MergeBase
+}
+
+// MergeBase is the merged tree of the leading layers shared by several
+// images, scanned once and reused to merge the layers of each of them
+type MergeBase struct {
+	layers int
+	tree   *mergeTree
+}
+
+// ScanLayers scans the headers of layers and returns their merged tree, so
+// images sharing these layers can be merged without scanning them again
+// with MergeOpts.Base. Layers already scanned in opts.Base are skipped.
+func ScanLayers(layers []Layer, opts MergeOpts) (*MergeBase, error) {
+	m, err := scanLayers(layers, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &MergeBase{layers: len(layers), tree: m}, nil
+}
+
+// MergeLayers applies layers in order, resolving whiteouts, and writes the
+// resulting filesystem to w. Layer headers are scanned first so only the
+// entries that survive in the merged filesystem are written. Directories are
+// written first, then other entries in layer order.
+//
+// With Parallelism, headers of several layers are read at once and applied
+// in order, then layers to write are decompressed ahead into temporary
+// tarballs.
+func MergeLayers(layers []Layer, w EntryWriter, opts MergeOpts) error {
+	m, err := scanLayers(layers, opts)
+	if err != nil {
+		return err
+	}
+
+	if ww, ok := w.(WhiteoutWriter); ok {
+		for _, wh := range m.whiteouts {
+			if wh.layer < opts.Applied {
+				continue
+			}
+			if err := ww.Remove(wh.path, wh.opaque); err != nil {
+				return err
+			}
+		}
+	}
+
+	plan := m.plan()
+	for _, n := range plan.dirs {
+		h := n.header()
+		if n.hdr == nil && opts.DirMode != 0 {
+			h.Mode = int64(opts.DirMode.Perm())
+		}
+		if err := w.WriteEntry(h, nil); err != nil {
+			return err
+		}
+	}
+	if err := plan.writeApplied(layers, opts.Applied, w); err != nil {
+		return err
+	}
+	if opts.Parallelism < 2 {
+		for i, layer := range layers {
+			if !plan.layers[i] || i < opts.Applied {
+				continue
+			}
+			if err := plan.write(opts.Context, i, layer, w); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return inOrder(opts.Context, len(layers), opts.Parallelism, func(ctx context.Context, i int) (string, error) {
+		if !plan.layers[i] || i < opts.Applied {
+			return "", nil
+		}
+		return spillLayer(ctx, layers[i], opts.TempDir)
+	}, func(ctx context.Context, i int, filename string) error {
+		if filename == "" {
+			return nil
+		}
+		defer removeSpill(filename)
+		return plan.write(ctx, i, Layer{Filename: filename, Logger: layers[i].Logger}, w)
+	}, removeSpill)
+}
+
+// scanLayers scans the headers of the layers missing from opts.Base and
+// returns their merged tree
+func scanLayers(layers []Layer, opts MergeOpts) (*mergeTree, error) {
+	m := newMergeTree(includePaths(opts.Includes))
+	var from int
+	if opts.Base != nil {
+		if opts.Base.layers > len(layers) {
+			return nil, errors.Errorf("base of %d layers merged with %d layers", opts.Base.layers, len(layers))
+		}
+		m, from = opts.Base.tree.clone(), opts.Base.layers
+	}
+	if opts.Parallelism < 2 {
+		for i := from; i < len(layers); i++ {
+			if err := m.scan(opts.Context, i, layers[i]); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+	if err := inOrder(opts.Context, len(layers)-from, opts.Parallelism, func(ctx context.Context, i int) ([]*tar.Header, error) {
+		var headers []*tar.Header
+		err := readHeaders(ctx, layers[from+i], func(_ int, hdr *tar.Header) error {
+			headers = append(headers, hdr)
+			return nil
+		})
+		return headers, err
+	}, func(_ context.Context, i int, headers []*tar.Header) error {
+		for index, hdr := range headers {
+			if _, err := m.apply(layers[from+i].Logger, entryKey{layer: from + i, index: index}, hdr); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, func([]*tar.Header) {}); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func includePaths(includes []string) []string {
+	var pathsInArchive []string
+	for _, inc := range includes {
+		inc = strings.TrimPrefix(inc, "/")
+		if len(inc) > 0 {
+			pathsInArchive = append(pathsInArchive, inc)
+		}
+	}
+	return pathsInArchive
+}
+
+type entryKey struct {
+	layer int
+	index int
+}
+
+type mergeNode struct {
+	path     string
+	hdr      *tar.Header
+	key      entryKey
+	parent   *mergeNode
+	children map[string]*mergeNode
+	// linkRef is the entry holding the content of a hard link
+	linkRef *mergeNode
+}
+
+func (n *mergeNode) isDir() bool {
+	return n.hdr == nil || n.hdr.Typeflag == tar.TypeDir
+}
+
+// attached returns true if n is part of the tree, neither removed nor
+// replaced since it was merged
+func (n *mergeNode) attached() bool {
+	for ; n.parent != nil; n = n.parent {
+		if n.parent.children[path.Base(n.path)] != n {
+			return false
+		}
+	}
+	return n.path == "."
+}
+
+func (n *mergeNode) header() *tar.Header {
+	if n.hdr == nil {
+		return &tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     n.path,
+			Mode:     0o755,
+			ModTime:  time.Unix(0, 0),
+		}
+	}
+	h := *n.hdr
+	h.Name = n.path
+	return &h
+}
+
+type mergeTree struct {
+	root     *mergeNode
+	includes []string
+	// files holds the last regular file seen at a path, whether it was
+	// included or not, to resolve hard link targets
+	files map[string]*mergeNode
+	// whiteouts holds the whiteouts of included paths in layer order
+	whiteouts []whiteout
+	// onRemove is called with each node removed by a whiteout if set
+	onRemove func(n *mergeNode)
+}
+
+type whiteout struct {
+	path   string
+	opaque bool
+	layer  int
+}
+
+func newMergeTree(includes []string) *mergeTree {
+	return &mergeTree{
+		root:     &mergeNode{path: ".", children: map[string]*mergeNode{}},
+		includes: includes,
+		files:    map[string]*mergeNode{},
+	}
+}
+
+// clone returns a copy of the tree, which can be merged with more layers
+// without changing the original one
+func (m *mergeTree) clone() *mergeTree {
+	copies := map[*mergeNode]*mergeNode{}
+	var copyNode func(n *mergeNode) *mergeNode
+	copyNode = func(n *mergeNode) *mergeNode {
+		if c, ok := copies[n]; ok {
+			return c
+		}
+		c := *n
+		copies[n] = &c
+		if n.children != nil {
+			c.children = make(map[string]*mergeNode, len(n.children))
+			for name, child := range n.children {
+				c.children[name] = copyNode(child)
+			}
+		}
+		if n.linkRef != nil {
+			c.linkRef = copyNode(n.linkRef)
+		}
+		return &c
+	}
+
+	clone := &mergeTree{
+		root:      copyNode(m.root),
+		includes:  m.includes,
+		files:     make(map[string]*mergeNode, len(m.files)),
+		whiteouts: slices.Clone(m.whiteouts),
+	}
+	// files which are not part of the tree, such as the ones not included,
+	// are only referenced as hard link targets
+	for name, n := range m.files {
+		clone.files[name] = copyNode(n)
+	}
+	for _, c := range copies {
+		if p, ok := copies[c.parent]; ok {
+			c.parent = p
+		}
+	}
+	return clone
+}
+
+func (m *mergeTree) scan(ctx context.Context, layer int, l Layer) error {
+	return readHeaders(ctx, l, func(index int, hdr *tar.Header) error {
+		_, err := m.apply(l.Logger, entryKey{layer: layer, index: index}, hdr)
+		return err
+	})
+}
+
+// readHeaders calls fn for each header of a layer. Headers of an eStargz
+// layer stored in a file are read from its table of contents.
+func readHeaders(ctx context.Context, l Layer, fn func(index int, hdr *tar.Header) error) error {
+	l.Logger.Info().Msgf("Scanning blob")
+
+	if l.Open == nil {
+		headers, ok, err := tocHeaders(l.Filename)
+		if err != nil {
+			return err
+		} else if ok {
+			l.Logger.Debug().Msg("Reading headers from eStargz TOC")
+			for index, hdr := range headers {
+				if err := fn(index, hdr); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	tr, err := openLayer(ctx, l)
+	if errors.Is(err, errLayerFormat) {
+		l.Logger.Warn().Msg("Blob format not recognized")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer tr.Close()
+
+	for index := 0; ; index++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return tr.Close()
+		} else if err != nil {
+			return err
+		}
+		if err := fn(index, hdr); err != nil {
+			return err
+		}
+	}
+}
+
+// apply merges an entry of a layer in the tree, and returns the node
+// holding it if it is included
+func (m *mergeTree) apply(logger zerolog.Logger, key entryKey, hdr *tar.Header) (*mergeNode, error) {
+	if hdr.Typeflag == tar.TypeXGlobalHeader {
+		return nil, nil
+	}
+	entryName, err := normalizeArchivePath(hdr.Name)
+	if err != nil {
+		return nil, err
+	}
+	if shouldSkipReservedWhiteoutPath(entryName) {
+		logger.Debug().Msgf("Skipping reserved whiteout metadata %s", hdr.Name)
+		return nil, nil
+	}
+
+	if target, opaque, ok := whiteoutTarget(entryName); ok {
+		if !pathIntersects(m.includes, target) {
+			return nil, nil
+		}
+		parent, err := m.resolveDir(path.Dir(target), key, false)
+		if err != nil {
+			return nil, err
+		}
+		var n *mergeNode
+		// the opaque whiteout of the root folder has an empty target
+		if parent != nil && target != "" {
+			target = path.Join(parent.path, path.Base(target))
+			n = parent.children[path.Base(target)]
+		}
+		m.whiteouts = append(m.whiteouts, whiteout{path: target, opaque: opaque, layer: key.layer})
+		if n == nil {
+			return nil, nil
+		}
+		if opaque {
+			logger.Debug().Msgf("Applying opaque whiteout %s", hdr.Name)
+			m.prune(n, key.layer, false)
+		} else {
+			logger.Debug().Msgf("Applying whiteout %s", hdr.Name)
+			m.prune(n, key.layer, true)
+		}
+		return nil, nil
+	}
+
+	node := &mergeNode{path: entryName, hdr: hdr, key: key}
+	switch hdr.Typeflag {
+	case tar.TypeReg:
+		m.files[entryName] = node
+	case tar.TypeLink:
+		linkName, err := normalizeArchivePath(hdr.Linkname)
+		if err != nil {
+			return nil, err
+		}
+		target, ok := m.files[linkName]
+		if !ok {
+			logger.Warn().Msgf("Skipping hard link %s to unknown target %s", hdr.Name, hdr.Linkname)
+			return nil, nil
+		}
+		node.linkRef = target
+		m.files[entryName] = target
+	}
+
+	if entryName == "." || !fileIsIncluded(m.includes, entryName) {
+		return nil, nil
+	}
+
+	logger.Trace().Msgf("Merging %s", hdr.Name)
+	parent, err := m.resolveDir(path.Dir(entryName), key, true)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot merge %s", hdr.Name)
+	}
+	base := path.Base(entryName)
+	node.path = path.Join(parent.path, base)
+	node.parent = parent
+	if existing, ok := parent.children[base]; ok && existing.isDir() && hdr.Typeflag == tar.TypeDir {
+		existing.hdr = hdr
+		existing.key = key
+		return existing, nil
+	}
+	if hdr.Typeflag == tar.TypeDir {
+		node.children = map[string]*mergeNode{}
+	}
+	parent.children[base] = node
+	return node, nil
+}
+
+// stream merges the entries of a layer in the tree and writes them to w as
+// they are read. Entries of lower layers deleted by its whiteouts are
+// removed from w.
+func (m *mergeTree) stream(ctx context.Context, layer int, l Layer, w WhiteoutWriter) error {
+	l.Logger.Info().Msgf("Extracting blob")
+
+	tr, err := openLayer(ctx, l)
+	if errors.Is(err, errLayerFormat) {
+		l.Logger.Warn().Msg("Blob format not recognized")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer tr.Close()
+
+	var removed []*mergeNode
+	m.onRemove = func(n *mergeNode) {
+		removed = append(removed, n)
+	}
+	defer func() {
+		m.onRemove = nil
+	}()
+
+	for index := 0; ; index++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			if err := tr.drain(); err != nil {
+				return err
+			}
+			return tr.Close()
+		} else if err != nil {
+			return err
+		}
+		removed = removed[:0]
+		n, err := m.apply(l.Logger, entryKey{layer: layer, index: index}, hdr)
+		if err != nil {
+			return err
+		}
+		for _, r := range removed {
+			if err := w.Remove(r.path, false); err != nil {
+				return err
+			}
+		}
+		if n == nil {
+			continue
+		}
+		h, r := entryHeader(n, hdr), io.Reader(tr)
+		if n.linkRef != nil {
+			// hard links are written after their target, unless it is
+			// excluded or removed
+			if !n.linkRef.attached() {
+				l.Logger.Warn().Msgf("Skipping hard link %s to %s, which is not extracted", hdr.Name, hdr.Linkname)
+				continue
+			}
+			h.Linkname, h.Size, r = n.linkRef.path, 0, nil
+		}
+		l.Logger.Debug().Msgf("Writing %s", hdr.Name)
+		if err := w.WriteEntry(h, r); err != nil {
+			return err
+		}
+	}
+}
+
+// maxSymlinks is the number of symlinks followed to resolve a path before
+// giving up on a loop, as Linux does
+const maxSymlinks = 40
+
+// resolveDir returns the directory node at name, following the symlinks of
+// lower layers on the way like the layer would be applied on a filesystem.
+// Missing directories are created as implicit ones if create is set,
+// otherwise nil is returned. Symlinks resolving outside the tree are
+// rejected.
+func (m *mergeTree) resolveDir(name string, key entryKey, create bool) (*mergeNode, error) {
+	links := 0
+	return m.walkDir(m.root, name, key, create, &links)
+}
+
+func (m *mergeTree) walkDir(n *mergeNode, name string, key entryKey, create bool, links *int) (*mergeNode, error) {
+	if name == "." {
+		return n, nil
+	}
+	for _, segment := range strings.Split(name, "/") {
+		child := n.children[segment]
+		switch {
+		case child == nil:
+			if !create {
+				return nil, nil
+			}
+			child = &mergeNode{
+				path:     path.Join(n.path, segment),
+				key:      key,
+				parent:   n,
+				children: map[string]*mergeNode{},
+			}
+			n.children[segment] = child
+		case child.isDir():
+		case child.hdr.Typeflag == tar.TypeSymlink:
+			if *links++; *links > maxSymlinks {
+				return nil, errors.Errorf("too many levels of symbolic links at %s", child.path)
+			}
+			target := child.hdr.Linkname
+			if path.IsAbs(target) {
+				return nil, errors.Errorf("symlink %s to %q resolves outside destination", child.path, child.hdr.Linkname)
+			}
+			target = path.Join(n.path, target)
+			if target == ".." || strings.HasPrefix(target, "../") {
+				return nil, errors.Errorf("symlink %s to %q resolves outside destination", child.path, child.hdr.Linkname)
+			}
+			dir, err := m.walkDir(m.root, target, key, create, links)
+			if err != nil || dir == nil {
+				return nil, err
+			}
+			child = dir
+		case !create:
+			return nil, nil
+		default:
+			return nil, errors.Errorf("%s is not a directory", child.path)
+		}
+		n = child
+	}
+	return n, nil
+}
+
+// prune removes entries from lower layers under n, keeping the ones created
+// by the current layer. Returns false if n itself must be removed.
+func (m *mergeTree) prune(n *mergeNode, layer int, removeSelf bool) bool {
+	for name, child := range n.children {
+		if !m.prune(child, layer, true) {
+			delete(n.children, name)
+		}
+	}
+	if !removeSelf || n.key.layer == layer || len(n.children) > 0 {
+		return true
+	}
+	if n.parent != nil {
+		delete(n.parent.children, path.Base(n.path))
+	}
+	if m.onRemove != nil {
+		m.onRemove(n)
+	}
+	return false
+}
+
+type mergePlan struct {
+	dirs []*mergeNode
+	// entries maps a layer entry to the nodes written from it
+	entries map[entryKey][]*mergeNode
+	// layers marks layers that have entries to write
+	layers map[int]bool
+}
+
+func (m *mergeTree) plan() *mergePlan {
+	p := &mergePlan{
+		entries: map[entryKey][]*mergeNode{},
+		layers:  map[int]bool{},
+	}
+	var walk func(n *mergeNode)
+	walk = func(n *mergeNode) {
+		names := make([]string, 0, len(n.children))
+		for name := range n.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			child := n.children[name]
+			switch {
+			case child.isDir():
+				p.dirs = append(p.dirs, child)
+				walk(child)
+			case child.linkRef != nil:
+				// hard links are written along with the entry holding their
+				// content, so the link target is always written first
+				p.add(child.linkRef.key, child)
+			default:
+				p.add(child.key, child)
+			}
+		}
+	}
+	walk(m.root)
+
+	// keep the link target first if it is part of the merged filesystem
+	for key, nodes := range p.entries {
+		for i, n := range nodes {
+			if n.linkRef == nil && i > 0 {
+				nodes[0], nodes[i] = nodes[i], nodes[0]
+				p.entries[key] = nodes
+				break
+			}
+		}
+	}
+	return p
+}
+
+func (p *mergePlan) add(key entryKey, n *mergeNode) {
+	p.entries[key] = append(p.entries[key], n)
+	p.layers[key.layer] = true
+}
+
+// writeApplied writes the hard links added by the next layers to entries of
+// layers already applied
+func (p *mergePlan) writeApplied(layers []Layer, applied int, w EntryWriter) error {
+	keys := make([]entryKey, 0, len(p.entries))
+	for key := range p.entries {
+		if key.layer < applied {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].layer < keys[j].layer || (keys[i].layer == keys[j].layer && keys[i].index < keys[j].index)
+	})
+	for _, key := range keys {
+		nodes := p.entries[key]
+		for _, n := range nodes[1:] {
+			if n.key.layer < applied {
+				continue
+			}
+			if nodes[0].linkRef != nil {
+				layers[n.key.layer].Logger.Warn().Msgf("Skipping hard link %s to removed target %s", n.path, n.hdr.Linkname)
+				continue
+			}
+			h := n.header()
+			h.Typeflag = tar.TypeLink
+			h.Linkname = nodes[0].path
+			h.Size = 0
+			if err := w.WriteEntry(h, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *mergePlan) write(ctx context.Context, layer int, l Layer, w EntryWriter) error {
+	l.Logger.Info().Msgf("Writing blob")
+
+	tr, err := openLayer(ctx, l)
+	if err != nil {
+		return err
+	}
+	defer tr.Close()
+
+	for index := 0; ; index++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return tr.Close()
+		} else if err != nil {
+			return err
+		}
+		nodes, ok := p.entries[entryKey{layer: layer, index: index}]
+		if !ok {
+			continue
+		}
+		l.Logger.Debug().Msgf("Writing %s", hdr.Name)
+		if err := p.writeEntries(nodes, hdr, tr, w); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *mergePlan) writeEntries(nodes []*mergeNode, src *tar.Header, r io.Reader, w EntryWriter) error {
+	if len(nodes) == 1 {
+		return w.WriteEntry(entryHeader(nodes[0], src), r)
+	}
+	hw, ok := w.(HardlinkWriter)
+	if !ok {
+		return p.writeCopies(nodes, src, r, w)
+	}
+	links := make([]*tar.Header, 0, len(nodes)-1)
+	for _, n := range nodes[1:] {
+		h := n.header()
+		h.Typeflag = tar.TypeLink
+		h.Linkname = nodes[0].path
+		h.Size = 0
+		links = append(links, h)
+	}
+	return hw.WriteHardlinks(entryHeader(nodes[0], src), r, links)
+}
+
+// writeCopies writes the content of src for each node, for writers that
+// cannot represent hard links.
+func (p *mergePlan) writeCopies(nodes []*mergeNode, src *tar.Header, r io.Reader, w EntryWriter) error {
+	tmp, err := os.CreateTemp("", "undock-hardlink-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+	if _, err := io.Copy(tmp, r); err != nil {
+		return err
+	}
+	for _, n := range nodes {
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := w.WriteEntry(entryHeader(n, src), tmp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entryHeader returns the header of src at the path of n. Headers scanned
+// from a table of contents may lack some attributes, so the header of the
+// tarball is always used. Hard links written as regular files get the
+// content of src.
+func entryHeader(n *mergeNode, src *tar.Header) *tar.Header {
+	h := *src
+	h.Name = n.path
+	return &h
+}
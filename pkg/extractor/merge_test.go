@@ -0,0 +1,476 @@
+package extractor
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeLayersResolvesWhiteouts(t *testing.T) {
+	root := t.TempDir()
+
+	layer1 := filepath.Join(root, "layer1.tar")
+	writeTarFile(t, layer1, []tarEntry{
+		{name: "dir/", typeflag: tar.TypeDir},
+		{name: "dir/a.txt", body: "a"},
+		{name: "dir/b.txt", body: "b"},
+		{name: "other/x.txt", body: "x"},
+	})
+
+	layer2 := filepath.Join(root, "layer2.tar")
+	writeTarFile(t, layer2, []tarEntry{
+		{name: "dir/.wh.a.txt"},
+		{name: "other/y.txt", body: "y"},
+		{name: "other/.wh..wh..opq"},
+	})
+
+	w := &memWriter{}
+	require.NoError(t, MergeLayers(testLayers(layer1, layer2), w, MergeOpts{
+		Context: context.Background(),
+	}))
+
+	require.Equal(t, []string{"dir", "other", "dir/b.txt", "other/y.txt"}, w.names())
+	require.Equal(t, "y", w.entries["other/y.txt"].body)
+}
+
+func TestMergeLayersWritesLastVersionOnly(t *testing.T) {
+	root := t.TempDir()
+
+	layer1 := filepath.Join(root, "layer1.tar")
+	writeTarFile(t, layer1, []tarEntry{
+		{name: "file.txt", body: "old"},
+		{name: "dir/sub/file.txt", body: "old"},
+	})
+
+	layer2 := filepath.Join(root, "layer2.tar")
+	writeTarFile(t, layer2, []tarEntry{
+		{name: "file.txt", body: "new"},
+		{name: "dir", typeflag: tar.TypeSymlink, linkname: "elsewhere"},
+	})
+
+	w := &memWriter{}
+	require.NoError(t, MergeLayers(testLayers(layer1, layer2), w, MergeOpts{
+		Context: context.Background(),
+	}))
+
+	require.Equal(t, []string{"file.txt", "dir"}, w.names())
+	require.Equal(t, "new", w.entries["file.txt"].body)
+	require.Equal(t, "elsewhere", w.entries["dir"].hdr.Linkname)
+}
+
+func TestMergeLayersFollowsLowerDirSymlink(t *testing.T) {
+	root := t.TempDir()
+
+	layer1 := filepath.Join(root, "layer1.tar")
+	writeTarFile(t, layer1, []tarEntry{
+		{name: "usr/lib/", typeflag: tar.TypeDir},
+		{name: "usr/lib/a.so", body: "a"},
+		{name: "lib", typeflag: tar.TypeSymlink, linkname: "usr/lib"},
+		{name: "usr/lib64", typeflag: tar.TypeSymlink, linkname: "../lib"},
+	})
+
+	layer2 := filepath.Join(root, "layer2.tar")
+	writeTarFile(t, layer2, []tarEntry{
+		{name: "lib/b.so", body: "b"},
+		{name: "usr/lib64/c.so", body: "c"},
+		{name: "lib/.wh.a.so"},
+	})
+
+	w := &memWriter{}
+	require.NoError(t, MergeLayers(testLayers(layer1, layer2), w, MergeOpts{
+		Context: context.Background(),
+	}))
+
+	require.Equal(t, []string{"usr", "usr/lib", "lib", "usr/lib64", "usr/lib/b.so", "usr/lib/c.so"}, w.names())
+	require.Equal(t, "usr/lib", w.entries["lib"].hdr.Linkname)
+}
+
+func TestMergeLayersReplacesSymlinkWithDir(t *testing.T) {
+	root := t.TempDir()
+
+	layer1 := filepath.Join(root, "layer1.tar")
+	writeTarFile(t, layer1, []tarEntry{
+		{name: "usr/lib/a.so", body: "a"},
+		{name: "lib", typeflag: tar.TypeSymlink, linkname: "usr/lib"},
+	})
+
+	layer2 := filepath.Join(root, "layer2.tar")
+	writeTarFile(t, layer2, []tarEntry{
+		{name: "lib/", typeflag: tar.TypeDir},
+		{name: "lib/b.so", body: "b"},
+	})
+
+	w := &memWriter{}
+	require.NoError(t, MergeLayers(testLayers(layer1, layer2), w, MergeOpts{
+		Context: context.Background(),
+	}))
+
+	require.Equal(t, []string{"lib", "usr", "usr/lib", "usr/lib/a.so", "lib/b.so"}, w.names())
+	require.Equal(t, byte(tar.TypeDir), w.entries["lib"].hdr.Typeflag)
+}
+
+func TestMergeLayersRejectsSymlinkTraversal(t *testing.T) {
+	root := t.TempDir()
+
+	for name, linkname := range map[string]string{
+		"parent":   "..",
+		"absolute": "/etc",
+		"loop":     "pwn",
+	} {
+		t.Run(name, func(t *testing.T) {
+			layer := filepath.Join(root, name+".tar")
+			writeTarFile(t, layer, []tarEntry{
+				{name: "pwn", typeflag: tar.TypeSymlink, linkname: linkname},
+				{name: "pwn/escaped.txt", body: "nope"},
+			})
+
+			err := MergeLayers(testLayers(layer), &memWriter{}, MergeOpts{
+				Context: context.Background(),
+			})
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestMergeLayersSynthesizesIncludedParents(t *testing.T) {
+	root := t.TempDir()
+
+	layer := filepath.Join(root, "layer.tar")
+	writeTarFile(t, layer, []tarEntry{
+		{name: "etc/app/config.yaml", body: "wanted"},
+		{name: "usr/bin/tool", body: "skip"},
+	})
+
+	w := &memWriter{}
+	require.NoError(t, MergeLayers(testLayers(layer), w, MergeOpts{
+		Context:  context.Background(),
+		Includes: []string{"/etc/app"},
+	}))
+
+	require.Equal(t, []string{"etc", "etc/app", "etc/app/config.yaml"}, w.names())
+	require.Equal(t, byte(tar.TypeDir), w.entries["etc"].hdr.Typeflag)
+}
+
+func TestMergeLayersKeepsHardlinkToRemovedTarget(t *testing.T) {
+	root := t.TempDir()
+
+	layer1 := filepath.Join(root, "layer1.tar")
+	writeTarFile(t, layer1, []tarEntry{
+		{name: "bin/a", body: "data"},
+		{name: "bin/b", typeflag: tar.TypeLink, linkname: "bin/a"},
+		{name: "bin/c", typeflag: tar.TypeLink, linkname: "bin/b"},
+	})
+
+	layer2 := filepath.Join(root, "layer2.tar")
+	writeTarFile(t, layer2, []tarEntry{
+		{name: "bin/.wh.a"},
+	})
+
+	w := &memWriter{}
+	require.NoError(t, MergeLayers(testLayers(layer1, layer2), memHardlinkWriter{w}, MergeOpts{
+		Context: context.Background(),
+	}))
+
+	require.Equal(t, []string{"bin", "bin/b", "bin/c"}, w.names())
+	require.Equal(t, byte(tar.TypeReg), w.entries["bin/b"].hdr.Typeflag)
+	require.Equal(t, "data", w.entries["bin/b"].body)
+	require.Equal(t, byte(tar.TypeLink), w.entries["bin/c"].hdr.Typeflag)
+	require.Equal(t, "bin/b", w.entries["bin/c"].hdr.Linkname)
+}
+
+func TestMergeLayersCopiesHardlinksForZip(t *testing.T) {
+	root := t.TempDir()
+
+	layer := filepath.Join(root, "layer.tar")
+	writeTarFile(t, layer, []tarEntry{
+		{name: "a", body: "data"},
+		{name: "b", typeflag: tar.TypeLink, linkname: "a"},
+	})
+
+	var buf bytes.Buffer
+	w, err := NewArchiveWriter(OutputFormatZip, &buf)
+	require.NoError(t, err)
+	require.NoError(t, MergeLayers(testLayers(layer), w, MergeOpts{
+		Context: context.Background(),
+	}))
+	require.NoError(t, w.Close())
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	require.Len(t, zr.File, 2)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		require.NoError(t, err)
+		data, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		require.Equal(t, "data", string(data), f.Name)
+	}
+}
+
+func TestMergeLayersWritesTarGz(t *testing.T) {
+	root := t.TempDir()
+
+	layer := filepath.Join(root, "layer.tar.gz")
+	writeTarGzFile(t, layer, []tarEntry{
+		{name: "usr/bin/tool", body: "binary"},
+	})
+
+	var buf bytes.Buffer
+	w, err := NewArchiveWriter(OutputFormatTar, &buf)
+	require.NoError(t, err)
+	require.NoError(t, MergeLayers(testLayers(layer), PrefixWriter(w, "linux_amd64"), MergeOpts{
+		Context: context.Background(),
+	}))
+	require.NoError(t, w.Close())
+
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+	}
+	require.Equal(t, []string{"linux_amd64/", "linux_amd64/usr/", "linux_amd64/usr/bin/", "linux_amd64/usr/bin/tool"}, names)
+}
+
+func TestMergeLayersWithParallelism(t *testing.T) {
+	root := t.TempDir()
+	tempDir := filepath.Join(root, "tmp")
+	require.NoError(t, os.MkdirAll(tempDir, 0o755))
+
+	layer1 := filepath.Join(root, "layer1.tar.gz")
+	writeTarGzFile(t, layer1, []tarEntry{
+		{name: "dir/", typeflag: tar.TypeDir},
+		{name: "dir/a.txt", body: "a"},
+		{name: "dir/b.txt", body: "b"},
+		{name: "file.txt", body: "old"},
+	})
+	layer2 := filepath.Join(root, "layer2.tar.gz")
+	writeTarGzFile(t, layer2, []tarEntry{
+		{name: "dir/.wh.a.txt"},
+		{name: "file.txt", body: "new"},
+	})
+	// nothing of this layer survives
+	layer3 := filepath.Join(root, "layer3.tar")
+	writeTarFile(t, layer3, []tarEntry{
+		{name: "dir/c.txt", body: "c"},
+	})
+	layer4 := filepath.Join(root, "layer4.tar.gz")
+	writeTarGzFile(t, layer4, []tarEntry{
+		{name: "dir/.wh.c.txt"},
+		{name: "dir/d.txt", body: "d"},
+	})
+
+	w := &memWriter{}
+	require.NoError(t, MergeLayers(testLayers(layer1, layer2, layer3, layer4), w, MergeOpts{
+		Context:     context.Background(),
+		Parallelism: 2,
+		TempDir:     tempDir,
+	}))
+
+	require.Equal(t, []string{"dir", "dir/b.txt", "file.txt", "dir/d.txt"}, w.names())
+	require.Equal(t, "new", w.entries["file.txt"].body)
+
+	entries, err := os.ReadDir(tempDir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestMergeLayersReadsEStargzTOC(t *testing.T) {
+	root := t.TempDir()
+
+	layer1 := filepath.Join(root, "layer1.tar.gz")
+	writeEStargzFile(t, layer1, []tarEntry{
+		{name: "dir/", typeflag: tar.TypeDir},
+		{name: "dir/file.txt", body: "content"},
+		{name: "dir/link", typeflag: tar.TypeLink, linkname: "dir/file.txt"},
+		{name: "dir/symlink", typeflag: tar.TypeSymlink, linkname: "file.txt"},
+		{name: "other.txt", body: "removed"},
+	})
+
+	headers, ok, err := tocHeaders(layer1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	var names []string
+	for _, hdr := range headers {
+		names = append(names, hdr.Name)
+	}
+	require.Contains(t, names, "dir/link")
+
+	layer2 := filepath.Join(root, "layer2.tar")
+	writeTarFile(t, layer2, []tarEntry{
+		{name: ".wh.other.txt"},
+	})
+
+	w := &memWriter{}
+	require.NoError(t, MergeLayers(testLayers(layer1, layer2), w, MergeOpts{
+		Context: context.Background(),
+	}))
+
+	require.Equal(t, []string{"dir", "dir/file.txt", "dir/link", "dir/symlink"}, w.names())
+	require.Equal(t, "content", w.entries["dir/file.txt"].body)
+	require.Equal(t, "content", w.entries["dir/link"].body)
+	require.Equal(t, "file.txt", w.entries["dir/symlink"].hdr.Linkname)
+}
+
+func TestTOCHeadersIgnoresGzipLayer(t *testing.T) {
+	layer := filepath.Join(t.TempDir(), "layer.tar.gz")
+	writeTarGzFile(t, layer, []tarEntry{
+		{name: "file.txt", body: "content"},
+	})
+
+	_, ok, err := tocHeaders(layer)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+// writeEStargzFile writes an eStargz layer: the tarball entries, then the
+// TOC and the footer pointing to it as separate gzip members. The footer is
+// written by hand as estargz.Writer expects the gzip encoder to produce a
+// stored block for an empty member.
+func writeEStargzFile(t *testing.T, filename string, entries []tarEntry) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	writeTarEntries(t, tw, entries)
+	require.NoError(t, tw.Flush())
+	require.NoError(t, gw.Close())
+
+	toc := estargz.JTOC{Version: 1}
+	for _, entry := range entries {
+		e := &estargz.TOCEntry{Name: entry.name, Mode: 0o644, LinkName: entry.linkname}
+		switch entry.typeflag {
+		case tar.TypeDir:
+			e.Type = "dir"
+			e.Mode = 0o755
+		case tar.TypeLink:
+			e.Type = "hardlink"
+		case tar.TypeSymlink:
+			e.Type = "symlink"
+		default:
+			e.Type = "reg"
+			e.Size = int64(len(entry.body))
+		}
+		toc.Entries = append(toc.Entries, e)
+	}
+	appendEStargzTOC(t, &buf, toc)
+
+	require.NoError(t, os.WriteFile(filename, buf.Bytes(), 0o644))
+}
+
+// appendEStargzTOC appends the TOC of an eStargz layer and the footer
+// pointing to it, and returns the digest of the TOC
+func appendEStargzTOC(t *testing.T, buf *bytes.Buffer, toc estargz.JTOC) digest.Digest {
+	t.Helper()
+
+	tocOffset := buf.Len()
+	tocJSON, err := json.Marshal(toc)
+	require.NoError(t, err)
+
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	require.NoError(t, tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     estargz.TOCTarName,
+		Mode:     0o644,
+		Size:     int64(len(tocJSON)),
+	}))
+	_, err = tw.Write(tocJSON)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+
+	// gzip header with the TOC offset in the extra field, an empty stored
+	// block, then the checksum and size of the empty content
+	subfield := fmt.Sprintf("%016xSTARGZ", tocOffset)
+	footer := []byte{0x1f, 0x8b, 0x08, 0x04, 0, 0, 0, 0, 0, 0xff}
+	footer = binary.LittleEndian.AppendUint16(footer, uint16(4+len(subfield)))
+	footer = append(footer, 'S', 'G')
+	footer = binary.LittleEndian.AppendUint16(footer, uint16(len(subfield)))
+	footer = append(footer, subfield...)
+	footer = append(footer, 0x01, 0x00, 0x00, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0)
+	require.Len(t, footer, estargz.FooterSize)
+	buf.Write(footer)
+	return digest.FromBytes(tocJSON)
+}
+
+func testLayers(filenames ...string) []Layer {
+	layers := make([]Layer, 0, len(filenames))
+	for _, filename := range filenames {
+		layers = append(layers, Layer{
+			Filename: filename,
+			Logger:   zerolog.New(io.Discard),
+		})
+	}
+	return layers
+}
+
+type memEntry struct {
+	hdr  *tar.Header
+	body string
+}
+
+type memWriter struct {
+	order   []string
+	entries map[string]memEntry
+}
+
+func (m *memWriter) WriteEntry(hdr *tar.Header, r io.Reader) error {
+	if m.entries == nil {
+		m.entries = map[string]memEntry{}
+	}
+	var body []byte
+	if r != nil && hdr.Typeflag == tar.TypeReg {
+		var err error
+		if body, err = io.ReadAll(r); err != nil {
+			return err
+		}
+	}
+	m.order = append(m.order, hdr.Name)
+	m.entries[hdr.Name] = memEntry{hdr: hdr, body: string(body)}
+	return nil
+}
+
+type memHardlinkWriter struct {
+	*memWriter
+}
+
+func (m memHardlinkWriter) WriteHardlinks(hdr *tar.Header, r io.Reader, links []*tar.Header) error {
+	if err := m.WriteEntry(hdr, r); err != nil {
+		return err
+	}
+	for _, link := range links {
+		if err := m.WriteEntry(link, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memWriter) Close() error {
+	return nil
+}
+
+func (m *memWriter) names() []string {
+	return m.order
+}
@@ -0,0 +1,65 @@
+package extractor
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/crazy-max/undock/pkg/s3"
+	"github.com/rs/zerolog"
+)
+
+// objectWriter uploads the entries of a merged filesystem to an object
+// store. Attributes are stored as metadata the way s3fs does: mode with the
+// file type bits, uid, gid and mtime as decimal numbers. Symlinks are empty
+// objects with their target in metadata, and directories are empty objects
+// with a trailing slash.
+type objectWriter struct {
+	ctx    context.Context
+	client *s3.Client
+	bucket string
+	prefix string
+	logger zerolog.Logger
+}
+
+// NewObjectWriter creates an entry writer that uploads entries under the
+// prefix of a bucket
+func NewObjectWriter(ctx context.Context, client *s3.Client, bucket, prefix string, logger zerolog.Logger) EntryWriter {
+	return &objectWriter{
+		ctx:    ctx,
+		client: client,
+		bucket: bucket,
+		prefix: strings.Trim(prefix, "/"),
+		logger: logger,
+	}
+}
+
+func (o *objectWriter) WriteEntry(hdr *tar.Header, r io.Reader) error {
+	key := path.Join(o.prefix, hdr.Name)
+	metadata := map[string]string{
+		"mode":  strconv.FormatUint(uint64(fileMode(hdr)), 10),
+		"uid":   strconv.Itoa(hdr.Uid),
+		"gid":   strconv.Itoa(hdr.Gid),
+		"mtime": strconv.FormatInt(hdr.ModTime.Unix(), 10),
+	}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return o.client.PutObject(o.ctx, o.bucket, key+"/", nil, 0, metadata)
+	case tar.TypeReg:
+		o.logger.Debug().Msgf("Uploading %s", key)
+		return o.client.Upload(o.ctx, o.bucket, key, r, hdr.Size, metadata)
+	case tar.TypeSymlink:
+		metadata["symlink-target"] = hdr.Linkname
+		return o.client.PutObject(o.ctx, o.bucket, key, nil, 0, metadata)
+	default:
+		o.logger.Debug().Msgf("Skipping %s, cannot be stored as an object", hdr.Name)
+		return nil
+	}
+}
+
+func (o *objectWriter) Close() error {
+	return nil
+}
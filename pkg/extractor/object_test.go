@@ -0,0 +1,72 @@
+package extractor
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/crazy-max/undock/pkg/s3"
+	"github.com/crazy-max/undock/pkg/s3/s3test"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeLayersWritesObjects(t *testing.T) {
+	root := t.TempDir()
+
+	big := strings.Repeat("x", 10)
+	layer1 := filepath.Join(root, "layer1.tar")
+	writeTarFile(t, layer1, []tarEntry{
+		{name: "bin/", typeflag: tar.TypeDir},
+		{name: "bin/busybox", body: "busybox", mode: 0o755},
+		{name: "bin/ls", typeflag: tar.TypeSymlink, linkname: "busybox"},
+		{name: "dev/console", typeflag: tar.TypeChar, mode: 0o600},
+		{name: "etc/big", body: big},
+		{name: "etc/removed", body: "removed"},
+	})
+
+	layer2 := filepath.Join(root, "layer2.tar")
+	writeTarFile(t, layer2, []tarEntry{
+		{name: "etc/.wh.removed"},
+	})
+
+	srv := s3test.NewServer("access")
+	defer srv.Close()
+	client, err := s3.New(s3.Options{
+		Endpoint:    srv.URL,
+		Credentials: s3.Credentials{AccessKeyID: "access", SecretAccessKey: "secret"},
+		PartSize:    4,
+	})
+	require.NoError(t, err)
+
+	w := NewObjectWriter(context.Background(), client, "bucket", "/rootfs/", zerolog.New(io.Discard))
+	require.NoError(t, MergeLayers(testLayers(layer1, layer2), w, MergeOpts{
+		Context: context.Background(),
+	}))
+	require.NoError(t, w.Close())
+
+	require.Equal(t, []string{
+		"rootfs/bin/",
+		"rootfs/bin/busybox",
+		"rootfs/bin/ls",
+		"rootfs/dev/",
+		"rootfs/etc/",
+		"rootfs/etc/big",
+	}, srv.Keys("bucket"))
+
+	obj, _ := srv.Object("bucket", "rootfs/bin/busybox")
+	require.Equal(t, "busybox", string(obj.Body))
+	require.Equal(t, "33261", obj.Metadata["mode"])
+
+	obj, _ = srv.Object("bucket", "rootfs/bin/ls")
+	require.Empty(t, obj.Body)
+	require.Equal(t, "busybox", obj.Metadata["symlink-target"])
+	require.Equal(t, "41380", obj.Metadata["mode"])
+
+	obj, _ = srv.Object("bucket", "rootfs/etc/big")
+	require.Equal(t, big, string(obj.Body))
+	require.Equal(t, 3, obj.Parts)
+}
@@ -0,0 +1,206 @@
+package extractor
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"golang.org/x/sync/errgroup"
+)
+
+// ExtractLayersOpts holds extract layers options
+type ExtractLayersOpts struct {
+	Context  context.Context
+	Logger   zerolog.Logger
+	Includes []string
+	// Parallelism is the number of layers decompressed at once
+	Parallelism int
+	// TempDir holds decompressed layers until they are written. Defaults to
+	// os.TempDir.
+	TempDir string
+	// Applied is the number of leading layers already extracted in dest
+	Applied int
+	// Base is the scan of the first layers returned by ScanLayers, which
+	// are not scanned again
+	Base *MergeBase
+}
+
+// ExtractLayers extracts layers in dest folder. Layer headers are scanned
+// first to resolve whiteouts, so files overwritten or deleted by an upper
+// layer are never written. Ownership is not preserved and device nodes are
+// skipped. Folders missing from the layers are created with 0700 mode.
+func ExtractLayers(layers []Layer, dest string, opts ExtractLayersOpts) (err error) {
+	w, err := newDirWriter(dest, 0o700, opts.Logger)
+	if err != nil {
+		return err
+	}
+	// ownership and device nodes are not expected in a plain folder
+	w.unprivileged = true
+	defer func() {
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	return MergeLayers(layers, w, MergeOpts{
+		Context:     opts.Context,
+		Includes:    opts.Includes,
+		Parallelism: opts.Parallelism,
+		TempDir:     opts.TempDir,
+		Applied:     opts.Applied,
+		DirMode:     0o700,
+		Base:        opts.Base,
+	})
+}
+
+// StreamLayers extracts layers in dest folder like ExtractLayers, but reads
+// each of them once, e.g. to stream them from a registry without keeping
+// them on disk. Entries are written as they are read, and the ones deleted
+// by the whiteouts of an upper layer are removed once they are read. Hard
+// links to files which are not extracted are skipped. Parallelism and
+// TempDir are ignored. It returns the merged tree of the layers, to extract
+// images sharing them with ExtractLayersOpts.Base.
+func StreamLayers(layers []Layer, dest string, opts ExtractLayersOpts) (_ *MergeBase, err error) {
+	m := newMergeTree(includePaths(opts.Includes))
+	var from int
+	if opts.Base != nil {
+		if opts.Base.layers > len(layers) {
+			return nil, errors.Errorf("base of %d layers merged with %d layers", opts.Base.layers, len(layers))
+		}
+		m, from = opts.Base.tree.clone(), opts.Base.layers
+	}
+
+	w, err := newDirWriter(dest, 0o700, opts.Logger)
+	if err != nil {
+		return nil, err
+	}
+	w.unprivileged = true
+	defer func() {
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	for i := from; i < len(layers); i++ {
+		if i < opts.Applied {
+			err = m.scan(opts.Context, i, layers[i])
+		} else {
+			err = m.stream(opts.Context, i, layers[i], w)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &MergeBase{layers: len(layers), tree: m}, nil
+}
+
+// inOrder produces a value for each of n layers with up to parallelism
+// producers at once, and consumes them in order. A slot is held from
+// production until the value is consumed, which bounds the number of values
+// waiting. Values produced but not consumed on error are discarded.
+func inOrder[T any](ctx context.Context, n, parallelism int, produce func(ctx context.Context, i int) (T, error), consume func(ctx context.Context, i int, v T) error, discard func(T)) error {
+	if parallelism < 2 || n < 2 {
+		for i := range n {
+			v, err := produce(ctx, i)
+			if err != nil {
+				return err
+			}
+			if err := consume(ctx, i, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	values := make([]chan T, n)
+	for i := range values {
+		values[i] = make(chan T, 1)
+	}
+	defer func() {
+		for _, ch := range values {
+			select {
+			case v := <-ch:
+				discard(v)
+			default:
+			}
+		}
+	}()
+
+	slots := make(chan struct{}, parallelism)
+	eg, ctx := errgroup.WithContext(ctx)
+
+	eg.Go(func() error {
+		for i := range n {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return context.Cause(ctx)
+			}
+			eg.Go(func() error {
+				v, err := produce(ctx, i)
+				if err != nil {
+					return err
+				}
+				values[i] <- v
+				return nil
+			})
+		}
+		return nil
+	})
+
+	eg.Go(func() error {
+		for i := range n {
+			var v T
+			select {
+			case v = <-values[i]:
+			case <-ctx.Done():
+				return context.Cause(ctx)
+			}
+			err := consume(ctx, i, v)
+			<-slots
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return eg.Wait()
+}
+
+// spillLayer decompresses a layer blob into a temporary tarball
+func spillLayer(ctx context.Context, l Layer, tempDir string) (string, error) {
+	l.Logger.Debug().Msg("Decompressing blob")
+
+	ls, err := decompressLayer(ctx, l)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.CreateTemp(tempDir, "undock-layer-*.tar")
+	if err != nil {
+		_ = ls.Close()
+		return "", errors.Wrap(err, "cannot create temporary layer file")
+	}
+	_, err = io.Copy(f, ls)
+	// the error of a streamed blob, e.g. a digest mismatch, is returned on
+	// close
+	if cerr := ls.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// removeSpill removes a temporary tarball created by spillLayer
+func removeSpill(filename string) {
+	if filename != "" {
+		_ = os.Remove(filename)
+	}
+}
@@ -0,0 +1,265 @@
+package extractor
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractLayersAppliesLayersInOrder(t *testing.T) {
+	root := t.TempDir()
+	dest := filepath.Join(root, "dist")
+	tempDir := filepath.Join(root, "tmp")
+	require.NoError(t, os.MkdirAll(tempDir, 0o755))
+
+	layer1 := filepath.Join(root, "layer1.tar.gz")
+	writeTarGzFile(t, layer1, []tarEntry{
+		{name: "dir/", typeflag: tar.TypeDir},
+		{name: "dir/a.txt", body: "a"},
+		{name: "dir/b.txt", body: "b"},
+		{name: "file.txt", body: "old"},
+	})
+	layer2 := filepath.Join(root, "layer2.tar.gz")
+	writeTarGzFile(t, layer2, []tarEntry{
+		{name: "dir/.wh.a.txt"},
+		{name: "file.txt", body: "new"},
+	})
+	layer3 := filepath.Join(root, "layer3.tar")
+	writeTarFile(t, layer3, []tarEntry{
+		{name: "dir/a.txt", body: "again"},
+		{name: "dir/.wh..wh..opq"},
+	})
+	layer4 := filepath.Join(root, "layer4.tar.gz")
+	writeTarGzFile(t, layer4, []tarEntry{
+		{name: "dir/c.txt", body: "c"},
+	})
+
+	require.NoError(t, ExtractLayers(testLayers(layer1, layer2, layer3, layer4), dest, ExtractLayersOpts{
+		Context:     context.Background(),
+		Parallelism: 2,
+		TempDir:     tempDir,
+	}))
+
+	requireFileBody(t, filepath.Join(dest, "file.txt"), "new")
+	requireFileBody(t, filepath.Join(dest, "dir", "a.txt"), "again")
+	requireFileBody(t, filepath.Join(dest, "dir", "c.txt"), "c")
+	require.NoFileExists(t, filepath.Join(dest, "dir", "b.txt"))
+
+	entries, err := os.ReadDir(tempDir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestExtractLayersRemovesTemporaryFilesOnError(t *testing.T) {
+	root := t.TempDir()
+	tempDir := filepath.Join(root, "tmp")
+	require.NoError(t, os.MkdirAll(tempDir, 0o755))
+
+	layer := filepath.Join(root, "layer.tar.gz")
+	writeTarGzFile(t, layer, []tarEntry{
+		{name: "file.txt", body: "content"},
+	})
+	layers := testLayers(layer, layer, layer)
+	layers[1].Open = func() (io.ReadCloser, error) {
+		return nil, errors.New("blob unavailable")
+	}
+
+	err := ExtractLayers(layers, filepath.Join(root, "dist"), ExtractLayersOpts{
+		Context:     context.Background(),
+		Parallelism: 3,
+		TempDir:     tempDir,
+	})
+	require.EqualError(t, err, "blob unavailable")
+
+	entries, err := os.ReadDir(tempDir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestExtractLayersOnAppliedLayers(t *testing.T) {
+	root := t.TempDir()
+	dest := filepath.Join(root, "dist")
+
+	layer1 := filepath.Join(root, "layer1.tar")
+	writeTarFile(t, layer1, []tarEntry{
+		{name: "dir/", typeflag: tar.TypeDir},
+		{name: "dir/a.txt", body: "a"},
+		{name: "opaque/old.txt", body: "old"},
+		{name: "file.txt", body: "old"},
+		{name: "target.txt", body: "target"},
+	})
+	layer2 := filepath.Join(root, "layer2.tar")
+	writeTarFile(t, layer2, []tarEntry{
+		{name: "dir/.wh.a.txt"},
+		{name: "opaque/.wh..wh..opq"},
+		{name: "opaque/new.txt", body: "new"},
+		{name: "file.txt", body: "new"},
+		{name: "hardlink", typeflag: tar.TypeLink, linkname: "target.txt"},
+	})
+	layers := testLayers(layer1, layer2)
+
+	require.NoError(t, ExtractLayers(layers[:1], dest, ExtractLayersOpts{
+		Context: context.Background(),
+	}))
+	require.NoError(t, ExtractLayers(layers, dest, ExtractLayersOpts{
+		Context: context.Background(),
+		Applied: 1,
+	}))
+
+	require.NoFileExists(t, filepath.Join(dest, "dir", "a.txt"))
+	require.DirExists(t, filepath.Join(dest, "dir"))
+	require.NoFileExists(t, filepath.Join(dest, "opaque", "old.txt"))
+	requireFileBody(t, filepath.Join(dest, "opaque", "new.txt"), "new")
+	requireFileBody(t, filepath.Join(dest, "file.txt"), "new")
+	requireFileBody(t, filepath.Join(dest, "hardlink"), "target")
+}
+
+func TestExtractLayersOnScannedBase(t *testing.T) {
+	root := t.TempDir()
+
+	base := filepath.Join(root, "base.tar")
+	writeTarFile(t, base, []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/os-release", body: "base"},
+		{name: "etc/arch", body: "none"},
+		{name: "bin/busybox", body: "busybox"},
+		{name: "bin/sh", typeflag: tar.TypeLink, linkname: "bin/busybox"},
+	})
+	amd64 := filepath.Join(root, "amd64.tar")
+	writeTarFile(t, amd64, []tarEntry{
+		{name: "etc/arch", body: "amd64"},
+		{name: "bin/.wh.busybox"},
+	})
+	arm64 := filepath.Join(root, "arm64.tar")
+	writeTarFile(t, arm64, []tarEntry{
+		{name: "etc/.wh..wh..opq"},
+		{name: "etc/arch", body: "arm64"},
+	})
+
+	scan, err := ScanLayers(testLayers(base), MergeOpts{Context: context.Background()})
+	require.NoError(t, err)
+
+	// the base cannot hold more layers than the ones merged
+	_, err = ScanLayers(nil, MergeOpts{Context: context.Background(), Base: scan})
+	require.Error(t, err)
+
+	for _, platform := range []string{"amd64", "arm64"} {
+		dest := filepath.Join(root, platform)
+		require.NoError(t, ExtractLayers(testLayers(base, filepath.Join(root, platform+".tar")), dest, ExtractLayersOpts{
+			Context: context.Background(),
+			Base:    scan,
+		}))
+		requireFileBody(t, filepath.Join(dest, "etc", "arch"), platform)
+	}
+
+	// each image is merged from the base, unchanged by the other one
+	requireFileBody(t, filepath.Join(root, "amd64", "etc", "os-release"), "base")
+	requireFileBody(t, filepath.Join(root, "amd64", "bin", "sh"), "busybox")
+	require.NoFileExists(t, filepath.Join(root, "amd64", "bin", "busybox"))
+	require.NoFileExists(t, filepath.Join(root, "arm64", "etc", "os-release"))
+	requireFileBody(t, filepath.Join(root, "arm64", "bin", "busybox"), "busybox")
+	requireFileBody(t, filepath.Join(root, "arm64", "bin", "sh"), "busybox")
+}
+
+func TestStreamLayersAppliesLayersInOrder(t *testing.T) {
+	root := t.TempDir()
+	dest := filepath.Join(root, "dist")
+
+	layer1 := filepath.Join(root, "layer1.tar.gz")
+	writeTarGzFile(t, layer1, []tarEntry{
+		{name: "dir/", typeflag: tar.TypeDir},
+		{name: "dir/a.txt", body: "a"},
+		{name: "dir/b.txt", body: "b"},
+		{name: "file.txt", body: "old"},
+		{name: "target.txt", body: "target"},
+	})
+	layer2 := filepath.Join(root, "layer2.tar.gz")
+	writeTarGzFile(t, layer2, []tarEntry{
+		{name: "dir/.wh.a.txt"},
+		{name: "file.txt", body: "new"},
+		{name: "hardlink", typeflag: tar.TypeLink, linkname: "target.txt"},
+		{name: "removed", typeflag: tar.TypeLink, linkname: "dir/b.txt"},
+	})
+	layer3 := filepath.Join(root, "layer3.tar")
+	writeTarFile(t, layer3, []tarEntry{
+		{name: "dir/a.txt", body: "again"},
+		{name: "dir/.wh..wh..opq"},
+		{name: "dir/.wh.missing"},
+		{name: "removed", typeflag: tar.TypeLink, linkname: "dir/b.txt"},
+	})
+
+	var opened int
+	layers := testLayers(layer1, layer2, layer3)
+	for i := range layers {
+		filename := layers[i].Filename
+		layers[i].Open = func() (io.ReadCloser, error) {
+			opened++
+			return os.Open(filename)
+		}
+	}
+
+	_, err := StreamLayers(layers, dest, ExtractLayersOpts{
+		Context: context.Background(),
+	})
+	require.NoError(t, err)
+	require.Equal(t, len(layers), opened)
+
+	requireFileBody(t, filepath.Join(dest, "file.txt"), "new")
+	requireFileBody(t, filepath.Join(dest, "hardlink"), "target")
+	requireFileBody(t, filepath.Join(dest, "dir", "a.txt"), "again")
+	require.NoFileExists(t, filepath.Join(dest, "dir", "b.txt"))
+	// the hard link of the second layer keeps the content of its target
+	requireFileBody(t, filepath.Join(dest, "removed"), "b")
+}
+
+func TestStreamLayersOnStreamedBase(t *testing.T) {
+	root := t.TempDir()
+
+	base := filepath.Join(root, "base.tar")
+	writeTarFile(t, base, []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/os-release", body: "base"},
+		{name: "usr/lib/libc.so", body: "libc"},
+		{name: "lib", typeflag: tar.TypeSymlink, linkname: "usr/lib"},
+	})
+	amd64 := filepath.Join(root, "amd64.tar")
+	writeTarFile(t, amd64, []tarEntry{
+		{name: "etc/.wh.os-release"},
+		{name: "lib/ld.so", body: "amd64"},
+	})
+
+	shared := filepath.Join(root, "shared")
+	scan, err := StreamLayers(testLayers(base), shared, ExtractLayersOpts{
+		Context: context.Background(),
+	})
+	require.NoError(t, err)
+
+	dest := filepath.Join(root, "amd64")
+	require.NoError(t, CloneTree(shared, dest, zerolog.New(io.Discard)))
+	_, err = StreamLayers(testLayers(base, amd64), dest, ExtractLayersOpts{
+		Context: context.Background(),
+		Applied: 1,
+		Base:    scan,
+	})
+	require.NoError(t, err)
+
+	require.NoFileExists(t, filepath.Join(dest, "etc", "os-release"))
+	requireFileBody(t, filepath.Join(dest, "usr", "lib", "ld.so"), "amd64")
+	requireFileBody(t, filepath.Join(shared, "etc", "os-release"), "base")
+	require.NoFileExists(t, filepath.Join(shared, "usr", "lib", "ld.so"))
+}
+
+func requireFileBody(t *testing.T, filename string, expected string) {
+	t.Helper()
+
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	require.Equal(t, expected, string(data))
+}
@@ -0,0 +1,466 @@
+package extractor
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/mholt/archives"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// zstdChunkedManifestChecksum is the annotation of a zstd:chunked layer
+	// with the digest of its compressed table of contents
+	zstdChunkedManifestChecksum = "io.github.containers.zstd-chunked.manifest-checksum"
+	// zstdChunkedManifestPosition is the annotation of a zstd:chunked layer
+	// with the position of its table of contents in the blob, as
+	// offset:length:uncompressed length:type
+	zstdChunkedManifestPosition = "io.github.containers.zstd-chunked.manifest-position"
+	// zstdChunkedManifestType is the only supported type of table of
+	// contents of a zstd:chunked layer
+	zstdChunkedManifestType = 1
+)
+
+// PartialLayerOpts holds partial layer options
+type PartialLayerOpts struct {
+	Context  context.Context
+	Logger   zerolog.Logger
+	Includes []string
+}
+
+// HasTOC returns true if the annotations of a layer blob reference the
+// table of contents of an eStargz or zstd:chunked layer, whose files can be
+// read individually with WritePartialLayer
+func HasTOC(annotations map[string]string) bool {
+	_, stargz := annotations[estargz.TOCJSONDigestAnnotation]
+	_, zstdChunked := annotations[zstdChunkedManifestChecksum]
+	return stargz != zstdChunked
+}
+
+// WritePartialLayer writes an eStargz or zstd:chunked layer blob of the
+// given size to w as an uncompressed tarball, reading only its table of
+// contents and the content of the regular files matching the includes from
+// ra. Other entries are written without their content, except for the
+// targets of included hard links. The table of contents is verified against
+// the digest in the annotations of the blob, and the content of each file
+// against the digest in the table of contents.
+func WritePartialLayer(ra io.ReaderAt, size int64, annotations map[string]string, w io.Writer, opts PartialLayerOpts) error {
+	var files []partialFile
+	var decompress func(io.Reader) (io.ReadCloser, error)
+	var err error
+	switch {
+	case !HasTOC(annotations):
+		return errors.New("layer has no table of contents")
+	case annotations[estargz.TOCJSONDigestAnnotation] != "":
+		files, err = estargzFiles(ra, size, annotations[estargz.TOCJSONDigestAnnotation])
+		decompress = archives.Gz{}.OpenReader
+	default:
+		files, err = zstdChunkedFiles(ra, size, annotations)
+		decompress = archives.Zstd{}.OpenReader
+	}
+	if err != nil {
+		return err
+	}
+	return writePartial(ra, files, decompress, w, opts)
+}
+
+// partialFile is an entry of a layer blob with a table of contents
+type partialFile struct {
+	hdr *tar.Header
+	// digest of the content of a regular file
+	digest string
+	chunks []partialChunk
+}
+
+// partialChunk is a compressed chunk of the content of a regular file
+type partialChunk struct {
+	// offset and end of the compressed data in the blob
+	offset int64
+	end    int64
+	// inner is the offset of the chunk in the decompressed data
+	inner int64
+	// chunkOffset is the offset of the chunk in the file
+	chunkOffset int64
+	size        int64
+	zeros       bool
+}
+
+func writePartial(ra io.ReaderAt, files []partialFile, decompress func(io.Reader) (io.ReadCloser, error), w io.Writer, opts PartialLayerOpts) error {
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	includes := includePaths(opts.Includes)
+
+	// targets of included hard links are needed to write them
+	targets := map[string]struct{}{}
+	for _, f := range files {
+		if f.hdr.Typeflag != tar.TypeLink {
+			continue
+		}
+		name, err := normalizeArchivePath(f.hdr.Name)
+		if err != nil {
+			return err
+		}
+		if !pathIntersects(includes, name) {
+			continue
+		}
+		target, err := normalizeArchivePath(f.hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		targets[target] = struct{}{}
+	}
+
+	tw := tar.NewWriter(w)
+	for _, f := range files {
+		if err := context.Cause(ctx); err != nil {
+			return err
+		}
+		fetch := f.hdr.Typeflag == tar.TypeReg && f.hdr.Size > 0
+		if fetch {
+			name, err := normalizeArchivePath(f.hdr.Name)
+			if err != nil {
+				return err
+			}
+			if _, ok := targets[name]; !ok && !pathIntersects(includes, name) {
+				continue
+			}
+		}
+		if err := tw.WriteHeader(f.hdr); err != nil {
+			return err
+		}
+		if fetch {
+			opts.Logger.Debug().Msgf("Fetching %s", f.hdr.Name)
+			if err := writePartialContent(ctx, ra, f, decompress, tw); err != nil {
+				return errors.Wrapf(err, "cannot fetch %s", f.hdr.Name)
+			}
+		}
+	}
+	return tw.Close()
+}
+
+// writePartialContent writes the content of a regular file, reading each
+// of its chunks with a single read from ra
+func writePartialContent(ctx context.Context, ra io.ReaderAt, f partialFile, decompress func(io.Reader) (io.ReadCloser, error), w io.Writer) error {
+	dgst, err := digest.Parse(f.digest)
+	if err != nil {
+		return errors.Wrap(err, "invalid digest")
+	}
+	verifier := dgst.Verifier()
+	dst := io.MultiWriter(w, verifier)
+
+	var n int64
+	for _, ch := range f.chunks {
+		if err := context.Cause(ctx); err != nil {
+			return err
+		}
+		if ch.chunkOffset != n || ch.size < 0 || n+ch.size > f.hdr.Size {
+			return errors.Errorf("invalid chunk at offset %d", ch.chunkOffset)
+		}
+		if ch.zeros {
+			if _, err := io.CopyN(dst, zeroReader{}, ch.size); err != nil {
+				return err
+			}
+			n += ch.size
+			continue
+		}
+		if ch.offset < 0 || ch.end <= ch.offset || ch.inner < 0 {
+			return errors.Errorf("invalid chunk at offset %d", ch.chunkOffset)
+		}
+		compressed := make([]byte, ch.end-ch.offset)
+		if rn, err := ra.ReadAt(compressed, ch.offset); rn < len(compressed) {
+			return err
+		}
+		rc, err := decompress(bytes.NewReader(compressed))
+		if err != nil {
+			return err
+		}
+		if _, err := io.CopyN(io.Discard, rc, ch.inner); err != nil {
+			_ = rc.Close()
+			return err
+		}
+		_, err = io.CopyN(dst, rc, ch.size)
+		if cerr := rc.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		n += ch.size
+	}
+	if n != f.hdr.Size {
+		return errors.Errorf("size mismatch: expected %d bytes, got %d", f.hdr.Size, n)
+	} else if !verifier.Verified() {
+		return errors.New("digest mismatch")
+	}
+	return nil
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// estargzFiles reads the entries of an eStargz layer blob from its table of
+// contents
+func estargzFiles(ra io.ReaderAt, size int64, tocDigest string) ([]partialFile, error) {
+	tocOffset, footerSize, err := estargz.OpenFooter(io.NewSectionReader(ra, 0, size))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read eStargz footer")
+	}
+	tocSize := size - tocOffset - footerSize
+	if tocOffset < 0 || tocSize <= 0 {
+		return nil, errors.Errorf("invalid eStargz TOC offset %d", tocOffset)
+	}
+	// the TOC is read at once instead of in small reads by the decompressor
+	dt := make([]byte, tocSize)
+	if n, err := ra.ReadAt(dt, tocOffset); n < len(dt) {
+		return nil, errors.Wrap(err, "cannot read eStargz TOC")
+	}
+	toc, dgst, err := new(estargz.GzipDecompressor).ParseTOC(bytes.NewReader(dt))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse eStargz TOC")
+	}
+	if dgst.String() != tocDigest {
+		return nil, errors.Errorf("eStargz TOC digest mismatch: expected %s, got %s", tocDigest, dgst)
+	}
+
+	// the compressed data of a chunk ends where the next one starts
+	offsets := []int64{tocOffset}
+	for _, e := range toc.Entries {
+		if e.Offset > 0 {
+			offsets = append(offsets, e.Offset)
+		}
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	end := func(offset int64) int64 {
+		if i := sort.Search(len(offsets), func(i int) bool { return offsets[i] > offset }); i < len(offsets) {
+			return offsets[i]
+		}
+		return offset
+	}
+
+	// user and group names are only set for the first entry of an id
+	unames := map[int]string{}
+	gnames := map[int]string{}
+	var files []partialFile
+	for _, e := range toc.Entries {
+		if e.Type == "chunk" {
+			if len(files) == 0 || files[len(files)-1].hdr.Typeflag != tar.TypeReg {
+				return nil, errors.Errorf("unexpected eStargz chunk for %s", e.Name)
+			}
+			f := &files[len(files)-1]
+			f.chunks = append(f.chunks, estargzChunk(e, f.hdr.Size, end(e.Offset)))
+			continue
+		}
+		if e.Name == estargz.PrefetchLandmark || e.Name == estargz.NoPrefetchLandmark {
+			continue
+		}
+		if e.Uname != "" {
+			unames[e.UID] = e.Uname
+		}
+		if e.Gname != "" {
+			gnames[e.GID] = e.Gname
+		}
+		hdr, err := tocHeader(e)
+		if err != nil {
+			return nil, err
+		}
+		hdr.Uname = unames[e.UID]
+		hdr.Gname = gnames[e.GID]
+		f := partialFile{hdr: hdr, digest: e.Digest}
+		if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+			f.chunks = append(f.chunks, estargzChunk(e, hdr.Size, end(e.Offset)))
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+func estargzChunk(e *estargz.TOCEntry, fileSize, end int64) partialChunk {
+	size := e.ChunkSize
+	if size == 0 {
+		size = fileSize - e.ChunkOffset
+	}
+	return partialChunk{
+		offset:      e.Offset,
+		end:         end,
+		inner:       e.InnerOffset,
+		chunkOffset: e.ChunkOffset,
+		size:        size,
+	}
+}
+
+// zstdChunkedTOC is the table of contents of a zstd:chunked layer
+type zstdChunkedTOC struct {
+	Version int                `json:"version"`
+	Entries []zstdChunkedEntry `json:"entries"`
+}
+
+type zstdChunkedEntry struct {
+	Type        string            `json:"type"`
+	Name        string            `json:"name"`
+	Linkname    string            `json:"linkName,omitempty"`
+	Mode        int64             `json:"mode,omitempty"`
+	Size        int64             `json:"size,omitempty"`
+	UID         int               `json:"uid,omitempty"`
+	GID         int               `json:"gid,omitempty"`
+	ModTime     *time.Time        `json:"modtime,omitempty"`
+	Devmajor    int64             `json:"devMajor,omitempty"`
+	Devminor    int64             `json:"devMinor,omitempty"`
+	Xattrs      map[string]string `json:"xattrs,omitempty"`
+	Digest      string            `json:"digest,omitempty"`
+	Offset      int64             `json:"offset,omitempty"`
+	EndOffset   int64             `json:"endOffset,omitempty"`
+	ChunkSize   int64             `json:"chunkSize,omitempty"`
+	ChunkOffset int64             `json:"chunkOffset,omitempty"`
+	ChunkType   string            `json:"chunkType,omitempty"`
+}
+
+// zstdChunkedFiles reads the entries of a zstd:chunked layer blob from its
+// table of contents
+func zstdChunkedFiles(ra io.ReaderAt, size int64, annotations map[string]string) ([]partialFile, error) {
+	position := annotations[zstdChunkedManifestPosition]
+	fields := strings.Split(position, ":")
+	if len(fields) != 4 {
+		return nil, errors.Errorf("invalid zstd:chunked manifest position %q", position)
+	}
+	var values [4]int64
+	for i, field := range fields {
+		v, err := strconv.ParseInt(field, 10, 64)
+		if err != nil || v < 0 {
+			return nil, errors.Errorf("invalid zstd:chunked manifest position %q", position)
+		}
+		values[i] = v
+	}
+	offset, length, uncompressedLength, manifestType := values[0], values[1], values[2], values[3]
+	if manifestType != zstdChunkedManifestType {
+		return nil, errors.Errorf("unsupported zstd:chunked manifest type %d", manifestType)
+	} else if length == 0 || offset+length > size {
+		return nil, errors.Errorf("invalid zstd:chunked manifest position %q", position)
+	}
+	dgst, err := digest.Parse(annotations[zstdChunkedManifestChecksum])
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid zstd:chunked manifest checksum")
+	}
+
+	compressed := make([]byte, length)
+	if n, err := ra.ReadAt(compressed, offset); n < len(compressed) {
+		return nil, errors.Wrap(err, "cannot read zstd:chunked manifest")
+	}
+	if digest.FromBytes(compressed) != dgst {
+		return nil, errors.Errorf("zstd:chunked manifest digest mismatch: expected %s", dgst)
+	}
+	rc, err := archives.Zstd{}.OpenReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	dt, err := io.ReadAll(io.LimitReader(rc, uncompressedLength+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot decompress zstd:chunked manifest")
+	} else if int64(len(dt)) != uncompressedLength {
+		return nil, errors.Errorf("zstd:chunked manifest size mismatch: expected %d bytes, got %d", uncompressedLength, len(dt))
+	}
+	var toc zstdChunkedTOC
+	if err := json.Unmarshal(dt, &toc); err != nil {
+		return nil, errors.Wrap(err, "cannot parse zstd:chunked manifest")
+	} else if toc.Version != 1 {
+		return nil, errors.Errorf("unsupported zstd:chunked manifest version %d", toc.Version)
+	}
+
+	var files []partialFile
+	for _, e := range toc.Entries {
+		if e.Type == "chunk" {
+			if len(files) == 0 || files[len(files)-1].hdr.Typeflag != tar.TypeReg {
+				return nil, errors.Errorf("unexpected zstd:chunked chunk for %s", e.Name)
+			}
+			f := &files[len(files)-1]
+			f.chunks = append(f.chunks, zstdChunk(e, f.hdr.Size))
+			continue
+		}
+		hdr, err := zstdChunkedHeader(e)
+		if err != nil {
+			return nil, err
+		}
+		f := partialFile{hdr: hdr, digest: e.Digest}
+		if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+			f.chunks = append(f.chunks, zstdChunk(e, hdr.Size))
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+func zstdChunk(e zstdChunkedEntry, fileSize int64) partialChunk {
+	size := e.ChunkSize
+	if size == 0 {
+		size = fileSize - e.ChunkOffset
+	}
+	return partialChunk{
+		offset:      e.Offset,
+		end:         e.EndOffset,
+		chunkOffset: e.ChunkOffset,
+		size:        size,
+		zeros:       e.ChunkType == "zeros",
+	}
+}
+
+func zstdChunkedHeader(e zstdChunkedEntry) (*tar.Header, error) {
+	hdr := &tar.Header{
+		Name:     e.Name,
+		Mode:     e.Mode,
+		Uid:      e.UID,
+		Gid:      e.GID,
+		Linkname: e.Linkname,
+		Devmajor: e.Devmajor,
+		Devminor: e.Devminor,
+	}
+	switch e.Type {
+	case "dir":
+		hdr.Typeflag = tar.TypeDir
+	case "reg":
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = e.Size
+	case "symlink":
+		hdr.Typeflag = tar.TypeSymlink
+	case "hardlink":
+		hdr.Typeflag = tar.TypeLink
+	case "char":
+		hdr.Typeflag = tar.TypeChar
+	case "block":
+		hdr.Typeflag = tar.TypeBlock
+	case "fifo":
+		hdr.Typeflag = tar.TypeFifo
+	default:
+		return nil, errors.Errorf("unknown zstd:chunked entry type %q for %s", e.Type, e.Name)
+	}
+	if e.ModTime != nil {
+		hdr.ModTime = *e.ModTime
+	}
+	for k, v := range e.Xattrs {
+		value, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid xattr %s for %s", k, e.Name)
+		}
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = map[string]string{}
+		}
+		hdr.PAXRecords["SCHILY.xattr."+k] = string(value)
+	}
+	return hdr, nil
+}
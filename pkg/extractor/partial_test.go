@@ -0,0 +1,307 @@
+package extractor
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/mholt/archives"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWritePartialLayerEStargz(t *testing.T) {
+	blob, annotations := estargzBlob(t, partialEntries())
+	require.True(t, HasTOC(annotations))
+
+	ra := &countingReaderAt{ReaderAt: bytes.NewReader(blob)}
+	var buf bytes.Buffer
+	require.NoError(t, WritePartialLayer(ra, int64(len(blob)), annotations, &buf, PartialLayerOpts{
+		Context:  context.Background(),
+		Includes: []string{"/usr/bin"},
+	}))
+
+	requirePartialEntries(t, &buf)
+	require.Less(t, ra.n.Load(), int64(len(blob)/4))
+}
+
+func TestWritePartialLayerZstdChunked(t *testing.T) {
+	blob, annotations := zstdChunkedBlob(t, partialEntries())
+	require.True(t, HasTOC(annotations))
+
+	ra := &countingReaderAt{ReaderAt: bytes.NewReader(blob)}
+	var buf bytes.Buffer
+	require.NoError(t, WritePartialLayer(ra, int64(len(blob)), annotations, &buf, PartialLayerOpts{
+		Context:  context.Background(),
+		Includes: []string{"/usr/bin"},
+	}))
+
+	requirePartialEntries(t, &buf)
+	require.Less(t, ra.n.Load(), int64(len(blob)/4))
+}
+
+func TestWritePartialLayerRejectsTOCDigestMismatch(t *testing.T) {
+	blob, annotations := estargzBlob(t, partialEntries())
+	annotations[estargz.TOCJSONDigestAnnotation] = digest.FromString("other").String()
+
+	err := WritePartialLayer(bytes.NewReader(blob), int64(len(blob)), annotations, io.Discard, PartialLayerOpts{
+		Includes: []string{"/usr/bin"},
+	})
+	require.ErrorContains(t, err, "eStargz TOC digest mismatch")
+
+	blob, annotations = zstdChunkedBlob(t, partialEntries())
+	annotations[zstdChunkedManifestChecksum] = digest.FromString("other").String()
+	err = WritePartialLayer(bytes.NewReader(blob), int64(len(blob)), annotations, io.Discard, PartialLayerOpts{
+		Includes: []string{"/usr/bin"},
+	})
+	require.ErrorContains(t, err, "zstd:chunked manifest digest mismatch")
+}
+
+func TestHasTOC(t *testing.T) {
+	require.False(t, HasTOC(nil))
+	require.True(t, HasTOC(map[string]string{estargz.TOCJSONDigestAnnotation: "sha256:abc"}))
+	require.True(t, HasTOC(map[string]string{zstdChunkedManifestChecksum: "sha256:abc"}))
+	require.False(t, HasTOC(map[string]string{
+		estargz.TOCJSONDigestAnnotation: "sha256:abc",
+		zstdChunkedManifestChecksum:     "sha256:abc",
+	}))
+}
+
+// partialTool is split in a data chunk and a chunk of zeros
+var partialTool = "tool" + strings.Repeat("\x00", 2*partialChunkSize-4)
+
+// partialEntries returns a layer with a large file outside of /usr/bin,
+// and a hard link in /usr/bin to a file outside of it
+func partialEntries() []tarEntry {
+	large := make([]byte, 64<<10)
+	for i := range large {
+		large[i] = byte(rand.N(256))
+	}
+	return []tarEntry{
+		{name: "usr/", typeflag: tar.TypeDir},
+		{name: "usr/bin/", typeflag: tar.TypeDir},
+		{name: "usr/bin/tool", body: partialTool},
+		{name: "usr/lib/", typeflag: tar.TypeDir},
+		{name: "usr/lib/libtool.so", body: "library"},
+		{name: "usr/bin/libtool", typeflag: tar.TypeLink, linkname: "usr/lib/libtool.so"},
+		{name: "usr/share/large.bin", body: string(large)},
+		{name: "usr/share/.wh.removed"},
+	}
+}
+
+func requirePartialEntries(t *testing.T, r io.Reader) {
+	t.Helper()
+
+	tr := tar.NewReader(r)
+	var names []string
+	bodies := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+		dt, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		bodies[hdr.Name] = string(dt)
+	}
+	require.Equal(t, []string{
+		"usr/",
+		"usr/bin/",
+		"usr/bin/tool",
+		"usr/lib/",
+		"usr/lib/libtool.so",
+		"usr/bin/libtool",
+		"usr/share/.wh.removed",
+	}, names)
+	require.Equal(t, partialTool, bodies["usr/bin/tool"])
+	require.Equal(t, "library", bodies["usr/lib/libtool.so"])
+}
+
+// countingReaderAt counts the bytes read
+type countingReaderAt struct {
+	io.ReaderAt
+	n atomic.Int64
+}
+
+func (r *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.ReaderAt.ReadAt(p, off)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+// partialChunkSize is the maximum size of the chunks of a partialBlob
+const partialChunkSize = 1024
+
+// partialBlob writes the tarball of a layer as separate compressed members,
+// one for each chunk of the content of regular files, and one for the
+// headers in between
+type partialBlob struct {
+	t        *testing.T
+	buf      bytes.Buffer
+	pending  bytes.Buffer
+	tw       *tar.Writer
+	compress func(io.Writer) (io.WriteCloser, error)
+}
+
+func newPartialBlob(t *testing.T, compress func(io.Writer) (io.WriteCloser, error)) *partialBlob {
+	b := &partialBlob{t: t, compress: compress}
+	b.tw = tar.NewWriter(&b.pending)
+	return b
+}
+
+// flush compresses the pending tarball bytes in a member
+func (b *partialBlob) flush() {
+	if b.pending.Len() == 0 {
+		return
+	}
+	w, err := b.compress(&b.buf)
+	require.NoError(b.t, err)
+	_, err = w.Write(b.pending.Bytes())
+	require.NoError(b.t, err)
+	require.NoError(b.t, w.Close())
+	b.pending.Reset()
+}
+
+// write writes an entry and calls chunk with the offset and end of the
+// member of each chunk of its content
+func (b *partialBlob) write(entry tarEntry, chunk func(offset, end int64, data []byte)) {
+	hdr := &tar.Header{Name: entry.name, Mode: 0o644, Typeflag: entry.typeflag, Linkname: entry.linkname}
+	if hdr.Typeflag == 0 {
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = int64(len(entry.body))
+	}
+	require.NoError(b.t, b.tw.WriteHeader(hdr))
+	for data := []byte(entry.body); len(data) > 0; {
+		n := min(len(data), partialChunkSize)
+		b.flush()
+		offset := int64(b.buf.Len())
+		_, err := b.tw.Write(data[:n])
+		require.NoError(b.t, err)
+		b.flush()
+		chunk(offset, int64(b.buf.Len()), data[:n])
+		data = data[n:]
+	}
+}
+
+func (b *partialBlob) close() {
+	require.NoError(b.t, b.tw.Close())
+	b.flush()
+}
+
+func estargzBlob(t *testing.T, entries []tarEntry) ([]byte, map[string]string) {
+	t.Helper()
+
+	b := newPartialBlob(t, func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(w), nil
+	})
+	toc := estargz.JTOC{Version: 1}
+	for _, entry := range entries {
+		e := &estargz.TOCEntry{Name: entry.name, Mode: 0o644, LinkName: entry.linkname}
+		switch entry.typeflag {
+		case tar.TypeDir:
+			e.Type = "dir"
+		case tar.TypeLink:
+			e.Type = "hardlink"
+		default:
+			e.Type = "reg"
+			e.Size = int64(len(entry.body))
+			e.Digest = digest.FromString(entry.body).String()
+		}
+		toc.Entries = append(toc.Entries, e)
+		var chunkOffset int64
+		b.write(entry, func(offset, _ int64, data []byte) {
+			if chunkOffset == 0 {
+				e.Offset = offset
+				e.ChunkSize = int64(len(data))
+			} else {
+				toc.Entries = append(toc.Entries, &estargz.TOCEntry{
+					Name:        entry.name,
+					Type:        "chunk",
+					Offset:      offset,
+					ChunkOffset: chunkOffset,
+					ChunkSize:   int64(len(data)),
+				})
+			}
+			chunkOffset += int64(len(data))
+		})
+	}
+	b.close()
+	tocDigest := appendEStargzTOC(t, &b.buf, toc)
+	return b.buf.Bytes(), map[string]string{estargz.TOCJSONDigestAnnotation: tocDigest.String()}
+}
+
+func zstdChunkedBlob(t *testing.T, entries []tarEntry) ([]byte, map[string]string) {
+	t.Helper()
+
+	b := newPartialBlob(t, archives.Zstd{}.OpenWriter)
+	var toc zstdChunkedTOC
+	toc.Version = 1
+	for _, entry := range entries {
+		e := zstdChunkedEntry{Name: entry.name, Mode: 0o644, Linkname: entry.linkname}
+		switch entry.typeflag {
+		case tar.TypeDir:
+			e.Type = "dir"
+		case tar.TypeLink:
+			e.Type = "hardlink"
+		default:
+			e.Type = "reg"
+			e.Size = int64(len(entry.body))
+			e.Digest = digest.FromString(entry.body).String()
+		}
+		toc.Entries = append(toc.Entries, e)
+		i := len(toc.Entries) - 1
+		var chunkOffset int64
+		b.write(entry, func(offset, end int64, data []byte) {
+			chunk := zstdChunkedEntry{
+				Name:        entry.name,
+				Type:        "chunk",
+				Offset:      offset,
+				EndOffset:   end,
+				ChunkOffset: chunkOffset,
+				ChunkSize:   int64(len(data)),
+			}
+			if bytes.Count(data, []byte{0}) == len(data) {
+				chunk.ChunkType = "zeros"
+			}
+			if chunkOffset == 0 {
+				toc.Entries[i].Offset, toc.Entries[i].EndOffset = chunk.Offset, chunk.EndOffset
+				toc.Entries[i].ChunkSize, toc.Entries[i].ChunkType = chunk.ChunkSize, chunk.ChunkType
+			} else {
+				toc.Entries = append(toc.Entries, chunk)
+			}
+			chunkOffset += int64(len(data))
+		})
+	}
+	b.close()
+
+	manifest, err := json.Marshal(toc)
+	require.NoError(t, err)
+	var compressed bytes.Buffer
+	zw, err := archives.Zstd{}.OpenWriter(&compressed)
+	require.NoError(t, err)
+	_, err = zw.Write(manifest)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	// the manifest is stored in a skippable frame
+	b.buf.Write(binary.LittleEndian.AppendUint32(nil, 0x184d2a50))
+	b.buf.Write(binary.LittleEndian.AppendUint32(nil, uint32(compressed.Len())))
+	offset := b.buf.Len()
+	b.buf.Write(compressed.Bytes())
+	return b.buf.Bytes(), map[string]string{
+		zstdChunkedManifestChecksum: digest.FromBytes(compressed.Bytes()).String(),
+		zstdChunkedManifestPosition: fmt.Sprintf("%d:%d:%d:1", offset, compressed.Len(), len(manifest)),
+	}
+}
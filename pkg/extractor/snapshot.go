@@ -0,0 +1,195 @@
+package extractor
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// UnpackSnapshotOpts holds unpack snapshot options
+type UnpackSnapshotOpts struct {
+	Context context.Context
+	// DiffID is the digest of the uncompressed layer, verified while the
+	// layer is unpacked
+	DiffID digest.Digest
+}
+
+// UnpackSnapshot unpacks a layer as is in the dir folder, so it can be
+// applied later on top of lower layers with ApplySnapshot. Whiteouts are
+// kept as empty files. The layer is unpacked in a temporary folder next to
+// dir and renamed once complete, so dir is either missing or complete. Like
+// ExtractLayers, ownership is not preserved and device nodes are skipped.
+func UnpackSnapshot(l Layer, dir string, opts UnpackSnapshotOpts) (err error) {
+	if err := os.MkdirAll(filepath.Dir(dir), 0o700); err != nil {
+		return err
+	}
+	tmpdir, err := os.MkdirTemp(filepath.Dir(dir), "."+filepath.Base(dir)+"-")
+	if err != nil {
+		return errors.Wrap(err, "cannot create snapshot folder")
+	}
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(tmpdir)
+		}
+	}()
+
+	if err := unpackSnapshot(l, tmpdir, opts); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpdir, dir); err != nil {
+		// unpacked by another extraction in the meantime
+		if _, serr := os.Stat(dir); serr == nil {
+			_ = os.RemoveAll(tmpdir)
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func unpackSnapshot(l Layer, dir string, opts UnpackSnapshotOpts) (err error) {
+	w, err := newDirWriter(dir, 0o700, l.Logger)
+	if err != nil {
+		return err
+	}
+	w.unprivileged = true
+	defer func() {
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	ls, err := decompressLayer(opts.Context, l)
+	if err != nil {
+		return err
+	}
+	// the error of a streamed blob, e.g. a digest mismatch, is returned on
+	// close
+	defer func() {
+		if cerr := ls.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	var verifier digest.Verifier
+	var r io.Reader = ls
+	if opts.DiffID != "" {
+		if err := opts.DiffID.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid diff ID %s", opts.DiffID)
+		}
+		verifier = opts.DiffID.Verifier()
+		r = io.TeeReader(ls, verifier)
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		name, err := normalizeArchivePath(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if name == "." || shouldSkipReservedWhiteoutPath(name) {
+			continue
+		}
+		if _, _, ok := whiteoutTarget(name); ok {
+			hdr = &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o600, ModTime: hdr.ModTime}
+		} else {
+			hdr.Name = name
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			if hdr.Linkname, err = normalizeArchivePath(hdr.Linkname); err != nil {
+				return err
+			}
+		}
+		if err := w.WriteEntry(hdr, tr); err != nil {
+			return errors.Wrapf(err, "cannot unpack %s", hdr.Name)
+		}
+	}
+
+	if verifier != nil {
+		// trailing padding of the tarball is part of the diff ID
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return err
+		}
+		if !verifier.Verified() {
+			return errors.Errorf("diff ID mismatch for layer %s", opts.DiffID)
+		}
+	}
+	return nil
+}
+
+// ApplySnapshotOpts holds apply snapshot options
+type ApplySnapshotOpts struct {
+	Logger   zerolog.Logger
+	Includes []string
+	// Hardlink hard links the files which cannot be reflinked instead of
+	// copying them. Hard linked files share their content with the
+	// snapshot, which is corrupted if they are modified in place.
+	Hardlink bool
+}
+
+// ApplySnapshot applies a layer unpacked by UnpackSnapshot on top of the
+// content of dest. Whiteouts are applied first, then the files of the layer
+// are cloned by reflink or copied like CloneTree does, or hard linked with
+// Hardlink.
+func ApplySnapshot(dir, dest string, opts ApplySnapshotOpts) error {
+	includes := includePaths(opts.Includes)
+
+	w, err := newDirWriter(dest, 0o700, opts.Logger)
+	if err != nil {
+		return err
+	}
+	if err := filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		target, opaque, ok := whiteoutTarget(filepath.ToSlash(rel))
+		if !ok || d.IsDir() || !pathIntersects(includes, target) {
+			return nil
+		}
+		if target == "" {
+			target = "."
+		}
+		if opaque {
+			opts.Logger.Debug().Msgf("Applying opaque whiteout %s", rel)
+		} else {
+			opts.Logger.Debug().Msgf("Applying whiteout %s", rel)
+		}
+		return w.Remove(target, opaque)
+	}); err != nil {
+		_ = w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return cloneTree(dir, dest, opts.Logger, opts.Hardlink, func(name string, d fs.DirEntry) bool {
+		if _, _, ok := whiteoutTarget(name); ok && !d.IsDir() {
+			return true
+		}
+		if d.IsDir() {
+			return !pathIntersects(includes, name)
+		}
+		return !fileIsIncluded(includes, name)
+	})
+}
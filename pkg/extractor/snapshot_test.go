@@ -0,0 +1,92 @@
+package extractor
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplySnapshotsInOrder(t *testing.T) {
+	root := t.TempDir()
+	dest := filepath.Join(root, "dist")
+
+	layer1 := filepath.Join(root, "layer1.tar")
+	writeTarFile(t, layer1, []tarEntry{
+		{name: "dir/", typeflag: tar.TypeDir},
+		{name: "dir/a.txt", body: "a"},
+		{name: "opaque/old.txt", body: "old"},
+		{name: "file.txt", body: "old"},
+	})
+	layer2 := filepath.Join(root, "layer2.tar")
+	writeTarFile(t, layer2, []tarEntry{
+		{name: "dir/.wh.a.txt"},
+		{name: "opaque/.wh..wh..opq"},
+		{name: "opaque/new.txt", body: "new"},
+		{name: "file.txt", body: "new"},
+		{name: "hardlink", typeflag: tar.TypeLink, linkname: "file.txt"},
+	})
+
+	for i, layer := range testLayers(layer1, layer2) {
+		dir := filepath.Join(root, "snapshots", string(rune('1'+i)))
+		require.NoError(t, UnpackSnapshot(layer, dir, UnpackSnapshotOpts{
+			Context: context.Background(),
+			DiffID:  fileDigest(t, layer.Filename),
+		}))
+		require.NoError(t, ApplySnapshot(dir, dest, ApplySnapshotOpts{
+			Logger: zerolog.New(io.Discard),
+		}))
+	}
+
+	// whiteouts are kept in the snapshot
+	require.FileExists(t, filepath.Join(root, "snapshots", "2", "dir", ".wh.a.txt"))
+
+	require.NoFileExists(t, filepath.Join(dest, "dir", "a.txt"))
+	require.NoFileExists(t, filepath.Join(dest, "dir", ".wh.a.txt"))
+	require.DirExists(t, filepath.Join(dest, "dir"))
+	require.NoFileExists(t, filepath.Join(dest, "opaque", "old.txt"))
+	requireFileBody(t, filepath.Join(dest, "opaque", "new.txt"), "new")
+	requireFileBody(t, filepath.Join(dest, "file.txt"), "new")
+	requireFileBody(t, filepath.Join(dest, "hardlink"), "new")
+
+	// files are not hard linked to the snapshot unless asked
+	snapfi, err := os.Stat(filepath.Join(root, "snapshots", "2", "file.txt"))
+	require.NoError(t, err)
+	destfi, err := os.Stat(filepath.Join(dest, "file.txt"))
+	require.NoError(t, err)
+	require.False(t, os.SameFile(snapfi, destfi))
+}
+
+func TestUnpackSnapshotRejectsDiffIDMismatch(t *testing.T) {
+	root := t.TempDir()
+	layer := filepath.Join(root, "layer.tar")
+	writeTarFile(t, layer, []tarEntry{{name: "file.txt", body: "content"}})
+
+	dir := filepath.Join(root, "snapshots", "layer")
+	err := UnpackSnapshot(testLayers(layer)[0], dir, UnpackSnapshotOpts{
+		Context: context.Background(),
+		DiffID:  digest.FromString("other"),
+	})
+	require.ErrorContains(t, err, "diff ID mismatch")
+
+	entries, err := os.ReadDir(filepath.Join(root, "snapshots"))
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func fileDigest(t *testing.T, filename string) digest.Digest {
+	t.Helper()
+
+	f, err := os.Open(filename)
+	require.NoError(t, err)
+	defer f.Close()
+	dgst, err := digest.FromReader(f)
+	require.NoError(t, err)
+	return dgst
+}
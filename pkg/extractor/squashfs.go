@@ -0,0 +1,638 @@
+package extractor
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	squashfsMagic         = 0x73717368
+	squashfsBlockLog      = 17
+	squashfsBlockSize     = 1 << squashfsBlockLog
+	squashfsMetadataSize  = 8192
+	squashfsSuperblockLen = 96
+	squashfsCompGzip      = 1
+	squashfsNoTable       = math.MaxUint64
+	squashfsNoIndex       = math.MaxUint32
+
+	squashfsFlagNoFragments = 0x0010
+	squashfsFlagNoXattrs    = 0x0200
+
+	squashfsMetadataUncompressed = 1 << 15
+	squashfsDataUncompressed     = 1 << 24
+
+	squashfsTypeDir     = 1
+	squashfsTypeFile    = 2
+	squashfsTypeSymlink = 3
+	squashfsTypeBlock   = 4
+	squashfsTypeChar    = 5
+	squashfsTypeFifo    = 6
+	// extended inode types follow the basic ones
+	squashfsTypeExtended = 7
+)
+
+// squashfsWriter writes entries as a SquashFS 4.0 image compressed with
+// gzip. Content of regular files is written as it comes, while inodes,
+// directories, ids and xattrs are written on close. Fragments are not used
+// so the tail of each file gets its own block.
+type squashfsWriter struct {
+	out   *imageOutput
+	tree  *imageTree
+	pos   int64
+	mtime int64
+	z     *zlib.Writer
+	zbuf  bytes.Buffer
+	buf   []byte
+
+	inodes *squashfsMetaWriter
+	dirs   *squashfsMetaWriter
+	ids    []uint32
+	idx    map[uint32]uint16
+	xattrs squashfsXattrs
+}
+
+type squashfsXattrs struct {
+	kv  *squashfsMetaWriter
+	ids []squashfsXattrID
+	idx map[string]uint32
+}
+
+type squashfsXattrID struct {
+	Ref   uint64
+	Count uint32
+	Size  uint32
+}
+
+func newSquashfsWriter(w io.Writer) (*squashfsWriter, error) {
+	out, err := newImageOutput(w)
+	if err != nil {
+		return nil, err
+	}
+	s := &squashfsWriter{
+		out:  out,
+		tree: newImageTree(),
+		pos:  squashfsSuperblockLen,
+		buf:  make([]byte, squashfsBlockSize),
+		idx:  map[uint32]uint16{},
+		xattrs: squashfsXattrs{
+			idx: map[string]uint32{},
+		},
+	}
+	s.z = zlib.NewWriter(&s.zbuf)
+	s.inodes = &squashfsMetaWriter{s: s}
+	s.dirs = &squashfsMetaWriter{s: s}
+	s.xattrs.kv = &squashfsMetaWriter{s: s}
+	// superblock is written on close
+	if _, err := out.Write(make([]byte, squashfsSuperblockLen)); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *squashfsWriter) WriteEntry(hdr *tar.Header, r io.Reader) error {
+	inode, err := s.tree.add(hdr, nil)
+	if err != nil {
+		return err
+	}
+	return s.writeContent(inode, r)
+}
+
+func (s *squashfsWriter) WriteHardlinks(hdr *tar.Header, r io.Reader, links []*tar.Header) error {
+	inode, err := s.tree.add(hdr, nil)
+	if err != nil {
+		return err
+	}
+	if err := s.writeContent(inode, r); err != nil {
+		return err
+	}
+	for _, link := range links {
+		h := *hdr
+		h.Name = link.Name
+		if _, err := s.tree.add(&h, inode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *squashfsWriter) writeContent(inode *imageInode, r io.Reader) error {
+	hdr := inode.hdr
+	if t := hdr.ModTime.Unix(); t > s.mtime {
+		s.mtime = t
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+	inode.start = s.pos
+	var size int64
+	for size < hdr.Size {
+		n := int64(squashfsBlockSize)
+		if rem := hdr.Size - size; rem < n {
+			n = rem
+		}
+		if r == nil {
+			return errors.Errorf("short read for %s: %d/%d bytes", hdr.Name, size, hdr.Size)
+		}
+		if _, err := io.ReadFull(r, s.buf[:n]); err != nil {
+			return errors.Wrapf(err, "short read for %s", hdr.Name)
+		}
+		data, compressed, err := s.compress(s.buf[:n])
+		if err != nil {
+			return err
+		}
+		if _, err := s.out.Write(data); err != nil {
+			return err
+		}
+		blockSize := uint32(len(data))
+		if !compressed {
+			blockSize |= squashfsDataUncompressed
+		}
+		inode.blocks = append(inode.blocks, blockSize)
+		s.pos += int64(len(data))
+		size += n
+	}
+	return nil
+}
+
+// compress returns the compressed data, or the data itself if compression
+// does not make it smaller
+func (s *squashfsWriter) compress(p []byte) ([]byte, bool, error) {
+	s.zbuf.Reset()
+	s.z.Reset(&s.zbuf)
+	if _, err := s.z.Write(p); err != nil {
+		return nil, false, err
+	}
+	if err := s.z.Close(); err != nil {
+		return nil, false, err
+	}
+	if s.zbuf.Len() < len(p) {
+		return s.zbuf.Bytes(), true, nil
+	}
+	return p, false, nil
+}
+
+func (s *squashfsWriter) Close() error {
+	if err := s.writeImage(); err != nil {
+		return err
+	}
+	return s.out.Close()
+}
+
+func (s *squashfsWriter) writeImage() error {
+	// inodes are numbered and written children first, so directories can
+	// reference the inodes of their entries
+	var nodes []*imageNode
+	var walk func(n *imageNode)
+	walk = func(n *imageNode) {
+		for _, child := range n.sortedChildren() {
+			if child.children != nil {
+				walk(child)
+			} else if child.inode.ino == 0 {
+				child.inode.ino = uint32(len(nodes) + 1)
+				nodes = append(nodes, child)
+			}
+		}
+		n.inode.ino = uint32(len(nodes) + 1)
+		nodes = append(nodes, n)
+	}
+	walk(s.tree.root)
+
+	for _, n := range nodes {
+		if err := s.writeInode(n, uint32(len(nodes))); err != nil {
+			return errors.Wrapf(err, "cannot write inode for %s", n.inode.hdr.Name)
+		}
+	}
+
+	sb := squashfsSuperblock{
+		Magic:         squashfsMagic,
+		InodeCount:    uint32(len(nodes)),
+		ModTime:       uint32(s.mtime),
+		BlockSize:     squashfsBlockSize,
+		Compression:   squashfsCompGzip,
+		BlockLog:      squashfsBlockLog,
+		Flags:         squashfsFlagNoFragments,
+		VersionMajor:  4,
+		RootInode:     s.tree.root.inode.ref,
+		FragmentTable: squashfsNoTable,
+		ExportTable:   squashfsNoTable,
+		XattrIDTable:  squashfsNoTable,
+		IDCount:       uint16(len(s.ids)),
+		InodeTable:    uint64(s.pos),
+	}
+	if err := s.writeMetaTable(s.inodes); err != nil {
+		return err
+	}
+	sb.DirectoryTable = uint64(s.pos)
+	if err := s.writeMetaTable(s.dirs); err != nil {
+		return err
+	}
+
+	ids := &squashfsMetaWriter{s: s}
+	for _, id := range s.ids {
+		if err := binary.Write(ids, binary.LittleEndian, id); err != nil {
+			return err
+		}
+	}
+	idTable, err := s.writeIndexedTable(ids, nil)
+	if err != nil {
+		return err
+	}
+	sb.IDTable = idTable
+
+	if len(s.xattrs.ids) == 0 {
+		sb.Flags |= squashfsFlagNoXattrs
+	} else {
+		kvTable := uint64(s.pos)
+		if err := s.writeMetaTable(s.xattrs.kv); err != nil {
+			return err
+		}
+		xids := &squashfsMetaWriter{s: s}
+		for _, id := range s.xattrs.ids {
+			if err := binary.Write(xids, binary.LittleEndian, id); err != nil {
+				return err
+			}
+		}
+		// the xattr id table is preceded by the location of the kv table
+		// and the number of ids
+		var header bytes.Buffer
+		_ = binary.Write(&header, binary.LittleEndian, kvTable)
+		_ = binary.Write(&header, binary.LittleEndian, uint32(len(s.xattrs.ids)))
+		_ = binary.Write(&header, binary.LittleEndian, uint32(0))
+		xidTable, err := s.writeIndexedTable(xids, header.Bytes())
+		if err != nil {
+			return err
+		}
+		sb.XattrIDTable = xidTable
+	}
+
+	sb.BytesUsed = uint64(s.pos)
+	// image is padded to 4K like mksquashfs does
+	if rem := s.pos % 4096; rem != 0 {
+		if err := s.writeTable(make([]byte, 4096-rem)); err != nil {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, sb); err != nil {
+		return err
+	}
+	return s.out.writeAt(buf.Bytes(), 0)
+}
+
+func (s *squashfsWriter) writeTable(p []byte) error {
+	if _, err := s.out.Write(p); err != nil {
+		return err
+	}
+	s.pos += int64(len(p))
+	return nil
+}
+
+func (s *squashfsWriter) writeMetaTable(m *squashfsMetaWriter) error {
+	if err := m.finish(); err != nil {
+		return err
+	}
+	return s.writeTable(m.buf.Bytes())
+}
+
+// writeIndexedTable writes the metadata blocks of a table followed by the
+// header and the location of each block. It returns the location of the
+// header.
+func (s *squashfsWriter) writeIndexedTable(m *squashfsMetaWriter, header []byte) (uint64, error) {
+	start := uint64(s.pos)
+	if err := s.writeMetaTable(m); err != nil {
+		return 0, err
+	}
+	buf := bytes.NewBuffer(header)
+	for _, block := range m.blocks {
+		_ = binary.Write(buf, binary.LittleEndian, start+block)
+	}
+	pos := uint64(s.pos)
+	return pos, s.writeTable(buf.Bytes())
+}
+
+func (s *squashfsWriter) id(v int) (uint16, error) {
+	if v < 0 || v > math.MaxUint32 {
+		return 0, errors.Errorf("invalid id %d", v)
+	}
+	if i, ok := s.idx[uint32(v)]; ok {
+		return i, nil
+	}
+	if len(s.ids) > math.MaxUint16 {
+		return 0, errors.New("too many uids and gids")
+	}
+	i := uint16(len(s.ids))
+	s.ids = append(s.ids, uint32(v))
+	s.idx[uint32(v)] = i
+	return i, nil
+}
+
+// xattr returns the index of the xattrs of an entry in the xattr id table
+func (s *squashfsWriter) xattr(hdr *tar.Header) (uint32, error) {
+	var kv bytes.Buffer
+	var count uint32
+	for _, xattr := range imageXattrs(hdr) {
+		var typ uint16
+		var name string
+		switch {
+		case strings.HasPrefix(xattr.name, "user."):
+			typ, name = 0, strings.TrimPrefix(xattr.name, "user.")
+		case strings.HasPrefix(xattr.name, "trusted."):
+			typ, name = 1, strings.TrimPrefix(xattr.name, "trusted.")
+		case strings.HasPrefix(xattr.name, "security."):
+			typ, name = 2, strings.TrimPrefix(xattr.name, "security.")
+		default:
+			// squashfs cannot store other namespaces
+			continue
+		}
+		_ = binary.Write(&kv, binary.LittleEndian, typ)
+		_ = binary.Write(&kv, binary.LittleEndian, uint16(len(name)))
+		kv.WriteString(name)
+		_ = binary.Write(&kv, binary.LittleEndian, uint32(len(xattr.value)))
+		kv.WriteString(xattr.value)
+		count++
+	}
+	if count == 0 {
+		return squashfsNoIndex, nil
+	}
+	if i, ok := s.xattrs.idx[kv.String()]; ok {
+		return i, nil
+	}
+	ref := s.xattrs.kv.ref()
+	if _, err := s.xattrs.kv.Write(kv.Bytes()); err != nil {
+		return 0, err
+	}
+	i := uint32(len(s.xattrs.ids))
+	s.xattrs.ids = append(s.xattrs.ids, squashfsXattrID{
+		Ref:   ref,
+		Count: count,
+		Size:  uint32(kv.Len()),
+	})
+	s.xattrs.idx[kv.String()] = i
+	return i, nil
+}
+
+func (s *squashfsWriter) writeInode(n *imageNode, count uint32) error {
+	inode := n.inode
+	hdr := inode.hdr
+	uid, err := s.id(hdr.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := s.id(hdr.Gid)
+	if err != nil {
+		return err
+	}
+	xattr, err := s.xattr(hdr)
+	if err != nil {
+		return err
+	}
+
+	var typ uint16
+	var body bytes.Buffer
+	le := func(v any) {
+		_ = binary.Write(&body, binary.LittleEndian, v)
+	}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		ref, size, err := s.writeDirectory(n)
+		if err != nil {
+			return err
+		}
+		parent := count + 1
+		if n.parent != nil {
+			parent = n.parent.inode.ino
+		}
+		nlink := uint32(2 + n.subdirs())
+		if xattr == squashfsNoIndex && size <= math.MaxUint16 {
+			typ = squashfsTypeDir
+			le(uint32(ref >> 16))
+			le(nlink)
+			le(uint16(size))
+			le(uint16(ref & 0xffff))
+			le(parent)
+		} else {
+			typ = squashfsTypeDir + squashfsTypeExtended
+			le(nlink)
+			le(size)
+			le(uint32(ref >> 16))
+			le(parent)
+			le(uint16(0)) // no directory index
+			le(uint16(ref & 0xffff))
+			le(xattr)
+		}
+	case tar.TypeReg:
+		if xattr == squashfsNoIndex && inode.nlink == 1 && inode.start <= math.MaxUint32 && hdr.Size <= math.MaxUint32 {
+			typ = squashfsTypeFile
+			le(uint32(inode.start))
+			le(uint32(squashfsNoIndex)) // no fragment
+			le(uint32(0))
+			le(uint32(hdr.Size))
+		} else {
+			typ = squashfsTypeFile + squashfsTypeExtended
+			le(uint64(inode.start))
+			le(uint64(hdr.Size))
+			le(uint64(0)) // no sparse blocks
+			le(inode.nlink)
+			le(uint32(squashfsNoIndex)) // no fragment
+			le(uint32(0))
+			le(xattr)
+		}
+		le(inode.blocks)
+	case tar.TypeSymlink:
+		typ = squashfsTypeSymlink
+		le(inode.nlink)
+		le(uint32(len(hdr.Linkname)))
+		body.WriteString(hdr.Linkname)
+		if xattr != squashfsNoIndex {
+			typ += squashfsTypeExtended
+			le(xattr)
+		}
+	case tar.TypeBlock, tar.TypeChar:
+		typ = squashfsTypeBlock
+		if hdr.Typeflag == tar.TypeChar {
+			typ = squashfsTypeChar
+		}
+		le(inode.nlink)
+		le(encodeDev(hdr.Devmajor, hdr.Devminor))
+		if xattr != squashfsNoIndex {
+			typ += squashfsTypeExtended
+			le(xattr)
+		}
+	case tar.TypeFifo:
+		typ = squashfsTypeFifo
+		le(inode.nlink)
+		if xattr != squashfsNoIndex {
+			typ += squashfsTypeExtended
+			le(xattr)
+		}
+	}
+
+	inode.ref = s.inodes.ref()
+	if err := binary.Write(s.inodes, binary.LittleEndian, squashfsInodeHeader{
+		Type:  typ,
+		Mode:  uint16(hdr.Mode & 0o7777),
+		UID:   uid,
+		GID:   gid,
+		MTime: uint32(hdr.ModTime.Unix()),
+		Ino:   inode.ino,
+	}); err != nil {
+		return err
+	}
+	_, err = s.inodes.Write(body.Bytes())
+	return err
+}
+
+// writeDirectory writes the entries of a directory to the directory table.
+// It returns the location of the entries and the size expected by the
+// directory inode.
+func (s *squashfsWriter) writeDirectory(n *imageNode) (uint64, uint32, error) {
+	var buf bytes.Buffer
+	le := func(v any) {
+		_ = binary.Write(&buf, binary.LittleEndian, v)
+	}
+	children := n.sortedChildren()
+	for i := 0; i < len(children); {
+		// entries of a header have inodes in the same metadata block and
+		// inode numbers close to the one of the header
+		base := children[i].inode
+		j := i
+		for ; j < len(children) && j-i < 256; j++ {
+			inode := children[j].inode
+			if inode.ref>>16 != base.ref>>16 {
+				break
+			}
+			if d := int64(inode.ino) - int64(base.ino); d < math.MinInt16 || d > math.MaxInt16 {
+				break
+			}
+		}
+		le(uint32(j - i - 1))
+		le(uint32(base.ref >> 16))
+		le(base.ino)
+		for _, child := range children[i:j] {
+			if len(child.name) > 256 {
+				return 0, 0, errors.Errorf("name %s is too long", child.name)
+			}
+			le(uint16(child.inode.ref & 0xffff))
+			le(int16(int64(child.inode.ino) - int64(base.ino)))
+			le(squashfsBasicType(child.inode.hdr))
+			le(uint16(len(child.name) - 1))
+			buf.WriteString(child.name)
+		}
+		i = j
+	}
+	ref := s.dirs.ref()
+	if _, err := s.dirs.Write(buf.Bytes()); err != nil {
+		return 0, 0, err
+	}
+	// size includes the . and .. entries that are not stored
+	return ref, uint32(buf.Len() + 3), nil
+}
+
+func squashfsBasicType(hdr *tar.Header) uint16 {
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return squashfsTypeDir
+	case tar.TypeSymlink:
+		return squashfsTypeSymlink
+	case tar.TypeBlock:
+		return squashfsTypeBlock
+	case tar.TypeChar:
+		return squashfsTypeChar
+	case tar.TypeFifo:
+		return squashfsTypeFifo
+	default:
+		return squashfsTypeFile
+	}
+}
+
+type squashfsSuperblock struct {
+	Magic          uint32
+	InodeCount     uint32
+	ModTime        uint32
+	BlockSize      uint32
+	FragmentCount  uint32
+	Compression    uint16
+	BlockLog       uint16
+	Flags          uint16
+	IDCount        uint16
+	VersionMajor   uint16
+	VersionMinor   uint16
+	RootInode      uint64
+	BytesUsed      uint64
+	IDTable        uint64
+	XattrIDTable   uint64
+	InodeTable     uint64
+	DirectoryTable uint64
+	FragmentTable  uint64
+	ExportTable    uint64
+}
+
+type squashfsInodeHeader struct {
+	Type  uint16
+	Mode  uint16
+	UID   uint16
+	GID   uint16
+	MTime uint32
+	Ino   uint32
+}
+
+// squashfsMetaWriter writes a table as metadata blocks of 8K that are
+// compressed as they fill up.
+type squashfsMetaWriter struct {
+	s      *squashfsWriter
+	buf    bytes.Buffer
+	cur    []byte
+	blocks []uint64
+}
+
+// ref returns the location of the next byte written: the start of its
+// metadata block relative to the table and the offset in the block
+func (m *squashfsMetaWriter) ref() uint64 {
+	return uint64(m.buf.Len())<<16 | uint64(len(m.cur))
+}
+
+func (m *squashfsMetaWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		c := min(squashfsMetadataSize-len(m.cur), len(p))
+		m.cur = append(m.cur, p[:c]...)
+		p = p[c:]
+		if len(m.cur) == squashfsMetadataSize {
+			if err := m.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (m *squashfsMetaWriter) flush() error {
+	data, compressed, err := m.s.compress(m.cur)
+	if err != nil {
+		return err
+	}
+	size := uint16(len(data))
+	if !compressed {
+		size |= squashfsMetadataUncompressed
+	}
+	m.blocks = append(m.blocks, uint64(m.buf.Len()))
+	_ = binary.Write(&m.buf, binary.LittleEndian, size)
+	m.buf.Write(data)
+	m.cur = m.cur[:0]
+	return nil
+}
+
+// finish flushes the last block
+func (m *squashfsMetaWriter) finish() error {
+	if len(m.cur) > 0 {
+		return m.flush()
+	}
+	return nil
+}
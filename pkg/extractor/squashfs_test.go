@@ -0,0 +1,254 @@
+package extractor
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeLayersWritesSquashfs(t *testing.T) {
+	root := t.TempDir()
+
+	big := strings.Repeat("0123456789", squashfsBlockSize/5)
+	layer1 := filepath.Join(root, "layer1.tar")
+	writeTarFile(t, layer1, []tarEntry{
+		{name: "bin/", typeflag: tar.TypeDir},
+		{name: "bin/busybox", body: "busybox", mode: 0o755},
+		{name: "bin/sh", typeflag: tar.TypeLink, linkname: "bin/busybox"},
+		{name: "bin/ls", typeflag: tar.TypeSymlink, linkname: "busybox"},
+		{name: "dev/console", typeflag: tar.TypeChar, mode: 0o600},
+		{name: "etc/big", body: big},
+		{name: "etc/removed", body: "removed"},
+	})
+
+	layer2 := filepath.Join(root, "layer2.tar")
+	writeTarFile(t, layer2, []tarEntry{
+		{name: "etc/.wh.removed"},
+	})
+
+	var buf bytes.Buffer
+	w, err := NewArchiveWriter(OutputFormatSquashfs, &buf)
+	require.NoError(t, err)
+	require.NoError(t, MergeLayers(testLayers(layer1, layer2), w, MergeOpts{
+		Context: context.Background(),
+	}))
+	require.NoError(t, w.Close())
+	require.Zero(t, buf.Len()%4096)
+
+	entries := readSquashfs(t, buf.Bytes())
+	require.Equal(t, []string{"bin", "bin/busybox", "bin/ls", "bin/sh", "dev", "dev/console", "etc", "etc/big"}, squashfsNames(entries))
+
+	require.Equal(t, uint16(squashfsTypeFile+squashfsTypeExtended), entries["bin/busybox"].typ)
+	require.Equal(t, uint16(0o755), entries["bin/busybox"].mode)
+	require.Equal(t, "busybox", entries["bin/busybox"].body)
+	require.Equal(t, entries["bin/busybox"].ino, entries["bin/sh"].ino)
+	require.Equal(t, "busybox", entries["bin/sh"].body)
+
+	require.Equal(t, uint16(squashfsTypeSymlink), entries["bin/ls"].typ)
+	require.Equal(t, "busybox", entries["bin/ls"].body)
+	require.Equal(t, uint16(squashfsTypeChar), entries["dev/console"].typ)
+	require.Equal(t, big, entries["etc/big"].body)
+}
+
+func TestSquashfsWriterIsReproducible(t *testing.T) {
+	write := func() []byte {
+		var buf bytes.Buffer
+		w, err := newSquashfsWriter(&buf)
+		require.NoError(t, err)
+		require.NoError(t, w.WriteEntry(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     "etc/passwd",
+			Mode:     0o644,
+			Size:     4,
+			Uid:      1000,
+			Gid:      2000,
+			PAXRecords: map[string]string{
+				paxXattrPrefix + "user.foo": "bar",
+			},
+		}, strings.NewReader("root")))
+		require.NoError(t, w.Close())
+		return buf.Bytes()
+	}
+
+	data := write()
+	require.Equal(t, data, write())
+
+	entries := readSquashfs(t, data)
+	require.Equal(t, uint16(squashfsTypeFile+squashfsTypeExtended), entries["etc/passwd"].typ)
+	require.Equal(t, uint32(1000), entries["etc/passwd"].uid)
+	require.Equal(t, uint32(2000), entries["etc/passwd"].gid)
+	require.Equal(t, "root", entries["etc/passwd"].body)
+	require.Zero(t, entries["etc/passwd"].xattr)
+}
+
+type squashfsEntry struct {
+	typ   uint16
+	mode  uint16
+	uid   uint32
+	gid   uint32
+	ino   uint32
+	xattr uint32
+	body  string
+}
+
+func squashfsNames(entries map[string]squashfsEntry) []string {
+	var names []string
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// readSquashfs reads the entries of a squashfs image written by
+// squashfsWriter
+func readSquashfs(t *testing.T, data []byte) map[string]squashfsEntry {
+	t.Helper()
+
+	var sb squashfsSuperblock
+	require.NoError(t, binary.Read(bytes.NewReader(data), binary.LittleEndian, &sb))
+	require.Equal(t, uint32(squashfsMagic), sb.Magic)
+	require.Equal(t, uint16(4), sb.VersionMajor)
+
+	inflate := func(p []byte) []byte {
+		zr, err := zlib.NewReader(bytes.NewReader(p))
+		require.NoError(t, err)
+		out, err := io.ReadAll(zr)
+		require.NoError(t, err)
+		return out
+	}
+	// readMeta reads the metadata blocks of a table and maps the start of
+	// each block to its offset in the uncompressed table
+	readMeta := func(start, end uint64) ([]byte, map[uint64]int) {
+		var table []byte
+		blocks := map[uint64]int{}
+		for pos := start; pos < end; {
+			size := binary.LittleEndian.Uint16(data[pos:])
+			n := uint64(size &^ squashfsMetadataUncompressed)
+			block := data[pos+2 : pos+2+n]
+			blocks[pos-start] = len(table)
+			if size&squashfsMetadataUncompressed == 0 {
+				block = inflate(block)
+			}
+			table = append(table, block...)
+			pos += 2 + n
+		}
+		return table, blocks
+	}
+	inodes, inodeBlocks := readMeta(sb.InodeTable, sb.DirectoryTable)
+	dirs, dirBlocks := readMeta(sb.DirectoryTable, binary.LittleEndian.Uint64(data[sb.IDTable:]))
+	idTable, _ := readMeta(binary.LittleEndian.Uint64(data[sb.IDTable:]), sb.IDTable)
+
+	entries := map[string]squashfsEntry{}
+	var walk func(name string, ref uint64)
+	walk = func(name string, ref uint64) {
+		r := bytes.NewReader(inodes[inodeBlocks[ref>>16]+int(ref&0xffff):])
+		var hdr squashfsInodeHeader
+		require.NoError(t, binary.Read(r, binary.LittleEndian, &hdr))
+		entry := squashfsEntry{
+			typ:   hdr.Type,
+			mode:  hdr.Mode,
+			uid:   binary.LittleEndian.Uint32(idTable[hdr.UID*4:]),
+			gid:   binary.LittleEndian.Uint32(idTable[hdr.GID*4:]),
+			ino:   hdr.Ino,
+			xattr: squashfsNoIndex,
+		}
+		le := func(v any) {
+			require.NoError(t, binary.Read(r, binary.LittleEndian, v))
+		}
+
+		var dirBlock, dirSize, fileSize uint32
+		var dirOffset uint16
+		var start uint64
+		var u16 uint16
+		var u32 uint32
+		var u64 uint64
+		switch hdr.Type {
+		case squashfsTypeDir:
+			le(&dirBlock)
+			le(&u32)
+			le(&u16)
+			dirSize = uint32(u16)
+			le(&dirOffset)
+		case squashfsTypeDir + squashfsTypeExtended:
+			le(&u32)
+			le(&dirSize)
+			le(&dirBlock)
+			le(&u32)
+			le(&u16)
+			le(&dirOffset)
+			le(&entry.xattr)
+		case squashfsTypeFile:
+			le(&u32)
+			start = uint64(u32)
+			le(&u32)
+			le(&u32)
+			le(&fileSize)
+		case squashfsTypeFile + squashfsTypeExtended:
+			le(&start)
+			le(&u64)
+			fileSize = uint32(u64)
+			le(&u64)
+			le(&u32)
+			le(&u32)
+			le(&u32)
+			le(&entry.xattr)
+		case squashfsTypeSymlink:
+			le(&u32)
+			le(&u32)
+			target := make([]byte, u32)
+			le(target)
+			entry.body = string(target)
+		}
+
+		switch hdr.Type {
+		case squashfsTypeFile, squashfsTypeFile + squashfsTypeExtended:
+			var body []byte
+			for uint32(len(body)) < fileSize {
+				var size uint32
+				le(&size)
+				block := data[start : start+uint64(size&^squashfsDataUncompressed)]
+				start += uint64(len(block))
+				if size&squashfsDataUncompressed == 0 {
+					block = inflate(block)
+				}
+				body = append(body, block...)
+			}
+			entry.body = string(body)
+		case squashfsTypeDir, squashfsTypeDir + squashfsTypeExtended:
+			listing := bytes.NewReader(dirs[dirBlocks[uint64(dirBlock)]+int(dirOffset):][:dirSize-3])
+			for listing.Len() > 0 {
+				var count, inodeStart, base uint32
+				for _, v := range []any{&count, &inodeStart, &base} {
+					require.NoError(t, binary.Read(listing, binary.LittleEndian, v))
+				}
+				for range count + 1 {
+					var offset, typ, nameSize uint16
+					var diff int16
+					for _, v := range []any{&offset, &diff, &typ, &nameSize} {
+						require.NoError(t, binary.Read(listing, binary.LittleEndian, v))
+					}
+					child := make([]byte, nameSize+1)
+					_, err := io.ReadFull(listing, child)
+					require.NoError(t, err)
+					walk(path.Join(name, string(child)), uint64(inodeStart)<<16|uint64(offset))
+				}
+			}
+		}
+		if name != "" {
+			entries[name] = entry
+		}
+	}
+	walk("", sb.RootInode)
+	return entries
+}
@@ -0,0 +1,106 @@
+package extractor
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/pkg/errors"
+)
+
+// tocHeaders returns the headers of an eStargz layer from its table of
+// contents, in the order of the tarball, so the layer does not need to be
+// decompressed to be scanned. ok is false if the blob is not an eStargz
+// layer.
+func tocHeaders(filename string) (_ []*tar.Header, ok bool, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	sr := io.NewSectionReader(f, 0, fi.Size())
+	tocOffset, footerSize, err := estargz.OpenFooter(sr)
+	if err != nil {
+		return nil, false, nil
+	}
+	toc, _, err := new(estargz.GzipDecompressor).ParseTOC(io.NewSectionReader(f, tocOffset, fi.Size()-tocOffset-footerSize))
+	if err != nil {
+		return nil, false, errors.Wrap(err, "cannot parse eStargz TOC")
+	}
+
+	// user and group names are only set for the first entry of an id
+	unames := map[int]string{}
+	gnames := map[int]string{}
+	var headers []*tar.Header
+	for _, e := range toc.Entries {
+		if e.Type == "chunk" {
+			continue
+		}
+		if e.Uname != "" {
+			unames[e.UID] = e.Uname
+		}
+		if e.Gname != "" {
+			gnames[e.GID] = e.Gname
+		}
+		hdr, err := tocHeader(e)
+		if err != nil {
+			return nil, false, err
+		}
+		hdr.Uname = unames[e.UID]
+		hdr.Gname = gnames[e.GID]
+		headers = append(headers, hdr)
+	}
+	return headers, true, nil
+}
+
+func tocHeader(e *estargz.TOCEntry) (*tar.Header, error) {
+	hdr := &tar.Header{
+		Name:     e.Name,
+		Mode:     e.Mode,
+		Uid:      e.UID,
+		Gid:      e.GID,
+		Linkname: e.LinkName,
+		Devmajor: int64(e.DevMajor),
+		Devminor: int64(e.DevMinor),
+	}
+	switch e.Type {
+	case "dir":
+		hdr.Typeflag = tar.TypeDir
+	case "reg":
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = e.Size
+	case "symlink":
+		hdr.Typeflag = tar.TypeSymlink
+	case "hardlink":
+		hdr.Typeflag = tar.TypeLink
+	case "char":
+		hdr.Typeflag = tar.TypeChar
+	case "block":
+		hdr.Typeflag = tar.TypeBlock
+	case "fifo":
+		hdr.Typeflag = tar.TypeFifo
+	default:
+		return nil, errors.Errorf("unknown eStargz entry type %q for %s", e.Type, e.Name)
+	}
+	if e.ModTime3339 != "" {
+		mtime, err := time.Parse(time.RFC3339, e.ModTime3339)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid modification time for %s", e.Name)
+		}
+		hdr.ModTime = mtime
+	}
+	for k, v := range e.Xattrs {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = map[string]string{}
+		}
+		hdr.PAXRecords["SCHILY.xattr."+k] = string(v)
+	}
+	return hdr, nil
+}
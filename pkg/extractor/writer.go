@@ -0,0 +1,272 @@
+package extractor
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"io"
+	"path"
+	"time"
+
+	"github.com/mholt/archives"
+	"github.com/pkg/errors"
+)
+
+// OutputFormat defines how the extracted content is written
+type OutputFormat string
+
+const (
+	OutputFormatDir        OutputFormat = "dir"
+	OutputFormatTar        OutputFormat = "tar"
+	OutputFormatTarGz      OutputFormat = "tar.gz"
+	OutputFormatTarZst     OutputFormat = "tar.zst"
+	OutputFormatZip        OutputFormat = "zip"
+	OutputFormatCpio       OutputFormat = "cpio"
+	OutputFormatCpioGz     OutputFormat = "cpio.gz"
+	OutputFormatCpioZst    OutputFormat = "cpio.zst"
+	OutputFormatSquashfs   OutputFormat = "squashfs"
+	OutputFormatErofs      OutputFormat = "erofs"
+	OutputFormatOCI        OutputFormat = "oci"
+	OutputFormatOCIArchive OutputFormat = "oci-archive"
+)
+
+// IsArchive returns true if the output format is a single archive stream
+// or filesystem image
+func (f OutputFormat) IsArchive() bool {
+	switch f {
+	case OutputFormatTar, OutputFormatTarGz, OutputFormatTarZst, OutputFormatZip,
+		OutputFormatCpio, OutputFormatCpioGz, OutputFormatCpioZst,
+		OutputFormatSquashfs, OutputFormatErofs:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsOCI returns true if the output format repacks the extracted content as
+// an OCI image
+func (f OutputFormat) IsOCI() bool {
+	return f == OutputFormatOCI || f == OutputFormatOCIArchive
+}
+
+// EntryWriter writes the entries of a merged filesystem. Entry names are
+// slash-separated paths relative to the root, without leading or trailing
+// slash. The reader is only set for regular files.
+type EntryWriter interface {
+	WriteEntry(hdr *tar.Header, r io.Reader) error
+	Close() error
+}
+
+// HardlinkWriter is implemented by entry writers that can represent hard
+// links. WriteHardlinks writes a regular file along with the hard links to
+// it. Other writers get a copy of the content for each link.
+type HardlinkWriter interface {
+	EntryWriter
+	WriteHardlinks(hdr *tar.Header, r io.Reader, links []*tar.Header) error
+}
+
+// WhiteoutWriter is implemented by entry writers that may already hold
+// content, like a folder. Whiteouts of the merged layers are applied with
+// Remove before entries are written: the entry at name is removed, or only
+// its children if opaque is set.
+type WhiteoutWriter interface {
+	EntryWriter
+	Remove(name string, opaque bool) error
+}
+
+// NewArchiveWriter creates an entry writer for the given archive format
+func NewArchiveWriter(format OutputFormat, w io.Writer) (EntryWriter, error) {
+	switch format {
+	case OutputFormatTar:
+		return newTarWriter(w, nil), nil
+	case OutputFormatTarGz, OutputFormatTarZst:
+		cw, err := compressWriter(format, w)
+		if err != nil {
+			return nil, err
+		}
+		return newTarWriter(cw, cw), nil
+	case OutputFormatCpio:
+		return newCpioWriter(w, nil), nil
+	case OutputFormatCpioGz, OutputFormatCpioZst:
+		cw, err := compressWriter(format, w)
+		if err != nil {
+			return nil, err
+		}
+		return newCpioWriter(cw, cw), nil
+	case OutputFormatZip:
+		return &zipWriter{zw: zip.NewWriter(w)}, nil
+	case OutputFormatSquashfs:
+		return newSquashfsWriter(w)
+	case OutputFormatErofs:
+		return newErofsWriter(w)
+	default:
+		return nil, errors.Errorf("unsupported archive format %q", format)
+	}
+}
+
+func compressWriter(format OutputFormat, w io.Writer) (io.WriteCloser, error) {
+	switch path.Ext(string(format)) {
+	case ".gz":
+		return archives.Gz{}.OpenWriter(w)
+	case ".zst":
+		return archives.Zstd{}.OpenWriter(w)
+	default:
+		return nil, errors.Errorf("unsupported compression for %q", format)
+	}
+}
+
+// PrefixWriter returns an entry writer that places all entries under the
+// given directory. Closing it does not close the underlying writer.
+func PrefixWriter(w EntryWriter, prefix string) EntryWriter {
+	pw := &prefixWriter{w: w, prefix: path.Clean(prefix)}
+	if hw, ok := w.(HardlinkWriter); ok {
+		return &prefixHardlinkWriter{prefixWriter: pw, hw: hw}
+	}
+	return pw
+}
+
+type prefixWriter struct {
+	w       EntryWriter
+	prefix  string
+	written bool
+}
+
+func (p *prefixWriter) WriteEntry(hdr *tar.Header, r io.Reader) error {
+	if err := p.writePrefix(); err != nil {
+		return err
+	}
+	return p.w.WriteEntry(p.header(hdr), r)
+}
+
+func (p *prefixWriter) writePrefix() error {
+	if p.written {
+		return nil
+	}
+	p.written = true
+	return p.w.WriteEntry(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     p.prefix,
+		Mode:     0o755,
+		ModTime:  time.Unix(0, 0),
+	}, nil)
+}
+
+func (p *prefixWriter) header(hdr *tar.Header) *tar.Header {
+	h := *hdr
+	h.Name = path.Join(p.prefix, hdr.Name)
+	if h.Typeflag == tar.TypeLink {
+		h.Linkname = path.Join(p.prefix, hdr.Linkname)
+	}
+	return &h
+}
+
+func (p *prefixWriter) Close() error {
+	return nil
+}
+
+type prefixHardlinkWriter struct {
+	*prefixWriter
+	hw HardlinkWriter
+}
+
+func (p *prefixHardlinkWriter) WriteHardlinks(hdr *tar.Header, r io.Reader, links []*tar.Header) error {
+	if err := p.writePrefix(); err != nil {
+		return err
+	}
+	plinks := make([]*tar.Header, 0, len(links))
+	for _, link := range links {
+		plinks = append(plinks, p.header(link))
+	}
+	return p.hw.WriteHardlinks(p.header(hdr), r, plinks)
+}
+
+type tarWriter struct {
+	tw *tar.Writer
+	cw io.Closer
+}
+
+func newTarWriter(w io.Writer, cw io.Closer) *tarWriter {
+	return &tarWriter{tw: tar.NewWriter(w), cw: cw}
+}
+
+func (t *tarWriter) WriteEntry(hdr *tar.Header, r io.Reader) error {
+	h := *hdr
+	h.Format = tar.FormatUnknown
+	if h.Typeflag == tar.TypeDir {
+		h.Name += "/"
+	}
+	if err := t.tw.WriteHeader(&h); err != nil {
+		return errors.Wrapf(err, "cannot write header for %s", hdr.Name)
+	}
+	if r == nil || h.Typeflag != tar.TypeReg {
+		return nil
+	}
+	_, err := io.Copy(t.tw, r)
+	return err
+}
+
+func (t *tarWriter) WriteHardlinks(hdr *tar.Header, r io.Reader, links []*tar.Header) error {
+	if err := t.WriteEntry(hdr, r); err != nil {
+		return err
+	}
+	for _, link := range links {
+		if err := t.WriteEntry(link, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *tarWriter) Close() error {
+	err := t.tw.Close()
+	if t.cw != nil {
+		if cerr := t.cw.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+type zipWriter struct {
+	zw *zip.Writer
+}
+
+func (z *zipWriter) WriteEntry(hdr *tar.Header, r io.Reader) error {
+	switch hdr.Typeflag {
+	case tar.TypeDir, tar.TypeReg, tar.TypeSymlink:
+	default:
+		// zip cannot represent device nodes or fifos
+		return nil
+	}
+
+	fh, err := zip.FileInfoHeader(hdr.FileInfo())
+	if err != nil {
+		return err
+	}
+	fh.Name = hdr.Name
+	fh.Modified = hdr.ModTime
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		fh.Name += "/"
+		fh.Method = zip.Store
+	case tar.TypeSymlink:
+		fh.Method = zip.Store
+	default:
+		fh.Method = zip.Deflate
+	}
+
+	w, err := z.zw.CreateHeader(fh)
+	if err != nil {
+		return errors.Wrapf(err, "cannot write header for %s", hdr.Name)
+	}
+	switch {
+	case hdr.Typeflag == tar.TypeSymlink:
+		_, err = io.WriteString(w, hdr.Linkname)
+	case r != nil && hdr.Typeflag == tar.TypeReg:
+		_, err = io.Copy(w, r)
+	}
+	return err
+}
+
+func (z *zipWriter) Close() error {
+	return z.zw.Close()
+}
@@ -0,0 +1,277 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// challenge is the authentication challenge of a registry
+type challenge struct {
+	scheme string
+	params map[string]string
+}
+
+// ping resolves the base URL of the registry and its authentication
+// challenge. HTTP is tried if HTTPS fails and the client is insecure.
+func (c *Client) ping(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.base != "" {
+		return c.base, nil
+	}
+
+	schemes := []string{"https"}
+	if c.insecure {
+		schemes = append(schemes, "http")
+	}
+	var err error
+	for _, scheme := range schemes {
+		base := scheme + "://" + c.host
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, base+"/v2/", nil)
+		if err != nil {
+			return "", err
+		}
+		var res *http.Response
+		res, err = c.do(req)
+		if err != nil {
+			continue
+		}
+		_ = res.Body.Close()
+		if res.StatusCode == http.StatusUnauthorized {
+			c.challenge = parseChallenge(res.Header.Get("WWW-Authenticate"))
+		}
+		c.base = base
+		return base, nil
+	}
+	return "", errors.Wrapf(err, "cannot reach registry %s", c.host)
+}
+
+// token is a bearer token of a scope. done is closed once it is fetched,
+// the other fields being set before.
+type token struct {
+	done    chan struct{}
+	value   string
+	refresh time.Time
+	err     error
+}
+
+const (
+	// defaultTokenExpiry is the lifetime of tokens issued without
+	// expires_in, as per the distribution token specification
+	defaultTokenExpiry = 60 * time.Second
+	// tokenRefreshRatio is the part of their lifetime after which tokens
+	// are refreshed, so they do not expire while requests are sent
+	tokenRefreshRatio = 0.9
+)
+
+// authorize sets the Authorization header of a request to repo. Tokens
+// are fetched once per scope without holding the lock, concurrent requests
+// of the same scope waiting for the same fetch, and are refreshed before
+// they expire.
+func (c *Client) authorize(ctx context.Context, req *http.Request, repo string) error {
+	c.mu.Lock()
+	ch := c.challenge
+	c.mu.Unlock()
+	if ch == nil {
+		return nil
+	} else if c.creds.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.creds.Token)
+		return nil
+	}
+	switch ch.scheme {
+	case "basic":
+		if c.creds.Username != "" {
+			req.SetBasicAuth(c.creds.Username, c.creds.Password)
+		}
+	case "bearer":
+		value, err := c.token(ctx, ch, "repository:"+repo+":pull")
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+value)
+	}
+	return nil
+}
+
+// token returns the bearer token of scope, fetching it if it is missing or
+// about to expire. The fetch of a caller whose context is canceled is
+// retried by the callers waiting for it.
+func (c *Client) token(ctx context.Context, ch *challenge, scope string) (string, error) {
+	for {
+		c.mu.Lock()
+		t, ok := c.tokens[scope]
+		if ok && t.fetched() && (t.err != nil || !time.Now().Before(t.refresh)) {
+			ok = false
+		}
+		if !ok {
+			t = &token{done: make(chan struct{})}
+			c.tokens[scope] = t
+			c.mu.Unlock()
+			c.fetch(ctx, ch, scope, t)
+			return t.value, t.err
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-t.done:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		if t.err == nil {
+			return t.value, nil
+		} else if !errors.Is(t.err, context.Canceled) && !errors.Is(t.err, context.DeadlineExceeded) {
+			return "", t.err
+		}
+	}
+}
+
+// fetch fetches the token t of scope, and forgets it if it failed
+func (c *Client) fetch(ctx context.Context, ch *challenge, scope string, t *token) {
+	defer close(t.done)
+	start := time.Now()
+	var expiresIn time.Duration
+	t.value, expiresIn, t.err = c.fetchToken(ctx, ch, scope)
+	if t.err != nil {
+		c.mu.Lock()
+		if c.tokens[scope] == t {
+			delete(c.tokens, scope)
+		}
+		c.mu.Unlock()
+		return
+	}
+	t.refresh = start.Add(time.Duration(float64(expiresIn) * tokenRefreshRatio))
+}
+
+// fetched returns true if the fetch of the token is done
+func (t *token) fetched() bool {
+	select {
+	case <-t.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// resetToken forgets the token of repo rejected by the registry, set in
+// the Authorization header of req, so a new one is fetched unless another
+// request already did. It returns false if requests are not authorized
+// with tokens.
+func (c *Client) resetToken(req *http.Request, repo string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.challenge == nil || c.challenge.scheme != "bearer" || c.creds.Token != "" {
+		return false
+	}
+	scope := "repository:" + repo + ":pull"
+	if t, ok := c.tokens[scope]; ok && t.fetched() && "Bearer "+t.value == req.Header.Get("Authorization") {
+		delete(c.tokens, scope)
+	}
+	return true
+}
+
+// tokenClientID identifies the client in OAuth2 token requests
+const tokenClientID = "undock"
+
+// fetchToken requests a bearer token for scope from the realm of the
+// challenge, with the identity token as OAuth2 refresh token if set. It
+// returns the token and its lifetime.
+func (c *Client) fetchToken(ctx context.Context, ch *challenge, scope string) (string, time.Duration, error) {
+	realm, err := url.Parse(ch.params["realm"])
+	if err != nil || realm.Host == "" {
+		return "", 0, errors.Errorf("invalid token realm %q", ch.params["realm"])
+	}
+	service := ch.params["service"]
+
+	var req *http.Request
+	if c.creds.IdentityToken != "" {
+		form := url.Values{}
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", c.creds.IdentityToken)
+		form.Set("client_id", tokenClientID)
+		form.Set("scope", scope)
+		if service != "" {
+			form.Set("service", service)
+		}
+		if req, err = http.NewRequestWithContext(ctx, http.MethodPost, realm.String(), strings.NewReader(form.Encode())); err != nil {
+			return "", 0, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		query := realm.Query()
+		if service != "" {
+			query.Set("service", service)
+		}
+		query.Set("scope", scope)
+		realm.RawQuery = query.Encode()
+		if req, err = http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil); err != nil {
+			return "", 0, err
+		}
+		if c.creds.Username != "" {
+			req.SetBasicAuth(c.creds.Username, c.creds.Password)
+		}
+	}
+	res, err := c.do(req)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "cannot request token")
+	}
+	if res.StatusCode/100 != 2 {
+		return "", 0, errors.Wrap(responseError(res), "cannot request token")
+	}
+	defer res.Body.Close()
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", 0, errors.Wrap(err, "cannot parse token")
+	}
+	expiresIn := defaultTokenExpiry
+	if body.ExpiresIn > 0 {
+		expiresIn = time.Duration(body.ExpiresIn) * time.Second
+	}
+	if body.Token != "" {
+		return body.Token, expiresIn, nil
+	} else if body.AccessToken != "" {
+		return body.AccessToken, expiresIn, nil
+	}
+	return "", 0, errors.New("empty token")
+}
+
+// parseChallenge parses a WWW-Authenticate header such as
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+func parseChallenge(header string) *challenge {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	ch := &challenge{scheme: strings.ToLower(scheme), params: map[string]string{}}
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				ch.params[key] = value[1:]
+				break
+			}
+			ch.params[key] = value[1 : end+1]
+			rest = value[end+2:]
+		} else {
+			v, r, _ := strings.Cut(value, ",")
+			ch.params[key] = strings.TrimSpace(v)
+			rest = r
+		}
+		rest = strings.TrimPrefix(strings.TrimSpace(rest), ",")
+		rest = strings.TrimSpace(rest)
+	}
+	return ch
+}
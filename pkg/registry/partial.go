@@ -0,0 +1,213 @@
+package registry
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// partialBlob is the content of a blob being downloaded, kept next to the
+// blob file along with the ranges already downloaded so an interrupted
+// download can be resumed
+type partialBlob struct {
+	f         *os.File
+	statename string
+
+	mu    sync.Mutex
+	state partialState
+}
+
+// partialState is the state of a partial blob
+type partialState struct {
+	Digest digest.Digest `json:"digest"`
+	Size   int64         `json:"size"`
+	// Ranges downloaded, as sorted and disjoint [start, end) offsets
+	Ranges [][2]int64 `json:"ranges"`
+}
+
+// partialNames returns the names of the content and state of the partial
+// blob of filename
+func partialNames(filename string) (string, string) {
+	name := filepath.Join(filepath.Dir(filename), "."+filepath.Base(filename)+".partial")
+	return name, name + ".json"
+}
+
+// DownloadedSize returns the number of bytes of a blob already downloaded to
+// filename by an interrupted download, which DownloadBlob resumes
+func DownloadedSize(filename string, dgst digest.Digest, size int64) int64 {
+	_, statename := partialNames(filename)
+	state, ok := readPartialState(statename, dgst, size)
+	if !ok {
+		return 0
+	}
+	return state.downloaded()
+}
+
+func readPartialState(statename string, dgst digest.Digest, size int64) (partialState, bool) {
+	var state partialState
+	dt, err := os.ReadFile(statename)
+	if err != nil || json.Unmarshal(dt, &state) != nil || state.Digest != dgst || state.Size != size {
+		return partialState{}, false
+	}
+	var end int64
+	for _, r := range state.Ranges {
+		if r[0] < end || r[1] <= r[0] || r[1] > size {
+			return partialState{}, false
+		}
+		end = r[1]
+	}
+	return state, true
+}
+
+// openPartialBlob opens the partial blob of filename. Its content is
+// discarded if its state does not match the digest and size of the blob.
+func openPartialBlob(filename string, dgst digest.Digest, size int64) (*partialBlob, error) {
+	dataname, statename := partialNames(filename)
+	state, ok := readPartialState(statename, dgst, size)
+	f, err := os.OpenFile(dataname, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	p := &partialBlob{f: f, statename: statename, state: state}
+	if !ok {
+		p.state = partialState{Digest: dgst, Size: size}
+		if err := f.Truncate(0); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (s partialState) downloaded() int64 {
+	var n int64
+	for _, r := range s.Ranges {
+		n += r[1] - r[0]
+	}
+	return n
+}
+
+// missing returns the ranges of the blob not downloaded yet
+func (p *partialBlob) missing() [][2]int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var missing [][2]int64
+	var start int64
+	for _, r := range p.state.Ranges {
+		if r[0] > start {
+			missing = append(missing, [2]int64{start, r[0]})
+		}
+		start = r[1]
+	}
+	if start < p.state.Size {
+		missing = append(missing, [2]int64{start, p.state.Size})
+	}
+	return missing
+}
+
+// add records a downloaded range and saves the state
+func (p *partialBlob) add(start, end int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ranges := append(p.state.Ranges, [2]int64{start, end})
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		if last := &merged[len(merged)-1]; r[0] <= last[1] {
+			last[1] = max(last[1], r[1])
+		} else {
+			merged = append(merged, r)
+		}
+	}
+	p.state.Ranges = merged
+	return p.save()
+}
+
+// reset discards the content downloaded so far
+func (p *partialBlob) reset() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state.Ranges = nil
+	if err := p.f.Truncate(0); err != nil {
+		return err
+	}
+	return p.save()
+}
+
+// save writes the state next to the partial content
+func (p *partialBlob) save() error {
+	dt, err := json.Marshal(p.state)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p.statename), filepath.Base(p.statename)+"-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(dt)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p.statename)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return errors.Wrap(err, "cannot save partial blob state")
+	}
+	return nil
+}
+
+// verify verifies the size and digest of the downloaded content
+func (p *partialBlob) verify() error {
+	if _, err := p.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	verifier := p.state.Digest.Verifier()
+	n, err := io.Copy(verifier, p.f)
+	if err != nil {
+		return err
+	}
+	if n != p.state.Size {
+		return errors.Errorf("size mismatch for blob %s: expected %d bytes, got %d", p.state.Digest, p.state.Size, n)
+	} else if !verifier.Verified() {
+		return errors.Errorf("digest mismatch for blob %s", p.state.Digest)
+	}
+	return nil
+}
+
+// commit moves the downloaded content to filename
+func (p *partialBlob) commit(filename string) error {
+	if err := p.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(p.f.Name(), filename); err != nil {
+		return err
+	}
+	return os.Remove(p.statename)
+}
+
+// close keeps the partial blob to resume its download, unless nothing was
+// downloaded
+func (p *partialBlob) close() error {
+	err := p.f.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.state.Ranges) == 0 {
+		p.remove()
+	}
+	return err
+}
+
+// remove removes the content and state of the partial blob
+func (p *partialBlob) remove() {
+	_ = p.f.Close()
+	_ = os.Remove(p.f.Name())
+	_ = os.Remove(p.statename)
+}
@@ -0,0 +1,102 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Quota is the rate limit of the manifest requests of a registry, as told
+// by the RateLimit-Limit and RateLimit-Remaining headers of its responses
+type Quota struct {
+	// Limit is the number of requests allowed in the window
+	Limit int
+	// Remaining is the number of requests left in the window
+	Remaining int
+	// Window of the limit, zero if not told
+	Window time.Duration
+}
+
+func (q Quota) String() string {
+	if q.Window == 0 {
+		return fmt.Sprintf("%d of %d requests remaining", q.Remaining, q.Limit)
+	}
+	return fmt.Sprintf("%d of %d requests remaining per %s", q.Remaining, q.Limit, q.Window)
+}
+
+// TooManyRequestsError is returned when the registry answers with 429 Too
+// Many Requests
+type TooManyRequestsError struct {
+	// RetryAfter is the delay told by the Retry-After header, zero if not
+	// set
+	RetryAfter time.Duration
+	// Quota of the registry, nil if not told
+	Quota *Quota
+}
+
+func (e *TooManyRequestsError) Error() string {
+	if e.Quota == nil {
+		return "registry: too many requests"
+	}
+	return "registry: too many requests, " + e.Quota.String()
+}
+
+// Quota sends a HEAD request of the manifest of a tag or digest of repo,
+// which does not count against the rate limit of Docker Hub, and returns
+// the quota told by the registry, or nil if it has none
+func (c *Client) Quota(ctx context.Context, repo, ref string) (*Quota, error) {
+	res, err := c.headManifest(ctx, repo, ref)
+	if err != nil {
+		return nil, err
+	}
+	return parseQuota(res.Header), nil
+}
+
+// parseQuota returns the quota told by the headers of a response, or nil if
+// there is none
+func parseQuota(h http.Header) *Quota {
+	limit, window, ok := parseQuotaHeader(h.Get("RateLimit-Limit"))
+	if !ok {
+		return nil
+	}
+	remaining, _, ok := parseQuotaHeader(h.Get("RateLimit-Remaining"))
+	if !ok {
+		return nil
+	}
+	return &Quota{Limit: limit, Remaining: remaining, Window: window}
+}
+
+// parseQuotaHeader parses a number of requests and its window in seconds,
+// such as 100;w=21600
+func parseQuotaHeader(v string) (int, time.Duration, bool) {
+	parts := strings.Split(v, ";")
+	n, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, false
+	}
+	var window time.Duration
+	for _, p := range parts[1:] {
+		if k, s, ok := strings.Cut(strings.TrimSpace(p), "="); ok && k == "w" {
+			if secs, err := strconv.Atoi(s); err == nil {
+				window = time.Duration(secs) * time.Second
+			}
+		}
+	}
+	return n, window, true
+}
+
+// parseRetryAfter parses a Retry-After header, in seconds or as an HTTP
+// date, and returns zero if it is not set or invalid
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	} else if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(max(secs, 0)) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
@@ -0,0 +1,77 @@
+package registry
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter limits the rate of the bytes read through it, shared by all
+// the readers it wraps. Bursts of up to one second of bytes are allowed.
+type RateLimiter struct {
+	rate  float64
+	burst int
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter of rate bytes per second
+func NewRateLimiter(rate int64) *RateLimiter {
+	return &RateLimiter{
+		rate:   float64(rate),
+		burst:  int(max(rate, 1)),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// Reader returns a reader of r which waits for the rate to allow the bytes
+// read, or fails with the cause of ctx if it is done first
+func (l *RateLimiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	return &rateLimitedReader{ctx: ctx, r: r, l: l}
+}
+
+// wait waits until n bytes are allowed. Bytes are reserved right away so
+// concurrent readers share the rate.
+func (l *RateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(float64(l.burst), l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+type rateLimitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *RateLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > r.l.burst {
+		p = p[:r.l.burst]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.l.wait(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
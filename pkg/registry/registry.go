@@ -0,0 +1,450 @@
+// Package registry implements a minimal client for OCI distribution
+// registries, limited to what is needed to download large blobs with
+// concurrent range requests and to read parts of blobs.
+package registry
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// DefaultChunkSize is the size of the ranges of a blob downloaded at
+	// once
+	DefaultChunkSize = 16 << 20
+
+	// dockerHub is the domain of Docker Hub references, served by
+	// dockerHubRegistry
+	dockerHub         = "docker.io"
+	dockerHubRegistry = "registry-1.docker.io"
+)
+
+// errRangeUnsupported is returned when the registry ignores range requests
+var errRangeUnsupported = errors.New("range requests not supported")
+
+// Credentials to authenticate with
+type Credentials struct {
+	Username string
+	Password string
+	// Token is sent as bearer token instead of requesting one with the
+	// username and password
+	Token string
+	// IdentityToken is an OAuth2 refresh token exchanged for bearer tokens
+	// instead of the username and password
+	IdentityToken string
+}
+
+// manifestMediaTypes are accepted by manifest requests
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// Options represents client options
+type Options struct {
+	// Credentials to authenticate with. Requests are anonymous if empty.
+	Credentials Credentials
+	// Insecure skips TLS verification and falls back to HTTP if the
+	// registry cannot be reached over HTTPS
+	Insecure bool
+	// UserAgent sent with requests
+	UserAgent string
+	// ChunkSize is the size of the ranges downloaded at once. Blobs larger
+	// than ChunkSize are downloaded with concurrent range requests.
+	ChunkSize int64
+	// Connections is the number of ranges of a blob downloaded at once
+	Connections int
+	// RequestTimeout is the time to wait for the response to a request,
+	// or for the next bytes of its body, before it fails with a
+	// TimeoutError. No timeout if zero.
+	RequestTimeout time.Duration
+	// RateLimiter limits the rate of the responses read, and can be shared
+	// with other clients. No limit if nil.
+	RateLimiter *RateLimiter
+	// TLSConfig of the connections to the registry. Insecure still falls
+	// back to HTTP if set.
+	TLSConfig *tls.Config
+	// Proxy returns the proxy of a request. Defaults to the proxy
+	// environment variables.
+	Proxy func(*http.Request) (*url.URL, error)
+	// HTTPClient to send requests with. TLSConfig and Proxy are ignored if
+	// set.
+	HTTPClient *http.Client
+	// OnQuota is called with the quota told by the responses of the
+	// registry, each time it changes
+	OnQuota func(Quota)
+}
+
+// Client downloads blobs from a registry
+type Client struct {
+	host        string
+	creds       Credentials
+	insecure    bool
+	userAgent   string
+	chunkSize   int64
+	connections int
+	httpClient  *http.Client
+	timeout     time.Duration
+	limiter     *RateLimiter
+	onQuota     func(Quota)
+
+	mu        sync.Mutex
+	base      string
+	challenge *challenge
+	tokens    map[string]*token
+
+	// quotaMu is separate from mu, which is held by ping during its
+	// request
+	quotaMu sync.Mutex
+	quota   *Quota
+}
+
+// Error is an error response of the registry
+type Error struct {
+	StatusCode int
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("registry: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return "registry: " + e.Code + ": " + e.Message
+}
+
+// New creates a new client for the registry of a reference domain
+func New(domain string, opts Options) *Client {
+	c := &Client{
+		host:        domain,
+		creds:       opts.Credentials,
+		insecure:    opts.Insecure,
+		userAgent:   opts.UserAgent,
+		chunkSize:   opts.ChunkSize,
+		connections: opts.Connections,
+		httpClient:  opts.HTTPClient,
+		timeout:     opts.RequestTimeout,
+		limiter:     opts.RateLimiter,
+		onQuota:     opts.OnQuota,
+		tokens:      map[string]*token{},
+	}
+	if c.host == dockerHub {
+		c.host = dockerHubRegistry
+	}
+	if c.chunkSize <= 0 {
+		c.chunkSize = DefaultChunkSize
+	}
+	if c.connections < 1 {
+		c.connections = 1
+	}
+	if c.httpClient == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if opts.TLSConfig != nil {
+			transport.TLSClientConfig = opts.TLSConfig
+		} else if c.insecure {
+			transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true} //nolint:gosec // explicitly requested with insecure
+		}
+		if opts.Proxy != nil {
+			transport.Proxy = opts.Proxy
+		}
+		c.httpClient = &http.Client{Transport: transport}
+	}
+	return c
+}
+
+// DownloadBlob downloads a blob of repo to filename and verifies its digest
+// and size. Blobs larger than the chunk size are downloaded with concurrent
+// range requests, or in a single request if the registry does not support
+// them. filename is written once the blob is verified. The content of an
+// interrupted download is kept next to filename, and only the missing
+// ranges are downloaded by the next call.
+func (c *Client) DownloadBlob(ctx context.Context, repo string, dgst digest.Digest, size int64, filename string) error {
+	if err := dgst.Validate(); err != nil {
+		return errors.Wrapf(err, "invalid digest %s", dgst)
+	}
+	p, err := openPartialBlob(filename, dgst, size)
+	if err != nil {
+		return errors.Wrap(err, "cannot open partial blob")
+	}
+
+	err = c.download(ctx, repo, dgst, size, p)
+	if errors.Is(err, errRangeUnsupported) {
+		// the download starts over in a single request
+		if err = p.reset(); err == nil {
+			err = c.downloadRange(ctx, repo, dgst, size, 0, size, p)
+		}
+	}
+	if err != nil {
+		_ = p.close()
+		return errors.Wrapf(err, "cannot download blob %s", dgst)
+	}
+
+	if err := p.verify(); err != nil {
+		p.remove()
+		return err
+	}
+	return p.commit(filename)
+}
+
+// download downloads the missing ranges of a blob, split in chunks
+// downloaded concurrently if there are several connections
+func (c *Client) download(ctx context.Context, repo string, dgst digest.Digest, size int64, p *partialBlob) error {
+	var ranges [][2]int64
+	for _, r := range p.missing() {
+		if c.connections < 2 {
+			ranges = append(ranges, r)
+			continue
+		}
+		for start := r[0]; start < r[1]; start += c.chunkSize {
+			ranges = append(ranges, [2]int64{start, min(start+c.chunkSize, r[1])})
+		}
+	}
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.SetLimit(c.connections)
+	for _, r := range ranges {
+		eg.Go(func() error {
+			return c.downloadRange(ctx, repo, dgst, size, r[0], r[1], p)
+		})
+	}
+	return eg.Wait()
+}
+
+// downloadRange downloads the bytes start to end excluded of a blob at
+// their offset in p, in a single request without range if it is the whole
+// blob. The bytes received are kept even if the request fails.
+func (c *Client) downloadRange(ctx context.Context, repo string, dgst digest.Digest, size, start, end int64, p *partialBlob) error {
+	var rc io.ReadCloser
+	if start == 0 && end == size {
+		res, err := c.getBlob(ctx, repo, dgst, "")
+		if err != nil {
+			return err
+		}
+		rc = res.Body
+	} else {
+		var err error
+		if rc, err = c.getRange(ctx, repo, dgst, start, end-1); err != nil {
+			return err
+		}
+	}
+	defer rc.Close()
+	n, err := io.Copy(io.NewOffsetWriter(p.f, start), io.LimitReader(rc, end-start))
+	if n > 0 {
+		if aerr := p.add(start, start+n); err == nil {
+			err = aerr
+		}
+	}
+	if err != nil {
+		return err
+	} else if n != end-start {
+		return errors.Errorf("short range for bytes %d-%d: got %d bytes", start, end-1, n)
+	}
+	return nil
+}
+
+// getRange requests the bytes start to end included of a blob.
+// errRangeUnsupported is returned if the registry ignores the range.
+func (c *Client) getRange(ctx context.Context, repo string, dgst digest.Digest, start, end int64) (io.ReadCloser, error) {
+	res, err := c.getBlob(ctx, repo, dgst, fmt.Sprintf("bytes=%d-%d", start, end))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusPartialContent {
+		_ = res.Body.Close()
+		return nil, errRangeUnsupported
+	}
+	if cr := res.Header.Get("Content-Range"); !strings.HasPrefix(cr, fmt.Sprintf("bytes %d-%d/", start, end)) {
+		_ = res.Body.Close()
+		return nil, errors.Errorf("unexpected range %q for bytes %d-%d", cr, start, end)
+	}
+	return res.Body, nil
+}
+
+// BlobReaderAt returns a reader of a blob of repo of the given size, each
+// read being a range request, so parts of a blob can be read without
+// downloading it. The content is not verified against the digest of the
+// blob, which is up to the caller.
+func (c *Client) BlobReaderAt(ctx context.Context, repo string, dgst digest.Digest, size int64) io.ReaderAt {
+	return &blobReaderAt{ctx: ctx, c: c, repo: repo, dgst: dgst, size: size}
+}
+
+type blobReaderAt struct {
+	ctx  context.Context
+	c    *Client
+	repo string
+	dgst digest.Digest
+	size int64
+}
+
+func (r *blobReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.Errorf("negative offset %d", off)
+	} else if off >= r.size {
+		return 0, io.EOF
+	} else if len(p) == 0 {
+		return 0, nil
+	}
+	end := min(off+int64(len(p)), r.size) - 1
+	rc, err := r.c.getRange(r.ctx, r.repo, r.dgst, off, end)
+	if err != nil {
+		return 0, errors.Wrapf(err, "cannot read blob %s", r.dgst)
+	}
+	defer rc.Close()
+	n, err := io.ReadFull(rc, p[:end-off+1])
+	if err != nil {
+		return n, errors.Wrapf(err, "cannot read blob %s", r.dgst)
+	} else if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// ManifestDigest returns the digest of the manifest of a tag or digest of
+// repo, told by a HEAD request which does not count against the rate limit
+// of Docker Hub
+func (c *Client) ManifestDigest(ctx context.Context, repo, ref string) (digest.Digest, error) {
+	res, err := c.headManifest(ctx, repo, ref)
+	if err != nil {
+		return "", err
+	}
+	dgst, err := digest.Parse(res.Header.Get("Docker-Content-Digest"))
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid digest of manifest %s of %s", ref, repo)
+	}
+	return dgst, nil
+}
+
+// headManifest sends a HEAD request of the manifest of a tag or digest of
+// repo, and returns its successful response
+func (c *Client) headManifest(ctx context.Context, repo, ref string) (*http.Response, error) {
+	base, err := c.ping(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, base+"/v2/"+repo+"/manifests/"+ref, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	if err := c.authorize(ctx, req, repo); err != nil {
+		return nil, err
+	}
+	res, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		return nil, responseError(res)
+	}
+	_ = res.Body.Close()
+	return res, nil
+}
+
+// getBlob sends a blob request, with a Range header if rng is set. The
+// token is renewed once if it expired during a long download.
+func (c *Client) getBlob(ctx context.Context, repo string, dgst digest.Digest, rng string) (*http.Response, error) {
+	base, err := c.ping(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/v2/"+repo+"/blobs/"+dgst.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+		if err := c.authorize(ctx, req, repo); err != nil {
+			return nil, err
+		}
+		res, err := c.do(req)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode/100 == 2 {
+			return res, nil
+		}
+		rerr := responseError(res)
+		if res.StatusCode == http.StatusUnauthorized && attempt == 0 && c.resetToken(req, repo) {
+			continue
+		}
+		return nil, rerr
+	}
+}
+
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+	do := c.httpClient.Do
+	if c.timeout > 0 {
+		do = c.doWithTimeout
+	}
+	res, err := do(req)
+	if err != nil {
+		return res, err
+	}
+	c.reportQuota(res.Header)
+	if c.limiter == nil {
+		return res, nil
+	}
+	res.Body = struct {
+		io.Reader
+		io.Closer
+	}{c.limiter.Reader(req.Context(), res.Body), res.Body}
+	return res, nil
+}
+
+// reportQuota calls OnQuota with the quota told by the headers of a
+// response, if it is not the one of the previous response
+func (c *Client) reportQuota(h http.Header) {
+	if c.onQuota == nil {
+		return
+	}
+	quota := parseQuota(h)
+	if quota == nil {
+		return
+	}
+	c.quotaMu.Lock()
+	changed := c.quota == nil || *c.quota != *quota
+	c.quota = quota
+	c.quotaMu.Unlock()
+	if changed {
+		c.onQuota(*quota)
+	}
+}
+
+// responseError reads the error of a response and closes its body. A
+// TooManyRequestsError is returned for 429 Too Many Requests.
+func responseError(res *http.Response) error {
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusTooManyRequests {
+		return &TooManyRequestsError{
+			RetryAfter: parseRetryAfter(res.Header.Get("Retry-After")),
+			Quota:      parseQuota(res.Header),
+		}
+	}
+	rerr := &Error{StatusCode: res.StatusCode}
+	var body struct {
+		Errors []Error `json:"errors"`
+	}
+	if dt, err := io.ReadAll(io.LimitReader(res.Body, 1<<20)); err == nil && json.Unmarshal(dt, &body) == nil && len(body.Errors) > 0 {
+		rerr.Code = body.Errors[0].Code
+		rerr.Message = body.Errors[0].Message
+	}
+	return rerr
+}
@@ -0,0 +1,392 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crazy-max/undock/pkg/registry/registrytest"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseChallenge(t *testing.T) {
+	ch := parseChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/alpine:pull,push"`)
+	assert.Equal(t, "bearer", ch.scheme)
+	assert.Equal(t, map[string]string{
+		"realm":   "https://auth.docker.io/token",
+		"service": "registry.docker.io",
+		"scope":   "repository:library/alpine:pull,push",
+	}, ch.params)
+
+	ch = parseChallenge(`Basic realm=registry`)
+	assert.Equal(t, "basic", ch.scheme)
+	assert.Equal(t, map[string]string{"realm": "registry"}, ch.params)
+}
+
+func TestDownloadBlobWithRanges(t *testing.T) {
+	srv := registrytest.NewServer()
+	defer srv.Close()
+	srv.Username, srv.Password = "user", "pass"
+
+	blob := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+	dgst := srv.AddBlob(blob)
+
+	c := New(srv.Host(), Options{
+		Credentials: Credentials{Username: "user", Password: "pass"},
+		ChunkSize:   1000,
+		Connections: 4,
+		HTTPClient:  srv.Client(),
+	})
+	filename := filepath.Join(t.TempDir(), dgst.Encoded())
+	require.NoError(t, c.DownloadBlob(context.Background(), "library/app", dgst, int64(len(blob)), filename))
+
+	dt, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, blob, dt)
+
+	requests, ranges := srv.BlobRequests()
+	assert.Equal(t, 16, requests)
+	assert.Equal(t, 16, ranges)
+}
+
+func TestDownloadBlobWithoutRangeSupport(t *testing.T) {
+	srv := registrytest.NewServer()
+	defer srv.Close()
+	srv.NoRanges = true
+
+	blob := bytes.Repeat([]byte("a"), 5000)
+	dgst := srv.AddBlob(blob)
+
+	c := New(srv.Host(), Options{
+		ChunkSize:   1000,
+		Connections: 2,
+		HTTPClient:  srv.Client(),
+	})
+	filename := filepath.Join(t.TempDir(), dgst.Encoded())
+	require.NoError(t, c.DownloadBlob(context.Background(), "app", dgst, int64(len(blob)), filename))
+
+	dt, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, blob, dt)
+}
+
+func TestDownloadBlobResumesInterruptedDownload(t *testing.T) {
+	srv := registrytest.NewServer()
+	defer srv.Close()
+
+	blob := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+	dgst := srv.AddBlob(blob)
+
+	c := New(srv.Host(), Options{HTTPClient: srv.Client()})
+	filename := filepath.Join(t.TempDir(), dgst.Encoded())
+	srv.FailAfter = 5000
+	require.Error(t, c.DownloadBlob(context.Background(), "app", dgst, int64(len(blob)), filename))
+	assert.NoFileExists(t, filename)
+	assert.Equal(t, int64(5000), DownloadedSize(filename, dgst, int64(len(blob))))
+
+	srv.FailAfter = 0
+	require.NoError(t, c.DownloadBlob(context.Background(), "app", dgst, int64(len(blob)), filename))
+	dt, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, blob, dt)
+	assert.Equal(t, int64(0), DownloadedSize(filename, dgst, int64(len(blob))))
+
+	// the blob is downloaded from where it was interrupted
+	requests, ranges := srv.BlobRequests()
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, 1, ranges)
+
+	entries, err := os.ReadDir(filepath.Dir(filename))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestDownloadBlobResumesInterruptedRanges(t *testing.T) {
+	srv := registrytest.NewServer()
+	defer srv.Close()
+
+	blob := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+	dgst := srv.AddBlob(blob)
+
+	c := New(srv.Host(), Options{
+		ChunkSize:   4000,
+		Connections: 4,
+		HTTPClient:  srv.Client(),
+	})
+	filename := filepath.Join(t.TempDir(), dgst.Encoded())
+	srv.FailAfter = 1000
+	require.Error(t, c.DownloadBlob(context.Background(), "app", dgst, int64(len(blob)), filename))
+	assert.GreaterOrEqual(t, DownloadedSize(filename, dgst, int64(len(blob))), int64(1000))
+
+	srv.FailAfter = 0
+	require.NoError(t, c.DownloadBlob(context.Background(), "app", dgst, int64(len(blob)), filename))
+	dt, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, blob, dt)
+}
+
+func TestDownloadBlobRestartsWithOtherDigest(t *testing.T) {
+	srv := registrytest.NewServer()
+	defer srv.Close()
+
+	blob := bytes.Repeat([]byte("a"), 5000)
+	dgst := srv.AddBlob(blob)
+
+	c := New(srv.Host(), Options{HTTPClient: srv.Client()})
+	filename := filepath.Join(t.TempDir(), "blob")
+	srv.FailAfter = 1000
+	require.Error(t, c.DownloadBlob(context.Background(), "app", dgst, int64(len(blob)), filename))
+
+	other := bytes.Repeat([]byte("b"), 5000)
+	otherDigest := srv.AddBlob(other)
+	assert.Equal(t, int64(0), DownloadedSize(filename, otherDigest, int64(len(other))))
+	srv.FailAfter = 0
+	require.NoError(t, c.DownloadBlob(context.Background(), "app", otherDigest, int64(len(other)), filename))
+	dt, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, other, dt)
+}
+
+func TestDownloadBlobRejectsDigestMismatch(t *testing.T) {
+	srv := registrytest.NewServer()
+	defer srv.Close()
+
+	blob := bytes.Repeat([]byte("a"), 5000)
+	srv.AddBlob(blob)
+	other := digest.FromString("other")
+
+	c := New(srv.Host(), Options{
+		ChunkSize:   1000,
+		Connections: 2,
+		HTTPClient:  srv.Client(),
+	})
+	dir := t.TempDir()
+	err := c.DownloadBlob(context.Background(), "app", other, int64(len(blob)), filepath.Join(dir, other.Encoded()))
+	require.ErrorContains(t, err, "BLOB_UNKNOWN")
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestDownloadBlobRejectsInvalidCredentials(t *testing.T) {
+	srv := registrytest.NewServer()
+	defer srv.Close()
+	srv.Username, srv.Password = "user", "pass"
+	dgst := srv.AddBlob([]byte("content"))
+
+	c := New(srv.Host(), Options{
+		Credentials: Credentials{Username: "user", Password: "wrong"},
+		HTTPClient:  srv.Client(),
+	})
+	err := c.DownloadBlob(context.Background(), "app", dgst, 7, filepath.Join(t.TempDir(), "blob"))
+	require.ErrorContains(t, err, "cannot request token: registry: UNAUTHORIZED: invalid credentials")
+}
+
+func TestDownloadBlobWithToken(t *testing.T) {
+	srv := registrytest.NewServer()
+	defer srv.Close()
+	srv.Username, srv.Password = "user", "pass"
+	dgst := srv.AddBlob([]byte("content"))
+
+	c := New(srv.Host(), Options{
+		Credentials: Credentials{Token: srv.IssueToken()},
+		HTTPClient:  srv.Client(),
+	})
+	filename := filepath.Join(t.TempDir(), "blob")
+	require.NoError(t, c.DownloadBlob(context.Background(), "app", dgst, 7, filename))
+	dt, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, "content", string(dt))
+}
+
+func TestDownloadBlobWithIdentityToken(t *testing.T) {
+	srv := registrytest.NewServer()
+	defer srv.Close()
+	srv.Username, srv.Password = "user", "pass"
+	srv.IdentityToken = "refresh"
+	dgst := srv.AddBlob([]byte("content"))
+
+	c := New(srv.Host(), Options{
+		Credentials: Credentials{IdentityToken: "refresh"},
+		HTTPClient:  srv.Client(),
+	})
+	filename := filepath.Join(t.TempDir(), "blob")
+	require.NoError(t, c.DownloadBlob(context.Background(), "app", dgst, 7, filename))
+	dt, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, "content", string(dt))
+
+	c = New(srv.Host(), Options{
+		Credentials: Credentials{IdentityToken: "wrong"},
+		HTTPClient:  srv.Client(),
+	})
+	err = c.DownloadBlob(context.Background(), "app", dgst, 7, filepath.Join(t.TempDir(), "other"))
+	require.ErrorContains(t, err, "cannot request token: registry: UNAUTHORIZED: invalid refresh token")
+}
+
+func TestDownloadBlobFetchesTokenOnce(t *testing.T) {
+	srv := registrytest.NewServer()
+	defer srv.Close()
+	srv.TokenDelay = 100 * time.Millisecond
+
+	blob := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+	dgst := srv.AddBlob(blob)
+
+	c := New(srv.Host(), Options{
+		ChunkSize:   1000,
+		Connections: 4,
+		HTTPClient:  srv.Client(),
+	})
+	require.NoError(t, c.DownloadBlob(context.Background(), "app", dgst, int64(len(blob)), filepath.Join(t.TempDir(), "blob")))
+	assert.Equal(t, 1, srv.TokenRequests())
+}
+
+func TestDownloadBlobRefreshesTokenBeforeExpiry(t *testing.T) {
+	srv := registrytest.NewServer()
+	defer srv.Close()
+	srv.TokenExpiry = time.Second
+	dgst := srv.AddBlob([]byte("content"))
+
+	c := New(srv.Host(), Options{HTTPClient: srv.Client()})
+	require.NoError(t, c.DownloadBlob(context.Background(), "app", dgst, 7, filepath.Join(t.TempDir(), "blob")))
+	require.NoError(t, c.DownloadBlob(context.Background(), "app", dgst, 7, filepath.Join(t.TempDir(), "blob")))
+	assert.Equal(t, 1, srv.TokenRequests())
+
+	// the token is refreshed once most of its lifetime is elapsed
+	time.Sleep(950 * time.Millisecond)
+	require.NoError(t, c.DownloadBlob(context.Background(), "app", dgst, 7, filepath.Join(t.TempDir(), "blob")))
+	assert.Equal(t, 2, srv.TokenRequests())
+}
+
+func TestDownloadBlobTimeout(t *testing.T) {
+	for _, stall := range []string{"response", "body"} {
+		t.Run(stall, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/v2/" {
+					return
+				}
+				if stall == "body" {
+					w.Header().Set("Content-Length", "7")
+					_, _ = w.Write([]byte("con"))
+					w.(http.Flusher).Flush()
+				}
+				<-r.Context().Done()
+			}))
+			defer srv.Close()
+
+			c := New(srv.Listener.Addr().String(), Options{
+				Insecure:       true,
+				RequestTimeout: 50 * time.Millisecond,
+			})
+			err := c.DownloadBlob(context.Background(), "app", digest.FromString("content"), 7, filepath.Join(t.TempDir(), "blob"))
+			var terr *TimeoutError
+			require.ErrorAs(t, err, &terr)
+			assert.Equal(t, 50*time.Millisecond, terr.After)
+		})
+	}
+}
+
+func TestQuota(t *testing.T) {
+	srv := registrytest.NewServer()
+	defer srv.Close()
+	srv.RateLimit = 100
+	srv.AddManifest("app", "application/vnd.oci.image.manifest.v1+json", []byte("{}"), "latest")
+
+	var reported []Quota
+	c := New(srv.Host(), Options{
+		HTTPClient: srv.Client(),
+		OnQuota: func(quota Quota) {
+			reported = append(reported, quota)
+		},
+	})
+	quota, err := c.Quota(context.Background(), "app", "latest")
+	require.NoError(t, err)
+	assert.Equal(t, &Quota{Limit: 100, Remaining: 100, Window: 6 * time.Hour}, quota)
+
+	srv.TooManyRequests = 1
+	srv.RetryAfter = "120"
+	_, err = c.Quota(context.Background(), "app", "latest")
+	var tooManyErr *TooManyRequestsError
+	require.ErrorAs(t, err, &tooManyErr)
+	assert.Equal(t, 2*time.Minute, tooManyErr.RetryAfter)
+	assert.Equal(t, 100, tooManyErr.Quota.Limit)
+	// the quota is reported once as long as it does not change
+	assert.Equal(t, []Quota{*quota}, reported)
+}
+
+func TestManifestDigest(t *testing.T) {
+	srv := registrytest.NewServer()
+	defer srv.Close()
+	dgst := srv.AddManifest("app", "application/vnd.oci.image.manifest.v1+json", []byte("{}"), "latest")
+
+	c := New(srv.Host(), Options{HTTPClient: srv.Client()})
+	got, err := c.ManifestDigest(context.Background(), "app", "latest")
+	require.NoError(t, err)
+	assert.Equal(t, dgst, got)
+
+	_, err = c.ManifestDigest(context.Background(), "app", "missing")
+	var regErr *Error
+	require.ErrorAs(t, err, &regErr)
+	assert.Equal(t, http.StatusNotFound, regErr.StatusCode)
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(100_000)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := io.Copy(io.Discard, l.Reader(context.Background(), bytes.NewReader(make([]byte, 75_000))))
+			assert.NoError(t, err)
+			assert.Equal(t, int64(75_000), n)
+		}()
+	}
+	wg.Wait()
+	// the first 100KB are allowed at once, the next 50KB take half a second
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(errors.New("stopped"))
+	_, err := io.Copy(io.Discard, l.Reader(ctx, bytes.NewReader(make([]byte, 200_000))))
+	require.EqualError(t, err, "stopped")
+}
+
+func TestBlobReaderAt(t *testing.T) {
+	srv := registrytest.NewServer()
+	defer srv.Close()
+
+	blob := []byte("0123456789")
+	dgst := srv.AddBlob(blob)
+
+	c := New(srv.Host(), Options{HTTPClient: srv.Client()})
+	ra := c.BlobReaderAt(context.Background(), "app", dgst, int64(len(blob)))
+
+	p := make([]byte, 4)
+	n, err := ra.ReadAt(p, 3)
+	require.NoError(t, err)
+	assert.Equal(t, "3456", string(p[:n]))
+
+	n, err = ra.ReadAt(p, 8)
+	require.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, "89", string(p[:n]))
+
+	_, err = ra.ReadAt(p, 10)
+	require.ErrorIs(t, err, io.EOF)
+
+	requests, ranges := srv.BlobRequests()
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, 2, ranges)
+}
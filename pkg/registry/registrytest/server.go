@@ -0,0 +1,331 @@
+// Package registrytest provides an in-memory registry for tests, standing
+// in for a distribution registry with the subset of the API used by the
+// registry package and the docker transport.
+package registrytest
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// Server is an in-memory registry served over HTTPS. Requests are
+// authorized with bearer tokens issued by its token endpoint.
+type Server struct {
+	*httptest.Server
+	// Username and Password expected in token requests if set, anonymous
+	// tokens are issued otherwise
+	Username string
+	Password string
+	// IdentityToken is the refresh token expected in OAuth2 token requests
+	// instead of Username and Password if set
+	IdentityToken string
+	// TokenExpiry is the lifetime of the issued tokens, told with
+	// expires_in, after which they are rejected. Tokens do not expire if
+	// zero.
+	TokenExpiry time.Duration
+	// TokenDelay delays the responses of the token endpoint
+	TokenDelay time.Duration
+	// NoRanges ignores Range headers of blob requests
+	NoRanges bool
+	// FailAfter interrupts blob responses after FailAfter bytes if set
+	FailAfter int64
+	// Unavailable is the number of next manifest or blob requests answered
+	// with 503 Service Unavailable
+	Unavailable int
+	// TooManyRequests is the number of next manifest or blob requests
+	// answered with 429 Too Many Requests, with the Retry-After header set
+	// to RetryAfter if not empty
+	TooManyRequests int
+	RetryAfter      string
+	// RateLimit is the number of manifest GET requests told in the
+	// RateLimit-Limit header, like Docker Hub does. Headers are not sent if
+	// zero.
+	RateLimit int
+
+	mu               sync.Mutex
+	blobs            map[digest.Digest][]byte
+	manifests        map[string]manifest
+	tokens           map[string]time.Time
+	tokenRequests    int
+	blobRequests     int
+	rangeRequests    int
+	manifestRequests int
+	manifestHeads    int
+}
+
+type manifest struct {
+	mediaType string
+	body      []byte
+}
+
+// NewServer starts a registry
+func NewServer() *Server {
+	s := &Server{
+		blobs:     map[digest.Digest][]byte{},
+		manifests: map[string]manifest{},
+		tokens:    map[string]time.Time{},
+	}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Host returns the host of the registry, to use as reference domain
+func (s *Server) Host() string {
+	return strings.TrimPrefix(s.URL, "https://")
+}
+
+// AddBlob stores a blob and returns its digest
+func (s *Server) AddBlob(body []byte) digest.Digest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dgst := digest.FromBytes(body)
+	s.blobs[dgst] = body
+	return dgst
+}
+
+// AddManifest stores a manifest of repo under its digest and the given
+// tags, and returns its digest
+func (s *Server) AddManifest(repo, mediaType string, body []byte, tags ...string) digest.Digest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dgst := digest.FromBytes(body)
+	for _, ref := range append(tags, dgst.String()) {
+		s.manifests[repo+":"+ref] = manifest{mediaType: mediaType, body: body}
+	}
+	return dgst
+}
+
+// BlobRequests returns the number of blob requests served, and the number
+// of them with a Range header
+func (s *Server) BlobRequests() (requests int, ranges int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.blobRequests, s.rangeRequests
+}
+
+// TokenRequests returns the number of requests to the token endpoint
+func (s *Server) TokenRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tokenRequests
+}
+
+// ManifestRequests returns the number of manifest GET and HEAD requests
+// served
+func (s *Server) ManifestRequests() (gets int, heads int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.manifestRequests, s.manifestHeads
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		s.serveToken(w, r)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/v2/") {
+		http.NotFound(w, r)
+		return
+	}
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+s.URL+`/token",service="registrytest"`)
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+		return
+	}
+
+	p := strings.TrimPrefix(r.URL.Path, "/v2/")
+	if p != "" && s.unavailable() {
+		writeError(w, http.StatusServiceUnavailable, "UNAVAILABLE", "service unavailable")
+		return
+	} else if p != "" && s.tooManyRequests() {
+		s.writeRateLimit(w)
+		if s.RetryAfter != "" {
+			w.Header().Set("Retry-After", s.RetryAfter)
+		}
+		writeError(w, http.StatusTooManyRequests, "TOOMANYREQUESTS", "too many requests")
+		return
+	}
+	switch {
+	case p == "":
+		w.WriteHeader(http.StatusOK)
+	case strings.Contains(p, "/manifests/"):
+		i := strings.LastIndex(p, "/manifests/")
+		s.serveManifest(w, r, p[:i], p[i+len("/manifests/"):])
+	case strings.Contains(p, "/blobs/"):
+		i := strings.LastIndex(p, "/blobs/")
+		s.serveBlob(w, r, digest.Digest(p[i+len("/blobs/"):]))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// unavailable returns true if a request is answered with 503 Service
+// Unavailable
+func (s *Server) unavailable() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Unavailable <= 0 {
+		return false
+	}
+	s.Unavailable--
+	return true
+}
+
+// tooManyRequests returns true if a request is answered with 429 Too Many
+// Requests
+func (s *Server) tooManyRequests() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.TooManyRequests <= 0 {
+		return false
+	}
+	s.TooManyRequests--
+	return true
+}
+
+// writeRateLimit sets the RateLimit headers of a response if RateLimit is
+// set
+func (s *Server) writeRateLimit(w http.ResponseWriter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.RateLimit <= 0 {
+		return
+	}
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(s.RateLimit)+";w=21600")
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(max(s.RateLimit-s.manifestRequests, 0))+";w=21600")
+}
+
+func (s *Server) serveToken(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.tokenRequests++
+	s.mu.Unlock()
+	time.Sleep(s.TokenDelay)
+
+	key := "token"
+	if r.Method == http.MethodPost {
+		if s.IdentityToken == "" || r.PostFormValue("grant_type") != "refresh_token" || r.PostFormValue("refresh_token") != s.IdentityToken {
+			writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "invalid refresh token")
+			return
+		}
+		key = "access_token"
+	} else if s.Username != "" {
+		if username, password, ok := r.BasicAuth(); !ok || username != s.Username || password != s.Password {
+			writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "invalid credentials")
+			return
+		}
+	}
+	body := map[string]any{key: s.IssueToken()}
+	if s.TokenExpiry > 0 {
+		body["expires_in"] = int(s.TokenExpiry / time.Second)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// IssueToken returns a new bearer token accepted by the registry until
+// TokenExpiry
+func (s *Server) IssueToken() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token := "token-" + strconv.Itoa(len(s.tokens))
+	var expiry time.Time
+	if s.TokenExpiry > 0 {
+		expiry = time.Now().Add(s.TokenExpiry)
+	}
+	s.tokens[token] = expiry
+	return token
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expiry, ok := s.tokens[token]
+	return ok && (expiry.IsZero() || time.Now().Before(expiry))
+}
+
+func (s *Server) serveManifest(w http.ResponseWriter, r *http.Request, repo, ref string) {
+	s.mu.Lock()
+	m, ok := s.manifests[repo+":"+ref]
+	if ok && r.Method == http.MethodGet {
+		s.manifestRequests++
+	} else if ok && r.Method == http.MethodHead {
+		s.manifestHeads++
+	}
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+		return
+	}
+	s.writeRateLimit(w)
+	w.Header().Set("Content-Type", m.mediaType)
+	w.Header().Set("Docker-Content-Digest", digest.FromBytes(m.body).String())
+	w.Header().Set("Content-Length", strconv.Itoa(len(m.body)))
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, _ = w.Write(m.body)
+}
+
+func (s *Server) serveBlob(w http.ResponseWriter, r *http.Request, dgst digest.Digest) {
+	s.mu.Lock()
+	body, ok := s.blobs[dgst]
+	if ok && r.Method == http.MethodGet {
+		s.blobRequests++
+		if r.Header.Get("Range") != "" {
+			s.rangeRequests++
+		}
+	}
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown")
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", dgst.String())
+	if s.NoRanges {
+		r.Header.Del("Range")
+	}
+	if s.FailAfter > 0 {
+		w = &failingWriter{ResponseWriter: w, n: s.FailAfter}
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+}
+
+// failingWriter writes up to n bytes of a response body, the connection
+// being closed once the handler returns
+type failingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > w.n {
+		p = p[:w.n]
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.n -= int64(n)
+	if err == nil && w.n == 0 {
+		err = http.ErrAbortHandler
+	}
+	return n, err
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
@@ -0,0 +1,83 @@
+package registry
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TimeoutError is returned when a registry sends neither the response to a
+// request nor the next bytes of its body in time
+type TimeoutError struct {
+	After time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return "no response from registry in " + e.After.String()
+}
+
+// Timeout returns true so the error is handled like a network timeout
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// doWithTimeout sends a request which fails with a TimeoutError if the
+// response headers, or the next bytes of the response body, are not
+// received in time
+func (c *Client) doWithTimeout(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancelCause(req.Context())
+	timer := time.AfterFunc(c.timeout, func() {
+		cancel(&TimeoutError{After: c.timeout})
+	})
+	res, err := c.httpClient.Do(req.WithContext(ctx))
+	timer.Stop()
+	if err != nil {
+		cause := context.Cause(ctx)
+		cancel(nil)
+		var terr *TimeoutError
+		if errors.As(cause, &terr) {
+			return nil, terr
+		}
+		return nil, err
+	}
+	res.Body = &timeoutBody{
+		rc:      res.Body,
+		ctx:     ctx,
+		cancel:  cancel,
+		timer:   timer,
+		timeout: c.timeout,
+	}
+	return res, nil
+}
+
+// timeoutBody is a response body whose request is cancelled if a read
+// receives no bytes in time
+type timeoutBody struct {
+	rc      io.ReadCloser
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	b.timer.Reset(b.timeout)
+	n, err := b.rc.Read(p)
+	b.timer.Stop()
+	if err != nil && !errors.Is(err, io.EOF) {
+		var terr *TimeoutError
+		if errors.As(context.Cause(b.ctx), &terr) {
+			return n, terr
+		}
+	}
+	return n, err
+}
+
+func (b *timeoutBody) Close() error {
+	b.timer.Stop()
+	b.cancel(nil)
+	return b.rc.Close()
+}
@@ -0,0 +1,300 @@
+// Package s3 implements a minimal client for S3 compatible object stores,
+// limited to what is needed to upload objects.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// Scheme of object store URLs
+	Scheme = "s3://"
+
+	// DefaultPartSize is the size of the parts of a multipart upload
+	DefaultPartSize = 16 << 20
+
+	// maxParts is the maximum number of parts of a multipart upload
+	maxParts = 10000
+)
+
+// Credentials to sign requests with
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// Options represents client options
+type Options struct {
+	// Endpoint of the object store. Requests are sent to AWS if empty,
+	// otherwise buckets are addressed in the path of the endpoint URL.
+	Endpoint string
+	// Region of the bucket
+	Region string
+	// Credentials to sign requests with. Requests are anonymous if empty.
+	Credentials Credentials
+	// PartSize of multipart uploads. Objects larger than PartSize are
+	// uploaded in parts.
+	PartSize int64
+	// HTTPClient to send requests with
+	HTTPClient *http.Client
+}
+
+// OptionsFromEnv returns client options from the standard AWS environment
+// variables
+func OptionsFromEnv() Options {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_S3")
+	if endpoint == "" {
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	return Options{
+		Endpoint: endpoint,
+		Region:   region,
+		Credentials: Credentials{
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		},
+	}
+}
+
+// Client uploads objects to an S3 compatible object store
+type Client struct {
+	endpoint   *url.URL
+	pathStyle  bool
+	region     string
+	creds      Credentials
+	partSize   int64
+	httpClient *http.Client
+}
+
+// Error is an error response of the object store
+type Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return "s3: " + http.StatusText(e.StatusCode)
+	}
+	return "s3: " + e.Code + ": " + e.Message
+}
+
+// New creates a new object store client
+func New(opts Options) (*Client, error) {
+	c := &Client{
+		region:     opts.Region,
+		creds:      opts.Credentials,
+		partSize:   opts.PartSize,
+		httpClient: opts.HTTPClient,
+	}
+	if c.region == "" {
+		c.region = "us-east-1"
+	}
+	if c.partSize <= 0 {
+		c.partSize = DefaultPartSize
+	}
+	if c.httpClient == nil {
+		c.httpClient = http.DefaultClient
+	}
+	if opts.Endpoint == "" {
+		c.endpoint = &url.URL{Scheme: "https", Host: "s3." + c.region + ".amazonaws.com"}
+		return c, nil
+	}
+	endpoint, err := url.Parse(opts.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, errors.Errorf("invalid endpoint %q", opts.Endpoint)
+	}
+	c.endpoint = endpoint
+	c.pathStyle = true
+	return c, nil
+}
+
+// IsURL returns true if s is an object store URL
+func IsURL(s string) bool {
+	return strings.HasPrefix(s, Scheme)
+}
+
+// ParseURL parses an s3://bucket/prefix URL
+func ParseURL(s string) (bucket string, prefix string, err error) {
+	if !IsURL(s) {
+		return "", "", errors.Errorf("invalid object store URL %q", s)
+	}
+	bucket, prefix, _ = strings.Cut(strings.TrimPrefix(s, Scheme), "/")
+	if bucket == "" {
+		return "", "", errors.Errorf("missing bucket in %q", s)
+	}
+	return bucket, strings.Trim(prefix, "/"), nil
+}
+
+// Upload uploads an object of the given size from r. Objects larger than
+// the part size are uploaded in parts. Metadata keys are sent as
+// x-amz-meta-* headers.
+func (c *Client) Upload(ctx context.Context, bucket, key string, r io.Reader, size int64, metadata map[string]string) error {
+	if size <= c.partSize {
+		return c.PutObject(ctx, bucket, key, r, size, metadata)
+	}
+	return c.multipartUpload(ctx, bucket, key, r, size, metadata)
+}
+
+// PutObject uploads an object of the given size from r in a single request
+func (c *Client) PutObject(ctx context.Context, bucket, key string, r io.Reader, size int64, metadata map[string]string) error {
+	req, err := c.newRequest(ctx, http.MethodPut, bucket, key, nil, io.LimitReader(r, size), size)
+	if err != nil {
+		return err
+	}
+	setMetadata(req, metadata)
+	res, err := c.do(req)
+	if err != nil {
+		return errors.Wrapf(err, "cannot upload %s", key)
+	}
+	return res.Body.Close()
+}
+
+func (c *Client) multipartUpload(ctx context.Context, bucket, key string, r io.Reader, size int64, metadata map[string]string) (err error) {
+	partSize := c.partSize
+	if n := (size + maxParts - 1) / maxParts; n > partSize {
+		partSize = n
+	}
+
+	req, err := c.newRequest(ctx, http.MethodPost, bucket, key, url.Values{"uploads": {""}}, nil, 0)
+	if err != nil {
+		return err
+	}
+	setMetadata(req, metadata)
+	var initiate struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := c.doXML(req, &initiate); err != nil {
+		return errors.Wrapf(err, "cannot create multipart upload for %s", key)
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		// release the parts already uploaded, with a fresh context as the
+		// upload context may be canceled
+		req, aerr := c.newRequest(context.WithoutCancel(ctx), http.MethodDelete, bucket, key, url.Values{"uploadId": {initiate.UploadID}}, nil, 0)
+		if aerr == nil {
+			if res, aerr := c.do(req); aerr == nil {
+				_ = res.Body.Close()
+			}
+		}
+	}()
+
+	type part struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	var parts []part
+	for offset, number := int64(0), 1; offset < size; offset, number = offset+partSize, number+1 {
+		n := min(partSize, size-offset)
+		req, err := c.newRequest(ctx, http.MethodPut, bucket, key, url.Values{
+			"partNumber": {strconv.Itoa(number)},
+			"uploadId":   {initiate.UploadID},
+		}, io.LimitReader(r, n), n)
+		if err != nil {
+			return err
+		}
+		res, err := c.do(req)
+		if err != nil {
+			return errors.Wrapf(err, "cannot upload part %d of %s", number, key)
+		}
+		_ = res.Body.Close()
+		parts = append(parts, part{PartNumber: number, ETag: res.Header.Get("ETag")})
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	req, err = c.newRequest(ctx, http.MethodPost, bucket, key, url.Values{"uploadId": {initiate.UploadID}}, bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return err
+	}
+	// errors of a complete request can be returned with a 200 status code
+	var complete struct {
+		XMLName xml.Name
+		Error
+	}
+	if err := c.doXML(req, &complete); err != nil {
+		return errors.Wrapf(err, "cannot complete multipart upload for %s", key)
+	} else if complete.XMLName.Local == "Error" {
+		complete.StatusCode = http.StatusOK
+		return errors.Wrapf(&complete.Error, "cannot complete multipart upload for %s", key)
+	}
+	return nil
+}
+
+func (c *Client) newRequest(ctx context.Context, method, bucket, key string, query url.Values, body io.Reader, size int64) (*http.Request, error) {
+	u := *c.endpoint
+	if c.pathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + bucket + "/" + key
+	} else {
+		u.Host = bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	// keys are sent encoded the way they are signed
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	return req, nil
+}
+
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	c.sign(req)
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 == 2 {
+		return res, nil
+	}
+	defer res.Body.Close()
+	serr := &Error{StatusCode: res.StatusCode}
+	if dt, err := io.ReadAll(io.LimitReader(res.Body, 1<<20)); err == nil {
+		_ = xml.Unmarshal(dt, serr)
+	}
+	return nil, serr
+}
+
+func (c *Client) doXML(req *http.Request, v any) error {
+	res, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return xml.NewDecoder(res.Body).Decode(v)
+}
+
+func setMetadata(req *http.Request, metadata map[string]string) {
+	for k, v := range metadata {
+		req.Header.Set("X-Amz-Meta-"+k, v)
+	}
+}
@@ -0,0 +1,193 @@
+// Package s3test provides an in-memory S3 compatible server for tests,
+// standing in for MinIO with the subset of the API used by the s3 package.
+package s3test
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Object is an object stored in the server
+type Object struct {
+	Body     []byte
+	Metadata map[string]string
+	// Parts is the number of parts of a multipart upload, 0 otherwise
+	Parts int
+}
+
+// Server is an in-memory object store serving path-style requests
+type Server struct {
+	*httptest.Server
+	// AccessKeyID expected in the credential of signed requests
+	AccessKeyID string
+
+	mu      sync.Mutex
+	objects map[string]*Object
+	uploads map[string]*upload
+	nextID  int
+}
+
+type upload struct {
+	key      string
+	metadata map[string]string
+	parts    map[int][]byte
+}
+
+// NewServer starts a server accepting requests signed with accessKeyID
+func NewServer(accessKeyID string) *Server {
+	s := &Server{
+		AccessKeyID: accessKeyID,
+		objects:     map[string]*Object{},
+		uploads:     map[string]*upload{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Object returns the object stored at bucket/key
+func (s *Server) Object(bucket, key string) (*Object, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[bucket+"/"+key]
+	return obj, ok
+}
+
+// Keys returns the sorted keys stored in bucket
+func (s *Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for k := range s.objects {
+		if key, ok := strings.CutPrefix(k, bucket+"/"); ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Uploads returns the number of multipart uploads in progress
+func (s *Server) Uploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.uploads)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.Contains(r.Header.Get("Authorization"), "Credential="+s.AccessKeyID+"/") {
+		writeError(w, http.StatusForbidden, "InvalidAccessKeyId", "The access key ID does not exist")
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	if !strings.Contains(name, "/") {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", "missing key")
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.nextID++
+		id := strconv.Itoa(s.nextID)
+		s.uploads[id] = &upload{key: name, metadata: metadata(r), parts: map[int][]byte{}}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			UploadID string   `xml:"UploadId"`
+		}{UploadID: id})
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		up, ok := s.uploads[query.Get("uploadId")]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchUpload", "upload not found")
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		up.parts[number] = body
+		w.Header().Set("ETag", etag(body))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		up, ok := s.uploads[query.Get("uploadId")]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchUpload", "upload not found")
+			return
+		}
+		var complete struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			writeError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+			return
+		}
+		obj := &Object{Metadata: up.metadata, Parts: len(complete.Parts)}
+		for i, part := range complete.Parts {
+			data, ok := up.parts[part.PartNumber]
+			if !ok || part.PartNumber != i+1 || part.ETag != etag(data) {
+				writeError(w, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("invalid part %d", part.PartNumber))
+				return
+			}
+			obj.Body = append(obj.Body, data...)
+		}
+		s.objects[up.key] = obj
+		delete(s.uploads, query.Get("uploadId"))
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Key     string   `xml:"Key"`
+		}{Key: up.key})
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		s.objects[name] = &Object{Body: body, Metadata: metadata(r)}
+		w.Header().Set("ETag", etag(body))
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented", r.Method+" is not implemented")
+	}
+}
+
+func metadata(r *http.Request) map[string]string {
+	md := map[string]string{}
+	for k := range r.Header {
+		if name, ok := strings.CutPrefix(strings.ToLower(k), "x-amz-meta-"); ok {
+			md[name] = r.Header.Get(k)
+		}
+	}
+	return md
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_ = xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}{Code: code, Message: message})
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,144 @@
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	signAlgorithm   = "AWS4-HMAC-SHA256"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	emptyPayload    = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	amzDateFormat   = "20060102T150405Z"
+)
+
+// now returns the signing time, overridden in tests
+var now = time.Now
+
+// sign signs a request with AWS Signature Version 4. Request bodies are not
+// hashed, except empty ones, so they can be streamed.
+func (c *Client) sign(req *http.Request) {
+	if c.creds.AccessKeyID == "" {
+		return
+	}
+	t := now().UTC()
+	req.Header.Set("X-Amz-Date", t.Format(amzDateFormat))
+	if c.creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.creds.SessionToken)
+	}
+	if req.Header.Get("X-Amz-Content-Sha256") == "" {
+		if req.ContentLength == 0 {
+			req.Header.Set("X-Amz-Content-Sha256", emptyPayload)
+		} else {
+			req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+		}
+	}
+
+	signedHeaders, canonicalHeaders := canonicalHeaders(req)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+
+	scope := t.Format("20060102") + "/" + c.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		signAlgorithm,
+		t.Format(amzDateFormat),
+		scope,
+		hexSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.creds.SecretAccessKey), t.Format("20060102"))
+	for _, s := range []string{c.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", signAlgorithm+
+		" Credential="+c.creds.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+
+		", Signature="+signature)
+}
+
+// canonicalHeaders returns the names and canonical form of the signed
+// headers: host, content headers and x-amz-* headers
+func canonicalHeaders(req *http.Request) (string, string) {
+	values := map[string]string{"host": req.URL.Host}
+	if req.Host != "" {
+		values["host"] = req.Host
+	}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if k == "content-type" || k == "content-md5" || k == "range" || strings.HasPrefix(k, "x-amz-") {
+			values[k] = strings.Join(v, ",")
+		}
+	}
+	names := make([]string, 0, len(values))
+	for k := range values {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	for _, k := range names {
+		sb.WriteString(k + ":" + strings.TrimSpace(values[k]) + "\n")
+	}
+	return strings.Join(names, ";"), sb.String()
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			params = append(params, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// uriEncode encodes s as specified for signing: all bytes except unreserved
+// characters are percent-encoded, slashes are kept unless encodeSlash is set
+func uriEncode(s string, encodeSlash bool) string {
+	const hexChars = "0123456789ABCDEF"
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		b := s[i]
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '.', b == '_', b == '~', b == '/' && !encodeSlash:
+			sb.WriteByte(b)
+		default:
+			sb.WriteByte('%')
+			sb.WriteByte(hexChars[b>>4])
+			sb.WriteByte(hexChars[b&0xf])
+		}
+	}
+	return sb.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}